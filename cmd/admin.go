@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"log"
+	"main/database"
+	"os"
+	"time"
+)
+
+// createAdmin makes the named account an admin, creating it first when it does not exist.
+// usage: nkata create-admin -username alice [-password secret] [-display-name Alice]
+// the password can also come from NKATA_ADMIN_PASSWORD so it stays out of shell history.
+func createAdmin(databaseConfig database.DatabaseConfig, args []string) {
+
+	flags := flag.NewFlagSet("create-admin", flag.ExitOnError)
+	username := flags.String("username", "", "admin username, at most 10 characters")
+	password := flags.String("password", os.Getenv("NKATA_ADMIN_PASSWORD"), "password for a new account, at least 8 characters")
+	displayName := flags.String("display-name", "", "display name for a new account")
+	flags.Parse(args)
+
+	if *username == "" || len(*username) > 10 {
+		log.Fatal("create-admin: -username is required and at most 10 characters")
+	}
+
+	db, err := database.ConnectDatabase(databaseConfig)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer db.Close()
+
+	repo := database.NewUserRepository(db)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err = repo.GetAdminUser(ctx, *username)
+
+	switch {
+	case err == sql.ErrNoRows:
+
+		if len(*password) < 8 {
+			log.Fatal("create-admin: a new account needs -password with at least 8 characters")
+		}
+
+		if *displayName == "" {
+			*displayName = *username
+		}
+
+		user := &database.User{Username: *username, DisplayName: *displayName, Password: *password}
+
+		if err := repo.CreateUser(ctx, user); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Print("created account " + *username)
+
+	case err != nil:
+		log.Fatal(err)
+	}
+
+	if _, err := repo.SetUserRole(ctx, *username, database.Admin); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := repo.SetUserEnabled(ctx, *username, true); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Print(*username + " is now an admin")
+}
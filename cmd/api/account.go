@@ -0,0 +1,538 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"main/database"
+	"main/internal/mailer"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var otpPurposeDeleteAccount string = "DeleteAccount"
+
+type DeleteAccountPayload struct {
+	Password string `json:"password"`
+	Otp      int    `json:"otp"` // from /v1/user/delete/otp, for accounts that sign in without a password
+}
+
+type AccountDeletionJson struct {
+	Status      int       `json:"status"`
+	Message     string    `json:"message"`
+	DeleteAfter time.Time `json:"delete_after"`
+}
+
+// @Summary Send account deletion otp
+// @Description Emails an otp that confirms DELETE /v1/user, for accounts that sign in with a provider or passkey
+// @Tags User
+// @Produce json
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 429 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/user/delete/otp [post]
+func (api *ApiService) SendDeleteAccountOtp(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	user, err := api.database.GetByUsername(ctx, username)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if user.Email == "" {
+		badRequest(w, r, errors.New("add an email to your account or confirm with your password"))
+		return
+	}
+
+	if err := api.issueOtp(ctx, user.Username, user.Email, otpPurposeDeleteAccount); err != nil {
+		if err == errOtpCooldown {
+			tooManyRequest(w, r, err)
+			return
+		}
+		internalServer(w, r, errors.New("failed to send otp email"))
+		return
+	}
+
+	s := StandardResponse{
+		Status:  http.StatusOK,
+		Message: "otp sent to " + user.Email,
+	}
+
+	writeJson(w, http.StatusOK, s)
+}
+
+// @Summary Delete account
+// @Description Confirm with the password or an otp. The account is signed out everywhere and deleted after the grace period, signing in before then cancels the deletion.
+// @Tags User
+// @Accept json
+// @Produce json
+// @Param payload body DeleteAccountPayload true "password or otp"
+// @Success 202 {object} AccountDeletionJson
+// @Failure 400 {object} errorslope
+// @Failure 401 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/user [delete]
+func (api *ApiService) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+
+	var payload DeleteAccountPayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	user, err := api.database.GetByUsername(ctx, username)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	switch {
+	case payload.Password != "":
+
+		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(payload.Password)); err != nil {
+			unauthorized(w, r, errors.New("invalid password"))
+			return
+		}
+
+	case payload.Otp != 0 && user.Email != "":
+
+		if _, err := api.verifyOtp(ctx, user.Email, otpPurposeDeleteAccount, payload.Otp); err != nil {
+			otpError(w, r, err)
+			return
+		}
+
+	default:
+		badRequest(w, r, errors.New("password or otp is required"))
+		return
+	}
+
+	deleteAfter := time.Now().Add(api.config.AccountConfig.DeletionGracePeriod)
+
+	if err := api.database.ScheduleAccountDeletion(ctx, username, deleteAfter); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if err := api.signOutEverywhere(r, username); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	api.rClient.Del(ctx, redisUserKey(username))
+
+	audit(r, "account_deletion_scheduled", "username", username, "delete_after", deleteAfter)
+
+	writeJson(w, http.StatusAccepted, AccountDeletionJson{
+		Status:      http.StatusAccepted,
+		Message:     "account will be deleted, sign in before then to cancel",
+		DeleteAfter: deleteAfter,
+	})
+}
+
+// purgeDueAccounts deletes accounts whose grace period is over, a batch per run
+func (api *ApiService) purgeDueAccounts(ctx context.Context) {
+
+	usernames, err := api.database.GetAccountsDueForDeletion(ctx, 100)
+
+	if err != nil {
+		log.Printf("account purge failed: %v", err)
+		return
+	}
+
+	for _, username := range usernames {
+
+		imageUrl, groups, err := api.database.PurgeUser(ctx, username)
+
+		if err != nil {
+			if err != sql.ErrNoRows {
+				log.Printf("account purge of %s failed: %v", username, err)
+			}
+			continue
+		}
+
+		if imageUrl != "" {
+			if err := os.Remove(profileStorageDir + path.Base(imageUrl)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("account purge of %s could not remove profile picture: %v", username, err)
+			}
+		}
+
+		for _, group := range groups {
+			api.removeGroupFiles(ctx, group)
+		}
+
+		api.rClient.Del(ctx, redisUserKey(username))
+
+		files, err := api.database.DeleteDataExportsByUsername(ctx, username)
+
+		if err != nil {
+			log.Printf("account purge of %s could not remove data exports: %v", username, err)
+		}
+
+		removeExportFiles(files)
+
+		auditLog.Info("account_deleted", "username", username)
+	}
+}
+
+func (api *ApiService) StartAccountPurge(ctx context.Context) {
+
+	ticker := time.NewTicker(api.config.AccountConfig.PurgeInterval)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				api.purgeDueAccounts(ctx)
+			}
+		}
+	}()
+}
+
+type UsernameChangedJson struct {
+	Username  string `json:"username"`
+	Token     string `json:"token"` // access token for the new username, older access tokens stop working
+	ExpiresIn int64  `json:"expires_in"`
+}
+
+// @Summary Change username
+// @Description Renames the account everywhere. The old name stays reserved for you for a while, other sessions have to refresh their token.
+// @Tags User
+// @Accept json
+// @Produce json
+// @Param payload body UsernamePayload true "new username"
+// @Success 200 {object} UsernameChangedJson
+// @Failure 400 {object} errorslope
+// @Failure 409 {object} errorslope
+// @Failure 429 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/user/username [put]
+func (api *ApiService) ChangeUsername(w http.ResponseWriter, r *http.Request) {
+
+	var payload UsernamePayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	if payload.Username == "" || len(payload.Username) > 10 || strings.ContainsAny(payload.Username, " \t\r\n") {
+		badRequest(w, r, errors.New("username must be 1 to 10 characters without spaces"))
+		return
+	}
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	sessionId, err := getSessionIdFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if payload.Username == username {
+		badRequest(w, r, errors.New("that is already your username"))
+		return
+	}
+
+	config := api.config.AccountConfig
+
+	err = api.database.ChangeUsername(ctx, username, payload.Username, time.Now().Add(-config.UsernameChangeInterval), time.Now().Add(config.UsernameReservation))
+
+	if err != nil {
+		switch err {
+		case database.ErrUsernameTaken:
+			conflict(w, r, errors.New("username "+payload.Username+" is taken"))
+		case database.ErrUsernameChangeSoon:
+			tooManyRequest(w, r, errors.New("you can change your username once every "+strconv.Itoa(int(config.UsernameChangeInterval.Hours()/24))+" days"))
+		default:
+			internalServer(w, r, err)
+		}
+		return
+	}
+
+	api.rClient.Del(ctx, redisUserKey(username), redisUserKey(payload.Username))
+
+	audit(r, "username_changed", "from", username, "to", payload.Username)
+
+	accessToken, err := api.signAccessToken(payload.Username, sessionId)
+
+	if err != nil {
+		internalServer(w, r, errors.New("failed to generate token"))
+		return
+	}
+
+	writeJson(w, http.StatusOK, UsernameChangedJson{
+		Username:  payload.Username,
+		Token:     accessToken,
+		ExpiresIn: int64(api.config.SessionConfig.AccessTokenTtl.Seconds()),
+	})
+}
+
+// @Summary Get username history
+// @Description Your previous usernames, newest first
+// @Tags User
+// @Produce json
+// @Success 200 {array} database.UsernameChange
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/user/username/history [get]
+func (api *ApiService) GetUsernameHistory(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	history, err := api.database.GetUsernameHistory(ctx, username)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, history)
+}
+
+// @Summary Change email
+// @Description Sends an otp to the new address, confirm it at /v1/user/email/verify
+// @Tags User
+// @Accept json
+// @Produce json
+// @Param payload body EmailPayload true "new email"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 429 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/user/email [put]
+func (api *ApiService) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+
+	var payload EmailPayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	if _, err := mail.ParseAddress(payload.Email); err != nil {
+		badRequest(w, r, errors.New("invalid email address"))
+		return
+	}
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	// the otp row holds the pending address until it is verified
+	err = api.issueOtp(ctx, username, payload.Email, otpPurposeChangeEmail)
+
+	if err != nil {
+		if err == errOtpCooldown {
+			tooManyRequest(w, r, err)
+			return
+		}
+		internalServer(w, r, errors.New("failed to send otp email"))
+		return
+	}
+
+	s := StandardResponse{
+		Status:  http.StatusOK,
+		Message: "otp sent to " + payload.Email,
+	}
+
+	writeJson(w, http.StatusOK, s)
+}
+
+// @Summary Verify email change
+// @Description Makes the new address the account email. When there was an old address it gets a link to undo the change.
+// @Tags User
+// @Accept json
+// @Produce json
+// @Param payload body OtpPayload true "new email and the otp sent to it"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 401 {object} errorslope
+// @Failure 409 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/user/email/verify [post]
+func (api *ApiService) VerifyEmailChange(w http.ResponseWriter, r *http.Request) {
+
+	var payload OtpPayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	otp, err := api.verifyOtp(ctx, payload.Email, otpPurposeChangeEmail, payload.Otp)
+
+	if err != nil {
+		otpError(w, r, err)
+		return
+	}
+
+	if otp.Username != username {
+		unauthorized(w, r, errors.New("user does not have permission to perform this action"))
+		return
+	}
+
+	revertToken, err := randomString(32)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	config := api.config.AccountConfig
+
+	oldEmail, err := api.database.ChangeUserEmail(ctx, username, otp.Email, hashLinkToken(revertToken), time.Now().Add(config.EmailRevertWindow))
+
+	if err != nil {
+		if strings.Contains(err.Error(), "users_email_key") {
+			conflict(w, r, errors.New(otp.Email+" is already used by another account"))
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	api.rClient.Del(ctx, redisUserKey(username))
+
+	audit(r, "email_changed", "username", username, "had_email", oldEmail != "")
+
+	if oldEmail != "" {
+
+		message, err := mailer.EmailChangedMessage(oldEmail, mailer.EmailChangedData{
+			Username:         username,
+			NewEmail:         otp.Email,
+			RevertLink:       api.config.ExportConfig.PublicBaseUrl + "/v1/auth/email/revert?token=" + url.QueryEscape(revertToken),
+			RevertWindowDays: int(config.EmailRevertWindow.Hours() / 24),
+		})
+
+		if err == nil {
+			err = api.mailer.Send(ctx, message)
+		}
+
+		if err != nil {
+			log.Printf("email change notice for %s failed: %v", username, err)
+		}
+	}
+
+	s := StandardResponse{
+		Status:  http.StatusOK,
+		Message: "email changed to " + otp.Email,
+	}
+
+	writeJson(w, http.StatusOK, s)
+}
+
+// @Summary Undo email change
+// @Description The link sent to the previous address. Restores it and signs the account out everywhere.
+// @Tags Auth
+// @Produce json
+// @Param token query string true "revert token"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 409 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Router /v1/auth/email/revert [get]
+func (api *ApiService) RevertEmailChange(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	username, err := api.database.RevertEmailChange(ctx, hashLinkToken(r.URL.Query().Get("token")))
+
+	if err != nil {
+		if err == database.ErrEmailRevertInvalid {
+			badRequest(w, r, err)
+			return
+		}
+		if strings.Contains(err.Error(), "users_email_key") {
+			conflict(w, r, errors.New("the previous address now belongs to another account"))
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	// whoever changed the address may still be signed in
+	if err := api.signOutEverywhere(r, username); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	api.rClient.Del(ctx, redisUserKey(username))
+
+	audit(r, "email_change_reverted", "username", username)
+
+	s := StandardResponse{
+		Status:  http.StatusOK,
+		Message: "email change undone and all sessions signed out, reset your password if someone else made the change",
+	}
+
+	writeJson(w, http.StatusOK, s)
+}
@@ -0,0 +1,347 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"main/database"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type RolePayload struct {
+	Role string `json:"role"` // user or admin
+}
+
+func pageParams(r *http.Request) (int64, int64, error) {
+
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	limit, errp := strconv.Atoi(r.URL.Query().Get("limit"))
+
+	if err != nil || errp != nil || page < 1 || limit < 1 || limit > 100 {
+		return 0, 0, errors.New("page and limit must be numbers, limit at most 100")
+	}
+
+	return int64(page), int64(limit), nil
+}
+
+// signOutEverywhere ends every session of the user and stops pushes to their devices
+func (api *ApiService) signOutEverywhere(r *http.Request, username string) error {
+
+	if err := api.database.RevokeAllSessions(r.Context(), username); err != nil {
+		return err
+	}
+
+	return api.database.DeleteDeviceTokensByUsername(r.Context(), username)
+}
+
+// adminTarget loads the user named in the url, admins cannot act on their own account through these routes
+func (api *ApiService) adminTarget(w http.ResponseWriter, r *http.Request) (*database.AdminUser, string, bool) {
+
+	admin, err := getUsernameFromCtx(r.Context())
+
+	if err != nil {
+		internalServer(w, r, err)
+		return nil, "", false
+	}
+
+	username := chi.URLParam(r, "username")
+
+	if username == admin {
+		forbidden(w, r, errors.New("admins cannot change their own account here"))
+		return nil, "", false
+	}
+
+	user, err := api.database.GetAdminUser(r.Context(), username)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			notFound(w, r, errors.New("no user found with username "+username))
+			return nil, "", false
+		}
+		internalServer(w, r, err)
+		return nil, "", false
+	}
+
+	return user, admin, true
+}
+
+// @Summary List users
+// @Description Admin only
+// @Tags Admin
+// @Produce json
+// @Param page query string true "page"
+// @Param limit query string true "limit, at most 100"
+// @Success 200 {object} database.PaginatedResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/admin/users [get]
+func (api *ApiService) AdminListUsers(w http.ResponseWriter, r *http.Request) {
+
+	page, limit, err := pageParams(r)
+
+	if err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	response, err := api.database.ListUsers(r.Context(), page, limit)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, response)
+}
+
+// @Summary Search users
+// @Description Admin only, matches username, display name or email
+// @Tags Admin
+// @Produce json
+// @Param q query string true "search term"
+// @Param page query string true "page"
+// @Param limit query string true "limit, at most 100"
+// @Success 200 {object} database.PaginatedResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/admin/users/search [get]
+func (api *ApiService) AdminSearchUsers(w http.ResponseWriter, r *http.Request) {
+
+	term := r.URL.Query().Get("q")
+
+	if term == "" {
+		badRequest(w, r, errors.New("q is required"))
+		return
+	}
+
+	page, limit, err := pageParams(r)
+
+	if err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	response, err := api.database.SearchUsers(r.Context(), term, page, limit)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, response)
+}
+
+// @Summary Get user
+// @Description Admin only
+// @Tags Admin
+// @Produce json
+// @Param username path string true "username"
+// @Success 200 {object} database.AdminUser
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/admin/users/{username} [get]
+func (api *ApiService) AdminGetUser(w http.ResponseWriter, r *http.Request) {
+
+	username := chi.URLParam(r, "username")
+
+	user, err := api.database.GetAdminUser(r.Context(), username)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			notFound(w, r, errors.New("no user found with username "+username))
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, user)
+}
+
+func (api *ApiService) setUserEnabled(w http.ResponseWriter, r *http.Request, enabled bool) {
+
+	user, admin, ok := api.adminTarget(w, r)
+
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+
+	if _, err := api.database.SetUserEnabled(ctx, user.Username, enabled); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	message := user.Username + " enabled"
+
+	if !enabled {
+
+		if err := api.signOutEverywhere(r, user.Username); err != nil {
+			internalServer(w, r, err)
+			return
+		}
+
+		message = user.Username + " disabled and signed out"
+	}
+
+	audit(r, "admin_set_enabled", "admin", admin, "username", user.Username, "enabled", enabled)
+
+	s := StandardResponse{
+		Status:  http.StatusOK,
+		Message: message,
+	}
+
+	writeJson(w, http.StatusOK, s)
+}
+
+// @Summary Disable user
+// @Description Admin only, the user is signed out everywhere and cannot sign in until enabled
+// @Tags Admin
+// @Produce json
+// @Param username path string true "username"
+// @Success 200 {object} StandardResponse
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/admin/users/{username}/disable [put]
+func (api *ApiService) AdminDisableUser(w http.ResponseWriter, r *http.Request) {
+	api.setUserEnabled(w, r, false)
+}
+
+// @Summary Enable user
+// @Description Admin only
+// @Tags Admin
+// @Produce json
+// @Param username path string true "username"
+// @Success 200 {object} StandardResponse
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/admin/users/{username}/enable [put]
+func (api *ApiService) AdminEnableUser(w http.ResponseWriter, r *http.Request) {
+	api.setUserEnabled(w, r, true)
+}
+
+// @Summary Change user role
+// @Description Admin only, promote to admin or demote to user
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param username path string true "username"
+// @Param payload body RolePayload true "new role"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/admin/users/{username}/role [put]
+func (api *ApiService) AdminSetUserRole(w http.ResponseWriter, r *http.Request) {
+
+	var payload RolePayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	role, err := database.ParseRole(payload.Role)
+
+	if err != nil || payload.Role != role.String() {
+		badRequest(w, r, errors.New("role must be user or admin"))
+		return
+	}
+
+	user, admin, ok := api.adminTarget(w, r)
+
+	if !ok {
+		return
+	}
+
+	if _, err := api.database.SetUserRole(r.Context(), user.Username, role); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	audit(r, "admin_set_role", "admin", admin, "username", user.Username, "from", user.Role, "to", role.String())
+
+	s := StandardResponse{
+		Status:  http.StatusOK,
+		Message: user.Username + " is now " + role.String(),
+	}
+
+	writeJson(w, http.StatusOK, s)
+}
+
+// @Summary Force password reset
+// @Description Admin only, replaces the password with a random one, signs the user out everywhere and emails a reset otp when the account has an email
+// @Tags Admin
+// @Produce json
+// @Param username path string true "username"
+// @Success 200 {object} StandardResponse
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/admin/users/{username}/reset-password [post]
+func (api *ApiService) AdminForcePasswordReset(w http.ResponseWriter, r *http.Request) {
+
+	user, admin, ok := api.adminTarget(w, r)
+
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+
+	password, err := randomString(32)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if err := api.database.SetUserPasswordByUsername(ctx, user.Username, password); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if err := api.signOutEverywhere(r, user.Username); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	message := "password reset, " + user.Username + " has no email and must use another sign-in method"
+
+	if user.Email != "" {
+
+		err := api.issueOtp(ctx, user.Username, user.Email, otpPurposeResetPassword)
+
+		if err != nil && err != errOtpCooldown {
+			internalServer(w, r, errors.New("password reset but failed to send otp email"))
+			return
+		}
+
+		message = "password reset, a reset otp was sent to " + user.Email
+	}
+
+	audit(r, "admin_force_password_reset", "admin", admin, "username", user.Username)
+
+	s := StandardResponse{
+		Status:  http.StatusOK,
+		Message: message,
+	}
+
+	writeJson(w, http.StatusOK, s)
+}
@@ -4,6 +4,10 @@ import (
 	"context"
 	"log"
 	"main/database"
+	"main/internal/mailer"
+	"main/internal/oidc"
+	"main/internal/push"
+	"main/internal/token"
 	"net/http"
 	"time"
 
@@ -19,10 +23,14 @@ type ApiService struct {
 	database *database.DataRepository
 	config   *Config
 	rClient *redis.Client
+	push     *push.Dispatcher
+	mailer   mailer.Mailer
+	tokens   *token.Manager
+	oidcProviders map[string]*oidc.Provider
 }
 
-func NewRepos(userRepo *database.DataRepository, config *Config,rClient *redis.Client) *ApiService {
-	return &ApiService{database: userRepo, config: config,rClient: rClient}
+func NewRepos(userRepo *database.DataRepository, config *Config,rClient *redis.Client, pushDispatcher *push.Dispatcher, mail mailer.Mailer, tokens *token.Manager, oidcProviders map[string]*oidc.Provider) *ApiService {
+	return &ApiService{database: userRepo, config: config,rClient: rClient, push: pushDispatcher, mailer: mail, tokens: tokens, oidcProviders: oidcProviders}
 }
 
 // @title Example API
@@ -41,6 +49,8 @@ func IntiApi(config *Config) {
 	defer db.Close()
 	log.Print("Database conection established")
 
+	checkMigrations(db, config.DatabaseConfig.RequireMigrations)
+
 	redisOption := redis.Options{
 		Addr: config.RedisConfig.Addre,
 		Password: config.RedisConfig.Password,
@@ -60,16 +70,46 @@ func IntiApi(config *Config) {
 	r := chi.NewRouter()
 
 	uRepo := database.NewUserRepository(db)
+	uRepo.SetMaxGroupMembers(config.GroupConfig.MaxMembers)
+
+	pushDispatcher := newPushDispatcher(config.PushConfig, uRepo)
+
+	mailQueue := newMailQueue(config.MailConfig)
+	defer mailQueue.Close()
+
+	if config.TokenConfig.SigningKeyFile == "" {
+		log.Print("JWT_SIGNING_KEY_FILE not set signing with a throwaway key, tokens will not survive a restart")
+	}
 
-	apiService := NewRepos(uRepo, config,redisClient)
+	tokenManager, err := token.NewManager(config.TokenConfig)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	oidcProviders := newOidcProviders(config.OidcProviders)
+
+	apiService := NewRepos(uRepo, config,redisClient, pushDispatcher, mailQueue, tokenManager, oidcProviders)
+
+	trustedProxies, err := parseTrustedProxies(config.RateLimitConfig.TrustedProxies)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	apiService.StartOtpCleanup(context.Background())
+	apiService.StartAccountPurge(context.Background())
+	apiService.StartExportCleanup(context.Background())
 
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
+	r.Use(realIp(trustedProxies))
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.Timeout(90 * time.Second))
 	r.Use(apiService.HandleRateLimiter)
 
+	r.Get("/.well-known/jwks.json", tokenManager.JWKSHandler)
+
 	r.Route("/v1", func(r chi.Router) {
 
 		r.Get("/ping", func(w http.ResponseWriter, r *http.Request) {
@@ -88,17 +128,50 @@ func IntiApi(config *Config) {
 		// ))
 
 		r.Route("/user", func(r chi.Router) {
-			r.Use(HandleJWTAuth)
+			r.Use(apiService.HandleJWTAuth)
 			r.Get("/", apiService.GetByUsername)
+			r.Delete("/", apiService.DeleteAccount)
+			r.Post("/delete/otp", apiService.SendDeleteAccountOtp)
+			r.Post("/export", apiService.RequestDataExport)
+			r.Get("/export", apiService.GetDataExport)
 			r.Put("/update", apiService.Update)
-			r.Put("/add-email", apiService.AddEmail)
-			r.Post("/add-email-verify", apiService.AddEmailVerify)
+			r.Put("/username", apiService.ChangeUsername)
+			r.Get("/username/history", apiService.GetUsernameHistory)
+			r.Put("/email", apiService.ChangeEmail)
+			r.Post("/email/verify", apiService.VerifyEmailChange)
 			r.Post("/upload-profile-picture", apiService.UploadProfilPic)
 			r.Get("/search/{username}", apiService.GetByUsernameSearch)
+			r.Get("/blocks", apiService.GetBlockedUsers)
+			r.Post("/blocks/{username}", apiService.BlockUser)
+			r.Delete("/blocks/{username}", apiService.UnblockUser)
+			r.Post("/2fa/enroll", apiService.EnrollTotp)
+			r.Post("/2fa/confirm", apiService.ConfirmTotp)
+			r.Post("/2fa/disable", apiService.DisableTotp)
+			r.Get("/passkeys", apiService.GetPasskeys)
+			r.Post("/passkeys/register/begin", apiService.BeginPasskeyRegistration)
+			r.Post("/passkeys/register/finish", apiService.FinishPasskeyRegistration)
+			r.Put("/passkeys/{id}", apiService.RenamePasskey)
+			r.Delete("/passkeys/{id}", apiService.DeletePasskey)
+			r.Get("/identities", apiService.GetOidcIdentities)
+			r.Post("/identities/{provider}/link", apiService.LinkOidcIdentity)
+			r.Post("/identities/{provider}/link/confirm", apiService.ConfirmOidcLink)
+			r.Delete("/identities/{provider}", apiService.UnlinkOidcIdentity)
+		})
+
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(apiService.HandleJWTAuth)
+			r.Use(RequireRole(database.Admin))
+			r.Get("/users", apiService.AdminListUsers)
+			r.Get("/users/search", apiService.AdminSearchUsers)
+			r.Get("/users/{username}", apiService.AdminGetUser)
+			r.Put("/users/{username}/disable", apiService.AdminDisableUser)
+			r.Put("/users/{username}/enable", apiService.AdminEnableUser)
+			r.Put("/users/{username}/role", apiService.AdminSetUserRole)
+			r.Post("/users/{username}/reset-password", apiService.AdminForcePasswordReset)
 		})
 
 		r.Route("/firendship", func(r chi.Router) {
-			r.Use(HandleJWTAuth)
+			r.Use(apiService.HandleJWTAuth)
 			r.Post("/request/send", apiService.SendFriendRequest)
 			r.Post("/request/respond", apiService.RespondFriendRequest)
 			r.Delete("/request/delete/{id}", apiService.DeleteFriendRequest)
@@ -113,10 +186,44 @@ func IntiApi(config *Config) {
 			r.Post("/group/add-member", apiService.AddGroupMember)
 			r.Delete("/group/remove-member", apiService.RemoveGroupMember)
 			r.Delete("/group/delete/{id}", apiService.DeleteGroup)
+			r.Put("/group/promote", apiService.PromoteGroupMember)
+			r.Put("/group/demote", apiService.DemoteGroupMember)
+			r.Get("/group/{id}/permissions", apiService.GetGroupPermissions)
+			r.Put("/group/permissions", apiService.UpdateGroupPermission)
+			r.Get("/group/{id}/pins", apiService.GetPinnedMessages)
+			r.Post("/group/{id}/pins/{message_id}", apiService.PinMessage)
+			r.Delete("/group/{id}/pins/{message_id}", apiService.UnpinMessage)
+			r.Post("/group/invites", apiService.CreateGroupInvite)
+			r.Get("/group/{id}/invites", apiService.GetGroupInvites)
+			r.Delete("/group/{id}/invites/{invite_id}", apiService.RevokeGroupInvite)
+			r.Post("/group/join/{token}", apiService.JoinGroupByInvite)
+			r.Put("/group/privacy", apiService.UpdateGroupPrivacy)
+			r.Put("/group/announcement", apiService.UpdateGroupAnnouncement)
+			r.Post("/group/{id}/join", apiService.JoinGroup)
+			r.Get("/group/{id}/join-requests", apiService.GetGroupJoinRequests)
+			r.Post("/group/{id}/join-requests/{request_id}/approve", apiService.ApproveGroupJoinRequest)
+			r.Post("/group/{id}/join-requests/{request_id}/reject", apiService.RejectGroupJoinRequest)
+			r.Post("/group/ban", apiService.BanGroupMember)
+			r.Get("/group/{id}/bans", apiService.GetGroupBans)
+			r.Delete("/group/{id}/bans/{username}", apiService.UnbanGroupMember)
+			r.Post("/group/mute", apiService.MuteGroupMember)
+			r.Post("/group/unmute", apiService.UnmuteGroupMember)
+			r.Post("/group/transfer", apiService.OfferGroupOwnership)
+			r.Get("/group/{id}/transfer", apiService.GetGroupOwnershipTransfer)
+			r.Post("/group/{id}/transfer/accept", apiService.AcceptGroupOwnership)
+			r.Delete("/group/{id}/transfer", apiService.CancelGroupOwnershipTransfer)
+			r.Post("/group/{id}/leave", apiService.LeaveGroup)
+		})
+
+		r.Route("/device", func(r chi.Router) {
+			r.Use(apiService.HandleJWTAuth)
+			r.Get("/", apiService.GetDevices)
+			r.Post("/register", apiService.RegisterDevice)
+			r.Delete("/{token}", apiService.UnregisterDevice)
 		})
 
 		r.Route("/message", func(r chi.Router) {
-			r.Use(HandleJWTAuth)
+			r.Use(apiService.HandleJWTAuth)
 			r.Get("/get/{message_id}", apiService.GetMessageByMessageId)
 			// r.Post("/upload-media/{friendship_id}",)
 			r.Post("/ws/{friendship_id}", apiService.MessageWsHandler)
@@ -125,12 +232,53 @@ func IntiApi(config *Config) {
 			r.Delete("/delete/{message_id}", apiService.DeleteMessageByMessageId)
 		})
 
+		r.Route("/group", func(r chi.Router) {
+			r.Use(apiService.HandleJWTAuth)
+			r.Get("/{id}/audit", apiService.GetGroupAudit)
+		})
+
+		r.Route("/channel", func(r chi.Router) {
+			r.Use(apiService.HandleJWTAuth)
+			r.Post("/create", apiService.CreateChannel)
+			r.Put("/update", apiService.UpdateChannel)
+			r.Put("/admins", apiService.SetChannelAdmin)
+			r.Post("/subscribers", apiService.AddChannelSubscriber)
+			r.Get("/subscribed", apiService.GetSubscribedChannels)
+			r.Get("/handle/{handle}", apiService.GetChannelByHandle)
+			r.Get("/{id}", apiService.GetChannel)
+			r.Delete("/{id}", apiService.DeleteChannel)
+			r.Post("/{id}/subscribe", apiService.SubscribeChannel)
+			r.Post("/{id}/unsubscribe", apiService.UnsubscribeChannel)
+			r.Get("/{id}/subscribers", apiService.GetChannelSubscribers)
+			r.Get("/{id}/posts", apiService.GetChannelPosts)
+			r.Post("/{id}/posts", apiService.PostToChannel)
+		})
+
+		r.Route("/community", func(r chi.Router) {
+			r.Use(apiService.HandleJWTAuth)
+			r.Post("/create", apiService.CreateCommunity)
+			r.Get("/mine", apiService.GetMyCommunities)
+			r.Put("/update", apiService.UpdateCommunity)
+			r.Post("/members", apiService.AddCommunityMember)
+			r.Put("/admins", apiService.SetCommunityAdmin)
+			r.Post("/groups", apiService.CreateCommunityGroup)
+			r.Get("/{id}", apiService.GetCommunity)
+			r.Delete("/{id}", apiService.DeleteCommunity)
+			r.Get("/{id}/members", apiService.GetCommunityMembers)
+			r.Delete("/{id}/members/{username}", apiService.RemoveCommunityMember)
+			r.Get("/{id}/groups", apiService.GetCommunityGroups)
+			r.Post("/{id}/leave", apiService.LeaveCommunity)
+		})
+
 		r.Route("/media", func(r chi.Router) {
 			r.Get("/profiles/{img_name}", apiService.LoadProfilPic)
 			r.Get("/groups/{img_name}", apiService.LoadGroupPic)
 			r.Get("/chat/{img_name}", apiService.LoadMessagefile)
+			r.Get("/exports/{id}", apiService.DownloadDataExport)
 		})
 
+		r.Get("/invite/{token}", apiService.PreviewGroupInvite)
+
 		r.Route("/auth", func(r chi.Router) {
 			r.Post("/sign-up", apiService.RegisterUser)
 			r.Post("/sign-in-with-username", apiService.SignInUsername)
@@ -139,6 +287,21 @@ func IntiApi(config *Config) {
 			r.Post("/reset-password", apiService.SendResetPasswordOtp)
 			r.Post("/reset-password-verify", apiService.VerifyResetPasswordOtp)
 			r.Get("/check-username", apiService.CheackUsernameAvailability)
+			r.Post("/refresh", apiService.RefreshToken)
+			r.Post("/2fa/verify", apiService.VerifyMfa)
+			r.Post("/passkey/begin", apiService.BeginPasskeyLogin)
+			r.Post("/passkey/finish", apiService.FinishPasskeyLogin)
+			r.Get("/oidc/{provider}/start", apiService.StartOidcLogin)
+			r.Get("/oidc/{provider}/callback", apiService.OidcCallback)
+			r.Get("/email/revert", apiService.RevertEmailChange)
+
+			r.Group(func(r chi.Router) {
+				r.Use(apiService.HandleJWTAuth)
+				r.Post("/logout", apiService.Logout)
+				r.Get("/sessions", apiService.GetSessions)
+				r.Delete("/sessions", apiService.RevokeAllSessions)
+				r.Delete("/sessions/{id}", apiService.RevokeSession)
+			})
 		})
 
 	})
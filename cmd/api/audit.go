@@ -0,0 +1,28 @@
+package api
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+)
+
+// security events go out as json lines on stdout so they can be shipped apart from the request log
+var auditLog = slog.New(slog.NewJSONHandler(os.Stdout, nil)).With("log", "audit")
+
+// clientIp is the address set by realIp, without the port
+func clientIp(r *http.Request) string {
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// audit records a security event, args are slog key value pairs
+func audit(r *http.Request, event string, args ...any) {
+	auditLog.Info(event, append([]any{"ip", clientIp(r), "user_agent", r.UserAgent()}, args...)...)
+}
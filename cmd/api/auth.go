@@ -4,13 +4,7 @@ import (
 	"database/sql"
 	"errors"
 	"main/database"
-	"main/internal/evn"
-	"math/rand"
 	"net/http"
-	"strconv"
-	"time"
-
-	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -21,8 +15,9 @@ type RegisterUserPayload struct {
 }
 
 type LoginUsernamePayload struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	DeviceName string `json:"device_name"`
 }
 
 type LoginEmailePayload struct {
@@ -31,8 +26,9 @@ type LoginEmailePayload struct {
 }
 
 type OtpPayloadLogin struct {
-	Email string `json:"email"`
-	Otp   int    `json:"otp"`
+	Email      string `json:"email"`
+	Otp        int    `json:"otp"`
+	DeviceName string `json:"device_name"`
 }
 
 type OtpPayloadReset struct {
@@ -50,7 +46,9 @@ type BoolPayload struct {
 }
 
 type JwtJson struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"` // access token lifetime in seconds
 }
 
 type EmailPayload struct {
@@ -58,12 +56,13 @@ type EmailPayload struct {
 }
 
 type OtpPayload struct {
-	Otp int64 `json:"otp"`
+	Email string `json:"email"`
+	Otp   int    `json:"otp"`
 }
 
 var otpPurposeLogin string = "Login"
 var otpPurposeResetPassword string = "Reset"
-var otpPurposeAddEmail string = "AddEmail"
+var otpPurposeChangeEmail string = "ChangeEmail"
 
 // RegisterUser
 // @Summary Sign-up
@@ -105,6 +104,12 @@ func (apiService *ApiService) RegisterUser(w http.ResponseWriter, r *http.Reques
 
 	ctx := r.Context()
 
+	// also covers names reserved after a username change
+	if apiService.database.CheackUsernameAvailability(ctx, user.Username) {
+		conflict(w, r, errors.New("user with username "+user.Username+" already exist"))
+		return
+	}
+
 	err := apiService.database.CreateUser(ctx, user)
 
 	if err != nil {
@@ -134,12 +139,14 @@ func (apiService *ApiService) RegisterUser(w http.ResponseWriter, r *http.Reques
 // @Accept json
 // @Produce json
 // @Param payload body LoginUsernamePayload true "User sign-in credentials"
-// @Success 200 {object} JwtJson
+// @Success 202 {object} JwtJson
+// @Success 202 {object} MfaPendingJson
 // @Failure 400 {object} errorslope
 // @Failure 500 {object} errorslope
 // @Failure 401 {object} errorslope
+// @Failure 429 {object} errorslope
 // @Router /v1/auth/sign-in-with-username [post]
-func (apiService *ApiService) SignInUsername(w http.ResponseWriter, r *http.Request) {
+func (api *ApiService) SignInUsername(w http.ResponseWriter, r *http.Request) {
 
 	var payload LoginUsernamePayload
 
@@ -150,11 +157,18 @@ func (apiService *ApiService) SignInUsername(w http.ResponseWriter, r *http.Requ
 
 	ctx := r.Context()
 
-	user, err := apiService.database.GetByUsername(ctx, payload.Username)
+	if !api.guardSignIn(w, r, payload.Username) {
+		return
+	}
+
+	user, err := api.database.GetByUsername(ctx, payload.Username)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			unauthorized(w, r,  errors.New("invalid email or password"))
+			// same work and same answer as a wrong password
+			bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(payload.Password))
+			api.recordSignInFailure(r, "password", payload.Username, "")
+			unauthorized(w, r, errors.New("invalid username or password"))
 			return
 		}
 		internalServer(w, r, errors.New("somthing went wrong"))
@@ -164,31 +178,14 @@ func (apiService *ApiService) SignInUsername(w http.ResponseWriter, r *http.Requ
 	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(payload.Password))
 
 	if err != nil {
-		unauthorized(w, r, errors.New("invalid email or password"))
-		return
-	}
-
-	claims := jwt.MapClaims{
-		"username": user.Username,
-		"exp":      time.Now().Add(time.Hour * 48).Unix(),
-	}
-
-	var secret_words string = "A request for a long text message: Search results showIf this is your intent, please clarify the context and what you want the text to be about."
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	secret := evn.GetString(secret_words, "JWT_SERECT")
-
-	tokenString, err := token.SignedString([]byte(secret))
-
-	if err != nil {
-		err := errors.New("failed to generate token")
-		internalServer(w, r, err)
+		api.recordSignInFailure(r, "password", payload.Username, user.Username)
+		unauthorized(w, r, errors.New("invalid username or password"))
 		return
 	}
 
-	tokenResponse := JwtJson{Token: tokenString}
+	api.recordSignInSuccess(r, "password", payload.Username, user.Username)
 
-	writeJson(w, http.StatusAccepted, tokenResponse)
+	api.completeSignIn(w, r, user.Username, payload.DeviceName)
 }
 
 // sign in with email must verify email
@@ -202,8 +199,8 @@ func (apiService *ApiService) SignInUsername(w http.ResponseWriter, r *http.Requ
 // @Param payload body LoginEmailePayload true "User sign-in credentials"
 // @Success 200 {object} StandardResponse
 // @Failure 400 {object} errorslope
+// @Failure 429 {object} errorslope
 // @Failure 500 {object} errorslope
-// @Failure 401 {object} errorslope
 // @Router /v1/auth/sign-in-with-email [post]
 func (api *ApiService) SignInEmail(w http.ResponseWriter, r *http.Request) {
 
@@ -216,30 +213,18 @@ func (api *ApiService) SignInEmail(w http.ResponseWriter, r *http.Request) {
 
 	ctx := r.Context()
 
-	user, err := api.database.GetUserByEmail(ctx, payload.Email)
-
-	if err != nil {
-		if err == sql.ErrNoRows {
-			unauthorized(w, r,  errors.New("invalid email or password"))
-			return
-		}
-		internalServer(w, r, errors.New("somthing went wrong"))
+	if !api.guardSignIn(w, r, payload.Email) {
 		return
 	}
 
-	//send email with your smtp provider
-	otpToken := rand.Intn(9000000) + 100000
-
-	err = api.database.InsertOtp(ctx, user.Username, user.Email, otpPurposeLogin, int64(otpToken))
-
-	if err != nil {
-		internalServer(w, r, err)
+	if err := api.issueOtpIfExists(ctx, payload.Email, otpPurposeLogin); err != nil {
+		internalServer(w, r, errors.New("failed to send otp email"))
 		return
 	}
 
 	s := StandardResponse{
 		Status:  http.StatusOK,
-		Message: "otp " + strconv.Itoa(otpToken) + " sent to " + user.Email,
+		Message: "if an account uses " + payload.Email + " an otp has been sent to it",
 	}
 
 	writeJson(w, http.StatusOK, s)
@@ -253,10 +238,12 @@ func (api *ApiService) SignInEmail(w http.ResponseWriter, r *http.Request) {
 // @Accept json
 // @Produce json 
 // @Param payload body OtpPayloadLogin true "User sign-in credentials"
-// @Success 200 {object} JwtJson
+// @Success 202 {object} JwtJson
+// @Success 202 {object} MfaPendingJson
 // @Failure 400 {object} errorslope
 // @Failure 500 {object} errorslope
 // @Failure 401 {object} errorslope
+// @Failure 429 {object} errorslope
 // @Router /v1/auth/sign-in-with-email-verify [post]
 func (api *ApiService) VerifySignInEmailOtp(w http.ResponseWriter, r *http.Request) {
 
@@ -269,58 +256,28 @@ func (api *ApiService) VerifySignInEmailOtp(w http.ResponseWriter, r *http.Reque
 
 	ctx := r.Context()
 
-	otp, err := api.database.GetOtp(ctx, int64(payload.Otp))
-
-	if err != nil {
-		unauthorized(w, r, errors.New("otp is invalid"))
-		return
-	}
-
-	if otp.Purpose != otpPurposeLogin || otp.Email != payload.Email {
-		unauthorized(w, r, errors.New("otp is invalid"))
-		return
-	}
-
-	now := time.Now()
-	exp := otp.Exp;
-	// exp, err := time.Parse(time.RFC1123Z, otp.Exp)
-
-	// if err != nil {
-	// 	internalServer(w, r, err)
-	// 	return
-	// }
-
-	if exp.Before(now) {
-		unauthorized(w, r, errors.New("otp expired"))
+	if !api.guardSignIn(w, r, payload.Email) {
 		return
 	}
 
-	claims := jwt.MapClaims{
-		"username": otp.Username,
-		"exp":      time.Now().Add(time.Hour * 48).Unix(),
-	}
-
-	var secret_words string = "A request for a long text message: Search results showIf this is your intent, please clarify the context and what you want the text to be about."
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	secret := evn.GetString(secret_words, "JWT_SERECT")
-
-	tokenString, err := token.SignedString([]byte(secret))
+	otp, err := api.verifyOtp(ctx, payload.Email, otpPurposeLogin, payload.Otp)
 
 	if err != nil {
-		err := errors.New("failed to generate token")
-		internalServer(w, r, err)
+		if err == errOtpInvalid || err == errOtpTooManyAttempts {
+			api.recordSignInFailure(r, "email_otp", payload.Email, api.usernameForEmail(ctx, payload.Email))
+		}
+		otpError(w, r, err)
 		return
 	}
 
-	tokenResponse := JwtJson{Token: tokenString}
+	api.recordSignInSuccess(r, "email_otp", payload.Email, otp.Username)
 
-	writeJson(w, http.StatusAccepted, tokenResponse)
+	api.completeSignIn(w, r, otp.Username, payload.DeviceName)
 }
 
 // ResetPassword
 // @Summary Reset Password  
-// @Description Send otp email if exist
+// @Description Send otp email if exist, the response is the same whether or not it does
 // @Tags Auth
 // @Accept json
 // @Produce json
@@ -328,7 +285,6 @@ func (api *ApiService) VerifySignInEmailOtp(w http.ResponseWriter, r *http.Reque
 // @Success 200 {object} StandardResponse
 // @Failure 400 {object} errorslope
 // @Failure 500 {object} errorslope
-// @Failure 401 {object} errorslope
 // @Router /v1/auth/reset-password [post]
 func (api *ApiService) SendResetPasswordOtp(w http.ResponseWriter, r *http.Request) {
 
@@ -341,30 +297,14 @@ func (api *ApiService) SendResetPasswordOtp(w http.ResponseWriter, r *http.Reque
 
 	ctx := r.Context()
 
-	user, err := api.database.GetUserByEmail(ctx, payload.Email)
-
-	if err != nil {
-		if err == sql.ErrNoRows {
-			notFound(w, r, errors.New("no user found with email: "+payload.Email))
-			return
-		}
-		internalServer(w, r, errors.New("somthing went wrong"))
-		return
-	}
-
-	//send email with your smtp provider
-	otpToken := rand.Intn(9000000) + 100000
-
-	err = api.database.InsertOtp(ctx, user.Username, user.Email, otpPurposeResetPassword, int64(otpToken))
-
-	if err != nil {
-		internalServer(w, r, err)
+	if err := api.issueOtpIfExists(ctx, payload.Email, otpPurposeResetPassword); err != nil {
+		internalServer(w, r, errors.New("failed to send otp email"))
 		return
 	}
 
 	s := StandardResponse{
 		Status:  http.StatusOK,
-		Message: "otp " + strconv.Itoa(otpToken) + " sent to " + user.Email,
+		Message: "if an account uses " + payload.Email + " an otp has been sent to it",
 	}
 
 	writeJson(w, http.StatusOK, s)
@@ -382,6 +322,7 @@ func (api *ApiService) SendResetPasswordOtp(w http.ResponseWriter, r *http.Reque
 // @Failure 400 {object} errorslope
 // @Failure 500 {object} errorslope
 // @Failure 401 {object} errorslope
+// @Failure 429 {object} errorslope
 // @Router /v1/auth/reset-password-verify [post]
 func (api *ApiService) VerifyResetPasswordOtp(w http.ResponseWriter, r *http.Request) {
 
@@ -400,45 +341,31 @@ func (api *ApiService) VerifyResetPasswordOtp(w http.ResponseWriter, r *http.Req
 
 	ctx := r.Context()
 
-	otp, err := api.database.GetOtp(ctx, int64(payload.Otp))
-
-	if err != nil {
-		if err == sql.ErrNoRows {
-			unauthorized(w, r, err)
-			return
-		}
-
-		if err.Error() == "sql: Rows are closed" {
-			unauthorized(w, r, errors.New("invalid otp"))
-			return
-		}
-
-		internalServer(w, r, errors.New("somthing went wrong"))
+	if !api.guardSignIn(w, r, payload.Email) {
 		return
 	}
 
-	if otp.Email != payload.Email || otp.Purpose != otpPurposeResetPassword {
-		unauthorized(w, r, errors.New("invalid otp"))
+	otp, err := api.verifyOtp(ctx, payload.Email, otpPurposeResetPassword, payload.Otp)
+
+	if err != nil {
+		if err == errOtpInvalid || err == errOtpTooManyAttempts {
+			api.recordSignInFailure(r, "reset_otp", payload.Email, api.usernameForEmail(ctx, payload.Email))
+		}
+		otpError(w, r, err)
 		return
 	}
 
-	now := time.Now()
-	exp := otp.Exp;
-	// exp, err := time.Parse(time.RFC1123Z, otp.Exp)
+	api.recordSignInSuccess(r, "reset_otp", payload.Email, otp.Username)
 
-	// if err != nil {
-	// 	internalServer(w, r, err)
-	// 	return
-	// }
+	err = api.database.UpdateUserPassword(ctx, payload.Password, otp.Email)
 
-	if exp.Before(now) {
-		unauthorized(w, r, errors.New("otp expired"))
+	if err != nil {
+		internalServer(w, r, err)
 		return
 	}
 
-	err = api.database.UpdateUserPassword(ctx, payload.Password, otp.Email)
-
-	if err != nil {
+	// a password reset signs out every device that had the old password
+	if err := api.database.RevokeAllSessions(ctx, otp.Username); err != nil {
 		internalServer(w, r, err)
 		return
 	}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"main/database"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// errChatBlocked is why a message to a one-on-one chat is refused, it does not say who blocked whom
+var errChatBlocked = errors.New("you cannot send messages in this chat")
+
+// hiddenBy writes a not found response and reports true when the user userId, called username,
+// blocked the signed in user, so a blocker looks the same as someone who does not exist
+func (api *ApiService) hiddenBy(w http.ResponseWriter, r *http.Request, userId int64, username string) bool {
+
+	viewerId, err := getUserIdFromCtx(r.Context())
+
+	if err != nil {
+		internalServer(w, r, err)
+		return true
+	}
+
+	blocked, err := api.database.HasBlocked(r.Context(), userId, viewerId)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return true
+	}
+
+	if blocked {
+		notFound(w, r, errors.New("no user found with username: "+username))
+		return true
+	}
+
+	return false
+}
+
+// blockTarget resolves the username in the path to the user being blocked or unblocked
+func (api *ApiService) blockTarget(w http.ResponseWriter, r *http.Request) (int64, int64, bool) {
+
+	userId, err := getUserIdFromCtx(r.Context())
+
+	if err != nil {
+		internalServer(w, r, err)
+		return 0, 0, false
+	}
+
+	username := chi.URLParam(r, "username")
+
+	targetId, err := api.database.GetUserIdByUsername(r.Context(), username)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			notFound(w, r, errors.New("no user found with username: "+username))
+			return 0, 0, false
+		}
+		internalServer(w, r, err)
+		return 0, 0, false
+	}
+
+	if targetId == userId {
+		badRequest(w, r, errors.New("you cannot block yourself"))
+		return 0, 0, false
+	}
+
+	return userId, targetId, true
+}
+
+// @Summary Block user
+// @Description Stops friend requests both ways and new messages in your one-on-one chat, hides you from their search and stops them adding you to groups. Responds with json
+// @Tags User
+// @Produce json
+// @Param username path string true "username"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 409 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/user/blocks/{username} [post]
+func (api *ApiService) BlockUser(w http.ResponseWriter, r *http.Request) {
+
+	userId, targetId, ok := api.blockTarget(w, r)
+
+	if !ok {
+		return
+	}
+
+	username := chi.URLParam(r, "username")
+
+	if err := api.database.BlockUser(r.Context(), userId, targetId); err != nil {
+		if err == database.ErrAlreadyBlocked {
+			conflict(w, r, err)
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, StandardResponse{Status: http.StatusOK, Message: username + " blocked"})
+}
+
+// @Summary Unblock user
+// @Description Responds with json
+// @Tags User
+// @Produce json
+// @Param username path string true "username"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/user/blocks/{username} [delete]
+func (api *ApiService) UnblockUser(w http.ResponseWriter, r *http.Request) {
+
+	userId, targetId, ok := api.blockTarget(w, r)
+
+	if !ok {
+		return
+	}
+
+	username := chi.URLParam(r, "username")
+
+	if err := api.database.UnblockUser(r.Context(), userId, targetId); err != nil {
+		if err == database.ErrNotBlocked {
+			notFound(w, r, err)
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, StandardResponse{Status: http.StatusOK, Message: username + " unblocked"})
+}
+
+// @Summary Get blocked users
+// @Description Responds with json, most recent block first
+// @Tags User
+// @Produce json
+// @Param page query string true "page"
+// @Param limit query string true "limit"
+// @Success 200 {object} database.PaginatedResponse
+// @Failure 400 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/user/blocks [get]
+func (api *ApiService) GetBlockedUsers(w http.ResponseWriter, r *http.Request) {
+
+	userId, err := getUserIdFromCtx(r.Context())
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	query := r.URL.Query()
+
+	page, err1 := strconv.ParseInt(query.Get("page"), 10, 64)
+	limit, err2 := strconv.ParseInt(query.Get("limit"), 10, 64)
+
+	if err1 != nil || err2 != nil || page < 1 || limit < 1 || limit > 100 {
+		badRequest(w, r, errors.New("page must be a positive number and limit between 1 and 100"))
+		return
+	}
+
+	result, err := api.database.GetBlockedUsers(r.Context(), userId, limit, page)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, result)
+}
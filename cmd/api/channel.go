@@ -0,0 +1,860 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"main/database"
+	"main/internal/push"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+var channelHandlePattern = regexp.MustCompile(`^[a-z0-9_]{3,32}$`)
+
+const (
+	// subscribers loaded per query when a post is pushed out
+	channelFanOutBatch = 500
+	// pushes in flight at once for a single post
+	channelFanOutWorkers = 16
+)
+
+type CreateChannelPayload struct {
+	Name        string `json:"name"`
+	Handle      string `json:"handle"` // optional, 3 to 32 of a-z, 0-9 and _
+	Description string `json:"description"`
+	IsPublic    bool   `json:"is_public"` // public channels can be found by handle
+}
+
+type ChannelCreatedJson struct {
+	Id int64 `json:"id"`
+}
+
+// fields left out are not changed, an empty handle removes it
+type UpdateChannelPayload struct {
+	Id          int64   `json:"id"`
+	Name        *string `json:"name"`
+	Handle      *string `json:"handle"`
+	Description *string `json:"description"`
+	IsPublic    *bool   `json:"is_public"`
+}
+
+type ChannelAdminPayload struct {
+	Id       int64  `json:"id"`
+	Username string `json:"username"`
+	Admin    bool   `json:"admin"` // false makes them a plain subscriber again
+}
+
+type ChannelSubscriberPayload struct {
+	Id       int64  `json:"id"`
+	Username string `json:"username"`
+}
+
+type ChannelPostPayload struct {
+	TextContent string `json:"text_content"`
+}
+
+var (
+	errChannelPermission = errors.New("your role in this channel does not allow this")
+	errChannelNotFound   = errors.New("no channel found")
+	errChannelSocketPost = errors.New("channels take posts through /v1/channel/{id}/posts")
+)
+
+var channelRoleRank = map[database.ChannelRole]int{
+	database.ChannelRoleSubscriber: 1,
+	database.ChannelRoleAdmin:      2,
+	database.ChannelRoleOwner:      3,
+}
+
+func channelIdParam(w http.ResponseWriter, r *http.Request) (int64, bool) {
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+
+	if err != nil {
+		badRequest(w, r, errors.New("channel id is not a number"))
+		return 0, false
+	}
+
+	return id, true
+}
+
+// validChannelHandle lowercases the handle, empty is allowed and means no handle
+func validChannelHandle(handle string) (string, error) {
+
+	handle = strings.ToLower(strings.TrimSpace(handle))
+
+	if handle != "" && !channelHandlePattern.MatchString(handle) {
+		return "", errors.New("handle must be 3 to 32 letters, digits or underscores")
+	}
+
+	return handle, nil
+}
+
+func validChannelName(name string) error {
+
+	if strings.TrimSpace(name) == "" || utf8.RuneCountInString(name) > 255 {
+		return errors.New("name is required and at most 255 characters")
+	}
+
+	return nil
+}
+
+// authorizeChannel loads the channel as seen by the signed in user and checks they hold at least
+// role, an empty role lets anyone through to a public channel and only subscribers to a private one.
+// Writes the error response and returns false otherwise.
+func (api *ApiService) authorizeChannel(w http.ResponseWriter, r *http.Request, channelId int64, role database.ChannelRole) (*database.Channel, bool) {
+
+	userId, err := getUserIdFromCtx(r.Context())
+
+	if err != nil {
+		internalServer(w, r, err)
+		return nil, false
+	}
+
+	channel, err := api.database.GetChannel(r.Context(), userId, channelId)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			notFound(w, r, errChannelNotFound)
+			return nil, false
+		}
+		internalServer(w, r, err)
+		return nil, false
+	}
+
+	// the same answer as a missing channel, so ids cannot be probed for private ones
+	if !channel.Visible() {
+		notFound(w, r, errChannelNotFound)
+		return nil, false
+	}
+
+	if role != "" && channelRoleRank[channel.Role] < channelRoleRank[role] {
+		forbidden(w, r, errChannelPermission)
+		return nil, false
+	}
+
+	return channel, true
+}
+
+// @Summary Create channel
+// @Description The creator becomes the owner and first subscriber. Responds with json
+// @Tags Channel
+// @Accept json
+// @Produce json
+// @Param payload body CreateChannelPayload true "channel"
+// @Success 201 {object} ChannelCreatedJson
+// @Failure 400 {object} errorslope
+// @Failure 409 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/channel/create [post]
+func (api *ApiService) CreateChannel(w http.ResponseWriter, r *http.Request) {
+
+	var payload CreateChannelPayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	if err := validChannelName(payload.Name); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	handle, err := validChannelHandle(payload.Handle)
+
+	if err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	ctx := r.Context()
+
+	userId, err := getUserIdFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	id, err := api.database.InsertChannel(ctx, userId, payload.Name, handle, payload.Description, payload.IsPublic)
+
+	if err != nil {
+		if err == database.ErrChannelHandleTaken {
+			conflict(w, r, err)
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusCreated, ChannelCreatedJson{Id: id})
+}
+
+// @Summary Get channel
+// @Description Private channels are only found by their subscribers. Responds with json, role is empty when you are not subscribed
+// @Tags Channel
+// @Produce json
+// @Param id path string true "channel id"
+// @Success 200 {object} database.Channel
+// @Failure 400 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/channel/{id} [get]
+func (api *ApiService) GetChannel(w http.ResponseWriter, r *http.Request) {
+
+	channelId, ok := channelIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	channel, ok := api.authorizeChannel(w, r, channelId, "")
+
+	if !ok {
+		return
+	}
+
+	writeJson(w, http.StatusOK, channel)
+}
+
+// @Summary Find channel by handle
+// @Description Only public channels are found. Responds with json
+// @Tags Channel
+// @Produce json
+// @Param handle path string true "channel handle"
+// @Success 200 {object} database.Channel
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/channel/handle/{handle} [get]
+func (api *ApiService) GetChannelByHandle(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	userId, err := getUserIdFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	channel, err := api.database.GetPublicChannelByHandle(ctx, userId, chi.URLParam(r, "handle"))
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			notFound(w, r, errChannelNotFound)
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, channel)
+}
+
+// @Summary Update channel
+// @Description Owner and admins only. Responds with json
+// @Tags Channel
+// @Accept json
+// @Produce json
+// @Param payload body UpdateChannelPayload true "channel id and the fields to change"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 409 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/channel/update [put]
+func (api *ApiService) UpdateChannel(w http.ResponseWriter, r *http.Request) {
+
+	var payload UpdateChannelPayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	if payload.Name != nil {
+		if err := validChannelName(*payload.Name); err != nil {
+			badRequest(w, r, err)
+			return
+		}
+	}
+
+	if payload.Handle != nil {
+
+		handle, err := validChannelHandle(*payload.Handle)
+
+		if err != nil {
+			badRequest(w, r, err)
+			return
+		}
+
+		payload.Handle = &handle
+	}
+
+	if _, ok := api.authorizeChannel(w, r, payload.Id, database.ChannelRoleAdmin); !ok {
+		return
+	}
+
+	err := api.database.UpdateChannel(r.Context(), payload.Id, payload.Name, payload.Handle, payload.Description, payload.IsPublic)
+
+	if err != nil {
+		if err == database.ErrChannelHandleTaken {
+			conflict(w, r, err)
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, StandardResponse{Status: http.StatusOK, Message: "channel updated"})
+}
+
+// @Summary Delete channel
+// @Description Owner only, the posts go with it. Responds with json
+// @Tags Channel
+// @Produce json
+// @Param id path string true "channel id"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/channel/{id} [delete]
+func (api *ApiService) DeleteChannel(w http.ResponseWriter, r *http.Request) {
+
+	channelId, ok := channelIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	if _, ok := api.authorizeChannel(w, r, channelId, database.ChannelRoleOwner); !ok {
+		return
+	}
+
+	if err := api.database.DeleteChannel(r.Context(), channelId); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, StandardResponse{Status: http.StatusOK, Message: "channel deleted"})
+}
+
+// @Summary Subscribe to channel
+// @Description A private channel has to be joined through an admin, see /v1/channel/subscribers. Responds with json
+// @Tags Channel
+// @Produce json
+// @Param id path string true "channel id"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 409 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/channel/{id}/subscribe [post]
+func (api *ApiService) SubscribeChannel(w http.ResponseWriter, r *http.Request) {
+
+	channelId, ok := channelIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	channel, ok := api.authorizeChannel(w, r, channelId, "")
+
+	if !ok {
+		return
+	}
+
+	userId, err := getUserIdFromCtx(r.Context())
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if err := api.database.Subscribe(r.Context(), userId, channel.ID); err != nil {
+		if err == database.ErrAlreadySubscribed {
+			conflict(w, r, err)
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, StandardResponse{Status: http.StatusOK, Message: "subscribed to " + channel.Name})
+}
+
+// @Summary Unsubscribe from channel
+// @Description The owner cannot unsubscribe. Responds with json
+// @Tags Channel
+// @Produce json
+// @Param id path string true "channel id"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/channel/{id}/unsubscribe [post]
+func (api *ApiService) UnsubscribeChannel(w http.ResponseWriter, r *http.Request) {
+
+	channelId, ok := channelIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	userId, err := getUserIdFromCtx(r.Context())
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if err := api.database.Unsubscribe(r.Context(), userId, channelId); err != nil {
+		switch err {
+		case database.ErrNotSubscribed:
+			notFound(w, r, err)
+		case database.ErrChannelOwnerLeave:
+			forbidden(w, r, err)
+		default:
+			internalServer(w, r, err)
+		}
+		return
+	}
+
+	writeJson(w, http.StatusOK, StandardResponse{Status: http.StatusOK, Message: "unsubscribed"})
+}
+
+// @Summary Get subscribed channels
+// @Description Responds with json, most recently subscribed first
+// @Tags Channel
+// @Produce json
+// @Param page query string true "page"
+// @Param limit query string true "limit"
+// @Success 200 {object} database.PaginatedResponse
+// @Failure 400 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/channel/subscribed [get]
+func (api *ApiService) GetSubscribedChannels(w http.ResponseWriter, r *http.Request) {
+
+	page, limit, ok := channelPage(w, r)
+
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+
+	userId, err := getUserIdFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	result, err := api.database.GetSubscribedChannels(ctx, userId, limit, page)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, result)
+}
+
+// @Summary Get channel subscribers
+// @Description Owner and admins only. Responds with json
+// @Tags Channel
+// @Produce json
+// @Param id path string true "channel id"
+// @Param page query string true "page"
+// @Param limit query string true "limit"
+// @Success 200 {object} database.PaginatedResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/channel/{id}/subscribers [get]
+func (api *ApiService) GetChannelSubscribers(w http.ResponseWriter, r *http.Request) {
+
+	channelId, ok := channelIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	page, limit, ok := channelPage(w, r)
+
+	if !ok {
+		return
+	}
+
+	if _, ok := api.authorizeChannel(w, r, channelId, database.ChannelRoleAdmin); !ok {
+		return
+	}
+
+	result, err := api.database.GetChannelSubscribers(r.Context(), channelId, limit, page)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, result)
+}
+
+// @Summary Add channel subscriber
+// @Description Owner and admins only, this is the way into a private channel. Responds with json
+// @Tags Channel
+// @Accept json
+// @Produce json
+// @Param payload body ChannelSubscriberPayload true "channel id and username"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 409 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/channel/subscribers [post]
+func (api *ApiService) AddChannelSubscriber(w http.ResponseWriter, r *http.Request) {
+
+	var payload ChannelSubscriberPayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	channel, ok := api.authorizeChannel(w, r, payload.Id, database.ChannelRoleAdmin)
+
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+
+	actorId, err := getUserIdFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	actor, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	userId, err := api.database.GetUserIdByUsername(ctx, payload.Username)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			notFound(w, r, errors.New("no user found with username: "+payload.Username))
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	if err := api.database.AddChannelSubscriber(ctx, payload.Id, userId, actorId); err != nil {
+		switch err {
+		case database.ErrAlreadySubscribed:
+			conflict(w, r, errors.New(payload.Username+" is already subscribed to this channel"))
+		case database.ErrUserBlocked:
+			forbidden(w, r, errors.New("you cannot add "+payload.Username+" to this channel"))
+		default:
+			internalServer(w, r, err)
+		}
+		return
+	}
+
+	api.notify(payload.Username, "Channel", actor+" added you to "+channel.Name, map[string]string{
+		"type":       "channel_subscriber_added",
+		"channel_id": strconv.FormatInt(payload.Id, 10),
+	})
+
+	writeJson(w, http.StatusOK, StandardResponse{Status: http.StatusOK, Message: payload.Username + " added to " + channel.Name})
+}
+
+// @Summary Set channel admin
+// @Description Owner only, the user has to be subscribed. Responds with json
+// @Tags Channel
+// @Accept json
+// @Produce json
+// @Param payload body ChannelAdminPayload true "channel id, username and whether they are admin"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/channel/admins [put]
+func (api *ApiService) SetChannelAdmin(w http.ResponseWriter, r *http.Request) {
+
+	var payload ChannelAdminPayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	if _, ok := api.authorizeChannel(w, r, payload.Id, database.ChannelRoleOwner); !ok {
+		return
+	}
+
+	ctx := r.Context()
+
+	userId, err := api.database.GetUserIdByUsername(ctx, payload.Username)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			notFound(w, r, errors.New("no user found with username: "+payload.Username))
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	if err := api.database.SetChannelAdmin(ctx, userId, payload.Id, payload.Admin); err != nil {
+		if err == database.ErrNotSubscribed {
+			notFound(w, r, errors.New(payload.Username+" is not subscribed to this channel"))
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	message := payload.Username + " is now a subscriber"
+
+	if payload.Admin {
+		message = payload.Username + " is now an admin"
+	}
+
+	writeJson(w, http.StatusOK, StandardResponse{Status: http.StatusOK, Message: message})
+}
+
+// @Summary Post to channel
+// @Description Owner and admins only, subscribers are notified in the background. Responds with json
+// @Tags Channel
+// @Accept json
+// @Produce json
+// @Param id path string true "channel id"
+// @Param payload body ChannelPostPayload true "post"
+// @Success 201 {object} database.Message
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/channel/{id}/posts [post]
+func (api *ApiService) PostToChannel(w http.ResponseWriter, r *http.Request) {
+
+	channelId, ok := channelIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	var payload ChannelPostPayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	if strings.TrimSpace(payload.TextContent) == "" {
+		badRequest(w, r, errors.New("text_content is required"))
+		return
+	}
+
+	channel, ok := api.authorizeChannel(w, r, channelId, database.ChannelRoleAdmin)
+
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+
+	userId, err := getUserIdFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	now := time.Now()
+
+	message := database.Message{
+		MessageID:      uuid.New().String(),
+		FriendshipID:   database.ChannelChatId(channel.ID),
+		SenderID:       userId,
+		SenderUsername: username,
+		MessageType:    "MessageChat",
+		TextContent:    payload.TextContent,
+		CreatedAt:      now.String(),
+		ModifiedAt:     now.String(),
+	}
+
+	if err := api.database.InsertMessage(ctx, message.MessageID, message.FriendshipID, userId, message.MessageType, message.TextContent, now); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	api.fanOutChannelPost(*channel, message)
+
+	writeJson(w, http.StatusCreated, message)
+}
+
+// @Summary Get channel posts
+// @Description Private channels only for their subscribers. Responds with json
+// @Tags Channel
+// @Produce json
+// @Param id path string true "channel id"
+// @Param page query string true "page"
+// @Param limit query string true "limit"
+// @Success 200 {object} database.PaginatedResponse
+// @Failure 400 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/channel/{id}/posts [get]
+func (api *ApiService) GetChannelPosts(w http.ResponseWriter, r *http.Request) {
+
+	channelId, ok := channelIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	page, limit, ok := channelPage(w, r)
+
+	if !ok {
+		return
+	}
+
+	if _, ok := api.authorizeChannel(w, r, channelId, ""); !ok {
+		return
+	}
+
+	result, err := api.database.GetMessages(r.Context(), database.ChannelChatId(channelId), int(page), int(limit))
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, result)
+}
+
+func channelPage(w http.ResponseWriter, r *http.Request) (int64, int64, bool) {
+
+	query := r.URL.Query()
+
+	page, err1 := strconv.ParseInt(query.Get("page"), 10, 64)
+	limit, err2 := strconv.ParseInt(query.Get("limit"), 10, 64)
+
+	if err1 != nil || err2 != nil || page < 1 || limit < 1 || limit > 100 {
+		badRequest(w, r, errors.New("page must be a positive number and limit between 1 and 100"))
+		return 0, 0, false
+	}
+
+	return page, limit, true
+}
+
+// fanOutChannelPost pushes a post to every subscriber but the sender. Subscribers are read in keyset
+// batches and handed to a fixed pool of workers, so neither memory nor the number of goroutines
+// grows with the size of the channel.
+func (api *ApiService) fanOutChannelPost(channel database.Channel, message database.Message) {
+
+	go func() {
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		defer cancel()
+
+		notification := push.Notification{
+			Title: channel.Name,
+			Body:  message.TextContent,
+			Data: map[string]string{
+				"type":       "channel_post",
+				"channel_id": strconv.FormatInt(channel.ID, 10),
+				"message_id": message.MessageID,
+			},
+		}
+
+		usernames := make(chan string, channelFanOutBatch)
+
+		var wg sync.WaitGroup
+
+		for i := 0; i < channelFanOutWorkers; i++ {
+
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				for username := range usernames {
+					if err := api.push.Dispatch(ctx, username, notification); err != nil {
+						log.Printf("channel %d push to %s failed: %v", channel.ID, username, err)
+					}
+				}
+			}()
+		}
+
+		var afterId int64
+
+		for {
+
+			batch, err := api.database.GetChannelSubscriberBatch(ctx, channel.ID, afterId, channelFanOutBatch)
+
+			if err != nil {
+				log.Printf("failed to load subscribers of channel %d for push: %v", channel.ID, err)
+				break
+			}
+
+			for _, subscriber := range batch {
+				if subscriber.UserID != message.SenderID {
+					usernames <- subscriber.Username
+				}
+			}
+
+			if len(batch) < channelFanOutBatch {
+				break
+			}
+
+			afterId = batch[len(batch)-1].UserID
+		}
+
+		close(usernames)
+		wg.Wait()
+	}()
+}
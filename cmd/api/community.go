@@ -0,0 +1,709 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"main/database"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+type CreateCommunityPayload struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type CommunityCreatedJson struct {
+	Id                  int64 `json:"id"`
+	AnnouncementGroupId int64 `json:"announcement_group_id"`
+}
+
+// empty fields are not changed
+type UpdateCommunityPayload struct {
+	Id          int64  `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type CommunityMemberPayload struct {
+	Id       int64  `json:"id"`
+	Username string `json:"username"`
+}
+
+type CommunityAdminPayload struct {
+	Id       int64  `json:"id"`
+	Username string `json:"username"`
+	Admin    bool   `json:"admin"` // false makes them a plain member again
+}
+
+type CommunityGroupCreatedJson struct {
+	Id int64 `json:"id"`
+}
+
+type CreateCommunityGroupPayload struct {
+	Id          int64  `json:"id"` // community id
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Privacy     string `json:"privacy"` // open, request_to_join or invite_only, defaults to open
+}
+
+var (
+	errNotCommunityMember  = errors.New("you are not a member of this community")
+	errCommunityPermission = errors.New("your role in this community does not allow this action")
+)
+
+func communityIdParam(w http.ResponseWriter, r *http.Request) (int64, bool) {
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+
+	if err != nil {
+		badRequest(w, r, errors.New("community id is not a number"))
+		return 0, false
+	}
+
+	return id, true
+}
+
+// authorizeCommunity returns the signed in user's membership when they hold at least role, or
+// writes the error response and returns false
+func (api *ApiService) authorizeCommunity(w http.ResponseWriter, r *http.Request, communityId int64, role database.CommunityRole) (*database.CommunityMember, bool) {
+
+	userId, err := getUserIdFromCtx(r.Context())
+
+	if err != nil {
+		internalServer(w, r, err)
+		return nil, false
+	}
+
+	member, err := api.database.GetCommunityMember(r.Context(), userId, communityId)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			forbidden(w, r, errNotCommunityMember)
+			return nil, false
+		}
+		internalServer(w, r, err)
+		return nil, false
+	}
+
+	if !member.Role.AtLeast(role) {
+		forbidden(w, r, errCommunityPermission)
+		return nil, false
+	}
+
+	return member, true
+}
+
+// communityTarget loads the member an action is aimed at, the actor has to outrank them
+func (api *ApiService) communityTarget(w http.ResponseWriter, r *http.Request, actor *database.CommunityMember, username string) (*database.CommunityMember, bool) {
+
+	ctx := r.Context()
+
+	userId, err := api.database.GetUserIdByUsername(ctx, username)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			notFound(w, r, errors.New("no user found with username: "+username))
+			return nil, false
+		}
+		internalServer(w, r, err)
+		return nil, false
+	}
+
+	target, err := api.database.GetCommunityMember(ctx, userId, actor.CommunityID)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			notFound(w, r, errors.New(username+" is not a member of this community"))
+			return nil, false
+		}
+		internalServer(w, r, err)
+		return nil, false
+	}
+
+	if !actor.Role.Outranks(target.Role) {
+		forbidden(w, r, errCommunityPermission)
+		return nil, false
+	}
+
+	return target, true
+}
+
+func validCommunityName(name string) error {
+
+	if strings.TrimSpace(name) == "" || utf8.RuneCountInString(name) > 200 {
+		return errors.New("name is required and at most 200 characters")
+	}
+
+	return nil
+}
+
+// @Summary Create community
+// @Description The creator becomes the owner. An announcement group, where only admins post, is created with it and every member is placed in it. Responds with json
+// @Tags Community
+// @Accept json
+// @Produce json
+// @Param payload body CreateCommunityPayload true "community"
+// @Success 201 {object} CommunityCreatedJson
+// @Failure 400 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/community/create [post]
+func (api *ApiService) CreateCommunity(w http.ResponseWriter, r *http.Request) {
+
+	var payload CreateCommunityPayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	if err := validCommunityName(payload.Name); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	ctx := r.Context()
+
+	userId, err := getUserIdFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	id, err := api.database.InsertCommunity(ctx, userId, payload.Name, payload.Description)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	community, err := api.database.GetCommunity(ctx, userId, id)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusCreated, CommunityCreatedJson{Id: id, AnnouncementGroupId: community.AnnouncementGroupID})
+}
+
+// @Summary Get my communities
+// @Description Responds with json
+// @Tags Community
+// @Produce json
+// @Success 200 {array} database.Community
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/community/mine [get]
+func (api *ApiService) GetMyCommunities(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	userId, err := getUserIdFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	communities, err := api.database.GetUserCommunities(ctx, userId)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, communities)
+}
+
+// @Summary Get community
+// @Description Members only. Responds with json
+// @Tags Community
+// @Produce json
+// @Param id path string true "community id"
+// @Success 200 {object} database.Community
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/community/{id} [get]
+func (api *ApiService) GetCommunity(w http.ResponseWriter, r *http.Request) {
+
+	communityId, ok := communityIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	member, ok := api.authorizeCommunity(w, r, communityId, database.CommunityRoleMember)
+
+	if !ok {
+		return
+	}
+
+	community, err := api.database.GetCommunity(r.Context(), member.UserID, communityId)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, community)
+}
+
+// @Summary Update community
+// @Description Owner and admins only. Responds with json
+// @Tags Community
+// @Accept json
+// @Produce json
+// @Param payload body UpdateCommunityPayload true "community id and the fields to change"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/community/update [put]
+func (api *ApiService) UpdateCommunity(w http.ResponseWriter, r *http.Request) {
+
+	var payload UpdateCommunityPayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	if payload.Name == "" && payload.Description == "" {
+		badRequest(w, r, errors.New("name and description cannot both be empty"))
+		return
+	}
+
+	if payload.Name != "" {
+		if err := validCommunityName(payload.Name); err != nil {
+			badRequest(w, r, err)
+			return
+		}
+	}
+
+	if _, ok := api.authorizeCommunity(w, r, payload.Id, database.CommunityRoleAdmin); !ok {
+		return
+	}
+
+	if err := api.database.UpdateCommunity(r.Context(), payload.Id, payload.Name, payload.Description); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, StandardResponse{Status: http.StatusOK, Message: "community updated"})
+}
+
+// @Summary Delete community
+// @Description Owner only, every group of the community is deleted with it. Responds with json
+// @Tags Community
+// @Produce json
+// @Param id path string true "community id"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/community/{id} [delete]
+func (api *ApiService) DeleteCommunity(w http.ResponseWriter, r *http.Request) {
+
+	communityId, ok := communityIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	if _, ok := api.authorizeCommunity(w, r, communityId, database.CommunityRoleOwner); !ok {
+		return
+	}
+
+	ctx := r.Context()
+
+	deleted, err := api.database.DeleteCommunity(ctx, communityId)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	for _, group := range deleted {
+		api.removeGroupFiles(ctx, group)
+	}
+
+	writeJson(w, http.StatusOK, StandardResponse{Status: http.StatusOK, Message: "community deleted with " + strconv.Itoa(len(deleted)) + " groups"})
+}
+
+// @Summary Get community members
+// @Description The member directory, owner and admins first. Members only. Responds with json
+// @Tags Community
+// @Produce json
+// @Param id path string true "community id"
+// @Param page query string true "page"
+// @Param limit query string true "limit"
+// @Param search query string false "start of a username"
+// @Success 200 {object} database.PaginatedResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/community/{id}/members [get]
+func (api *ApiService) GetCommunityMembers(w http.ResponseWriter, r *http.Request) {
+
+	communityId, ok := communityIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+
+	page, err1 := strconv.ParseInt(query.Get("page"), 10, 64)
+	limit, err2 := strconv.ParseInt(query.Get("limit"), 10, 64)
+
+	if err1 != nil || err2 != nil || page < 1 || limit < 1 || limit > 100 {
+		badRequest(w, r, errors.New("page must be a positive number and limit between 1 and 100"))
+		return
+	}
+
+	if _, ok := api.authorizeCommunity(w, r, communityId, database.CommunityRoleMember); !ok {
+		return
+	}
+
+	// the search is a prefix match, its wildcards are taken literally
+	search := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(query.Get("search"))
+
+	result, err := api.database.GetCommunityMembers(r.Context(), communityId, search, limit, page)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, result)
+}
+
+// @Summary Add community member
+// @Description Owner and admins only, the new member is placed in the announcement group. Responds with json
+// @Tags Community
+// @Accept json
+// @Produce json
+// @Param payload body CommunityMemberPayload true "community id and username"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 409 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/community/members [post]
+func (api *ApiService) AddCommunityMember(w http.ResponseWriter, r *http.Request) {
+
+	var payload CommunityMemberPayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	actor, ok := api.authorizeCommunity(w, r, payload.Id, database.CommunityRoleAdmin)
+
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+
+	userId, err := api.database.GetUserIdByUsername(ctx, payload.Username)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			notFound(w, r, errors.New("no user found with username: "+payload.Username))
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	info := database.Message{
+		MessageID:      uuid.New().String(),
+		SenderUsername: payload.Username,
+		TextContent:    payload.Username + " joined the community",
+	}
+
+	joined, err := api.database.AddCommunityMember(ctx, payload.Id, userId, actor.UserID, &info)
+
+	if err != nil {
+		if err == database.ErrAlreadyCommunityMember {
+			conflict(w, r, errors.New(payload.Username+" is already a member of this community"))
+			return
+		}
+		if err == database.ErrUserBlocked {
+			forbidden(w, r, errors.New("you cannot add "+payload.Username+" to this community"))
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	if joined {
+		api.notifyChatParticipants(info)
+	}
+
+	api.notify(payload.Username, "Community", actor.Username+" added you to a community", map[string]string{
+		"type":         "community_member_added",
+		"community_id": strconv.FormatInt(payload.Id, 10),
+	})
+
+	writeJson(w, http.StatusOK, StandardResponse{Status: http.StatusOK, Message: payload.Username + " added to the community"})
+}
+
+// @Summary Remove community member
+// @Description Owner and admins only, the member is taken out of every group of the community too. Responds with json
+// @Tags Community
+// @Produce json
+// @Param id path string true "community id"
+// @Param username path string true "username"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/community/{id}/members/{username} [delete]
+func (api *ApiService) RemoveCommunityMember(w http.ResponseWriter, r *http.Request) {
+
+	communityId, ok := communityIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	actor, ok := api.authorizeCommunity(w, r, communityId, database.CommunityRoleAdmin)
+
+	if !ok {
+		return
+	}
+
+	target, ok := api.communityTarget(w, r, actor, chi.URLParam(r, "username"))
+
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+
+	deleted, err := api.database.RemoveCommunityMember(ctx, communityId, target.UserID, actor.UserID)
+
+	if err != nil {
+		if err == database.ErrNotCommunityMember {
+			notFound(w, r, errors.New(target.Username+" is not a member of this community"))
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	for _, group := range deleted {
+		api.removeGroupFiles(ctx, group)
+	}
+
+	writeJson(w, http.StatusOK, StandardResponse{Status: http.StatusOK, Message: target.Username + " removed from the community"})
+}
+
+// @Summary Set community admin
+// @Description Owner only. Responds with json
+// @Tags Community
+// @Accept json
+// @Produce json
+// @Param payload body CommunityAdminPayload true "community id, username and whether they are admin"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/community/admins [put]
+func (api *ApiService) SetCommunityAdmin(w http.ResponseWriter, r *http.Request) {
+
+	var payload CommunityAdminPayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	actor, ok := api.authorizeCommunity(w, r, payload.Id, database.CommunityRoleOwner)
+
+	if !ok {
+		return
+	}
+
+	target, ok := api.communityTarget(w, r, actor, payload.Username)
+
+	if !ok {
+		return
+	}
+
+	if err := api.database.SetCommunityAdmin(r.Context(), payload.Id, target.UserID, payload.Admin); err != nil {
+		if err == database.ErrNotCommunityMember {
+			notFound(w, r, errors.New(payload.Username+" is not a member of this community"))
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	message := payload.Username + " is now a member"
+
+	if payload.Admin {
+		message = payload.Username + " is now an admin"
+	}
+
+	writeJson(w, http.StatusOK, StandardResponse{Status: http.StatusOK, Message: message})
+}
+
+// @Summary Leave community
+// @Description Leaves every group of the community too. An owner who leaves hands the community to the longest standing admin, then member, it is deleted with its groups when they were the last one. Responds with json
+// @Tags Community
+// @Produce json
+// @Param id path string true "community id"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/community/{id}/leave [post]
+func (api *ApiService) LeaveCommunity(w http.ResponseWriter, r *http.Request) {
+
+	communityId, ok := communityIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+
+	userId, err := getUserIdFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	deleted, err := api.database.LeaveCommunity(ctx, communityId, userId)
+
+	if err != nil {
+		if err == database.ErrNotCommunityMember {
+			forbidden(w, r, errNotCommunityMember)
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	for _, group := range deleted {
+		api.removeGroupFiles(ctx, group)
+	}
+
+	writeJson(w, http.StatusOK, StandardResponse{Status: http.StatusOK, Message: "you left the community"})
+}
+
+// @Summary Get community groups
+// @Description Members only. Lists the groups you are in and the ones you can join or ask to join, invite only groups you are not in stay hidden. Join them with /v1/firendship/group/{id}/join. Responds with json
+// @Tags Community
+// @Produce json
+// @Param id path string true "community id"
+// @Success 200 {array} database.CommunityGroup
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/community/{id}/groups [get]
+func (api *ApiService) GetCommunityGroups(w http.ResponseWriter, r *http.Request) {
+
+	communityId, ok := communityIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	member, ok := api.authorizeCommunity(w, r, communityId, database.CommunityRoleMember)
+
+	if !ok {
+		return
+	}
+
+	groups, err := api.database.GetCommunityGroups(r.Context(), member.UserID, communityId)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, groups)
+}
+
+// @Summary Create community group
+// @Description Owner and admins only, the creator becomes the group owner. Only community members can join it. Responds with json
+// @Tags Community
+// @Accept json
+// @Produce json
+// @Param payload body CreateCommunityGroupPayload true "community id and group"
+// @Success 201 {object} CommunityGroupCreatedJson
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/community/groups [post]
+func (api *ApiService) CreateCommunityGroup(w http.ResponseWriter, r *http.Request) {
+
+	var payload CreateCommunityGroupPayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	if strings.TrimSpace(payload.Name) == "" {
+		badRequest(w, r, errors.New("name is required"))
+		return
+	}
+
+	privacy := database.GroupPrivacyOpen
+
+	if payload.Privacy != "" {
+
+		parsed, err := database.ParseGroupPrivacy(payload.Privacy)
+
+		if err != nil {
+			badRequest(w, r, err)
+			return
+		}
+
+		privacy = parsed
+	}
+
+	actor, ok := api.authorizeCommunity(w, r, payload.Id, database.CommunityRoleAdmin)
+
+	if !ok {
+		return
+	}
+
+	groupId, err := api.database.InsertCommunityGroup(r.Context(), payload.Id, actor.UserID, payload.Name, payload.Description, privacy)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusCreated, CommunityGroupCreatedJson{Id: groupId})
+}
@@ -1,9 +1,19 @@
 package api
 
-import "main/database"
+import (
+	"main/database"
+	"main/internal/mailer"
+	"main/internal/oidc"
+	"main/internal/token"
+	"main/internal/webauthn"
+	"time"
+)
 
 type RateLimitConfig struct {
 	MaxRequestPerMin int64
+	// reverse proxies, addresses or CIDR ranges, whose X-Forwarded-For and X-Real-IP are believed.
+	// Empty means the server is reached directly and the peer address is the client.
+	TrustedProxies []string
 }
 
 type RedisConfig struct{
@@ -14,8 +24,85 @@ type RedisConfig struct{
 
 }
 
+type PushConfig struct {
+	FCMCredentialsFile string // firebase service account json, empty disables android push
+
+	APNsKeyFile    string // .p8 auth key, empty disables ios push
+	APNsKeyID      string
+	APNsTeamID     string
+	APNsTopic      string
+	APNsProduction bool
+}
+
+type MailConfig struct {
+	Driver      string // smtp or log
+	From        string
+	SMTP        mailer.SMTPConfig
+	LogDir      string // log driver writes .eml files here, empty prints to the log
+	Workers     int
+	MaxAttempts int
+}
+
+type OtpConfig struct {
+	HashKey         []byte
+	Ttl             time.Duration
+	MaxAttempts     int
+	ResendCooldown  time.Duration
+	CleanupInterval time.Duration
+}
+
+type SessionConfig struct {
+	AccessTokenTtl  time.Duration
+	RefreshTokenTtl time.Duration
+}
+
+type MfaConfig struct {
+	Issuer string // name shown in authenticator apps
+	Skew   int    // time steps accepted either side of now
+}
+
+type LockoutConfig struct {
+	MaxFailures     int           // failed sign-ins for one account before it is locked
+	MaxIpFailures   int           // failed sign-ins from one ip, across accounts, before the ip is locked
+	BaseDelay       time.Duration // wait after the first failure, doubled for each further one
+	MaxDelay        time.Duration
+	LockoutDuration time.Duration
+	FailureWindow   time.Duration // failures older than this are forgotten
+}
+
+type AccountConfig struct {
+	DeletionGracePeriod time.Duration // signing in before it is over cancels a deletion
+	PurgeInterval       time.Duration
+
+	UsernameChangeInterval time.Duration // minimum time between two username changes
+	UsernameReservation    time.Duration // how long an old username stays reserved for its owner
+	EmailRevertWindow      time.Duration // how long the old address can undo an email change
+}
+
+type ExportConfig struct {
+	Dir           string        // finished archives, kept until the link expires
+	LinkTtl       time.Duration
+	PublicBaseUrl string        // prefix of the download link sent to the user
+}
+
+type GroupConfig struct {
+	MaxMembers int // 0 is no limit
+}
+
 type Config struct {
 	DatabaseConfig  database.DatabaseConfig
 	RateLimitConfig RateLimitConfig
 	RedisConfig RedisConfig
+	PushConfig      PushConfig
+	MailConfig      MailConfig
+	OtpConfig       OtpConfig
+	SessionConfig   SessionConfig
+	TokenConfig     token.Config
+	MfaConfig       MfaConfig
+	WebAuthnConfig  webauthn.Config
+	OidcProviders   []oidc.ProviderConfig
+	LockoutConfig   LockoutConfig
+	AccountConfig   AccountConfig
+	ExportConfig    ExportConfig
+	GroupConfig     GroupConfig
 }
\ No newline at end of file
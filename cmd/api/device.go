@@ -0,0 +1,226 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"main/database"
+	"main/internal/push"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type RegisterDevicePayload struct {
+	Token    string `json:"token"`
+	Platform string `json:"platform"` // android or ios
+}
+
+// deviceStore exposes the device_token table to the push dispatcher
+type deviceStore struct {
+	database *database.DataRepository
+}
+
+func (s deviceStore) GetDevices(ctx context.Context, username string) ([]push.Device, error) {
+
+	tokens, err := s.database.GetDeviceTokensByUsername(ctx, username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]push.Device, 0, len(tokens))
+
+	for _, token := range tokens {
+		devices = append(devices, push.Device{Token: token.Token, Platform: push.Platform(token.Platform)})
+	}
+
+	return devices, nil
+}
+
+func (s deviceStore) DeleteDevice(ctx context.Context, token string) error {
+	return s.database.DeleteDeviceToken(ctx, token)
+}
+
+func newPushDispatcher(config PushConfig, repo *database.DataRepository) *push.Dispatcher {
+
+	dispatcher := push.NewDispatcher(deviceStore{database: repo})
+
+	if config.FCMCredentialsFile != "" {
+
+		fcm, err := push.NewFCMProvider(config.FCMCredentialsFile)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		dispatcher.Register(push.Android, fcm)
+		log.Print("FCM push provider configured for project " + fcm.ProjectID)
+	}
+
+	if config.APNsKeyFile != "" {
+
+		apns, err := push.NewAPNsProvider(config.APNsKeyFile, config.APNsKeyID, config.APNsTeamID, config.APNsTopic, config.APNsProduction)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		dispatcher.Register(push.IOS, apns)
+		log.Print("APNs push provider configured for topic " + config.APNsTopic)
+	}
+
+	return dispatcher
+}
+
+// notify pushes in the background so a slow provider never holds up the request that triggered it
+func (api *ApiService) notify(username, title, body string, data map[string]string) {
+
+	go func() {
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		notification := push.Notification{Title: title, Body: body, Data: data}
+
+		if err := api.push.Dispatch(ctx, username, notification); err != nil {
+			log.Printf("push to %s failed: %v", username, err)
+		}
+	}()
+}
+
+// @Summary Register device for push notifications
+// @Description The device stops receiving pushes once the session it was registered from signs out
+// @Tags Device
+// @Accept json
+// @Produce json
+// @Param payload body RegisterDevicePayload true "FCM or APNs device token and platform"
+// @Success 200 {object} StandardResponse
+// @Failure 400  {object} errorslope
+// @Failure 500  {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/device/register [post]
+func (api *ApiService) RegisterDevice(w http.ResponseWriter, r *http.Request) {
+
+	var payload RegisterDevicePayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if payload.Token == "" {
+		badRequest(w, r, errors.New("token is required"))
+		return
+	}
+
+	platform, err := push.ParsePlatform(payload.Platform)
+
+	if err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	sessionId, err := getSessionIdFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	err = api.database.InsertDeviceToken(ctx, username, sessionId, payload.Token, string(platform))
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	s := StandardResponse{
+		Status:  http.StatusOK,
+		Message: "device registered for push notifications",
+	}
+
+	writeJson(w, http.StatusOK, s)
+}
+
+// @Summary Get registered devices
+// @Description Responds with json
+// @Tags Device
+// @Produce json
+// @Success 200 {array} database.DeviceToken
+// @Failure 500  {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/device/ [get]
+func (api *ApiService) GetDevices(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	devices, err := api.database.GetDeviceTokensByUsername(ctx, username)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, devices)
+}
+
+// @Summary Unregister device
+// @Description Responds with json
+// @Tags Device
+// @Produce json
+// @Param token path string true "device token"
+// @Success 200 {object} StandardResponse
+// @Failure 404  {object} errorslope
+// @Failure 500  {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/device/{token} [delete]
+func (api *ApiService) UnregisterDevice(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	token := chi.URLParam(r, "token")
+
+	deleted, err := api.database.DeleteDeviceTokenForUser(ctx, username, token)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if !deleted {
+		notFound(w, r, errors.New("no device registered with this token"))
+		return
+	}
+
+	s := StandardResponse{
+		Status:  http.StatusOK,
+		Message: "device unregistered",
+	}
+
+	writeJson(w, http.StatusOK, s)
+}
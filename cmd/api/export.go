@@ -0,0 +1,311 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"main/database"
+	"main/internal/export"
+	"main/internal/mailer"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// tokens in emailed links are stored as sha256 hex, like refresh tokens
+func hashLinkToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// writeDataExport builds the zip for the user at file
+func (api *ApiService) writeDataExport(ctx context.Context, username, file string) error {
+
+	sections, err := api.database.CollectUserData(ctx, username)
+
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(file)
+
+	if err != nil {
+		return err
+	}
+
+	defer out.Close()
+
+	archive := export.NewWriter(out, username)
+
+	for _, section := range sections {
+		if err := archive.AddJSON("data/"+section.Name+".json", section.Description, section.Rows, len(section.Rows)); err != nil {
+			return err
+		}
+	}
+
+	// media urls point at the storage directories, only the file name is trusted
+	for _, section := range sections {
+
+		for _, row := range section.Rows {
+
+			switch section.Name {
+			case "profile":
+				if imageUrl, _ := row["image_url"].(string); imageUrl != "" {
+					name := path.Base(imageUrl)
+					if err := archive.AddFile("media/profile/"+name, "your profile picture", profileStorageDir+name); err != nil {
+						return err
+					}
+				}
+			case "messages":
+				if mediaUrl, _ := row["media_url"].(string); mediaUrl != "" {
+					name := path.Base(mediaUrl)
+					if err := archive.AddFile("media/chat/"+name, "media you sent in chats", chatStorageDir+name); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// runDataExport runs in the background, the user is told by push and email when the download is ready
+func (api *ApiService) runDataExport(id, username string) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	config := api.config.ExportConfig
+
+	fail := func(err error) {
+		log.Printf("data export %s for %s failed: %v", id, username, err)
+		api.database.FailDataExport(ctx, id, "export could not be created, try again later")
+		api.notify(username, "Data export failed", "We could not prepare your data, please try again later", map[string]string{"type": "data_export_failed", "export_id": id})
+	}
+
+	if err := api.database.MarkDataExportRunning(ctx, id); err != nil {
+		fail(err)
+		return
+	}
+
+	file := filepath.Join(config.Dir, id+".zip")
+
+	if err := api.writeDataExport(ctx, username, file); err != nil {
+		os.Remove(file)
+		fail(err)
+		return
+	}
+
+	token, err := randomString(32)
+
+	if err != nil {
+		os.Remove(file)
+		fail(err)
+		return
+	}
+
+	if err := api.database.CompleteDataExport(ctx, id, file, hashLinkToken(token), time.Now().Add(config.LinkTtl)); err != nil {
+		os.Remove(file)
+		fail(err)
+		return
+	}
+
+	link := config.PublicBaseUrl + "/v1/media/exports/" + id + "?token=" + url.QueryEscape(token)
+
+	api.notify(username, "Your data export is ready", "Open the link we emailed you to download it", map[string]string{"type": "data_export_ready", "export_id": id, "download_url": link})
+
+	user, err := api.database.GetByUsername(ctx, username)
+
+	if err != nil || user.Email == "" {
+		return
+	}
+
+	message, err := mailer.ExportReadyMessage(user.Email, mailer.ExportData{
+		Username:       username,
+		Link:           link,
+		ExpiresInHours: int(config.LinkTtl.Hours()),
+	})
+
+	if err == nil {
+		err = api.mailer.Send(ctx, message)
+	}
+
+	if err != nil {
+		log.Printf("data export %s email to %s failed: %v", id, username, err)
+	}
+}
+
+// @Summary Request data export
+// @Description Starts collecting everything Nkata holds about you into a zip, you get a push and an email with a download link when it is ready. One export runs at a time.
+// @Tags User
+// @Produce json
+// @Success 202 {object} database.DataExport
+// @Failure 409 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/user/export [post]
+func (api *ApiService) RequestDataExport(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	id := uuid.New().String()
+
+	if err := api.database.InsertDataExport(ctx, id, username); err != nil {
+		if err == database.ErrExportRunning {
+			conflict(w, r, err)
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	go api.runDataExport(id, username)
+
+	audit(r, "data_export_requested", "username", username, "export_id", id)
+
+	dataExport, err := api.database.GetDataExportById(ctx, id)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusAccepted, dataExport)
+}
+
+// @Summary Get data export status
+// @Description The most recent export, the download link itself is only sent by email and push
+// @Tags User
+// @Produce json
+// @Success 200 {object} database.DataExport
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/user/export [get]
+func (api *ApiService) GetDataExport(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	dataExport, err := api.database.GetLatestDataExport(ctx, username)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			notFound(w, r, errors.New("no data export requested"))
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, dataExport)
+}
+
+// @Summary Download data export
+// @Description The link from the export email, it stops working when it expires
+// @Tags Media
+// @Produce application/zip
+// @Param id path string true "export id"
+// @Param token query string true "download token"
+// @Success 200 {file} file
+// @Failure 404 {object} errorslope
+// @Router /v1/media/exports/{id} [get]
+func (api *ApiService) DownloadDataExport(w http.ResponseWriter, r *http.Request) {
+
+	dataExport, err := api.database.GetDataExportById(r.Context(), chi.URLParam(r, "id"))
+
+	// every failure looks the same so export ids cannot be probed
+	invalid := errors.New("download link is invalid or has expired")
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			notFound(w, r, invalid)
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	tokenHash := hashLinkToken(r.URL.Query().Get("token"))
+
+	if dataExport.Status != database.ExportReady || dataExport.ExpiresAt == nil || time.Now().After(*dataExport.ExpiresAt) ||
+		subtle.ConstantTimeCompare([]byte(tokenHash), []byte(dataExport.DownloadTokenHash)) != 1 {
+		notFound(w, r, invalid)
+		return
+	}
+
+	audit(r, "data_export_downloaded", "username", dataExport.Username, "export_id", dataExport.ID)
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="nkata-export-`+dataExport.Username+`.zip"`)
+	http.ServeFile(w, r, dataExport.FilePath)
+}
+
+func removeExportFiles(files []string) {
+	for _, file := range files {
+		if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("data export cleanup: %v", err)
+		}
+	}
+}
+
+func (api *ApiService) StartExportCleanup(ctx context.Context) {
+
+	if err := os.MkdirAll(api.config.ExportConfig.Dir, 0o700); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.database.FailInterruptedDataExports(ctx); err != nil {
+		log.Printf("data export startup: %v", err)
+	}
+
+	ticker := time.NewTicker(time.Hour)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				files, err := api.database.DeleteExpiredDataExports(ctx)
+
+				if err != nil {
+					log.Printf("data export cleanup failed: %v", err)
+					continue
+				}
+
+				removeExportFiles(files)
+			}
+		}
+	}()
+}
@@ -1,7 +1,9 @@
 package api
 
 import (
+	"database/sql"
 	"errors"
+	"main/database"
 	"net/http"
 	"strconv"
 
@@ -26,6 +28,7 @@ type RespondFriendRequestPayload struct {
 // @Param payload body FriendRequestPayload true "id and friend id"
 // @Success 200 {object} StandardResponse
 // @Failure 400  {object} errorslope
+// @Failure 403  {object} errorslope
 // @Failure 500  {object} errorslope
 // @Router /v1/firendship/request/send [post]
 func (apiService *ApiService) SendFriendRequest(w http.ResponseWriter, r *http.Request) {
@@ -39,6 +42,13 @@ func (apiService *ApiService) SendFriendRequest(w http.ResponseWriter, r *http.R
 		return
 	}
 
+	userId, err := getUserIdFromCtx(r.Context())
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
 	if err := readJson(w, r, &payload); err != nil {
 		badRequest(w, r, err)
 		return
@@ -46,39 +56,49 @@ func (apiService *ApiService) SendFriendRequest(w http.ResponseWriter, r *http.R
 
 	ctx := r.Context()
 
-	if username == payload.FriendUsername{
-		forbidden(w,r,errors.New("user cannot send friend request to self"))
+	friendId, err := apiService.database.GetUserIdByUsername(ctx, payload.FriendUsername)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			notFound(w, r, errors.New("no user found with username: "+payload.FriendUsername))
+			return
+		}
+		internalServer(w, r, err)
 		return
 	}
 
-	userExist := apiService.database.CheackUsernameAvailability(ctx, payload.FriendUsername)
-
-	if !userExist {
-		notFound(w, r, errors.New("no user found with username: "+payload.FriendUsername))
+	if userId == friendId {
+		forbidden(w, r, errors.New("user cannot send friend request to self"))
 		return
 	}
 
-	boolean := apiService.database.HasSentMeRequest(ctx, payload.FriendUsername, username)
+	boolean := apiService.database.HasSentMeRequest(ctx, friendId, userId)
 
 	if boolean {
 		conflict(w, r, errors.New("user already sent you a friend request"))
 		return
 	}
 
-	duplicate := apiService.database.CheckDuplicateRequest(ctx, username, payload.FriendUsername)
+	duplicate := apiService.database.CheckDuplicateRequest(ctx, userId, friendId)
 
 	if duplicate {
 		conflict(w, r, errors.New("you already a friend request to this user"))
 		return
 	}
 
-	err = apiService.database.InsertFriendRequest(ctx, payload.FriendUsername, username)
+	err = apiService.database.InsertFriendRequest(ctx, friendId, userId)
 
 	if err != nil {
+		if err == database.ErrUserBlocked {
+			forbidden(w, r, errors.New("you cannot send a friend request to "+payload.FriendUsername))
+			return
+		}
 		internalServer(w, r, err)
 		return
 	}
 
+	apiService.notify(payload.FriendUsername, "New friend request", username+" sent you a friend request", map[string]string{"type": "friend_request"})
+
 	s := StandardResponse{
 		Status:  200,
 		Message: "Friend request sent successfully",
@@ -96,6 +116,7 @@ func (apiService *ApiService) SendFriendRequest(w http.ResponseWriter, r *http.R
 // @Param payload body RespondFriendRequestPayload true "id and status"
 // @Success 200 {object} StandardResponse
 // @Failure 400  {object} errorslope
+// @Failure 409  {object} errorslope
 // @Failure 500  {object} errorslope
 // @Router /v1/firendship/request/responed [post]
 func (api *ApiService) RespondFriendRequest(w http.ResponseWriter, r *http.Request) {
@@ -121,26 +142,35 @@ func (api *ApiService) RespondFriendRequest(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	if payload.Status == "accepted" {
+	userId, err := getUserIdFromCtx(ctx)
 
-		err := api.database.UpdateFriendRequestStatus(ctx, payload.Status, payload.Id)
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
 
-		if err != nil {
-			internalServer(w, r, err)
-			return
-		}
+	if frendRequest.SentToID != userId {
+		unauthorized(w, r, errors.New("user does not have permision to perform this action"))
+		return
+	}
 
-		var friendship_id = uuid.New().String()
+	if payload.Status == "accepted" {
 
-		err1 := api.database.InsertFriendship(ctx, frendRequest.SentBy, frendRequest.SentTo, friendship_id)
+		var friendship_id = uuid.New().String()
 
-		err = api.database.InsertFriendship(ctx, frendRequest.SentTo, frendRequest.SentBy, friendship_id)
+		err := api.database.AcceptFriendRequest(ctx, payload.Id, frendRequest.SentByID, frendRequest.SentToID, friendship_id)
 
-		if err != nil || err1 != nil {
+		if err != nil {
+			if err == database.ErrFriendRequestAnswered {
+				conflict(w, r, err)
+				return
+			}
 			internalServer(w, r, err)
 			return
 		}
 
+		api.notify(frendRequest.SentBy, "Friend request accepted", frendRequest.SentTo+" accepted your friend request", map[string]string{"type": "friend_request_accepted", "friendship_id": friendship_id})
+
 		s := StandardResponse{
 			Status:  200,
 			Message: "firend request accepted successfully",
@@ -154,6 +184,10 @@ func (api *ApiService) RespondFriendRequest(w http.ResponseWriter, r *http.Reque
 		err := api.database.UpdateFriendRequestStatus(ctx, payload.Status, payload.Id)
 
 		if err != nil {
+			if err == database.ErrFriendRequestAnswered {
+				conflict(w, r, err)
+				return
+			}
 			internalServer(w, r, err)
 			return
 		}
@@ -185,7 +219,7 @@ func (api *ApiService) RespondFriendRequest(w http.ResponseWriter, r *http.Reque
 // @Router /v1/firendship/request/delete/{id}  [delete]
 func (api *ApiService) DeleteFriendRequest(w http.ResponseWriter, r *http.Request) {
 
-	username, err := getUsernameFromCtx(r.Context())
+	userId, err := getUserIdFromCtx(r.Context())
 
 	if err != nil {
 		internalServer(w, r, err)
@@ -206,7 +240,7 @@ func (api *ApiService) DeleteFriendRequest(w http.ResponseWriter, r *http.Reques
 
 	if err != nil {
 
-		if err.Error() == "sql: no rows in result set"  || err.Error() == "sql: Rows are closed"{
+		if err == sql.ErrNoRows {
 			notFound(w, r, errors.New("no request found with id: "+id))
 			return
 		}
@@ -215,7 +249,7 @@ func (api *ApiService) DeleteFriendRequest(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	if request.SentBy != username {
+	if request.SentByID != userId {
 		unauthorized(w, r, errors.New("user does not have permision to perform this action"))
 		return
 	}
@@ -247,7 +281,7 @@ func (api *ApiService) DeleteFriendRequest(w http.ResponseWriter, r *http.Reques
 // @Router /v1/firendship/request/get-sent  [get]
 func (api *ApiService) GetFriendRequestSent(w http.ResponseWriter, r *http.Request) {
 
-	username, err := getUsernameFromCtx(r.Context())
+	userId, err := getUserIdFromCtx(r.Context())
 
 	if err != nil {
 		internalServer(w, r, err)
@@ -267,7 +301,7 @@ func (api *ApiService) GetFriendRequestSent(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	response, err := api.database.GetFriendRequestSentBy(ctx, username, int64(pageInt), int64(limitInt))
+	response, err := api.database.GetFriendRequestSentBy(ctx, userId, int64(pageInt), int64(limitInt))
 
 	if err != nil {
 		internalServer(w, r, err)
@@ -290,7 +324,7 @@ func (api *ApiService) GetFriendRequestSent(w http.ResponseWriter, r *http.Reque
 // @Router /v1/firendship/request/get-recieved  [get]
 func (api *ApiService) GetFriendRequestRecieved(w http.ResponseWriter, r *http.Request) {
 
-	username, err := getUsernameFromCtx(r.Context())
+	userId, err := getUserIdFromCtx(r.Context())
 
 	if err != nil {
 		internalServer(w, r, err)
@@ -310,7 +344,7 @@ func (api *ApiService) GetFriendRequestRecieved(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	response, err := api.database.GetFriendRequestSentTo(ctx, username, int64(pageInt), int64(limitInt))
+	response, err := api.database.GetFriendRequestSentTo(ctx, userId, int64(pageInt), int64(limitInt))
 
 	if err != nil {
 		internalServer(w, r, err)
@@ -2,17 +2,19 @@ package api
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"image"
 	"io"
 	"log"
 	"main/database"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	_ "image/gif"
@@ -23,6 +25,9 @@ import (
 	"github.com/redis/go-redis/v9"
 )
 
+// group pictures are stored here and served from /v1/media/groups/{img_name}
+const groupStorageDir = "/home/ifeanyi/nkata_storage/group/"
+
 type CreatGroup struct {
 	Name string `json:"name"`
 }
@@ -54,7 +59,7 @@ func (api *ApiService) CreateGroup(w http.ResponseWriter, r *http.Request) {
 
 	ctx := r.Context()
 
-	username, err := getUsernameFromCtx(ctx)
+	userId, err := getUserIdFromCtx(ctx)
 
 	if err != nil {
 		internalServer(w, r, err)
@@ -66,23 +71,7 @@ func (api *ApiService) CreateGroup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id, err := api.database.InsertGroup(ctx, group.Name)
-
-	if err != nil {
-		internalServer(w, r, err)
-		return
-	}
-
-	err = api.database.InsertGroupMember(ctx, username, id, "admin")
-
-	if err != nil {
-		internalServer(w, r, err)
-		return
-	}
-
-	err = api.database.InsertFriendshipGroup(ctx, username, id)
-
-	if err != nil {
+	if _, err := api.database.InsertGroup(ctx, userId, group.Name); err != nil {
 		internalServer(w, r, err)
 		return
 	}
@@ -98,7 +87,7 @@ func (api *ApiService) CreateGroup(w http.ResponseWriter, r *http.Request) {
 
 //  GetGroup
 // @Summary Get Group by id
-// @Description Responds with json
+// @Description Responds with json. Community groups are only shown to the members of the community, invite only ones to their own members
 // @Tags Friendship
 // @Produce json
 // @Param id path string true "id"
@@ -120,9 +109,29 @@ func (api *ApiService) GetGroupById(w http.ResponseWriter, r *http.Request) {
 
 	ctx := r.Context()
 
-	rGroup, err := getRedisGroup(ctx, idInt, api.rClient)
+	userId, err := getUserIdFromCtx(ctx)
 
 	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	// checked before the cache, a cached group is no more visible than one read from the database
+	visible, err := api.database.CanSeeGroup(ctx, userId, int64(idInt))
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if !visible {
+		notFound(w, r, errors.New("no group found with id: "+id))
+		return
+	}
+
+	rGroup, err := getRedisGroup(ctx, int64(idInt), api.rClient)
+
+	if err == nil && rGroup != nil {
 		writeJson(w, http.StatusOK, rGroup)
 		return
 	}
@@ -161,38 +170,20 @@ func (api *ApiService) DeleteGroup(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ctx := r.Context()
-	username, err := getUsernameFromCtx(ctx)
-
-	if err != nil {
-		internalServer(w, r, err)
-		return
-	}
-
-	member, err := api.database.GetGroupMemberByUsername(ctx, username, idInt)
-
-	if err != nil {
-		unauthorized(w, r, errors.New("user does not have permision to perform this action"))
-		return
-	}
 
-	if member.Role != "admin" {
-		unauthorized(w, r, errors.New("user does not have permision to perform this action"))
+	if _, ok := api.authorizeGroup(w, r, int64(idInt), database.GroupDelete); !ok {
 		return
 	}
 
-	err = api.database.DeleteGroup(ctx, int64(idInt))
+	// members, messages and the group chats go with it
+	deleted, err := api.database.DeleteGroup(ctx, int64(idInt))
 
 	if err != nil {
 		internalServer(w, r, err)
 		return
 	}
 
-	err = api.database.DeleteAllGroupMembers(ctx, int64(idInt))
-
-	if err != nil {
-		internalServer(w, r, err)
-		return
-	}
+	api.removeGroupFiles(ctx, *deleted)
 
 	s := StandardResponse{
 		Status:  200,
@@ -204,39 +195,53 @@ func (api *ApiService) DeleteGroup(w http.ResponseWriter, r *http.Request) {
 }
 
 // @Summary Get group members
-// @Description Responds with json
+// @Description Responds with json, members only. Owner and admins come first, each member with their profile and presence
 // @Tags Friendship
 // @Accept json
 // @Produce json
 // @Param id path string true "id"
 // @Param page query string true "page"
 // @Param limit query string true "limit"
-// @Success 200 {object} StandardResponse
+// @Param search query string false "start of a username or display name"
+// @Success 200 {object} database.PaginatedResponse
 // @Failure 400  {object} errorslope
+// @Failure 403  {object} errorslope
 // @Failure 500  {object} errorslope
-// @Failure 402  {object} errorslope
 // @Router /v1/firendship/group/get-members/{id} [get]
 func (api *ApiService) GetGroupMembers(w http.ResponseWriter, r *http.Request) {
 
-	id := chi.URLParam(r, "id")
-	page := r.URL.Query().Get("page")
-	limit := r.URL.Query().Get("limit")
+	groupId, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
 
-	idInt, err := strconv.Atoi(id)
-	pageInt, err1 := strconv.Atoi(page)
-	limitInt, err2 := strconv.Atoi(limit)
+	if err != nil {
+		badRequest(w, r, errors.New("group id must be a number"))
+		return
+	}
+
+	query := r.URL.Query()
 
-	if err != nil || err1 != nil || err2 != nil {
-		badRequest(w, r, errors.New("group id, page or limit might not be a number"))
+	page, err1 := strconv.ParseInt(query.Get("page"), 10, 64)
+	limit, err2 := strconv.ParseInt(query.Get("limit"), 10, 64)
+
+	if err1 != nil || err2 != nil || page < 1 || limit < 1 || limit > 100 {
+		badRequest(w, r, errors.New("page must be a positive number and limit between 1 and 100"))
 		return
 	}
 
-	ctx := r.Context()
+	if _, ok := api.authorizeGroup(w, r, groupId, ""); !ok {
+		return
+	}
 
-	result, err := api.database.GetGroupMembersByGroupId(ctx, int64(idInt), int64(limitInt), int64(pageInt))
+	// the search is a prefix match, its wildcards are taken literally
+	search := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(query.Get("search"))
 
-	writeJson(w, 200, result)
+	result, err := api.database.GetGroupMembersByGroupId(r.Context(), groupId, search, limit, page)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
 
+	writeJson(w, http.StatusOK, result)
 }
 
 // @Summary Add group member
@@ -261,16 +266,48 @@ func (api *ApiService) AddGroupMember(w http.ResponseWriter, r *http.Request) {
 
 	ctx := r.Context()
 
-	err := api.database.InsertGroupMember(ctx, newMember.Username, newMember.Id, "member")
+	actor, ok := api.authorizeGroup(w, r, newMember.Id, database.GroupAddMember)
+
+	if !ok {
+		return
+	}
+
+	memberId, err := api.database.GetUserIdByUsername(ctx, newMember.Username)
 
 	if err != nil {
+		if err == sql.ErrNoRows {
+			notFound(w, r, errors.New("no user found with username: "+newMember.Username))
+			return
+		}
 		internalServer(w, r, err)
 		return
 	}
 
-	err = api.database.InsertFriendshipGroup(ctx, newMember.Username, newMember.Id)
+	event := database.GroupAuditEvent{GroupID: newMember.Id, ActorID: actor.UserID, TargetID: memberId, Action: database.GroupEventMemberAdded}
+
+	err = api.database.AddGroupMember(ctx, actor.UserID, memberId, newMember.Id, database.GroupRoleMember, event)
 
 	if err != nil {
+		if err == database.ErrAlreadyGroupMember {
+			conflict(w, r, errors.New(newMember.Username+" is already a member of this group"))
+			return
+		}
+		if err == database.ErrBannedFromGroup {
+			forbidden(w, r, errors.New(newMember.Username+" is banned from this group"))
+			return
+		}
+		if err == database.ErrNotCommunityMember {
+			forbidden(w, r, errors.New(newMember.Username+" is not a member of the community this group belongs to"))
+			return
+		}
+		if err == database.ErrGroupFull {
+			conflict(w, r, err)
+			return
+		}
+		if err == database.ErrUserBlocked {
+			forbidden(w, r, errors.New("you cannot add "+newMember.Username+" to this group"))
+			return
+		}
 		internalServer(w, r, err)
 		return
 	}
@@ -285,7 +322,7 @@ func (api *ApiService) AddGroupMember(w http.ResponseWriter, r *http.Request) {
 }
 
 // @Summary Remove group member
-// @Description Responds with json
+// @Description Kicks the member, they may be added or join again. Responds with json
 // @Tags Friendship
 // @Accept json
 // @Produce json
@@ -306,34 +343,32 @@ func (api *ApiService) RemoveGroupMember(w http.ResponseWriter, r *http.Request)
 
 	ctx := r.Context()
 
-	username, err := getUsernameFromCtx(ctx)
+	actor, ok := api.authorizeGroup(w, r, newMember.Id, database.GroupRemoveMember)
 
-	if err != nil {
-		internalServer(w, r, err)
+	if !ok {
 		return
 	}
 
-	member, err := api.database.GetGroupMemberByUsername(ctx, username, int(newMember.Id))
-
-	if err != nil {
-		unauthorized(w, r, errors.New("user does not have permision to perform this action"))
-		return
-	}
+	target, ok := api.groupTarget(w, r, actor, newMember.Username)
 
-	if member.Role != "admin" {
-		unauthorized(w, r, errors.New("user does not have permision to perform this action"))
+	if !ok {
 		return
 	}
 
-	err = api.database.DeleteGroupMember(ctx, newMember.Username, newMember.Id)
-	if err != nil {
-		internalServer(w, r, err)
-		return
+	event := database.GroupAuditEvent{
+		GroupID:  newMember.Id,
+		ActorID:  actor.UserID,
+		TargetID: target.UserID,
+		Action:   database.GroupEventMemberKicked,
 	}
 
-	err = api.database.UpdateFriendshipGroupId(ctx, newMember.Username, 000)
+	err := api.database.RemoveGroupMember(ctx, target.UserID, newMember.Id, event)
 
 	if err != nil {
+		if err == database.ErrNotGroupMember {
+			notFound(w, r, errors.New(newMember.Username+" is not a member of this group"))
+			return
+		}
 		internalServer(w, r, err)
 		return
 	}
@@ -368,13 +403,34 @@ func (api *ApiService) UpdateGroup(w http.ResponseWriter, r *http.Request) {
 
 	ctx := r.Context()
 
-	err := api.database.UpdateGroup(ctx, int(group.Id), group.Name, group.Description, "")
+	actor, ok := api.authorizeGroup(w, r, group.Id, database.GroupEditInfo)
+
+	if !ok {
+		return
+	}
+
+	before, err := api.database.GetGroupById(ctx, group.Id)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	err = api.database.UpdateGroup(ctx, int(group.Id), group.Name, group.Description, "")
 
 	if err != nil {
 		internalServer(w, r, err)
 		return
 	}
 
+	if group.Name != "" && group.Name != before.Name {
+		api.recordGroupEvent(ctx, database.GroupAuditEvent{GroupID: group.Id, ActorID: actor.UserID, Action: database.GroupEventRenamed, Before: before.Name, After: group.Name})
+	}
+
+	if group.Description != "" && group.Description != before.Description {
+		api.recordGroupEvent(ctx, database.GroupAuditEvent{GroupID: group.Id, ActorID: actor.UserID, Action: database.GroupEventDescriptionChanged, Before: before.Description, After: group.Description})
+	}
+
 	s := StandardResponse{
 		Status:  http.StatusOK,
 		Message: "group profile updated successfuly",
@@ -410,6 +466,19 @@ func (api *ApiService) UploadGroupPic(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	actor, ok := api.authorizeGroup(w, r, int64(idInt), database.GroupChangePicture)
+
+	if !ok {
+		return
+	}
+
+	before, err := api.database.GetGroupById(ctx, int64(idInt))
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
 	file, fileHeader, err := r.FormFile("img")
 
 	if err != nil {
@@ -430,7 +499,7 @@ func (api *ApiService) UploadGroupPic(w http.ResponseWriter, r *http.Request) {
 
 	currentTimeString := strconv.Itoa(int(currentTime)) + filepath.Ext(fileHeader.Filename)
 
-	destinationFile, err := os.Create("/home/ifeanyi/nkata_storage/group/" + currentTimeString)
+	destinationFile, err := os.Create(groupStorageDir + currentTimeString)
 
 	if err != nil {
 		internalServer(w, r, err)
@@ -462,6 +531,8 @@ func (api *ApiService) UploadGroupPic(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	api.recordGroupEvent(ctx, database.GroupAuditEvent{GroupID: int64(idInt), ActorID: actor.UserID, Action: database.GroupEventPictureChanged, Before: before.PicUrl, After: url})
+
 	s := StandardResponse{
 		Status:  http.StatusOK,
 		Message: "user profile picture updated successfuly",
@@ -482,7 +553,7 @@ func (api *ApiService) UploadGroupPic(w http.ResponseWriter, r *http.Request) {
 func (api *ApiService) LoadGroupPic(w http.ResponseWriter, r *http.Request) {
 
 	filename := chi.URLParam(r, "img_name")
-	url := "/home/ifeanyi/nkata_storage/group/" + filename
+	url := groupStorageDir + filename
 	file, err := os.Open(url)
 
 	if err != nil {
@@ -498,29 +569,53 @@ func (api *ApiService) LoadGroupPic(w http.ResponseWriter, r *http.Request) {
 	http.ServeContent(w, r, filename, time.Time{}, file)
 }
 
+// removeGroupFiles cleans up after a deleted group, the rows are gone already so failures are only logged
+func (api *ApiService) removeGroupFiles(ctx context.Context, group database.DeletedGroup) {
+
+	api.rClient.Del(ctx, redisGroupKey(group.ID))
+
+	files := make([]string, 0, len(group.MediaUrls)+1)
+
+	if group.PicUrl != "" {
+		files = append(files, groupStorageDir+path.Base(group.PicUrl))
+	}
+
+	for _, mediaUrl := range group.MediaUrls {
+		files = append(files, chatStorageDir+path.Base(mediaUrl))
+	}
+
+	for _, file := range files {
+		if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("could not remove file of deleted group %d: %v", group.ID, err)
+		}
+	}
+}
+
+func redisGroupKey(groupId int64) string {
+	return "group:" + strconv.FormatInt(groupId, 10)
+}
+
 func setRedisGroup(ctx context.Context, database *database.DataRepository, groupId int64, redisClient *redis.Client) {
 	group, err := database.GetGroupById(ctx, groupId)
 
 	if err != nil {
-		log.Printf(err.Error())
+		log.Print(err)
+		return
 	}
 
-	userJson, err := json.Marshal(group)
+	groupJson, err := json.Marshal(group)
 
 	if err != nil {
-		log.Printf(err.Error())
+		log.Print(err)
+		return
 	}
 
-	redisKey := fmt.Sprintf("user:%g", groupId)
-
-	redisClient.SetEx(ctx, redisKey, userJson, time.Minute*4)
+	redisClient.SetEx(ctx, redisGroupKey(groupId), groupJson, time.Minute*4)
 }
 
-func getRedisGroup(ctx context.Context, groupId int, redisClient *redis.Client) (*database.Group, error) {
-
-	redisKey := fmt.Sprintf("user:%g", groupId)
+func getRedisGroup(ctx context.Context, groupId int64, redisClient *redis.Client) (*database.Group, error) {
 
-	groupData, err := redisClient.Get(ctx, redisKey).Result()
+	groupData, err := redisClient.Get(ctx, redisGroupKey(groupId)).Result()
 
 	if err == redis.Nil {
 		return nil, nil
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"main/database"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// recordGroupEvent writes to the audit log after a change went through, a failure is logged
+// rather than reported since the change itself cannot be taken back
+func (api *ApiService) recordGroupEvent(ctx context.Context, event database.GroupAuditEvent) {
+
+	if err := api.database.InsertGroupEvent(ctx, event); err != nil {
+		log.Printf("failed to record group event %s for group %d: %v", event.Action, event.GroupID, err)
+	}
+}
+
+// optionalTime parses an RFC3339 query value, empty is nil
+func optionalTime(value string) (*time.Time, error) {
+
+	if value == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// @Summary Get group audit log
+// @Description Responds with json, newest first. Every filter is optional, from and to are RFC3339 times
+// @Tags Friendship
+// @Produce json
+// @Param id path string true "group id"
+// @Param page query string true "page"
+// @Param limit query string true "limit"
+// @Param action query string false "event, e.g. member_banned"
+// @Param actor query string false "username of who acted"
+// @Param target query string false "username of who was acted on"
+// @Param from query string false "earliest time"
+// @Param to query string false "latest time, exclusive"
+// @Success 200 {object} database.PaginatedResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/group/{id}/audit [get]
+func (api *ApiService) GetGroupAudit(w http.ResponseWriter, r *http.Request) {
+
+	groupId, ok := groupIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+
+	page, err1 := strconv.Atoi(query.Get("page"))
+	limit, err2 := strconv.Atoi(query.Get("limit"))
+
+	if err1 != nil || err2 != nil || page < 1 || limit < 1 || limit > 100 {
+		badRequest(w, r, errors.New("page must be a positive number and limit between 1 and 100"))
+		return
+	}
+
+	filter := database.GroupAuditFilter{
+		Actor:  query.Get("actor"),
+		Target: query.Get("target"),
+	}
+
+	if action := query.Get("action"); action != "" {
+
+		event, err := database.ParseGroupEvent(action)
+
+		if err != nil {
+			badRequest(w, r, err)
+			return
+		}
+
+		filter.Action = event
+	}
+
+	from, err1 := optionalTime(query.Get("from"))
+	to, err2 := optionalTime(query.Get("to"))
+
+	if err1 != nil || err2 != nil {
+		badRequest(w, r, errors.New("from and to must be RFC3339 times"))
+		return
+	}
+
+	filter.From, filter.To = from, to
+
+	if _, ok := api.authorizeGroup(w, r, groupId, database.GroupViewAudit); !ok {
+		return
+	}
+
+	result, err := api.database.GetGroupAuditEvents(r.Context(), groupId, filter, int64(limit), int64(page))
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, result)
+}
@@ -0,0 +1,268 @@
+package api
+
+import (
+	"errors"
+	"main/database"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+type GroupInvitePayload struct {
+	Id             int64 `json:"id"`
+	ExpiresInHours int64 `json:"expires_in_hours"` // 0 never expires
+	MaxUses        int64 `json:"max_uses"`         // 0 no limit
+}
+
+// the token is only ever returned here, the database keeps its hash
+type GroupInviteCreatedJson struct {
+	database.GroupInvite
+	Token string `json:"token"`
+	Link  string `json:"link"`
+}
+
+// @Summary Create group invite link
+// @Description Responds with json, keep the link: it cannot be shown again
+// @Tags Friendship
+// @Accept json
+// @Produce json
+// @Param payload body GroupInvitePayload true "group id, optional expiry and maximum uses"
+// @Success 201 {object} GroupInviteCreatedJson
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/invites [post]
+func (api *ApiService) CreateGroupInvite(w http.ResponseWriter, r *http.Request) {
+
+	var payload GroupInvitePayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	if payload.ExpiresInHours < 0 || payload.MaxUses < 0 {
+		badRequest(w, r, errors.New("expires_in_hours and max_uses cannot be negative"))
+		return
+	}
+
+	member, ok := api.authorizeGroup(w, r, payload.Id, database.GroupManageInvites)
+
+	if !ok {
+		return
+	}
+
+	var expiresAt *time.Time
+	var maxUses *int64
+
+	if payload.ExpiresInHours > 0 {
+		expires := time.Now().Add(time.Duration(payload.ExpiresInHours) * time.Hour)
+		expiresAt = &expires
+	}
+
+	if payload.MaxUses > 0 {
+		maxUses = &payload.MaxUses
+	}
+
+	token, err := randomString(24)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	invite, err := api.database.InsertGroupInvite(r.Context(), payload.Id, member.UserID, hashLinkToken(token), expiresAt, maxUses)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	invite.CreatedBy = member.Username
+
+	api.recordGroupEvent(r.Context(), database.GroupAuditEvent{GroupID: payload.Id, ActorID: member.UserID, Action: database.GroupEventInviteCreated, After: strconv.FormatInt(invite.ID, 10)})
+
+	writeJson(w, http.StatusCreated, GroupInviteCreatedJson{
+		GroupInvite: *invite,
+		Token:       token,
+		Link:        api.config.ExportConfig.PublicBaseUrl + "/v1/invite/" + url.PathEscape(token),
+	})
+}
+
+// @Summary Get group invite links
+// @Description Responds with json, including expired and revoked links
+// @Tags Friendship
+// @Produce json
+// @Param id path string true "group id"
+// @Success 200 {array} database.GroupInvite
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/{id}/invites [get]
+func (api *ApiService) GetGroupInvites(w http.ResponseWriter, r *http.Request) {
+
+	groupId, ok := groupIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	if _, ok := api.authorizeGroup(w, r, groupId, database.GroupManageInvites); !ok {
+		return
+	}
+
+	invites, err := api.database.GetGroupInvites(r.Context(), groupId)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, invites)
+}
+
+// @Summary Revoke group invite link
+// @Description Responds with json
+// @Tags Friendship
+// @Produce json
+// @Param id path string true "group id"
+// @Param invite_id path string true "invite id"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/{id}/invites/{invite_id} [delete]
+func (api *ApiService) RevokeGroupInvite(w http.ResponseWriter, r *http.Request) {
+
+	groupId, ok := groupIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	inviteId, err := strconv.ParseInt(chi.URLParam(r, "invite_id"), 10, 64)
+
+	if err != nil {
+		badRequest(w, r, errors.New("invite id is not a number"))
+		return
+	}
+
+	actor, ok := api.authorizeGroup(w, r, groupId, database.GroupManageInvites)
+
+	if !ok {
+		return
+	}
+
+	revoked, err := api.database.RevokeGroupInvite(r.Context(), groupId, inviteId)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if !revoked {
+		notFound(w, r, errors.New("no active invite found with id: "+strconv.FormatInt(inviteId, 10)))
+		return
+	}
+
+	api.recordGroupEvent(r.Context(), database.GroupAuditEvent{GroupID: groupId, ActorID: actor.UserID, Action: database.GroupEventInviteRevoked, Before: strconv.FormatInt(inviteId, 10)})
+
+	writeJson(w, http.StatusOK, StandardResponse{Status: http.StatusOK, Message: "invite link revoked"})
+}
+
+// @Summary Preview group invite
+// @Description Responds with json, no sign in needed
+// @Tags Friendship
+// @Produce json
+// @Param token path string true "invite token"
+// @Success 200 {object} database.GroupInvitePreview
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Router /v1/invite/{token} [get]
+func (api *ApiService) PreviewGroupInvite(w http.ResponseWriter, r *http.Request) {
+
+	preview, err := api.database.GetGroupInvitePreview(r.Context(), hashLinkToken(chi.URLParam(r, "token")))
+
+	if err != nil {
+		if err == database.ErrInviteInvalid {
+			notFound(w, r, err)
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, preview)
+}
+
+// @Summary Join group with invite
+// @Description Responds with json
+// @Tags Friendship
+// @Produce json
+// @Param token path string true "invite token"
+// @Success 200 {object} StandardResponse
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 409 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/join/{token} [post]
+func (api *ApiService) JoinGroupByInvite(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	userId, err := getUserIdFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	info := database.Message{
+		MessageID:      uuid.New().String(),
+		SenderUsername: username,
+		TextContent:    username + " joined via invite link",
+	}
+
+	err = api.database.JoinGroupByInvite(ctx, hashLinkToken(chi.URLParam(r, "token")), userId, &info)
+
+	if err != nil {
+		switch err {
+		case database.ErrInviteInvalid:
+			notFound(w, r, err)
+		case database.ErrAlreadyGroupMember:
+			conflict(w, r, errors.New("you are already a member of this group"))
+		case database.ErrBannedFromGroup, database.ErrNotCommunityMember:
+			forbidden(w, r, err)
+		case database.ErrGroupFull:
+			conflict(w, r, err)
+		default:
+			internalServer(w, r, err)
+		}
+		return
+	}
+
+	api.notifyChatParticipants(info)
+
+	s := StandardResponse{
+		Status:  http.StatusOK,
+		Message: "joined group " + info.FriendshipID,
+	}
+
+	writeJson(w, http.StatusOK, s)
+}
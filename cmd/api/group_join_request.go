@@ -0,0 +1,493 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"main/database"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+type GroupPrivacyPayload struct {
+	Id      int64  `json:"id"`
+	Privacy string `json:"privacy"` // open, request_to_join or invite_only
+}
+
+type GroupAnnouncementPayload struct {
+	Id      int64 `json:"id"`
+	Enabled bool  `json:"enabled"` // only admins post while enabled, everyone else reads and reacts
+}
+
+type JoinGroupPayload struct {
+	Message string `json:"message"` // optional, shown to the admins with a join request
+}
+
+// @Summary Update group privacy
+// @Description Responds with json, invite links keep working whatever the privacy
+// @Tags Friendship
+// @Accept json
+// @Produce json
+// @Param payload body GroupPrivacyPayload true "group id and privacy"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/privacy [put]
+func (api *ApiService) UpdateGroupPrivacy(w http.ResponseWriter, r *http.Request) {
+
+	var payload GroupPrivacyPayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	privacy, err := database.ParseGroupPrivacy(payload.Privacy)
+
+	if err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	ctx := r.Context()
+
+	actor, ok := api.authorizeGroup(w, r, payload.Id, database.GroupEditPrivacy)
+
+	if !ok {
+		return
+	}
+
+	before, err := api.database.GetGroupById(ctx, payload.Id)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if err := api.database.SetGroupPrivacy(ctx, payload.Id, privacy); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if before.Privacy != privacy {
+		api.recordGroupEvent(ctx, database.GroupAuditEvent{GroupID: payload.Id, ActorID: actor.UserID, Action: database.GroupEventPrivacyChanged, Before: string(before.Privacy), After: string(privacy)})
+	}
+
+	s := StandardResponse{
+		Status:  http.StatusOK,
+		Message: "group privacy set to " + string(privacy),
+	}
+
+	writeJson(w, http.StatusOK, s)
+	setRedisGroup(ctx, api.database, payload.Id, api.rClient)
+}
+
+// @Summary Set group announcement mode
+// @Description Responds with json, while enabled post_message needs admin or above whatever the group permissions say
+// @Tags Friendship
+// @Accept json
+// @Produce json
+// @Param payload body GroupAnnouncementPayload true "group id and whether announcement mode is on"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/announcement [put]
+func (api *ApiService) UpdateGroupAnnouncement(w http.ResponseWriter, r *http.Request) {
+
+	var payload GroupAnnouncementPayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	ctx := r.Context()
+
+	actor, ok := api.authorizeGroup(w, r, payload.Id, database.GroupSetAnnouncement)
+
+	if !ok {
+		return
+	}
+
+	before, err := api.database.GetGroupById(ctx, payload.Id)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if err := api.database.SetGroupAnnouncementOnly(ctx, payload.Id, payload.Enabled); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if before.AnnouncementOnly != payload.Enabled {
+		api.recordGroupEvent(ctx, database.GroupAuditEvent{
+			GroupID: payload.Id,
+			ActorID: actor.UserID,
+			Action:  database.GroupEventAnnouncementChanged,
+			Before:  strconv.FormatBool(before.AnnouncementOnly),
+			After:   strconv.FormatBool(payload.Enabled),
+		})
+	}
+
+	message := "announcement mode is off, members can post again"
+
+	if payload.Enabled {
+		message = "announcement mode is on, only admins can post"
+	}
+
+	writeJson(w, http.StatusOK, StandardResponse{Status: http.StatusOK, Message: message})
+	setRedisGroup(ctx, api.database, payload.Id, api.rClient)
+}
+
+// @Summary Join or ask to join group
+// @Description Open groups are joined straight away (200), request_to_join groups get a join request for the admins to approve (202)
+// @Tags Friendship
+// @Accept json
+// @Produce json
+// @Param id path string true "group id"
+// @Param payload body JoinGroupPayload false "message for the admins"
+// @Success 200 {object} StandardResponse
+// @Success 202 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 409 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/{id}/join [post]
+func (api *ApiService) JoinGroup(w http.ResponseWriter, r *http.Request) {
+
+	groupId, ok := groupIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	var payload JoinGroupPayload
+
+	if err := readJson(w, r, &payload); err != nil && !errors.Is(err, io.EOF) {
+		badRequest(w, r, err)
+		return
+	}
+
+	if utf8.RuneCountInString(payload.Message) > 500 {
+		badRequest(w, r, errors.New("message cannot be longer than 500 characters"))
+		return
+	}
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	userId, err := getUserIdFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	group, err := api.database.GetGroupById(ctx, groupId)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			notFound(w, r, errors.New("no group found with id: "+strconv.FormatInt(groupId, 10)))
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	if _, err := api.database.GetGroupMember(ctx, userId, groupId); err == nil {
+		conflict(w, r, errors.New("you are already a member of this group"))
+		return
+	} else if err != sql.ErrNoRows {
+		internalServer(w, r, err)
+		return
+	}
+
+	switch group.Privacy {
+
+	case database.GroupPrivacyOpen:
+
+		info := database.Message{
+			MessageID:      uuid.New().String(),
+			SenderUsername: username,
+			TextContent:    username + " joined the group",
+		}
+
+		if err := api.database.JoinOpenGroup(ctx, userId, groupId, &info); err != nil {
+			if err == database.ErrAlreadyGroupMember {
+				conflict(w, r, errors.New("you are already a member of this group"))
+				return
+			}
+			if err == database.ErrGroupFull {
+				conflict(w, r, err)
+				return
+			}
+			if err == database.ErrBannedFromGroup || err == database.ErrNotCommunityMember {
+				forbidden(w, r, err)
+				return
+			}
+			internalServer(w, r, err)
+			return
+		}
+
+		api.notifyChatParticipants(info)
+
+		writeJson(w, http.StatusOK, StandardResponse{Status: http.StatusOK, Message: "joined group " + group.Name})
+
+	case database.GroupPrivacyRequest:
+
+		if _, err := api.database.InsertGroupJoinRequest(ctx, userId, groupId, payload.Message); err != nil {
+			if err == database.ErrJoinRequestPending {
+				conflict(w, r, err)
+				return
+			}
+			if err == database.ErrBannedFromGroup || err == database.ErrNotCommunityMember {
+				forbidden(w, r, err)
+				return
+			}
+			internalServer(w, r, err)
+			return
+		}
+
+		api.notifyGroupJoinRequest(*group, username)
+
+		writeJson(w, http.StatusAccepted, StandardResponse{Status: http.StatusAccepted, Message: "join request sent to the group admins"})
+
+	default:
+		forbidden(w, r, errors.New("this group can only be joined with an invite"))
+	}
+}
+
+// push the new request to every member allowed to decide on it, the lookup runs off the request goroutine
+func (api *ApiService) notifyGroupJoinRequest(group database.Group, username string) {
+
+	go func() {
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		permissions, err := api.database.GetGroupPermissions(ctx, group.ID)
+
+		if err != nil {
+			log.Printf("failed to load group permissions for push: %v", err)
+			return
+		}
+
+		admins, err := api.database.GetGroupUsernamesByRole(ctx, group.ID, permissions.RolesAllowed(database.GroupManageRequests))
+
+		if err != nil {
+			log.Printf("failed to load group admins for push: %v", err)
+			return
+		}
+
+		for _, admin := range admins {
+			api.notify(admin, group.Name, username+" asked to join the group", map[string]string{
+				"type":     "group_join_request",
+				"group_id": strconv.FormatInt(group.ID, 10),
+			})
+		}
+	}()
+}
+
+// @Summary Get pending group join requests
+// @Description Responds with json, oldest first
+// @Tags Friendship
+// @Produce json
+// @Param id path string true "group id"
+// @Param page query string true "page"
+// @Param limit query string true "limit"
+// @Success 200 {object} database.PaginatedResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/{id}/join-requests [get]
+func (api *ApiService) GetGroupJoinRequests(w http.ResponseWriter, r *http.Request) {
+
+	groupId, ok := groupIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	page, err1 := strconv.Atoi(r.URL.Query().Get("page"))
+	limit, err2 := strconv.Atoi(r.URL.Query().Get("limit"))
+
+	if err1 != nil || err2 != nil || page < 1 || limit < 1 {
+		badRequest(w, r, errors.New("page and limit must be positive numbers"))
+		return
+	}
+
+	if _, ok := api.authorizeGroup(w, r, groupId, database.GroupManageRequests); !ok {
+		return
+	}
+
+	result, err := api.database.GetGroupJoinRequests(r.Context(), groupId, int64(limit), int64(page))
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, result)
+}
+
+func joinRequestIdParam(w http.ResponseWriter, r *http.Request) (int64, bool) {
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "request_id"), 10, 64)
+
+	if err != nil {
+		badRequest(w, r, errors.New("request id is not a number"))
+		return 0, false
+	}
+
+	return id, true
+}
+
+// @Summary Approve group join request
+// @Description Responds with json, the sender joins the group like a member added by an admin
+// @Tags Friendship
+// @Produce json
+// @Param id path string true "group id"
+// @Param request_id path string true "join request id"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 409 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/{id}/join-requests/{request_id}/approve [post]
+func (api *ApiService) ApproveGroupJoinRequest(w http.ResponseWriter, r *http.Request) {
+
+	groupId, ok := groupIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	requestId, ok := joinRequestIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	actor, ok := api.authorizeGroup(w, r, groupId, database.GroupManageRequests)
+
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+
+	request, err := api.database.GetGroupJoinRequest(ctx, groupId, requestId)
+
+	if err != nil {
+		if err == database.ErrJoinRequestNotFound {
+			notFound(w, r, err)
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	info := database.Message{
+		MessageID:      uuid.New().String(),
+		SenderUsername: request.Username,
+		TextContent:    request.Username + " joined the group",
+	}
+
+	err = api.database.ApproveGroupJoinRequest(ctx, groupId, requestId, actor.UserID, &info)
+
+	if err != nil {
+		switch err {
+		case database.ErrJoinRequestNotFound:
+			notFound(w, r, err)
+		case database.ErrAlreadyGroupMember:
+			conflict(w, r, errors.New(request.Username+" is already a member of this group"))
+		case database.ErrBannedFromGroup:
+			forbidden(w, r, errors.New(request.Username+" is banned from this group"))
+		case database.ErrNotCommunityMember:
+			forbidden(w, r, errors.New(request.Username+" is no longer a member of the community"))
+		case database.ErrGroupFull:
+			conflict(w, r, err)
+		default:
+			internalServer(w, r, err)
+		}
+		return
+	}
+
+	api.notifyChatParticipants(info)
+
+	api.notify(request.Username, "Join request approved", "you are now a member of the group", map[string]string{
+		"type":     "group_join_approved",
+		"group_id": strconv.FormatInt(groupId, 10),
+	})
+
+	writeJson(w, http.StatusOK, StandardResponse{Status: http.StatusOK, Message: request.Username + " added to group"})
+}
+
+// @Summary Reject group join request
+// @Description Responds with json, the sender may ask again
+// @Tags Friendship
+// @Produce json
+// @Param id path string true "group id"
+// @Param request_id path string true "join request id"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/{id}/join-requests/{request_id}/reject [post]
+func (api *ApiService) RejectGroupJoinRequest(w http.ResponseWriter, r *http.Request) {
+
+	groupId, ok := groupIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	requestId, ok := joinRequestIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	actor, ok := api.authorizeGroup(w, r, groupId, database.GroupManageRequests)
+
+	if !ok {
+		return
+	}
+
+	if err := api.database.RejectGroupJoinRequest(r.Context(), groupId, requestId, actor.UserID); err != nil {
+		if err == database.ErrJoinRequestNotFound {
+			notFound(w, r, err)
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, StandardResponse{Status: http.StatusOK, Message: "join request rejected"})
+}
@@ -0,0 +1,368 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"main/database"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type GroupBanPayload struct {
+	Id            int64  `json:"id"`
+	Username      string `json:"username"`
+	Reason        string `json:"reason"`
+	DurationHours int64  `json:"duration_hours"` // 0 bans until lifted
+}
+
+type GroupMutePayload struct {
+	Id              int64  `json:"id"`
+	Username        string `json:"username"`
+	DurationMinutes int64  `json:"duration_minutes"`
+}
+
+type errGroupMuted struct {
+	until time.Time
+}
+
+func (e errGroupMuted) Error() string {
+	return "you are muted in this group until " + e.until.Format(time.RFC3339)
+}
+
+// banSummary is the after value of a ban in the audit log
+func banSummary(reason string, expiresAt *time.Time) string {
+
+	summary := "permanent"
+
+	if expiresAt != nil {
+		summary = "until " + expiresAt.Format(time.RFC3339)
+	}
+
+	if reason != "" {
+		summary += ": " + reason
+	}
+
+	return summary
+}
+
+// @Summary Ban group member
+// @Description Removes the user from the group and keeps them out of every way back in, until the ban expires. Users who are not members can be banned too. Responds with json
+// @Tags Friendship
+// @Accept json
+// @Produce json
+// @Param payload body GroupBanPayload true "group id, username, optional reason and duration"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/ban [post]
+func (api *ApiService) BanGroupMember(w http.ResponseWriter, r *http.Request) {
+
+	var payload GroupBanPayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	if payload.DurationHours < 0 {
+		badRequest(w, r, errors.New("duration_hours cannot be negative"))
+		return
+	}
+
+	if utf8.RuneCountInString(payload.Reason) > 500 {
+		badRequest(w, r, errors.New("reason cannot be longer than 500 characters"))
+		return
+	}
+
+	ctx := r.Context()
+
+	actor, ok := api.authorizeGroup(w, r, payload.Id, database.GroupBanMember)
+
+	if !ok {
+		return
+	}
+
+	userId, err := api.database.GetUserIdByUsername(ctx, payload.Username)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			notFound(w, r, errors.New("no user found with username: "+payload.Username))
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	if userId == actor.UserID {
+		badRequest(w, r, errors.New("you cannot do this to yourself"))
+		return
+	}
+
+	// members have to rank below the actor, anyone else can be kept out
+	target, err := api.database.GetGroupMember(ctx, userId, payload.Id)
+
+	if err != nil && err != sql.ErrNoRows {
+		internalServer(w, r, err)
+		return
+	}
+
+	if err == nil && !actor.Role.Outranks(target.Role) {
+		forbidden(w, r, errors.New("you can only act on members below your role"))
+		return
+	}
+
+	var expiresAt *time.Time
+
+	if payload.DurationHours > 0 {
+		expires := time.Now().Add(time.Duration(payload.DurationHours) * time.Hour)
+		expiresAt = &expires
+	}
+
+	ban := database.GroupBan{
+		GroupID:    payload.Id,
+		UserID:     userId,
+		BannedByID: actor.UserID,
+		Reason:     payload.Reason,
+		ExpiresAt:  expiresAt,
+	}
+
+	event := database.GroupAuditEvent{
+		GroupID:  payload.Id,
+		ActorID:  actor.UserID,
+		TargetID: userId,
+		Action:   database.GroupEventMemberBanned,
+		After:    banSummary(payload.Reason, expiresAt),
+	}
+
+	if err := api.database.BanGroupMember(ctx, ban, event); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, StandardResponse{Status: http.StatusOK, Message: payload.Username + " banned from group"})
+}
+
+// @Summary Lift group ban
+// @Description Responds with json, the user may be added or join again
+// @Tags Friendship
+// @Produce json
+// @Param id path string true "group id"
+// @Param username path string true "banned username"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/{id}/bans/{username} [delete]
+func (api *ApiService) UnbanGroupMember(w http.ResponseWriter, r *http.Request) {
+
+	groupId, ok := groupIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	username := chi.URLParam(r, "username")
+
+	ctx := r.Context()
+
+	actor, ok := api.authorizeGroup(w, r, groupId, database.GroupBanMember)
+
+	if !ok {
+		return
+	}
+
+	userId, err := api.database.GetUserIdByUsername(ctx, username)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			notFound(w, r, errors.New("no user found with username: "+username))
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	event := database.GroupAuditEvent{
+		GroupID:  groupId,
+		ActorID:  actor.UserID,
+		TargetID: userId,
+		Action:   database.GroupEventMemberUnbanned,
+	}
+
+	lifted, err := api.database.UnbanGroupMember(ctx, userId, groupId, event)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if !lifted {
+		notFound(w, r, errors.New(username+" is not banned from this group"))
+		return
+	}
+
+	writeJson(w, http.StatusOK, StandardResponse{Status: http.StatusOK, Message: "ban lifted for " + username})
+}
+
+// @Summary Get group bans
+// @Description Responds with json, only bans still in force
+// @Tags Friendship
+// @Produce json
+// @Param id path string true "group id"
+// @Success 200 {array} database.GroupBan
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/{id}/bans [get]
+func (api *ApiService) GetGroupBans(w http.ResponseWriter, r *http.Request) {
+
+	groupId, ok := groupIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	if _, ok := api.authorizeGroup(w, r, groupId, database.GroupBanMember); !ok {
+		return
+	}
+
+	bans, err := api.database.GetGroupBans(r.Context(), groupId)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, bans)
+}
+
+// @Summary Mute group member
+// @Description The member keeps reading the group chat but cannot post for the duration. Responds with json
+// @Tags Friendship
+// @Accept json
+// @Produce json
+// @Param payload body GroupMutePayload true "group id, username and duration"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/mute [post]
+func (api *ApiService) MuteGroupMember(w http.ResponseWriter, r *http.Request) {
+
+	var payload GroupMutePayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	if payload.DurationMinutes < 1 {
+		badRequest(w, r, errors.New("duration_minutes must be at least 1"))
+		return
+	}
+
+	actor, ok := api.authorizeGroup(w, r, payload.Id, database.GroupMuteMember)
+
+	if !ok {
+		return
+	}
+
+	target, ok := api.groupTarget(w, r, actor, payload.Username)
+
+	if !ok {
+		return
+	}
+
+	until := time.Now().Add(time.Duration(payload.DurationMinutes) * time.Minute)
+
+	event := database.GroupAuditEvent{
+		GroupID:  payload.Id,
+		ActorID:  actor.UserID,
+		TargetID: target.UserID,
+		Action:   database.GroupEventMemberMuted,
+		After:    until.Format(time.RFC3339),
+	}
+
+	if target.IsMuted() {
+		event.Before = target.MutedUntil.Format(time.RFC3339)
+	}
+
+	api.setGroupMute(w, r, target, &until, event, payload.Username+" muted until "+until.Format(time.RFC3339))
+}
+
+// @Summary Unmute group member
+// @Description Responds with json
+// @Tags Friendship
+// @Accept json
+// @Produce json
+// @Param payload body AddGroup true "group id and username"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/unmute [post]
+func (api *ApiService) UnmuteGroupMember(w http.ResponseWriter, r *http.Request) {
+
+	var payload AddGroup
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	actor, ok := api.authorizeGroup(w, r, payload.Id, database.GroupMuteMember)
+
+	if !ok {
+		return
+	}
+
+	target, ok := api.groupTarget(w, r, actor, payload.Username)
+
+	if !ok {
+		return
+	}
+
+	if !target.IsMuted() {
+		badRequest(w, r, errors.New(payload.Username+" is not muted"))
+		return
+	}
+
+	event := database.GroupAuditEvent{
+		GroupID:  payload.Id,
+		ActorID:  actor.UserID,
+		TargetID: target.UserID,
+		Action:   database.GroupEventMemberUnmuted,
+		Before:   target.MutedUntil.Format(time.RFC3339),
+	}
+
+	api.setGroupMute(w, r, target, nil, event, payload.Username+" unmuted")
+}
+
+func (api *ApiService) setGroupMute(w http.ResponseWriter, r *http.Request, target *database.GroupMember, until *time.Time, event database.GroupAuditEvent, message string) {
+
+	err := api.database.SetGroupMemberMute(r.Context(), target.UserID, target.GroupID, until, event)
+
+	if err != nil {
+		if err == database.ErrNotGroupMember {
+			notFound(w, r, errors.New(target.Username+" is not a member of this group"))
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, StandardResponse{Status: http.StatusOK, Message: message})
+}
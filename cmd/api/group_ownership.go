@@ -0,0 +1,250 @@
+package api
+
+import (
+	"errors"
+	"main/database"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// how long the new owner has to accept a transfer
+const ownershipOfferTTL = 7 * 24 * time.Hour
+
+// @Summary Offer group ownership
+// @Description The member becomes owner once they accept, until then the offer can be cancelled. A new offer replaces the previous one. Responds with json
+// @Tags Friendship
+// @Accept json
+// @Produce json
+// @Param payload body AddGroup true "group id and username of the new owner"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/transfer [post]
+func (api *ApiService) OfferGroupOwnership(w http.ResponseWriter, r *http.Request) {
+
+	var payload AddGroup
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	ctx := r.Context()
+
+	owner, ok := api.authorizeGroup(w, r, payload.Id, database.GroupTransferOwner)
+
+	if !ok {
+		return
+	}
+
+	target, ok := api.groupTarget(w, r, owner, payload.Username)
+
+	if !ok {
+		return
+	}
+
+	expiresAt := time.Now().Add(ownershipOfferTTL)
+
+	if err := api.database.OfferGroupOwnership(ctx, payload.Id, owner.UserID, target.UserID, expiresAt); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	api.recordGroupEvent(ctx, database.GroupAuditEvent{GroupID: payload.Id, ActorID: owner.UserID, TargetID: target.UserID, Action: database.GroupEventOwnershipOffered})
+
+	api.notify(target.Username, "Group ownership", owner.Username+" wants to make you the owner of a group", map[string]string{
+		"type":     "group_ownership_offer",
+		"group_id": strconv.FormatInt(payload.Id, 10),
+	})
+
+	s := StandardResponse{
+		Status:  http.StatusOK,
+		Message: "ownership offered to " + target.Username + ", they have until " + expiresAt.Format(time.RFC3339) + " to accept",
+	}
+
+	writeJson(w, http.StatusOK, s)
+}
+
+// @Summary Get group ownership offer
+// @Description Responds with json
+// @Tags Friendship
+// @Produce json
+// @Param id path string true "group id"
+// @Success 200 {object} database.GroupOwnershipTransfer
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/{id}/transfer [get]
+func (api *ApiService) GetGroupOwnershipTransfer(w http.ResponseWriter, r *http.Request) {
+
+	groupId, ok := groupIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	if _, ok := api.authorizeGroup(w, r, groupId, ""); !ok {
+		return
+	}
+
+	transfer, err := api.database.GetGroupOwnershipTransfer(r.Context(), groupId)
+
+	if err != nil {
+		if err == database.ErrNoOwnershipTransfer {
+			notFound(w, r, errors.New("this group has no open ownership offer"))
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, transfer)
+}
+
+// @Summary Accept group ownership
+// @Description Responds with json, the previous owner stays on as admin
+// @Tags Friendship
+// @Produce json
+// @Param id path string true "group id"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/{id}/transfer/accept [post]
+func (api *ApiService) AcceptGroupOwnership(w http.ResponseWriter, r *http.Request) {
+
+	groupId, ok := groupIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	member, ok := api.authorizeGroup(w, r, groupId, "")
+
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+
+	previousId, err := api.database.AcceptGroupOwnership(ctx, groupId, member.UserID)
+
+	if err != nil {
+		switch err {
+		case database.ErrNoOwnershipTransfer:
+			notFound(w, r, err)
+		case database.ErrNotGroupMember:
+			forbidden(w, r, errNotGroupMember)
+		default:
+			internalServer(w, r, err)
+		}
+		return
+	}
+
+	if previous, err := api.database.GetGroupMember(ctx, previousId, groupId); err == nil {
+		api.notify(previous.Username, "Group ownership", member.Username+" is now the owner of the group", map[string]string{
+			"type":     "group_ownership_accepted",
+			"group_id": strconv.FormatInt(groupId, 10),
+		})
+	}
+
+	writeJson(w, http.StatusOK, StandardResponse{Status: http.StatusOK, Message: "you are now the owner of this group"})
+}
+
+// @Summary Cancel group ownership offer
+// @Description The owner withdraws the offer or the member declines it. Responds with json
+// @Tags Friendship
+// @Produce json
+// @Param id path string true "group id"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/{id}/transfer [delete]
+func (api *ApiService) CancelGroupOwnershipTransfer(w http.ResponseWriter, r *http.Request) {
+
+	groupId, ok := groupIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	member, ok := api.authorizeGroup(w, r, groupId, "")
+
+	if !ok {
+		return
+	}
+
+	cancelled, err := api.database.CancelGroupOwnershipTransfer(r.Context(), groupId, member.UserID)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if !cancelled {
+		notFound(w, r, errors.New("you have no open ownership offer in this group"))
+		return
+	}
+
+	writeJson(w, http.StatusOK, StandardResponse{Status: http.StatusOK, Message: "ownership offer cancelled"})
+}
+
+// @Summary Leave group
+// @Description An owner who leaves hands the group to the highest ranking, longest standing member, the group is deleted when they were the last one. Responds with json
+// @Tags Friendship
+// @Produce json
+// @Param id path string true "group id"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/{id}/leave [post]
+func (api *ApiService) LeaveGroup(w http.ResponseWriter, r *http.Request) {
+
+	groupId, ok := groupIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+
+	userId, err := getUserIdFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	deleted, err := api.database.LeaveGroup(ctx, userId, groupId)
+
+	if err != nil {
+		if err == database.ErrNotGroupMember {
+			forbidden(w, r, errNotGroupMember)
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	message := "you left the group"
+
+	if deleted != nil {
+		api.removeGroupFiles(ctx, *deleted)
+		message = "you left the group, it was deleted since nobody else was in it"
+	}
+
+	writeJson(w, http.StatusOK, StandardResponse{Status: http.StatusOK, Message: message})
+}
@@ -0,0 +1,475 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"main/database"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var (
+	errNotGroupMember  = errors.New("you are not a member of this group")
+	errGroupPermission = errors.New("your role in this group does not allow this action")
+)
+
+type GroupRolePayload struct {
+	Id       int64  `json:"id"`
+	Username string `json:"username"`
+	Role     string `json:"role"` // admin, moderator or member
+}
+
+type GroupPermissionPayload struct {
+	Id     int64  `json:"id"`
+	Action string `json:"action"` // add_member, remove_member, ban_member, mute_member, edit_info, change_picture, pin_message, post_message, react, delete_message, manage_roles, manage_invites, manage_join_requests, edit_privacy, set_announcement, view_audit
+	Role   string `json:"role"`   // lowest role allowed to perform it
+}
+
+type GroupPermissionsJson struct {
+	GroupID     int64                     `json:"group_id"`
+	Role        database.GroupRole        `json:"role"` // role of the signed in user
+	Permissions database.GroupPermissions `json:"permissions"`
+}
+
+// group chats use the group id as their friendship_id, one-on-one chats use a uuid
+func chatGroupId(friendshipId string) (int64, bool) {
+
+	groupId, err := strconv.ParseInt(friendshipId, 10, 64)
+
+	return groupId, err == nil
+}
+
+// groupAllows reports whether the user may perform action in the group. An empty action only
+// requires membership. The error is errNotGroupMember when the user is not in the group.
+func (api *ApiService) groupAllows(ctx context.Context, userId, groupId int64, action database.GroupAction) (*database.GroupMember, bool, error) {
+
+	member, err := api.database.GetGroupMember(ctx, userId, groupId)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, false, errNotGroupMember
+		}
+		return nil, false, err
+	}
+
+	if action == "" {
+		return member, true, nil
+	}
+
+	permissions, err := api.database.GetGroupPermissions(ctx, groupId)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	return member, permissions.Allows(member.Role, action), nil
+}
+
+// authorizeGroup is the check in front of every group action: it returns the signed in user's
+// membership, or writes the error response and returns false
+func (api *ApiService) authorizeGroup(w http.ResponseWriter, r *http.Request, groupId int64, action database.GroupAction) (*database.GroupMember, bool) {
+
+	userId, err := getUserIdFromCtx(r.Context())
+
+	if err != nil {
+		internalServer(w, r, err)
+		return nil, false
+	}
+
+	member, allowed, err := api.groupAllows(r.Context(), userId, groupId, action)
+
+	if err != nil {
+		if err == errNotGroupMember {
+			forbidden(w, r, err)
+			return nil, false
+		}
+		internalServer(w, r, err)
+		return nil, false
+	}
+
+	if !allowed {
+		forbidden(w, r, errGroupPermission)
+		return nil, false
+	}
+
+	return member, true
+}
+
+// groupTarget loads the member an action is aimed at, the actor has to outrank them
+func (api *ApiService) groupTarget(w http.ResponseWriter, r *http.Request, actor *database.GroupMember, username string) (*database.GroupMember, bool) {
+
+	ctx := r.Context()
+
+	userId, err := api.database.GetUserIdByUsername(ctx, username)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			notFound(w, r, errors.New("no user found with username: "+username))
+			return nil, false
+		}
+		internalServer(w, r, err)
+		return nil, false
+	}
+
+	if userId == actor.UserID {
+		badRequest(w, r, errors.New("you cannot do this to yourself"))
+		return nil, false
+	}
+
+	target, err := api.database.GetGroupMember(ctx, userId, actor.GroupID)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			notFound(w, r, errors.New(username+" is not a member of this group"))
+			return nil, false
+		}
+		internalServer(w, r, err)
+		return nil, false
+	}
+
+	if !actor.Role.Outranks(target.Role) {
+		forbidden(w, r, errors.New("you can only act on members below your role"))
+		return nil, false
+	}
+
+	return target, true
+}
+
+func groupIdParam(w http.ResponseWriter, r *http.Request) (int64, bool) {
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+
+	if err != nil {
+		badRequest(w, r, errors.New("group id is not a number"))
+		return 0, false
+	}
+
+	return id, true
+}
+
+func (api *ApiService) changeGroupRole(w http.ResponseWriter, r *http.Request, promote bool) {
+
+	var payload GroupRolePayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	role, err := database.ParseGroupRole(payload.Role)
+
+	if err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	if role == database.GroupRoleOwner {
+		badRequest(w, r, errors.New("a group has a single owner, offer ownership with a transfer instead"))
+		return
+	}
+
+	actor, ok := api.authorizeGroup(w, r, payload.Id, database.GroupManageRoles)
+
+	if !ok {
+		return
+	}
+
+	if !actor.Role.Outranks(role) {
+		forbidden(w, r, errors.New("you can only grant roles below your own"))
+		return
+	}
+
+	target, ok := api.groupTarget(w, r, actor, payload.Username)
+
+	if !ok {
+		return
+	}
+
+	if promote && !role.Outranks(target.Role) {
+		badRequest(w, r, errors.New(payload.Username+" is already "+string(target.Role)+", promote needs a higher role"))
+		return
+	}
+
+	if !promote && !target.Role.Outranks(role) {
+		badRequest(w, r, errors.New(payload.Username+" is "+string(target.Role)+", demote needs a lower role"))
+		return
+	}
+
+	if err := api.database.SetGroupMemberRole(r.Context(), target.UserID, payload.Id, role); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	event := database.GroupAuditEvent{
+		GroupID:  payload.Id,
+		ActorID:  actor.UserID,
+		TargetID: target.UserID,
+		Action:   database.GroupEventMemberPromoted,
+		Before:   string(target.Role),
+		After:    string(role),
+	}
+
+	if !promote {
+		event.Action = database.GroupEventMemberDemoted
+	}
+
+	api.recordGroupEvent(r.Context(), event)
+
+	api.notify(payload.Username, "Group role changed", "you are now "+string(role)+" in the group", map[string]string{"type": "group_role", "group_id": strconv.FormatInt(payload.Id, 10), "role": string(role)})
+
+	s := StandardResponse{
+		Status:  http.StatusOK,
+		Message: payload.Username + " is now " + string(role),
+	}
+
+	writeJson(w, http.StatusOK, s)
+}
+
+// @Summary Promote group member
+// @Description Responds with json, the new role has to be above the member's and below yours
+// @Tags Friendship
+// @Accept json
+// @Produce json
+// @Param payload body GroupRolePayload true "group id, username and new role"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/promote [put]
+func (api *ApiService) PromoteGroupMember(w http.ResponseWriter, r *http.Request) {
+	api.changeGroupRole(w, r, true)
+}
+
+// @Summary Demote group member
+// @Description Responds with json, the new role has to be below the member's
+// @Tags Friendship
+// @Accept json
+// @Produce json
+// @Param payload body GroupRolePayload true "group id, username and new role"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/demote [put]
+func (api *ApiService) DemoteGroupMember(w http.ResponseWriter, r *http.Request) {
+	api.changeGroupRole(w, r, false)
+}
+
+// @Summary Get group permissions
+// @Description Responds with json, the lowest role allowed to perform each action
+// @Tags Friendship
+// @Produce json
+// @Param id path string true "group id"
+// @Success 200 {object} GroupPermissionsJson
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/{id}/permissions [get]
+func (api *ApiService) GetGroupPermissions(w http.ResponseWriter, r *http.Request) {
+
+	groupId, ok := groupIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	member, ok := api.authorizeGroup(w, r, groupId, "")
+
+	if !ok {
+		return
+	}
+
+	permissions, err := api.database.GetGroupPermissions(r.Context(), groupId)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, GroupPermissionsJson{GroupID: groupId, Role: member.Role, Permissions: permissions})
+}
+
+// @Summary Update group permission
+// @Description Responds with json, only the owner can change who may perform an action
+// @Tags Friendship
+// @Accept json
+// @Produce json
+// @Param payload body GroupPermissionPayload true "group id, action and lowest role"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/permissions [put]
+func (api *ApiService) UpdateGroupPermission(w http.ResponseWriter, r *http.Request) {
+
+	var payload GroupPermissionPayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	action, err := database.ParseGroupAction(payload.Action)
+
+	if err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	role, err := database.ParseGroupRole(payload.Role)
+
+	if err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	actor, ok := api.authorizeGroup(w, r, payload.Id, database.GroupEditPermissions)
+
+	if !ok {
+		return
+	}
+
+	before, err := api.database.GetGroupPermissions(r.Context(), payload.Id)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if err := api.database.SetGroupPermission(r.Context(), payload.Id, action, role); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if before[action] != role {
+		api.recordGroupEvent(r.Context(), database.GroupAuditEvent{
+			GroupID: payload.Id,
+			ActorID: actor.UserID,
+			Action:  database.GroupEventPermissionChanged,
+			Before:  string(action) + ": " + string(before[action]),
+			After:   string(action) + ": " + string(role),
+		})
+	}
+
+	s := StandardResponse{
+		Status:  http.StatusOK,
+		Message: string(action) + " now needs " + string(role) + " or above",
+	}
+
+	writeJson(w, http.StatusOK, s)
+}
+
+// @Summary Get pinned messages
+// @Description Responds with json
+// @Tags Friendship
+// @Produce json
+// @Param id path string true "group id"
+// @Success 200 {array} database.Message
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/{id}/pins [get]
+func (api *ApiService) GetPinnedMessages(w http.ResponseWriter, r *http.Request) {
+
+	groupId, ok := groupIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	if _, ok := api.authorizeGroup(w, r, groupId, ""); !ok {
+		return
+	}
+
+	messages, err := api.database.GetPinnedMessages(r.Context(), strconv.FormatInt(groupId, 10))
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, messages)
+}
+
+func (api *ApiService) setMessagePinned(w http.ResponseWriter, r *http.Request, pinned bool) {
+
+	groupId, ok := groupIdParam(w, r)
+
+	if !ok {
+		return
+	}
+
+	member, ok := api.authorizeGroup(w, r, groupId, database.GroupPinMessage)
+
+	if !ok {
+		return
+	}
+
+	messageId := chi.URLParam(r, "message_id")
+
+	found, err := api.database.SetMessagePinned(r.Context(), messageId, strconv.FormatInt(groupId, 10), member.UserID, pinned)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if !found {
+		notFound(w, r, errors.New("no message found with message_id: "+messageId))
+		return
+	}
+
+	message := "message pinned"
+	event := database.GroupAuditEvent{GroupID: groupId, ActorID: member.UserID, Action: database.GroupEventMessagePinned, After: messageId}
+
+	if !pinned {
+		message = "message unpinned"
+		event = database.GroupAuditEvent{GroupID: groupId, ActorID: member.UserID, Action: database.GroupEventMessageUnpinned, Before: messageId}
+	}
+
+	api.recordGroupEvent(r.Context(), event)
+
+	writeJson(w, http.StatusOK, StandardResponse{Status: http.StatusOK, Message: message})
+}
+
+// @Summary Pin message
+// @Description Responds with json
+// @Tags Friendship
+// @Produce json
+// @Param id path string true "group id"
+// @Param message_id path string true "message id"
+// @Success 200 {object} StandardResponse
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/{id}/pins/{message_id} [post]
+func (api *ApiService) PinMessage(w http.ResponseWriter, r *http.Request) {
+	api.setMessagePinned(w, r, true)
+}
+
+// @Summary Unpin message
+// @Description Responds with json
+// @Tags Friendship
+// @Produce json
+// @Param id path string true "group id"
+// @Param message_id path string true "message id"
+// @Success 200 {object} StandardResponse
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/firendship/group/{id}/pins/{message_id} [delete]
+func (api *ApiService) UnpinMessage(w http.ResponseWriter, r *http.Request) {
+	api.setMessagePinned(w, r, false)
+}
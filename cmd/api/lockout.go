@@ -0,0 +1,207 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"main/internal/mailer"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var errSignInThrottled = errors.New("too many failed sign-in attempts try again later")
+
+// compared against when the account does not exist, so both cases cost one bcrypt comparison
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("nkata-dummy-password"), bcrypt.DefaultCost)
+
+// failures are counted per identifier the client typed (username or email) and per ip. Identifiers
+// that match no account are counted and locked the same way so responses never tell them apart.
+func signInKey(kind, scope, value string) string {
+	return "signin:" + kind + ":" + scope + ":" + strings.ToLower(strings.TrimSpace(value))
+}
+
+// checkSignIn returns how long the client has to wait before trying the account again, zero if it may try now
+func (api *ApiService) checkSignIn(ctx context.Context, account, ip string) (time.Duration, error) {
+
+	keys := []string{
+		signInKey("lock", "account", account),
+		signInKey("lock", "ip", ip),
+		signInKey("backoff", "account", account),
+		signInKey("backoff", "ip", ip),
+	}
+
+	var wait time.Duration
+
+	for _, key := range keys {
+
+		ttl, err := api.rClient.PTTL(ctx, key).Result()
+
+		if err != nil {
+			return 0, err
+		}
+
+		if ttl > wait {
+			wait = ttl
+		}
+	}
+
+	return wait, nil
+}
+
+// guardSignIn writes the throttled response and returns false when the client has to wait
+func (api *ApiService) guardSignIn(w http.ResponseWriter, r *http.Request, account string) bool {
+
+	wait, err := api.checkSignIn(r.Context(), account, clientIp(r))
+
+	if err != nil {
+		internalServer(w, r, errors.New("somthing went wrong"))
+		return false
+	}
+
+	if wait > 0 {
+		audit(r, "signin_throttled", "account", account, "retry_after", wait.Seconds())
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		tooManyRequest(w, r, errSignInThrottled)
+		return false
+	}
+
+	return true
+}
+
+func backoffDelay(config LockoutConfig, failures int64) time.Duration {
+
+	delay := config.BaseDelay
+
+	for i := int64(1); i < failures && delay < config.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > config.MaxDelay {
+		delay = config.MaxDelay
+	}
+
+	return delay
+}
+
+func (api *ApiService) countFailure(ctx context.Context, scope, value string) (int64, error) {
+
+	config := api.config.LockoutConfig
+	key := signInKey("failures", scope, value)
+
+	failures, err := api.rClient.Incr(ctx, key).Result()
+
+	if err != nil {
+		return 0, err
+	}
+
+	if failures == 1 {
+		api.rClient.Expire(ctx, key, config.FailureWindow)
+	}
+
+	api.rClient.Set(ctx, signInKey("backoff", scope, value), 1, backoffDelay(config, failures))
+
+	return failures, nil
+}
+
+// recordSignInFailure counts a failed attempt against the identifier and the ip. username is the
+// account the identifier belongs to, empty when there is none, and is told when it gets locked.
+func (api *ApiService) recordSignInFailure(r *http.Request, method, account, username string) {
+
+	ctx := r.Context()
+	config := api.config.LockoutConfig
+	ip := clientIp(r)
+
+	audit(r, "signin_failed", "method", method, "account", account, "known_account", username != "")
+
+	failures, err := api.countFailure(ctx, "account", account)
+
+	if err != nil {
+		log.Printf("signin failure tracking: %v", err)
+		return
+	}
+
+	if failures >= int64(config.MaxFailures) {
+
+		locked, err := api.rClient.SetNX(ctx, signInKey("lock", "account", account), 1, config.LockoutDuration).Result()
+
+		if err == nil && locked {
+
+			audit(r, "account_locked", "method", method, "account", account, "failures", failures, "known_account", username != "")
+
+			if username != "" {
+				api.notifyLockout(username, failures, ip)
+			}
+		}
+	}
+
+	ipFailures, err := api.countFailure(ctx, "ip", ip)
+
+	if err != nil {
+		log.Printf("signin failure tracking: %v", err)
+		return
+	}
+
+	if ipFailures >= int64(config.MaxIpFailures) {
+
+		locked, err := api.rClient.SetNX(ctx, signInKey("lock", "ip", ip), 1, config.LockoutDuration).Result()
+
+		if err == nil && locked {
+			audit(r, "ip_locked", "failures", ipFailures)
+		}
+	}
+}
+
+// recordSignInSuccess forgets the failures for the identifier, the ip keeps its count
+func (api *ApiService) recordSignInSuccess(r *http.Request, method, account, username string) {
+
+	audit(r, "signin_succeeded", "method", method, "account", account, "username", username)
+
+	api.rClient.Del(r.Context(), signInKey("failures", "account", account), signInKey("backoff", "account", account))
+}
+
+// usernameForEmail resolves the owner of an email for lockout notices, empty when there is none
+func (api *ApiService) usernameForEmail(ctx context.Context, email string) string {
+
+	user, err := api.database.GetUserByEmail(ctx, email)
+
+	if err != nil {
+		return ""
+	}
+
+	return user.Username
+}
+
+func (api *ApiService) notifyLockout(username string, failures int64, ip string) {
+
+	lockedForMins := int(api.config.LockoutConfig.LockoutDuration.Minutes())
+
+	api.notify(username, "Sign-in locked", "Too many failed sign-in attempts on your account, sign-in is locked for "+strconv.Itoa(lockedForMins)+" minutes", map[string]string{"type": "account_locked"})
+
+	ctx := context.Background()
+
+	user, err := api.database.GetByUsername(ctx, username)
+
+	if err != nil || user.Email == "" {
+		return
+	}
+
+	message, err := mailer.LockoutMessage(user.Email, mailer.LockoutData{
+		Username:      username,
+		Failures:      failures,
+		LockedForMins: lockedForMins,
+		Ip:            ip,
+	})
+
+	if err != nil {
+		log.Printf("lockout email for %s: %v", username, err)
+		return
+	}
+
+	if err := api.mailer.Send(ctx, message); err != nil {
+		log.Printf("lockout email for %s: %v", username, err)
+	}
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"context"
+	"log"
+	"main/internal/mailer"
+	"strconv"
+	"time"
+)
+
+func newMailQueue(config MailConfig) *mailer.Queue {
+
+	var m mailer.Mailer
+
+	switch config.Driver {
+	case "smtp":
+		smtpConfig := config.SMTP
+		smtpConfig.From = config.From
+		m = mailer.NewSMTPMailer(smtpConfig)
+		log.Print("Mail delivery through smtp server " + smtpConfig.Host)
+	case "log":
+		m = &mailer.LogMailer{From: config.From, Dir: config.LogDir}
+		log.Print("Mail delivery through log mailer, emails will not leave this machine")
+	default:
+		log.Fatalf("MAIL_DRIVER %q is not a mail driver, use smtp or log", config.Driver)
+	}
+
+	return mailer.NewQueue(m, config.Workers, config.MaxAttempts, 5*time.Second)
+}
+
+func (api *ApiService) sendOtpEmail(ctx context.Context, username, email, purpose string, code int) error {
+
+	message, err := mailer.OtpMessage(purpose, email, mailer.OtpData{
+		Username:      username,
+		Code:          strconv.Itoa(code),
+		ExpiresInMins: int(api.config.OtpConfig.Ttl.Minutes()),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return api.mailer.Send(ctx, message)
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -17,6 +18,9 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// chat media is stored here and served from /v1/media/chat/{img_name}
+const chatStorageDir = "/home/ifeanyi/nkata_storage/chat_storage/"
+
 var upgradeConn = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool {
 	return true
 }}
@@ -35,12 +39,12 @@ type Media struct {
 	MediaType string `json:"media_type"` // NoMedia,Image,Video,Audio,Doc
 }
 
+// the sender is always the signed in user, never taken from the payload
 type MessagePayload struct {
-	FriendshipID   string `json:"friendship_id"` //put groupd id here if group
-	SenderUsername string `json:"sender_username"`
-	MessageType    string `json:"message_type"` //MessageChat,MessageRaction,MessageInfo
-	TextContent    string `json:"text_content"`
-	Media          Media  `json:"media"`
+	FriendshipID string `json:"friendship_id"` //put groupd id here if group
+	MessageType  string `json:"message_type"`  //MessageChat,MessageRaction,MessageInfo
+	TextContent  string `json:"text_content"`
+	Media        Media  `json:"media"`
 }
 
 type MessageNotInDb struct {
@@ -48,6 +52,83 @@ type MessageNotInDb struct {
 	Info      string `json:"info"`
 }
 
+// sent back on the socket instead of broadcasting a message the sender may not post
+type MessageRejected struct {
+	FriendshipID string `json:"friendship_id"`
+	Info         string `json:"info"`
+}
+
+// canPost checks post_message, or react for reactions, and mutes for group chats. One-on-one chats
+// take messages from their two participants only, and not once one of them blocked the other.
+// Channels only take posts through their own endpoint.
+// It returns nil when the message may be sent, otherwise the reason it may not.
+func (api *ApiService) canPost(ctx context.Context, userId int64, friendshipId, messageType string) error {
+
+	if strings.HasPrefix(friendshipId, database.ChannelChatPrefix) {
+		return errChannelSocketPost
+	}
+
+	groupId, isGroup := chatGroupId(friendshipId)
+
+	if !isGroup {
+
+		err := api.database.CheckChatAccess(ctx, userId, friendshipId)
+
+		if err == database.ErrUserBlocked {
+			return errChatBlocked
+		}
+
+		return err
+	}
+
+	action := database.GroupPostMessage
+
+	if messageType == "MessageRaction" {
+		action = database.GroupReact
+	}
+
+	member, allowed, err := api.groupAllows(ctx, userId, groupId, action)
+
+	if err != nil {
+		return err
+	}
+
+	if !allowed {
+		return errGroupPermission
+	}
+
+	if member.IsMuted() {
+		return errGroupMuted{until: *member.MutedUntil}
+	}
+
+	return nil
+}
+
+// rejectMessage reports false when the message may be sent, otherwise tells the sender why not
+func (api *ApiService) rejectMessage(conn *websocket.Conn, ctx context.Context, userId int64, friendshipId, messageType string) bool {
+
+	reason := api.canPost(ctx, userId, friendshipId, messageType)
+
+	if reason == nil {
+		return false
+	}
+
+	var muted errGroupMuted
+
+	if reason != errNotGroupMember && reason != errGroupPermission && reason != errChannelSocketPost && reason != errChatBlocked && reason != database.ErrNotChatParticipant && !errors.As(reason, &muted) {
+		log.Printf("failed to check chat permission: %v", reason)
+		reason = errGroupPermission
+	}
+
+	byteResponse, err := json.Marshal(MessageRejected{FriendshipID: friendshipId, Info: reason.Error()})
+
+	if err == nil {
+		conn.WriteMessage(websocket.TextMessage, byteResponse)
+	}
+
+	return true
+}
+
 // @Summary Message ws connection
 // @Description Responds with json
 // @Tags Message
@@ -69,6 +150,31 @@ func (api *ApiService) MessageWsHandler(w http.ResponseWriter, r *http.Request)
 
 	defer conn.Close()
 
+	username, err := getUsernameFromCtx(r.Context())
+
+	if err != nil {
+		log.Printf("ws connection without a user: %v", err)
+		return
+	}
+
+	userId, err := getUserIdFromCtx(r.Context())
+
+	if err != nil {
+		log.Printf("ws connection without a user: %v", err)
+		return
+	}
+
+	if err := api.database.SetUserOnline(r.Context(), userId, true); err != nil {
+		log.Printf("failed to mark %s online: %v", username, err)
+	}
+
+	defer func() {
+		// the request context is done once the socket closes
+		if err := api.database.SetUserOnline(context.Background(), userId, false); err != nil {
+			log.Printf("failed to mark %s offline: %v", username, err)
+		}
+	}()
+
 	for {
 
 		messageType, data, err := conn.ReadMessage()
@@ -89,6 +195,10 @@ func (api *ApiService) MessageWsHandler(w http.ResponseWriter, r *http.Request)
 				return
 			}
 
+			if api.rejectMessage(conn, r.Context(), userId, messagePayload.FriendshipID, messagePayload.MessageType) {
+				continue
+			}
+
 			var messageId = uuid.New().String()
 
 			//broadcast message before insert for latency
@@ -98,7 +208,8 @@ func (api *ApiService) MessageWsHandler(w http.ResponseWriter, r *http.Request)
 			message := database.Message{
 				MessageID:      messageId,
 				FriendshipID:   messagePayload.FriendshipID,
-				SenderUsername: messagePayload.SenderUsername,
+				SenderID:       userId,
+				SenderUsername: username,
 				MessageType:    messagePayload.MessageType,
 				TextContent:    messagePayload.TextContent,
 				Media:          database.Media(messagePayload.Media),
@@ -117,7 +228,7 @@ func (api *ApiService) MessageWsHandler(w http.ResponseWriter, r *http.Request)
 				log.Panicf("socket publish failed: %t", err)
 			}
 
-			err = api.database.InsertMessage(r.Context(), messageId, messagePayload.FriendshipID, messagePayload.SenderUsername, message.MessageType, message.TextContent, now)
+			err = api.database.InsertMessage(r.Context(), messageId, messagePayload.FriendshipID, userId, message.MessageType, message.TextContent, now)
 
 			if err != nil {
 
@@ -139,8 +250,16 @@ func (api *ApiService) MessageWsHandler(w http.ResponseWriter, r *http.Request)
 
 			}
 
+			if err == nil {
+				api.notifyChatParticipants(message)
+			}
+
 		case websocket.BinaryMessage:
 
+			if api.rejectMessage(conn, r.Context(), userId, chi.URLParam(r, "friendship_id"), "MessageChat") {
+				continue
+			}
+
 			fileTypeHttp := http.DetectContentType(data)
 
 			var fileTypeHttpSplit = strings.Split(fileTypeHttp, "/")
@@ -151,7 +270,7 @@ func (api *ApiService) MessageWsHandler(w http.ResponseWriter, r *http.Request)
 
 			currentTimeString := strconv.Itoa(int(currentTime)) + fileExtention
 
-			destinationFile, err := os.Create("/home/ifeanyi/nkata_storage/chat_storage/" + currentTimeString)
+			destinationFile, err := os.Create(chatStorageDir + currentTimeString)
 
 			if err != nil {
 				internalServer(w, r, err)
@@ -171,11 +290,6 @@ func (api *ApiService) MessageWsHandler(w http.ResponseWriter, r *http.Request)
 				return
 			}
 			ctx := r.Context()
-			username, err := getUsernameFromCtx(ctx)
-			if err != nil {
-				internalServer(w, r, err)
-				return
-			}
 			now := time.Now()
 			friendshipId := chi.URLParam(r, "friendship_id")
 
@@ -188,6 +302,7 @@ func (api *ApiService) MessageWsHandler(w http.ResponseWriter, r *http.Request)
 			message := database.Message{
 				MessageID:      messageId,
 				FriendshipID:   friendshipId,
+				SenderID:       userId,
 				SenderUsername: username,
 				MessageType:    "MessageChat",
 				Media:          database.Media{MediaUrl: url, MediaType: fileExtention},
@@ -206,7 +321,7 @@ func (api *ApiService) MessageWsHandler(w http.ResponseWriter, r *http.Request)
 				log.Panicf("socket publish failed: %t", err)
 			}
 
-			err = api.database.InsertMessageMedia(ctx, messageId, friendshipId, username, "MessageChat", url, fileExtention, now)
+			err = api.database.InsertMessageMedia(ctx, messageId, friendshipId, userId, "MessageChat", url, fileExtention, now)
 			
 			if err != nil {
 
@@ -228,6 +343,10 @@ func (api *ApiService) MessageWsHandler(w http.ResponseWriter, r *http.Request)
 
 			}
 
+			if err == nil {
+				api.notifyChatParticipants(message)
+			}
+
 		default:
 			log.Printf("cannot determin incoming socket data type: %v", err)
 		}
@@ -235,6 +354,42 @@ func (api *ApiService) MessageWsHandler(w http.ResponseWriter, r *http.Request)
 	}
 
 }
+// push the message to everyone else in the chat, the lookup runs off the request goroutine
+func (api *ApiService) notifyChatParticipants(message database.Message) {
+
+	go func() {
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		usernames, err := api.database.GetFriendshipParticipants(ctx, message.FriendshipID)
+
+		if err != nil {
+			log.Printf("failed to load chat participants for push: %v", err)
+			return
+		}
+
+		body := message.TextContent
+
+		if body == "" {
+			body = "sent you a file"
+		}
+
+		for _, username := range usernames {
+
+			if username == message.SenderUsername {
+				continue
+			}
+
+			api.notify(username, message.SenderUsername, body, map[string]string{
+				"type":          "message",
+				"friendship_id": message.FriendshipID,
+				"message_id":    message.MessageID,
+			})
+		}
+	}()
+}
+
 // @Summary Get Messages with message_id
 // @Description Responds with json
 // @Tags Message
@@ -276,7 +431,7 @@ func (api *ApiService) GetMessageByMessageId(w http.ResponseWriter, r *http.Requ
 func (api *ApiService) LoadMessagefile(w http.ResponseWriter, r *http.Request) {
 
 	filename := chi.URLParam(r, "img_name")
-	url := "/home/ifeanyi/nkata_storage/chat_storage/" + filename
+	url := chatStorageDir + filename
 	file, err := os.Open(url)
 
 	if err != nil {
@@ -320,6 +475,21 @@ func (api *ApiService) GetMessages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// channel posts are read under the channel's own rules, private ones only by subscribers
+	if channelId, ok := strings.CutPrefix(id, database.ChannelChatPrefix); ok {
+
+		channelIdInt, err := strconv.ParseInt(channelId, 10, 64)
+
+		if err != nil {
+			notFound(w, r, errChannelNotFound)
+			return
+		}
+
+		if _, ok := api.authorizeChannel(w, r, channelIdInt, ""); !ok {
+			return
+		}
+	}
+
 	result, err := api.database.GetMessages(ctx, id, pageInt, limitInt)
 
 	if err != nil {
@@ -338,6 +508,7 @@ func (api *ApiService) GetMessages(w http.ResponseWriter, r *http.Request) {
 // @Success 200 {object} StandardResponse
 // @Failure 404 {object} errorslope
 // @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
 // @Failure 500 {object} errorslope
 // @Router /v1/message/delete/{message_id} [delete]
 func (api *ApiService) DeleteMessageByMessageId(w http.ResponseWriter, r *http.Request) {
@@ -346,13 +517,50 @@ func (api *ApiService) DeleteMessageByMessageId(w http.ResponseWriter, r *http.R
 
 	ctx := r.Context()
 
-	err := api.database.DeleteMessageById(ctx, id)
+	userId, err := getUserIdFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	message, err := api.database.GetMessageById(ctx, id)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			notFound(w, r, errors.New("no message found with message_id: "+id))
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	groupId, isGroup := chatGroupId(message.FriendshipID)
+
+	// anyone can delete their own messages, other people's only in groups that allow it
+	if message.SenderID != userId {
+
+		if !isGroup {
+			forbidden(w, r, errors.New("you can only delete your own messages"))
+			return
+		}
+
+		if _, ok := api.authorizeGroup(w, r, groupId, database.GroupDeleteMessage); !ok {
+			return
+		}
+	}
+
+	err = api.database.DeleteMessageById(ctx, id)
 
 	if err != nil {
 		internalServer(w, r, err)
 		return
 	}
 
+	if message.SenderID != userId {
+		api.recordGroupEvent(ctx, database.GroupAuditEvent{GroupID: groupId, ActorID: userId, TargetID: message.SenderID, Action: database.GroupEventMessageDeleted, Before: id})
+	}
+
 	s := StandardResponse{
 		Status:  200,
 		Message: "Message deleted successfully",
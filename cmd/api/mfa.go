@@ -0,0 +1,464 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"main/internal/token"
+	"main/internal/totp"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	tokenTypeMfaPending = "mfa_pending"
+	mfaPendingTtl       = 5 * time.Minute
+	mfaMaxAttempts      = 5
+	recoveryCodeCount   = 10
+)
+
+type MfaPendingJson struct {
+	MfaRequired bool   `json:"mfa_required"`
+	MfaToken    string `json:"mfa_token"`
+}
+
+type TotpEnrollJson struct {
+	Secret     string `json:"secret"`
+	OtpauthUri string `json:"otpauth_uri"`
+	QrCodePng  string `json:"qr_code_png"` // base64 encoded png of otpauth_uri
+}
+
+type TotpCodePayload struct {
+	Code string `json:"code"`
+}
+
+type RecoveryCodesJson struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type DisableTotpPayload struct {
+	Password string `json:"password"`
+	Code     string `json:"code"` // authenticator code or a recovery code
+}
+
+type MfaVerifyPayload struct {
+	MfaToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+	DeviceName   string `json:"device_name"`
+}
+
+var errAccountDisabled = errors.New("this account has been disabled")
+
+// accountEnabled writes a forbidden response and returns false for disabled accounts
+func (api *ApiService) accountEnabled(w http.ResponseWriter, r *http.Request, username string) bool {
+
+	access, err := api.database.GetUserAccess(r.Context(), username)
+
+	if err != nil {
+		internalServer(w, r, errors.New("somthing went wrong"))
+		return false
+	}
+
+	if !access.Enabled {
+		audit(r, "signin_refused_disabled", "username", username)
+		forbidden(w, r, errAccountDisabled)
+		return false
+	}
+
+	return true
+}
+
+// completeSignIn is the last step of every sign-in flow. Users with 2FA get a
+// short lived mfa token to exchange at /v1/auth/2fa/verify instead of a session.
+func (api *ApiService) completeSignIn(w http.ResponseWriter, r *http.Request, username, deviceName string) {
+
+	if !api.accountEnabled(w, r, username) {
+		return
+	}
+
+	mfa, err := api.database.GetTotp(r.Context(), username)
+
+	if err != nil {
+		internalServer(w, r, errors.New("somthing went wrong"))
+		return
+	}
+
+	if mfa.Enabled {
+
+		mfaToken, err := api.tokens.Sign(token.Claims{Username: username, Type: tokenTypeMfaPending}, mfaPendingTtl)
+
+		if err != nil {
+			internalServer(w, r, errors.New("failed to generate token"))
+			return
+		}
+
+		writeJson(w, http.StatusAccepted, MfaPendingJson{MfaRequired: true, MfaToken: mfaToken})
+		return
+	}
+
+	tokenResponse, err := api.issueSession(r, username, deviceName)
+
+	if err != nil {
+		internalServer(w, r, errors.New("failed to generate token"))
+		return
+	}
+
+	writeJson(w, http.StatusAccepted, tokenResponse)
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToUpper(strings.ReplaceAll(code, "-", ""))))
+	return hex.EncodeToString(sum[:])
+}
+
+// recovery codes look like ABCDE-FGHIJ, 50 random bits each
+func newRecoveryCodes() ([]string, []string, error) {
+
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+
+	for i := 0; i < recoveryCodeCount; i++ {
+
+		random := make([]byte, 7)
+
+		if _, err := rand.Read(random); err != nil {
+			return nil, nil, err
+		}
+
+		code := base32.StdEncoding.EncodeToString(random)[:10]
+		code = code[:5] + "-" + code[5:]
+
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// checkSecondFactor accepts a current authenticator code (each time step once) or an unused recovery code
+func (api *ApiService) checkSecondFactor(r *http.Request, username, code, recoveryCode string) (bool, error) {
+
+	ctx := r.Context()
+
+	if recoveryCode != "" {
+		return api.database.UseRecoveryCode(ctx, username, hashRecoveryCode(recoveryCode))
+	}
+
+	mfa, err := api.database.GetTotp(ctx, username)
+
+	if err != nil {
+		return false, err
+	}
+
+	if !mfa.Enabled {
+		return false, nil
+	}
+
+	step, ok := totp.ValidateAfter(mfa.Secret, code, time.Now(), api.config.MfaConfig.Skew, mfa.LastStep)
+
+	if !ok {
+		return false, nil
+	}
+
+	return api.database.UseTotpStep(ctx, username, step)
+}
+
+// @Summary Start 2FA enrolment
+// @Description Creates a pending TOTP secret and returns it as an otpauth uri and QR code. 2FA is enabled once a code is confirmed.
+// @Tags User
+// @Produce json
+// @Success 200 {object} TotpEnrollJson
+// @Failure 409 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/user/2fa/enroll [post]
+func (api *ApiService) EnrollTotp(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	mfa, err := api.database.GetTotp(ctx, username)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if mfa.Enabled {
+		conflict(w, r, errors.New("2fa is already enabled"))
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if err := api.database.SetPendingTotpSecret(ctx, username, secret); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	uri := totp.URI(api.config.MfaConfig.Issuer, username, secret)
+
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	response := TotpEnrollJson{
+		Secret:     secret,
+		OtpauthUri: uri,
+		QrCodePng:  base64.StdEncoding.EncodeToString(png),
+	}
+
+	writeJson(w, http.StatusOK, response)
+}
+
+// @Summary Confirm 2FA enrolment
+// @Description Enables 2FA with the first code from the authenticator app and returns single use recovery codes. They are only shown once.
+// @Tags User
+// @Accept json
+// @Produce json
+// @Param payload body TotpCodePayload true "authenticator code"
+// @Success 200 {object} RecoveryCodesJson
+// @Failure 400 {object} errorslope
+// @Failure 401 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/user/2fa/confirm [post]
+func (api *ApiService) ConfirmTotp(w http.ResponseWriter, r *http.Request) {
+
+	var payload TotpCodePayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	mfa, err := api.database.GetTotp(ctx, username)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if mfa.Enabled {
+		conflict(w, r, errors.New("2fa is already enabled"))
+		return
+	}
+
+	if mfa.Secret == "" {
+		badRequest(w, r, errors.New("start 2fa enrolment first"))
+		return
+	}
+
+	step, ok := totp.Validate(mfa.Secret, payload.Code, time.Now(), api.config.MfaConfig.Skew)
+
+	if !ok {
+		unauthorized(w, r, errors.New("invalid code"))
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if err := api.database.EnableTotp(ctx, username, step, hashes); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, RecoveryCodesJson{RecoveryCodes: codes})
+}
+
+// @Summary Disable 2FA
+// @Description Requires the account password and an authenticator or recovery code
+// @Tags User
+// @Accept json
+// @Produce json
+// @Param payload body DisableTotpPayload true "password and code"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 401 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/user/2fa/disable [post]
+func (api *ApiService) DisableTotp(w http.ResponseWriter, r *http.Request) {
+
+	var payload DisableTotpPayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	user, err := api.database.GetByUsername(ctx, username)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(payload.Password)); err != nil {
+		unauthorized(w, r, errors.New("invalid password or code"))
+		return
+	}
+
+	code, recoveryCode := payload.Code, ""
+
+	if len(payload.Code) != totp.Digits {
+		code, recoveryCode = "", payload.Code
+	}
+
+	ok, err := api.checkSecondFactor(r, username, code, recoveryCode)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if !ok {
+		unauthorized(w, r, errors.New("invalid password or code"))
+		return
+	}
+
+	if err := api.database.DisableTotp(ctx, username); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	s := StandardResponse{
+		Status:  http.StatusOK,
+		Message: "2fa disabled",
+	}
+
+	writeJson(w, http.StatusOK, s)
+}
+
+// @Summary Complete sign-in with 2FA
+// @Description Exchange the mfa_token from a sign-in endpoint and an authenticator or recovery code for a session
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param payload body MfaVerifyPayload true "mfa token and code"
+// @Success 202 {object} JwtJson
+// @Failure 400 {object} errorslope
+// @Failure 401 {object} errorslope
+// @Failure 429 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Router /v1/auth/2fa/verify [post]
+func (api *ApiService) VerifyMfa(w http.ResponseWriter, r *http.Request) {
+
+	var payload MfaVerifyPayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	ctx := r.Context()
+
+	claims, err := api.tokens.Parse(payload.MfaToken, tokenTypeMfaPending)
+
+	if err != nil {
+		unauthorized(w, r, errors.New("invalid or expired mfa token"))
+		return
+	}
+
+	if !api.guardSignIn(w, r, claims.Username) {
+		return
+	}
+
+	// one mfa token allows a handful of guesses, then the user has to sign in again
+	attemptsKey := "mfa:attempts:" + claims.ID
+
+	attempts, err := api.rClient.Incr(ctx, attemptsKey).Result()
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	api.rClient.Expire(ctx, attemptsKey, mfaPendingTtl)
+
+	if attempts > mfaMaxAttempts {
+		tooManyRequest(w, r, errors.New("too many wrong codes sign in again"))
+		return
+	}
+
+	ok, err := api.checkSecondFactor(r, claims.Username, payload.Code, payload.RecoveryCode)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			unauthorized(w, r, errors.New("invalid code"))
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	if !ok {
+		api.recordSignInFailure(r, "totp", claims.Username, claims.Username)
+		unauthorized(w, r, errors.New("invalid code"))
+		return
+	}
+
+	api.recordSignInSuccess(r, "totp", claims.Username, claims.Username)
+
+	// a used mfa token cannot start a second session
+	api.rClient.Set(ctx, attemptsKey, mfaMaxAttempts+1, mfaPendingTtl)
+
+	if !api.accountEnabled(w, r, claims.Username) {
+		return
+	}
+
+	tokenResponse, err := api.issueSession(r, claims.Username, payload.DeviceName)
+
+	if err != nil {
+		internalServer(w, r, errors.New("failed to generate token"))
+		return
+	}
+
+	writeJson(w, http.StatusAccepted, tokenResponse)
+}
@@ -5,13 +5,11 @@ import (
 	"errors"
 	// "fmt"
 	"log"
-	"main/internal/evn"
+	"main/database"
 	"net/http"
 	"strconv"
 	"sync"
 	"time"
-
-	"github.com/golang-jwt/jwt/v5"
 )
 
 type ClientRequest struct {
@@ -83,13 +81,13 @@ func (api *ApiService) HandleRateLimiter(h http.Handler) http.Handler {
 	})
 }
 
-func HandleJWTAuth(h http.Handler) http.Handler {
+func (api *ApiService) HandleJWTAuth(h http.Handler) http.Handler {
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		authHeaderString := r.Header.Get("Authorization")
 
-		if authHeaderString == "" {
+		if len(authHeaderString) < 8 {
 			err := errors.New("authorization header required")
 			unauthorized(w, r, err)
 			return
@@ -97,38 +95,78 @@ func HandleJWTAuth(h http.Handler) http.Handler {
 
 		tokenString := authHeaderString[7:]
 
-		var secret_words string = "A request for a long text message: Search results showIf this is your intent, please clarify the context and what you want the text to be about."
+		claims, err := api.tokens.Parse(tokenString, tokenTypeAccess)
 
-		secret := evn.GetString(secret_words, "JWT_SERECT")
+		if err != nil {
+			unauthorized(w, r, errors.New("invalid or expired token"))
+			return
+		}
 
-		token, err := jwt.Parse(tokenString, func(t *jwt.Token) (any, error) {
-			return []byte(secret), nil
-		})
+		username := claims.Username
+		sessionId := claims.SessionID
 
-		if err != nil {
+		session, err := api.database.GetSessionById(r.Context(), sessionId)
 
-			err := errors.New("invalid token")
-			unauthorized(w, r, err)
+		if err != nil || !session.Active() || session.Username != username {
+			unauthorized(w, r, errors.New("session has been signed out"))
 			return
 		}
 
-		claims := token.Claims.(jwt.MapClaims)
-		exp := claims["exp"]
-		username := claims["username"]
-
-		float_exp := exp.(float64)
+		// read on every request so disabling or demoting an account takes effect at once
+		access, err := api.database.GetUserAccess(r.Context(), username)
 
-		t := time.Unix(int64(float_exp), 0)
-		date_now := time.Now()
+		if err != nil {
+			unauthorized(w, r, errors.New("session has been signed out"))
+			return
+		}
 
-		if t.Before(date_now) {
-			err := errors.New("token expired")
-			unauthorized(w, r, err)
+		if !access.Enabled {
+			forbidden(w, r, errAccountDisabled)
 			return
 		}
 
 		ctx := context.WithValue(r.Context(), "user", username)
+		ctx = context.WithValue(ctx, "user_id", access.ID)
+		ctx = context.WithValue(ctx, "session", sessionId)
+		ctx = context.WithValue(ctx, "role", access.Role)
 		h.ServeHTTP(w, r.WithContext(ctx))
 	})
 
 }
+
+// RequireRole only lets through requests whose user has one of the roles, it must run after HandleJWTAuth
+func RequireRole(roles ...database.Role) func(http.Handler) http.Handler {
+
+	return func(h http.Handler) http.Handler {
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			role, err := getRoleFromCtx(r.Context())
+
+			if err != nil {
+				unauthorized(w, r, err)
+				return
+			}
+
+			for _, allowed := range roles {
+				if role == allowed {
+					h.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			forbidden(w, r, errors.New("you do not have permission to do this"))
+		})
+	}
+}
+
+func getRoleFromCtx(ctx context.Context) (database.Role, error) {
+
+	role, ok := ctx.Value("role").(database.Role)
+
+	if !ok {
+		return database.NUser, errors.New("no role found in token")
+	}
+
+	return role, nil
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"main/database"
+	"strconv"
+	"time"
+)
+
+// checkMigrations warns about pending schema migrations, or stops the server when required is set.
+// The server never applies migrations itself, that is left to `nkata migrate up`.
+func checkMigrations(db *sql.DB, required bool) {
+
+	migrator, err := database.NewMigrator(db)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	pending, err := migrator.Pending(ctx)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(pending) == 0 {
+		return
+	}
+
+	for _, p := range pending {
+		log.Print("pending migration " + strconv.FormatInt(p.Version, 10) + "_" + p.Name)
+	}
+
+	if required {
+		log.Fatal("refusing to start with pending migrations, run nkata migrate up")
+	}
+
+	log.Print("starting with pending migrations, set DATABASE_REQUIRE_MIGRATIONS=true to refuse")
+}
@@ -0,0 +1,631 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"main/database"
+	"main/internal/oidc"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/oauth2"
+)
+
+const oidcStateTtl = 10 * time.Minute
+
+type AuthorizationUrlJson struct {
+	AuthorizationUrl string `json:"authorization_url"`
+}
+
+// the callback of a link flow answers with this, the signed in user finishes the link with it
+type OidcLinkPendingJson struct {
+	LinkRequired bool   `json:"link_required"`
+	LinkToken    string `json:"link_token"`
+}
+
+type ConfirmOidcLinkPayload struct {
+	LinkToken string `json:"link_token"`
+}
+
+// the verified provider account waiting for the user who started the link, kept in redis under the link token
+type oidcPendingLink struct {
+	Provider string `json:"provider"`
+	LinkTo   string `json:"link_to"`
+	Subject  string `json:"subject"`
+	Email    string `json:"email"`
+}
+
+// what the callback needs to finish the flow, kept in redis under the state value
+type oidcState struct {
+	Provider   string `json:"provider"`
+	Verifier   string `json:"verifier"`
+	Nonce      string `json:"nonce"`
+	LinkTo     string `json:"link_to,omitempty"` // username when linking from account settings
+	DeviceName string `json:"device_name,omitempty"`
+}
+
+var (
+	errIdentityTaken     = errors.New("provider account is already linked to a user")
+	errProviderLinked    = errors.New("an account of this provider is already linked")
+	errIdentityNotLinked = errors.New("no account of this provider is linked")
+	errLastSignInMethod  = errors.New("add an email or passkey before unlinking your only sign-in method")
+	errLinkExpired       = errors.New("link request is invalid or expired")
+	errLinkNotYours      = errors.New("this link was started by another account")
+)
+
+// oidcAccounts is the part of the database social sign-in reads and writes
+type oidcAccounts interface {
+	CheackUsernameAvailability(ctx context.Context, username string) bool
+	InsertOidcUser(ctx context.Context, user *database.User, provider, subject, email string, emailVerified bool) error
+	GetByUsername(ctx context.Context, username string) (*database.User, error)
+	GetPasskeysByUsername(ctx context.Context, username string) ([]database.Passkey, error)
+	GetUserIdentity(ctx context.Context, provider, subject string) (*database.UserIdentity, error)
+	GetUserIdentities(ctx context.Context, username string) ([]database.UserIdentity, error)
+	InsertUserIdentity(ctx context.Context, username, provider, subject, email string) error
+	DeleteUserIdentity(ctx context.Context, username, provider string) (bool, error)
+}
+
+func newOidcProviders(configs []oidc.ProviderConfig) map[string]*oidc.Provider {
+
+	providers := make(map[string]*oidc.Provider)
+
+	for _, config := range configs {
+
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		provider, err := oidc.NewProvider(ctx, config)
+		cancel()
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		providers[config.Name] = provider
+		log.Print("Social login configured for " + config.Name)
+	}
+
+	return providers
+}
+
+func randomString(size int) (string, error) {
+
+	random := make([]byte, size)
+
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+func (api *ApiService) startOidc(w http.ResponseWriter, r *http.Request, linkTo string) {
+
+	provider, ok := api.oidcProviders[chi.URLParam(r, "provider")]
+
+	if !ok {
+		notFound(w, r, errors.New("unknown sign-in provider"))
+		return
+	}
+
+	state, err := randomString(24)
+	nonce, err1 := randomString(24)
+
+	if err != nil || err1 != nil {
+		internalServer(w, r, errors.New("somthing went wrong"))
+		return
+	}
+
+	saved := oidcState{
+		Provider:   provider.Name(),
+		Verifier:   oauth2.GenerateVerifier(),
+		Nonce:      nonce,
+		LinkTo:     linkTo,
+		DeviceName: r.URL.Query().Get("device_name"),
+	}
+
+	data, err := json.Marshal(saved)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if err := api.rClient.Set(r.Context(), "oidc:state:"+state, data, oidcStateTtl).Err(); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, AuthorizationUrlJson{AuthorizationUrl: provider.AuthCodeURL(state, saved.Verifier, nonce)})
+}
+
+// generateUsername derives a username from the external profile and appends digits until it is free
+func generateUsername(ctx context.Context, accounts oidcAccounts, identity *oidc.Identity) (string, error) {
+
+	candidates := []string{identity.PreferredUsername, strings.Split(identity.Email, "@")[0], identity.Name}
+
+	base := ""
+
+	for _, candidate := range candidates {
+
+		var b strings.Builder
+
+		for _, c := range strings.ToLower(candidate) {
+			if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '_' {
+				b.WriteRune(c)
+			}
+		}
+
+		if b.Len() > 0 {
+			base = b.String()
+			break
+		}
+	}
+
+	if base == "" {
+		base = "user"
+	}
+
+	// usernames are at most 10 characters, see RegisterUser
+	if len(base) > 10 {
+		base = base[:10]
+	}
+
+	if !accounts.CheackUsernameAvailability(ctx, base) {
+		return base, nil
+	}
+
+	if len(base) > 6 {
+		base = base[:6]
+	}
+
+	for i := 0; i < 20; i++ {
+
+		n, err := rand.Int(rand.Reader, big.NewInt(10000))
+
+		if err != nil {
+			return "", err
+		}
+
+		candidate := base + leftPad(n.String(), 4)
+
+		if !accounts.CheackUsernameAvailability(ctx, candidate) {
+			return candidate, nil
+		}
+	}
+
+	return "", errors.New("could not find a free username")
+}
+
+func leftPad(value string, size int) string {
+	return strings.Repeat("0", size-len(value)) + value
+}
+
+// oidcSignIn returns the user the provider account belongs to, creating one on the first sign-in
+func oidcSignIn(ctx context.Context, accounts oidcAccounts, provider string, identity *oidc.Identity) (string, error) {
+
+	existing, err := accounts.GetUserIdentity(ctx, provider, identity.Subject)
+
+	if err == nil {
+		return existing.Username, nil
+	}
+
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	return createOidcUser(ctx, accounts, provider, identity)
+}
+
+// createOidcUser creates an account for a first social login. The password is random and unknown to anyone,
+// the user signs in through the provider, or sets one through reset password once an email is on the account.
+func createOidcUser(ctx context.Context, accounts oidcAccounts, provider string, identity *oidc.Identity) (string, error) {
+
+	username, err := generateUsername(ctx, accounts, identity)
+
+	if err != nil {
+		return "", err
+	}
+
+	password, err := randomString(32)
+
+	if err != nil {
+		return "", err
+	}
+
+	displayName := identity.Name
+
+	if displayName == "" {
+		displayName = username
+	}
+
+	user := &database.User{Username: username, DisplayName: displayName, Password: password}
+
+	// only a verified address nobody else uses, matching emails are never linked automatically
+	err = accounts.InsertOidcUser(ctx, user, provider, identity.Subject, identity.Email, identity.EmailVerified)
+
+	if err == database.ErrIdentityExists {
+
+		// a second first sign-in with the same provider account got there first, it is the same person
+		existing, err := accounts.GetUserIdentity(ctx, provider, identity.Subject)
+
+		if err != nil {
+			return "", err
+		}
+
+		return existing.Username, nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return username, nil
+}
+
+// linkOidcIdentity adds the provider account to an existing user, one account per provider
+func linkOidcIdentity(ctx context.Context, accounts oidcAccounts, username, provider string, identity *oidc.Identity) error {
+
+	_, err := accounts.GetUserIdentity(ctx, provider, identity.Subject)
+
+	if err == nil {
+		return errIdentityTaken
+	}
+
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	if err := accounts.InsertUserIdentity(ctx, username, provider, identity.Subject, identity.Email); err != nil {
+
+		if strings.Contains(err.Error(), "user_identity_username_provider_key") {
+			return errProviderLinked
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// unlinkOidcIdentity removes the provider account unless it is the only way left to sign in
+func unlinkOidcIdentity(ctx context.Context, accounts oidcAccounts, username, provider string) error {
+
+	user, err := accounts.GetByUsername(ctx, username)
+
+	if err != nil {
+		return err
+	}
+
+	identities, err := accounts.GetUserIdentities(ctx, username)
+
+	if err != nil {
+		return err
+	}
+
+	passkeys, err := accounts.GetPasskeysByUsername(ctx, username)
+
+	if err != nil {
+		return err
+	}
+
+	// an email means password reset and email sign-in still work
+	if user.Email == "" && len(passkeys) == 0 && len(identities) <= 1 {
+		return errLastSignInMethod
+	}
+
+	deleted, err := accounts.DeleteUserIdentity(ctx, username, provider)
+
+	if err != nil {
+		return err
+	}
+
+	if !deleted {
+		return errIdentityNotLinked
+	}
+
+	return nil
+}
+
+// @Summary Start social sign-in
+// @Description Returns the provider url to send the user to, the provider redirects back to the callback endpoint
+// @Tags Auth
+// @Produce json
+// @Param provider path string true "provider name, e.g. google or github"
+// @Param device_name query string false "name for the new session"
+// @Success 200 {object} AuthorizationUrlJson
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Router /v1/auth/oidc/{provider}/start [get]
+func (api *ApiService) StartOidcLogin(w http.ResponseWriter, r *http.Request) {
+	api.startOidc(w, r, "")
+}
+
+// @Summary Social sign-in callback
+// @Description Completes sign-in, linking or first time sign-up for the provider account
+// @Tags Auth
+// @Produce json
+// @Param provider path string true "provider name"
+// @Param code query string true "authorization code"
+// @Param state query string true "state"
+// @Success 202 {object} JwtJson
+// @Success 202 {object} MfaPendingJson
+// @Success 200 {object} OidcLinkPendingJson
+// @Failure 400 {object} errorslope
+// @Failure 401 {object} errorslope
+// @Failure 409 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Router /v1/auth/oidc/{provider}/callback [get]
+func (api *ApiService) OidcCallback(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	if errCode := r.URL.Query().Get("error"); errCode != "" {
+		unauthorized(w, r, errors.New("sign-in was cancelled or denied: "+errCode))
+		return
+	}
+
+	data, err := api.rClient.GetDel(ctx, "oidc:state:"+r.URL.Query().Get("state")).Result()
+
+	if err != nil {
+		unauthorized(w, r, errors.New("sign-in state is invalid or expired"))
+		return
+	}
+
+	var saved oidcState
+
+	if err := json.Unmarshal([]byte(data), &saved); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	provider, ok := api.oidcProviders[chi.URLParam(r, "provider")]
+
+	if !ok || provider.Name() != saved.Provider {
+		badRequest(w, r, errors.New("provider does not match sign-in state"))
+		return
+	}
+
+	identity, err := provider.Exchange(ctx, r.URL.Query().Get("code"), saved.Verifier, saved.Nonce)
+
+	if err != nil {
+		log.Printf("oidc exchange with %s failed: %v", saved.Provider, err)
+		unauthorized(w, r, errors.New("sign-in with "+saved.Provider+" failed"))
+		return
+	}
+
+	// the callback is not signed in, whoever opens the provider url lands here. Linking waits for the
+	// user who started it to confirm while signed in, so a link url sent to someone else links nothing.
+	if saved.LinkTo != "" {
+
+		linkToken, err := randomString(24)
+
+		if err != nil {
+			internalServer(w, r, errors.New("somthing went wrong"))
+			return
+		}
+
+		pending, err := json.Marshal(oidcPendingLink{Provider: saved.Provider, LinkTo: saved.LinkTo, Subject: identity.Subject, Email: identity.Email})
+
+		if err != nil {
+			internalServer(w, r, err)
+			return
+		}
+
+		if err := api.rClient.Set(ctx, "oidc:link:"+linkToken, pending, oidcStateTtl).Err(); err != nil {
+			internalServer(w, r, err)
+			return
+		}
+
+		writeJson(w, http.StatusOK, OidcLinkPendingJson{LinkRequired: true, LinkToken: linkToken})
+		return
+	}
+
+	username, err := oidcSignIn(ctx, api.database, saved.Provider, identity)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	api.completeSignIn(w, r, username, saved.DeviceName)
+}
+
+// @Summary Link social account
+// @Description Returns the provider url, after signing in there the callback hands back a link token to confirm with /v1/user/identities/{provider}/link/confirm
+// @Tags User
+// @Produce json
+// @Param provider path string true "provider name"
+// @Success 200 {object} AuthorizationUrlJson
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/user/identities/{provider}/link [post]
+func (api *ApiService) LinkOidcIdentity(w http.ResponseWriter, r *http.Request) {
+
+	username, err := getUsernameFromCtx(r.Context())
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	api.startOidc(w, r, username)
+}
+
+// claim checks the pending link belongs to username and provider before it is applied
+func (p *oidcPendingLink) claim(username, provider string) error {
+
+	if p.Provider != provider {
+		return errLinkExpired
+	}
+
+	if p.LinkTo != username {
+		return errLinkNotYours
+	}
+
+	return nil
+}
+
+// @Summary Confirm social account link
+// @Description Links the provider account from the callback to the current user, only the user who started the link can confirm it
+// @Tags User
+// @Accept json
+// @Produce json
+// @Param provider path string true "provider name"
+// @Param payload body ConfirmOidcLinkPayload true "link token from the callback"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 403 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 409 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/user/identities/{provider}/link/confirm [post]
+func (api *ApiService) ConfirmOidcLink(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	var payload ConfirmOidcLinkPayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	// one attempt per token, a token that reached the wrong account is spent
+	data, err := api.rClient.GetDel(ctx, "oidc:link:"+payload.LinkToken).Result()
+
+	if err != nil {
+		notFound(w, r, errLinkExpired)
+		return
+	}
+
+	var pending oidcPendingLink
+
+	if err := json.Unmarshal([]byte(data), &pending); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	provider := chi.URLParam(r, "provider")
+
+	if err := pending.claim(username, provider); err != nil {
+		if err == errLinkNotYours {
+			log.Printf("oidc link for %s confirmed by %s, refused", pending.LinkTo, username)
+			forbidden(w, r, err)
+			return
+		}
+		notFound(w, r, err)
+		return
+	}
+
+	err = linkOidcIdentity(ctx, api.database, username, provider, &oidc.Identity{Subject: pending.Subject, Email: pending.Email})
+
+	switch {
+	case err == errIdentityTaken:
+		conflict(w, r, errors.New("this "+provider+" account is already linked to a user"))
+		return
+	case err == errProviderLinked:
+		conflict(w, r, errors.New("a "+provider+" account is already linked"))
+		return
+	case err != nil:
+		internalServer(w, r, err)
+		return
+	}
+
+	s := StandardResponse{
+		Status:  http.StatusOK,
+		Message: provider + " account linked",
+	}
+
+	writeJson(w, http.StatusOK, s)
+}
+
+// @Summary Get linked social accounts
+// @Description Responds with json
+// @Tags User
+// @Produce json
+// @Success 200 {array} database.UserIdentity
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/user/identities [get]
+func (api *ApiService) GetOidcIdentities(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	identities, err := api.database.GetUserIdentities(ctx, username)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, identities)
+}
+
+// @Summary Unlink social account
+// @Description Refused when it is the only way left to sign in
+// @Tags User
+// @Produce json
+// @Param provider path string true "provider name"
+// @Success 200 {object} StandardResponse
+// @Failure 404 {object} errorslope
+// @Failure 409 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/user/identities/{provider} [delete]
+func (api *ApiService) UnlinkOidcIdentity(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	provider := chi.URLParam(r, "provider")
+
+	err = unlinkOidcIdentity(ctx, api.database, username, provider)
+
+	switch {
+	case err == errLastSignInMethod:
+		conflict(w, r, err)
+		return
+	case err == errIdentityNotLinked:
+		notFound(w, r, errors.New("no "+provider+" account linked"))
+		return
+	case err != nil:
+		internalServer(w, r, err)
+		return
+	}
+
+	s := StandardResponse{
+		Status:  http.StatusOK,
+		Message: provider + " account unlinked",
+	}
+
+	writeJson(w, http.StatusOK, s)
+}
@@ -0,0 +1,497 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"main/database"
+	"main/internal/oidc"
+	"main/internal/oidc/oidctest"
+	"regexp"
+	"sync"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+// memoryAccounts keeps users, passkeys and linked identities the way the tables do, including the
+// unique constraints the handlers depend on
+type memoryAccounts struct {
+	mutex      sync.Mutex
+	users      map[string]*database.User
+	passkeys   map[string][]database.Passkey
+	identities []database.UserIdentity
+	takeAll    bool // every username is taken
+
+	// concurrentSignIn is stored just before the next InsertOidcUser, as if another first sign-in
+	// with the same provider account committed first
+	concurrentSignIn *database.UserIdentity
+}
+
+func newMemoryAccounts() *memoryAccounts {
+	return &memoryAccounts{users: map[string]*database.User{}, passkeys: map[string][]database.Passkey{}}
+}
+
+func (m *memoryAccounts) CheackUsernameAvailability(ctx context.Context, username string) bool {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, taken := m.users[username]
+
+	return taken || m.takeAll
+}
+
+// InsertOidcUser writes the user, email and identity together or not at all, like the transaction
+func (m *memoryAccounts) InsertOidcUser(ctx context.Context, user *database.User, provider, subject, email string, emailVerified bool) error {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.concurrentSignIn != nil {
+		m.identities = append(m.identities, *m.concurrentSignIn)
+		m.users[m.concurrentSignIn.Username] = &database.User{Username: m.concurrentSignIn.Username}
+		m.concurrentSignIn = nil
+	}
+
+	if _, ok := m.users[user.Username]; ok {
+		return errors.New(`pq: duplicate key value violates unique constraint "users_username_key"`)
+	}
+
+	for _, identity := range m.identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			return database.ErrIdentityExists
+		}
+	}
+
+	created := *user
+	created.Email = ""
+
+	if email != "" && emailVerified && !m.emailTaken(email) {
+		created.Email = email
+	}
+
+	m.users[user.Username] = &created
+	m.identities = append(m.identities, database.UserIdentity{Username: user.Username, Provider: provider, Subject: subject, Email: email})
+
+	return nil
+}
+
+func (m *memoryAccounts) emailTaken(email string) bool {
+
+	for _, user := range m.users {
+		if user.Email == email {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *memoryAccounts) GetByUsername(ctx context.Context, username string) (*database.User, error) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	user, ok := m.users[username]
+
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	found := *user
+
+	return &found, nil
+}
+
+func (m *memoryAccounts) GetPasskeysByUsername(ctx context.Context, username string) ([]database.Passkey, error) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.passkeys[username], nil
+}
+
+func (m *memoryAccounts) GetUserIdentity(ctx context.Context, provider, subject string) (*database.UserIdentity, error) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, identity := range m.identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			found := identity
+			return &found, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (m *memoryAccounts) GetUserIdentities(ctx context.Context, username string) ([]database.UserIdentity, error) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var identities []database.UserIdentity
+
+	for _, identity := range m.identities {
+		if identity.Username == username {
+			identities = append(identities, identity)
+		}
+	}
+
+	return identities, nil
+}
+
+func (m *memoryAccounts) InsertUserIdentity(ctx context.Context, username, provider, subject, email string) error {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, identity := range m.identities {
+
+		if identity.Provider == provider && identity.Subject == subject {
+			return errors.New(`pq: duplicate key value violates unique constraint "user_identity_provider_subject_key"`)
+		}
+
+		if identity.Username == username && identity.Provider == provider {
+			return errors.New(`pq: duplicate key value violates unique constraint "user_identity_username_provider_key"`)
+		}
+	}
+
+	m.identities = append(m.identities, database.UserIdentity{Username: username, Provider: provider, Subject: subject, Email: email})
+
+	return nil
+}
+
+func (m *memoryAccounts) DeleteUserIdentity(ctx context.Context, username, provider string) (bool, error) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for i, identity := range m.identities {
+		if identity.Username == username && identity.Provider == provider {
+			m.identities = append(m.identities[:i], m.identities[i+1:]...)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// signInWithIssuer runs the provider side of the flow: authorization url, sign-in as account at
+// the issuer and the code exchange, and returns the verified identity the callback works with
+func signInWithIssuer(t *testing.T, issuer *oidctest.Issuer, account oidctest.Account) *oidc.Identity {
+
+	t.Helper()
+
+	provider, err := oidc.NewProvider(context.Background(), oidc.ProviderConfig{
+		Name:         "mock",
+		Issuer:       issuer.URL(),
+		ClientID:     issuer.ClientID,
+		ClientSecret: issuer.ClientSecret,
+		RedirectURL:  "https://nkata.test/v1/auth/oidc/mock/callback",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := oauth2.GenerateVerifier()
+
+	code, _ := issuer.Authorize(t, provider.AuthCodeURL("state", verifier, "nonce"), account)
+
+	identity, err := provider.Exchange(context.Background(), code, verifier, "nonce")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return identity
+}
+
+func TestOidcFirstSignInCreatesUser(t *testing.T) {
+
+	issuer := oidctest.NewIssuer(t)
+	accounts := newMemoryAccounts()
+
+	account := oidctest.Account{
+		Subject:           "248289761001",
+		Email:             "ada@example.com",
+		EmailVerified:     true,
+		Name:              "Ada Lovelace",
+		PreferredUsername: "Ada.Lovelace",
+	}
+
+	username, err := oidcSignIn(context.Background(), accounts, "mock", signInWithIssuer(t, issuer, account))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// lower case, only letters digits and underscores, at most 10 characters
+	if username != "adalovelac" {
+		t.Errorf("username = %q, want adalovelac", username)
+	}
+
+	user, err := accounts.GetByUsername(context.Background(), username)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.DisplayName != "Ada Lovelace" || user.Email != "ada@example.com" || user.Password == "" {
+		t.Errorf("created user = %+v", user)
+	}
+
+	identities, _ := accounts.GetUserIdentities(context.Background(), username)
+
+	if len(identities) != 1 || identities[0].Provider != "mock" || identities[0].Subject != account.Subject {
+		t.Errorf("linked identities = %+v", identities)
+	}
+
+	// signing in again finds the same user instead of creating another one
+	again, err := oidcSignIn(context.Background(), accounts, "mock", signInWithIssuer(t, issuer, account))
+
+	if err != nil || again != username {
+		t.Fatalf("second sign-in = %q, %v, want %q", again, err, username)
+	}
+
+	if len(accounts.users) != 1 {
+		t.Errorf("%d users after signing in twice, want 1", len(accounts.users))
+	}
+}
+
+func TestOidcConcurrentFirstSignIn(t *testing.T) {
+
+	issuer := oidctest.NewIssuer(t)
+	accounts := newMemoryAccounts()
+
+	account := oidctest.Account{Subject: "sub-ada", PreferredUsername: "ada"}
+
+	accounts.concurrentSignIn = &database.UserIdentity{Username: "ada4821", Provider: "mock", Subject: "sub-ada"}
+
+	username, err := oidcSignIn(context.Background(), accounts, "mock", signInWithIssuer(t, issuer, account))
+
+	if err != nil {
+		t.Fatalf("sign-in that lost the race failed: %v", err)
+	}
+
+	if username != "ada4821" {
+		t.Errorf("username = %q, want the user the other sign-in created", username)
+	}
+
+	if len(accounts.users) != 1 {
+		t.Errorf("%d users, the losing sign-in left one behind", len(accounts.users))
+	}
+}
+
+func TestOidcFirstSignInEmail(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		verified  bool
+		otherUser bool // the address already belongs to someone
+		wantEmail string
+	}{
+		{name: "verified and free", verified: true, wantEmail: "grace@example.com"},
+		{name: "not verified", verified: false},
+		{name: "used by another account", verified: true, otherUser: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			issuer := oidctest.NewIssuer(t)
+			accounts := newMemoryAccounts()
+
+			if tt.otherUser {
+				accounts.users["grace"] = &database.User{Username: "grace", Email: "grace@example.com"}
+			}
+
+			account := oidctest.Account{Subject: "sub-grace", Email: "grace@example.com", EmailVerified: tt.verified, Name: "Grace Hopper"}
+
+			username, err := oidcSignIn(context.Background(), accounts, "mock", signInWithIssuer(t, issuer, account))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if user := accounts.users[username]; user.Email != tt.wantEmail {
+				t.Errorf("email on %s = %q, want %q", username, user.Email, tt.wantEmail)
+			}
+
+			if tt.otherUser && username == "grace" {
+				t.Error("sign-in matched the existing account by email")
+			}
+		})
+	}
+}
+
+func TestGenerateUsername(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		identity oidc.Identity
+		taken    []string
+		want     string
+	}{
+		{name: "preferred username", identity: oidc.Identity{PreferredUsername: "Ada.Lovelace", Email: "a@example.com"}, want: "^adalovelac$"},
+		{name: "email when there is no preferred username", identity: oidc.Identity{Email: "grace.hopper@example.com", Name: "Grace"}, want: "^gracehoppe$"},
+		{name: "name when there is nothing else", identity: oidc.Identity{Name: "Émile Zola"}, want: "^milezola$"},
+		{name: "nothing usable", identity: oidc.Identity{Name: "李白"}, want: "^user$"},
+		{name: "taken gets digits", identity: oidc.Identity{PreferredUsername: "ada"}, taken: []string{"ada"}, want: `^ada\d{4}$`},
+		{name: "long and taken is shortened", identity: oidc.Identity{PreferredUsername: "adalovelace"}, taken: []string{"adalovelac"}, want: `^adalov\d{4}$`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			accounts := newMemoryAccounts()
+
+			for _, username := range tt.taken {
+				accounts.users[username] = &database.User{Username: username}
+			}
+
+			username, err := generateUsername(context.Background(), accounts, &tt.identity)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !regexp.MustCompile(tt.want).MatchString(username) {
+				t.Errorf("username = %q, want %s", username, tt.want)
+			}
+		})
+	}
+
+	t.Run("everything taken", func(t *testing.T) {
+
+		accounts := newMemoryAccounts()
+		accounts.takeAll = true
+
+		if _, err := generateUsername(context.Background(), accounts, &oidc.Identity{PreferredUsername: "ada"}); err == nil {
+			t.Fatal("generateUsername returned a taken username")
+		}
+	})
+}
+
+func TestLinkOidcIdentity(t *testing.T) {
+
+	issuer := oidctest.NewIssuer(t)
+	accounts := newMemoryAccounts()
+
+	accounts.users["grace"] = &database.User{Username: "grace"}
+	accounts.users["ada"] = &database.User{Username: "ada"}
+
+	graceAtProvider := oidctest.Account{Subject: "sub-grace", Email: "grace@example.com", EmailVerified: true}
+
+	if err := linkOidcIdentity(context.Background(), accounts, "grace", "mock", signInWithIssuer(t, issuer, graceAtProvider)); err != nil {
+		t.Fatalf("link: %v", err)
+	}
+
+	// the linked account now signs in as the existing user
+	username, err := oidcSignIn(context.Background(), accounts, "mock", signInWithIssuer(t, issuer, graceAtProvider))
+
+	if err != nil || username != "grace" {
+		t.Fatalf("sign-in after linking = %q, %v, want grace", username, err)
+	}
+
+	if len(accounts.users) != 2 {
+		t.Errorf("%d users, signing in with a linked account created one", len(accounts.users))
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		account  oidctest.Account
+		wantErr  error
+	}{
+		{name: "provider account linked to someone else", username: "ada", account: graceAtProvider, wantErr: errIdentityTaken},
+		{name: "second account of the same provider", username: "grace", account: oidctest.Account{Subject: "sub-grace-work"}, wantErr: errProviderLinked},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			err := linkOidcIdentity(context.Background(), accounts, tt.username, "mock", signInWithIssuer(t, issuer, tt.account))
+
+			if err != tt.wantErr {
+				t.Fatalf("link error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUnlinkOidcIdentity(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		email    string
+		passkey  bool
+		linked   []string // providers linked to the user
+		provider string
+		wantErr  error
+	}{
+		{name: "only sign-in method", linked: []string{"mock"}, provider: "mock", wantErr: errLastSignInMethod},
+		{name: "email left", email: "grace@example.com", linked: []string{"mock"}, provider: "mock"},
+		{name: "passkey left", passkey: true, linked: []string{"mock"}, provider: "mock"},
+		{name: "another provider left", linked: []string{"mock", "github"}, provider: "mock"},
+		{name: "not linked", email: "grace@example.com", linked: []string{"github"}, provider: "mock", wantErr: errIdentityNotLinked},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			accounts := newMemoryAccounts()
+			accounts.users["grace"] = &database.User{Username: "grace", Email: tt.email}
+
+			if tt.passkey {
+				accounts.passkeys["grace"] = []database.Passkey{{Username: "grace", Name: "laptop"}}
+			}
+
+			for _, provider := range tt.linked {
+				if err := accounts.InsertUserIdentity(context.Background(), "grace", provider, "sub-"+provider, ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := unlinkOidcIdentity(context.Background(), accounts, "grace", tt.provider)
+
+			if err != tt.wantErr {
+				t.Fatalf("unlink error = %v, want %v", err, tt.wantErr)
+			}
+
+			_, lookupErr := accounts.GetUserIdentity(context.Background(), tt.provider, "sub-"+tt.provider)
+
+			if stillLinked := lookupErr == nil; stillLinked != (tt.wantErr == errLastSignInMethod) {
+				t.Errorf("%s still linked = %v after unlink returned %v", tt.provider, stillLinked, err)
+			}
+		})
+	}
+}
+
+func TestOidcPendingLinkClaim(t *testing.T) {
+
+	// started by grace from her settings, the provider sign-in may have happened in anyone's browser
+	pending := oidcPendingLink{Provider: "mock", LinkTo: "grace", Subject: "sub-victim"}
+
+	tests := []struct {
+		name     string
+		username string
+		provider string
+		wantErr  error
+	}{
+		{name: "the user who started it", username: "grace", provider: "mock"},
+		{name: "someone else signed in", username: "ada", provider: "mock", wantErr: errLinkNotYours},
+		{name: "another provider", username: "grace", provider: "github", wantErr: errLinkExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := pending.claim(tt.username, tt.provider); err != tt.wantErr {
+				t.Errorf("claim error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
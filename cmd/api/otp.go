@@ -0,0 +1,202 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"main/database"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	errOtpInvalid         = errors.New("invalid otp")
+	errOtpTooManyAttempts = errors.New("too many wrong attempts request a new otp")
+	errOtpCooldown        = errors.New("an otp was sent recently wait before requesting another")
+)
+
+// six digits from crypto/rand, kept in 100000-999999 so codes stay valid json numbers
+func generateOtp() (int, error) {
+
+	n, err := rand.Int(rand.Reader, big.NewInt(900000))
+
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n.Int64()) + 100000, nil
+}
+
+// the code space is small, so it is hashed with a server key rather than stored or plainly hashed
+func (api *ApiService) hashOtp(email, purpose string, code int) string {
+
+	mac := hmac.New(sha256.New, api.config.OtpConfig.HashKey)
+	mac.Write([]byte(email + "\x00" + purpose + "\x00" + strconv.Itoa(code)))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// issueOtp replaces any outstanding otp for the email and purpose with a new one and emails it. The
+// resend cooldown is taken first so two requests at once cannot both send a code.
+func (api *ApiService) issueOtp(ctx context.Context, username, email, purpose string) error {
+
+	config := api.config.OtpConfig
+
+	cooldownKey := "otp:cooldown:" + purpose + ":" + email
+
+	ok, err := api.rClient.SetNX(ctx, cooldownKey, 1, config.ResendCooldown).Result()
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return errOtpCooldown
+	}
+
+	if err := api.storeAndSendOtp(ctx, username, email, purpose); err != nil {
+
+		// the cooldown is only for codes that went out, the user may ask again right away
+		if err := api.rClient.Del(context.Background(), cooldownKey).Err(); err != nil {
+			log.Printf("otp cooldown for %s not released: %v", email, err)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (api *ApiService) storeAndSendOtp(ctx context.Context, username, email, purpose string) error {
+
+	code, err := generateOtp()
+
+	if err != nil {
+		return err
+	}
+
+	if err := api.database.DeleteOtps(ctx, email, purpose); err != nil {
+		return err
+	}
+
+	err = api.database.InsertOtp(ctx, username, email, purpose, api.hashOtp(email, purpose, code), time.Now().Add(api.config.OtpConfig.Ttl))
+
+	if err != nil {
+		return err
+	}
+
+	return api.sendOtpEmail(ctx, username, email, purpose, code)
+}
+
+// issueOtpIfExists sends an otp when the email belongs to an account. Unknown emails and the resend
+// cooldown are not errors, callers answer the same way in every case so emails cannot be probed.
+func (api *ApiService) issueOtpIfExists(ctx context.Context, email, purpose string) error {
+
+	user, err := api.database.GetUserByEmail(ctx, email)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+
+	err = api.issueOtp(ctx, user.Username, user.Email, purpose)
+
+	if err == errOtpCooldown {
+		return nil
+	}
+
+	return err
+}
+
+// verifyOtp checks the code against the active otp for the email and purpose and consumes it on success
+func (api *ApiService) verifyOtp(ctx context.Context, email, purpose string, code int) (*database.Otp, error) {
+
+	otp, err := api.database.GetActiveOtp(ctx, email, purpose)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errOtpInvalid
+		}
+		return nil, err
+	}
+
+	claimed, err := api.database.ClaimOtpAttempt(ctx, otp.ID, api.config.OtpConfig.MaxAttempts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !claimed {
+
+		// the otp is still there when the guesses ran out, otherwise someone else used it meanwhile
+		if exhausted, _ := api.database.ConsumeOtp(ctx, otp.ID); exhausted {
+			return nil, errOtpTooManyAttempts
+		}
+
+		return nil, errOtpInvalid
+	}
+
+	if !hmac.Equal([]byte(otp.TokenHash), []byte(api.hashOtp(email, purpose, code))) {
+		return nil, errOtpInvalid
+	}
+
+	consumed, err := api.database.ConsumeOtp(ctx, otp.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !consumed {
+		return nil, errOtpInvalid
+	}
+
+	return otp, nil
+}
+
+func otpError(w http.ResponseWriter, r *http.Request, err error) {
+
+	switch err {
+	case errOtpInvalid:
+		unauthorized(w, r, err)
+	case errOtpTooManyAttempts:
+		tooManyRequest(w, r, err)
+	default:
+		internalServer(w, r, errors.New("somthing went wrong"))
+	}
+}
+
+func (api *ApiService) StartOtpCleanup(ctx context.Context) {
+
+	ticker := time.NewTicker(api.config.OtpConfig.CleanupInterval)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				deleted, err := api.database.DeleteExpiredOtps(ctx)
+
+				if err != nil {
+					log.Printf("otp cleanup failed: %v", err)
+					continue
+				}
+
+				if deleted > 0 {
+					log.Printf("otp cleanup removed %d expired otps", deleted)
+				}
+			}
+		}
+	}()
+}
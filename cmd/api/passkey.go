@@ -0,0 +1,467 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"main/database"
+	"main/internal/webauthn"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+const passkeyChallengeTtl = 5 * time.Minute
+
+type PasskeyRegisterPayload struct {
+	Name       string                          `json:"name"`
+	Credential webauthn.RegistrationCredential `json:"credential"`
+}
+
+type PasskeyLoginPayload struct {
+	Credential webauthn.AssertionCredential `json:"credential"`
+	DeviceName string                       `json:"device_name"`
+}
+
+type RenamePasskeyPayload struct {
+	Name string `json:"name"`
+}
+
+// the webauthn user handle is the numeric user id, it must not change when the username does
+func userHandle(id int64) string {
+
+	var handle [8]byte
+	binary.BigEndian.PutUint64(handle[:], uint64(id))
+
+	return base64.RawURLEncoding.EncodeToString(handle[:])
+}
+
+// takeChallenge returns the value stored with the challenge inside clientDataJSON and deletes it so it cannot be replayed
+func (api *ApiService) takeChallenge(r *http.Request, ceremony, clientDataJSON string) (string, string, error) {
+
+	challenge, err := webauthn.ClientDataChallenge(clientDataJSON)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	value, err := api.rClient.GetDel(r.Context(), "webauthn:"+ceremony+":"+challenge).Result()
+
+	if err != nil {
+		return "", "", err
+	}
+
+	return challenge, value, nil
+}
+
+// @Summary Begin passkey registration
+// @Description Returns PublicKeyCredentialCreationOptions for navigator.credentials.create, binary fields are base64url
+// @Tags User
+// @Produce json
+// @Success 200 {object} webauthn.CreationOptions
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/user/passkeys/register/begin [post]
+func (api *ApiService) BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	user, err := api.database.GetByUsername(ctx, username)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	existing, err := api.database.GetPasskeysByUsername(ctx, username)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	exclude := make([]string, 0, len(existing))
+
+	for _, passkey := range existing {
+		exclude = append(exclude, passkey.CredentialID)
+	}
+
+	challenge, err := webauthn.NewChallenge()
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if err := api.rClient.Set(ctx, "webauthn:register:"+challenge, username, passkeyChallengeTtl).Err(); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	displayName := user.DisplayName
+
+	if displayName == "" {
+		displayName = username
+	}
+
+	webUser := webauthn.User{ID: userHandle(user.ID), Name: username, DisplayName: displayName}
+
+	writeJson(w, http.StatusOK, api.config.WebAuthnConfig.CreationOptions(challenge, webUser, exclude))
+}
+
+// @Summary Finish passkey registration
+// @Description Send the credential returned by navigator.credentials.create
+// @Tags User
+// @Accept json
+// @Produce json
+// @Param payload body PasskeyRegisterPayload true "passkey name and credential"
+// @Success 201 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 401 {object} errorslope
+// @Failure 409 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/user/passkeys/register/finish [post]
+func (api *ApiService) FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+
+	var payload PasskeyRegisterPayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	challenge, challengeUser, err := api.takeChallenge(r, "register", payload.Credential.Response.ClientDataJSON)
+
+	if err != nil || challengeUser != username {
+		unauthorized(w, r, errors.New("registration challenge is invalid or expired"))
+		return
+	}
+
+	credential, err := api.config.WebAuthnConfig.VerifyRegistration(challenge, payload.Credential)
+
+	if err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	name := payload.Name
+
+	if name == "" {
+		name = "Passkey"
+	}
+
+	passkey := database.Passkey{
+		Username:     username,
+		CredentialID: credential.ID,
+		PublicKey:    credential.PublicKey,
+		Algorithm:    credential.Algorithm,
+		SignCount:    int64(credential.SignCount),
+		Name:         name,
+	}
+
+	if err := api.database.InsertPasskey(ctx, &passkey); err != nil {
+
+		if err.Error() == `pq: duplicate key value violates unique constraint "webauthn_credential_credential_id_key"` {
+			conflict(w, r, errors.New("passkey already registered"))
+			return
+		}
+
+		internalServer(w, r, err)
+		return
+	}
+
+	s := StandardResponse{
+		Status:  http.StatusCreated,
+		Message: "passkey registered",
+	}
+
+	writeJson(w, http.StatusCreated, s)
+}
+
+// @Summary Get passkeys
+// @Description Responds with json
+// @Tags User
+// @Produce json
+// @Success 200 {array} database.Passkey
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/user/passkeys [get]
+func (api *ApiService) GetPasskeys(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	passkeys, err := api.database.GetPasskeysByUsername(ctx, username)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, passkeys)
+}
+
+// @Summary Rename passkey
+// @Description Responds with json
+// @Tags User
+// @Accept json
+// @Produce json
+// @Param id path string true "passkey id"
+// @Param payload body RenamePasskeyPayload true "new name"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/user/passkeys/{id} [put]
+func (api *ApiService) RenamePasskey(w http.ResponseWriter, r *http.Request) {
+
+	var payload RenamePasskeyPayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+
+	if err != nil {
+		badRequest(w, r, errors.New("id is not a number"))
+		return
+	}
+
+	if payload.Name == "" {
+		badRequest(w, r, errors.New("name is required"))
+		return
+	}
+
+	renamed, err := api.database.RenamePasskey(ctx, username, int64(id), payload.Name)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if !renamed {
+		notFound(w, r, errors.New("no passkey found with id: "+strconv.Itoa(id)))
+		return
+	}
+
+	s := StandardResponse{
+		Status:  http.StatusOK,
+		Message: "passkey renamed",
+	}
+
+	writeJson(w, http.StatusOK, s)
+}
+
+// @Summary Delete passkey
+// @Description Responds with json
+// @Tags User
+// @Produce json
+// @Param id path string true "passkey id"
+// @Success 200 {object} StandardResponse
+// @Failure 400 {object} errorslope
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/user/passkeys/{id} [delete]
+func (api *ApiService) DeletePasskey(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+
+	if err != nil {
+		badRequest(w, r, errors.New("id is not a number"))
+		return
+	}
+
+	deleted, err := api.database.DeletePasskey(ctx, username, int64(id))
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if !deleted {
+		notFound(w, r, errors.New("no passkey found with id: "+strconv.Itoa(id)))
+		return
+	}
+
+	s := StandardResponse{
+		Status:  http.StatusOK,
+		Message: "passkey deleted",
+	}
+
+	writeJson(w, http.StatusOK, s)
+}
+
+// @Summary Begin passkey sign-in
+// @Description Returns PublicKeyCredentialRequestOptions for navigator.credentials.get, binary fields are base64url
+// @Tags Auth
+// @Produce json
+// @Success 200 {object} webauthn.RequestOptions
+// @Failure 500 {object} errorslope
+// @Router /v1/auth/passkey/begin [post]
+func (api *ApiService) BeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+
+	challenge, err := webauthn.NewChallenge()
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if err := api.rClient.Set(r.Context(), "webauthn:login:"+challenge, "1", passkeyChallengeTtl).Err(); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, api.config.WebAuthnConfig.RequestOptions(challenge))
+}
+
+// @Summary Finish passkey sign-in
+// @Description Send the credential returned by navigator.credentials.get. A user verified passkey counts as both factors, otherwise 2FA still applies.
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param payload body PasskeyLoginPayload true "assertion"
+// @Success 202 {object} JwtJson
+// @Success 202 {object} MfaPendingJson
+// @Failure 400 {object} errorslope
+// @Failure 401 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Router /v1/auth/passkey/finish [post]
+func (api *ApiService) FinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+
+	var payload PasskeyLoginPayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	ctx := r.Context()
+
+	challenge, _, err := api.takeChallenge(r, "login", payload.Credential.Response.ClientDataJSON)
+
+	if err != nil {
+		if err == redis.Nil {
+			unauthorized(w, r, errors.New("sign-in challenge is invalid or expired"))
+			return
+		}
+		badRequest(w, r, err)
+		return
+	}
+
+	passkey, err := api.database.GetPasskeyByCredentialId(ctx, payload.Credential.ID)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			unauthorized(w, r, errors.New("unknown passkey"))
+			return
+		}
+		internalServer(w, r, err)
+		return
+	}
+
+	user, err := api.database.GetByUsername(ctx, passkey.Username)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if handle := payload.Credential.Response.UserHandle; handle != "" && handle != userHandle(user.ID) {
+		unauthorized(w, r, errors.New("passkey does not belong to this user"))
+		return
+	}
+
+	stored := webauthn.Credential{
+		ID:        passkey.CredentialID,
+		PublicKey: passkey.PublicKey,
+		Algorithm: passkey.Algorithm,
+		SignCount: uint32(passkey.SignCount),
+	}
+
+	signCount, userVerified, err := api.config.WebAuthnConfig.VerifyAssertion(challenge, stored, payload.Credential)
+
+	if err != nil {
+		unauthorized(w, r, err)
+		return
+	}
+
+	updated, err := api.database.UpdatePasskeySignCount(ctx, passkey.ID, passkey.SignCount, int64(signCount))
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if !updated {
+		unauthorized(w, r, webauthn.ErrSignCount)
+		return
+	}
+
+	if !userVerified {
+		api.completeSignIn(w, r, user.Username, payload.DeviceName)
+		return
+	}
+
+	if !api.accountEnabled(w, r, user.Username) {
+		return
+	}
+
+	tokenResponse, err := api.issueSession(r, user.Username, payload.DeviceName)
+
+	if err != nil {
+		internalServer(w, r, errors.New("failed to generate token"))
+		return
+	}
+
+	writeJson(w, http.StatusAccepted, tokenResponse)
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseTrustedProxies reads addresses and CIDR ranges, a single address is taken as its own range
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+
+	var networks []*net.IPNet
+
+	for _, proxy := range proxies {
+
+		if !strings.Contains(proxy, "/") {
+
+			ip := net.ParseIP(proxy)
+
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %q is not an ip address or range", proxy)
+			}
+
+			bits := 8 * len(ip.To4())
+
+			if bits == 0 {
+				bits = 8 * net.IPv6len
+			}
+
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q is not an ip address or range", proxy)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+func trusted(networks []*net.IPNet, address string) bool {
+
+	ip := net.ParseIP(address)
+
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// realIp replaces middleware.RealIP. X-Forwarded-For and X-Real-IP are written by whoever sends the
+// request, so they are only believed when the connection comes from one of the trusted proxies.
+// Otherwise the peer address stays, a client cannot pick a new ip for the rate limit or the sign-in
+// lockout by sending a header.
+func realIp(proxies []*net.IPNet) func(http.Handler) http.Handler {
+
+	return func(next http.Handler) http.Handler {
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			ip := forwardedIp(proxies, r)
+
+			if ip == "" {
+				ip = clientIp(r)
+			}
+
+			// without the port, a client opening new connections is still the same client
+			r.RemoteAddr = ip
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// forwardedIp is the client address the trusted proxies reported, empty to keep the peer address
+func forwardedIp(proxies []*net.IPNet, r *http.Request) string {
+
+	if !trusted(proxies, clientIp(r)) {
+		return ""
+	}
+
+	// every proxy appends the address it got the request from, the first one from the right that is
+	// not a trusted proxy is the client, anything left of it could have been sent by the client
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+
+		for i := len(hops) - 1; i >= 0; i-- {
+
+			hop := strings.TrimSpace(hops[i])
+
+			if net.ParseIP(hop) == nil {
+				return ""
+			}
+
+			if !trusted(proxies, hop) {
+				return hop
+			}
+		}
+
+		return ""
+	}
+
+	if realIp := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIp) != nil {
+		return realIp
+	}
+
+	return ""
+}
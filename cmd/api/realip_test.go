@@ -0,0 +1,69 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRealIp(t *testing.T) {
+
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "2001:db8::1"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string][]string
+		want       string
+	}{
+		{name: "direct client", remoteAddr: "203.0.113.7:51234", want: "203.0.113.7"},
+		{name: "direct client sending forwarded for", remoteAddr: "203.0.113.7:51234", headers: map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, want: "203.0.113.7"},
+		{name: "direct client sending real ip", remoteAddr: "203.0.113.7:51234", headers: map[string][]string{"X-Real-IP": {"198.51.100.1"}}, want: "203.0.113.7"},
+		{name: "through a trusted proxy", remoteAddr: "10.0.0.2:443", headers: map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, want: "198.51.100.1"},
+		{name: "client prepends its own hop", remoteAddr: "10.0.0.2:443", headers: map[string][]string{"X-Forwarded-For": {"192.0.2.99, 198.51.100.1"}}, want: "198.51.100.1"},
+		{name: "two trusted proxies", remoteAddr: "10.0.0.2:443", headers: map[string][]string{"X-Forwarded-For": {"198.51.100.1, 10.1.1.1"}}, want: "198.51.100.1"},
+		{name: "header repeated", remoteAddr: "10.0.0.2:443", headers: map[string][]string{"X-Forwarded-For": {"192.0.2.99", "198.51.100.1"}}, want: "198.51.100.1"},
+		{name: "real ip from a trusted proxy", remoteAddr: "[2001:db8::1]:443", headers: map[string][]string{"X-Real-IP": {"198.51.100.1"}}, want: "198.51.100.1"},
+		{name: "garbage from a trusted proxy", remoteAddr: "10.0.0.2:443", headers: map[string][]string{"X-Forwarded-For": {"not-an-ip"}}, want: "10.0.0.2"},
+		{name: "trusted proxy without headers", remoteAddr: "10.0.0.2:443", want: "10.0.0.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			var got string
+
+			handler := realIp(proxies)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = clientIp(r)
+			}))
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/auth/login", nil)
+			r.RemoteAddr = tt.remoteAddr
+
+			for key, values := range tt.headers {
+				for _, value := range values {
+					r.Header.Add(key, value)
+				}
+			}
+
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			if got != tt.want {
+				t.Errorf("client ip = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxiesRejectsGarbage(t *testing.T) {
+
+	for _, proxy := range []string{"proxy.internal", "10.0.0.0/33", ""} {
+		if _, err := parseTrustedProxies([]string{proxy}); err == nil {
+			t.Errorf("parseTrustedProxies accepted %q", proxy)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"main/database"
+	"main/internal/token"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const tokenTypeAccess = "access"
+
+type RefreshTokenPayload struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+func getSessionIdFromCtx(ctx context.Context) (string, error) {
+
+	sessionId, ok := ctx.Value("session").(string)
+
+	if !ok {
+		return "", errors.New("no session found in token")
+	}
+
+	return sessionId, nil
+}
+
+func newRefreshToken() (string, string, error) {
+
+	random := make([]byte, 32)
+
+	if _, err := rand.Read(random); err != nil {
+		return "", "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(random)
+
+	return token, hashRefreshToken(token), nil
+}
+
+// refresh tokens are 256 random bits so a plain sha256 is enough to keep them out of the database
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (api *ApiService) signAccessToken(username, sessionId string) (string, error) {
+
+	claims := token.Claims{
+		Username:  username,
+		SessionID: sessionId,
+		Type:      tokenTypeAccess,
+	}
+
+	return api.tokens.Sign(claims, api.config.SessionConfig.AccessTokenTtl)
+}
+
+// issueSession starts a new session (token family) for the user and returns its first token pair
+func (api *ApiService) issueSession(r *http.Request, username, deviceName string) (*JwtJson, error) {
+
+	// signing in during the deletion grace period keeps the account
+	cancelled, err := api.database.CancelAccountDeletion(r.Context(), username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if cancelled {
+		audit(r, "account_deletion_cancelled", "username", username)
+	}
+
+	refreshToken, refreshHash, err := newRefreshToken()
+
+	if err != nil {
+		return nil, err
+	}
+
+	session := database.Session{
+		ID:         uuid.New().String(),
+		Username:   username,
+		DeviceName: deviceName,
+		Ip:         r.RemoteAddr,
+		UserAgent:  r.UserAgent(),
+		ExpiresAt:  time.Now().Add(api.config.SessionConfig.RefreshTokenTtl),
+	}
+
+	if err := api.database.InsertSession(r.Context(), &session, refreshHash); err != nil {
+		return nil, err
+	}
+
+	accessToken, err := api.signAccessToken(username, session.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &JwtJson{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(api.config.SessionConfig.AccessTokenTtl.Seconds()),
+	}, nil
+}
+
+func (api *ApiService) revokeSession(ctx context.Context, username, sessionId string) (bool, error) {
+
+	revoked, err := api.database.RevokeSession(ctx, username, sessionId)
+
+	if err != nil || !revoked {
+		return revoked, err
+	}
+
+	return true, api.database.DeleteDeviceTokensBySession(ctx, sessionId)
+}
+
+// @Summary Refresh access token
+// @Description Exchanges a refresh token for a new access and refresh token. Each refresh token works once, reusing one signs out the whole session.
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param payload body RefreshTokenPayload true "refresh token"
+// @Success 200 {object} JwtJson
+// @Failure 400 {object} errorslope
+// @Failure 401 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Router /v1/auth/refresh [post]
+func (api *ApiService) RefreshToken(w http.ResponseWriter, r *http.Request) {
+
+	var payload RefreshTokenPayload
+
+	if err := readJson(w, r, &payload); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	ctx := r.Context()
+
+	refreshToken, refreshHash, err := newRefreshToken()
+
+	if err != nil {
+		internalServer(w, r, errors.New("failed to generate token"))
+		return
+	}
+
+	session, err := api.database.RotateRefreshToken(ctx, hashRefreshToken(payload.RefreshToken), refreshHash)
+
+	if err != nil {
+
+		if err == database.ErrRefreshTokenReused {
+			log.Printf("refresh token reuse detected, revoked session %s of %s", session.ID, session.Username)
+			api.database.DeleteDeviceTokensBySession(ctx, session.ID)
+			unauthorized(w, r, errors.New("refresh token already used, session has been signed out"))
+			return
+		}
+
+		if err == database.ErrSessionInvalid {
+			unauthorized(w, r, errors.New("invalid refresh token"))
+			return
+		}
+
+		internalServer(w, r, errors.New("somthing went wrong"))
+		return
+	}
+
+	accessToken, err := api.signAccessToken(session.Username, session.ID)
+
+	if err != nil {
+		internalServer(w, r, errors.New("failed to generate token"))
+		return
+	}
+
+	tokenResponse := JwtJson{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(api.config.SessionConfig.AccessTokenTtl.Seconds()),
+	}
+
+	writeJson(w, http.StatusOK, tokenResponse)
+}
+
+// @Summary Sign out
+// @Description Revokes the session of the token used for this request
+// @Tags Auth
+// @Produce json
+// @Success 200 {object} StandardResponse
+// @Failure 401 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/auth/logout [post]
+func (api *ApiService) Logout(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	sessionId, err := getSessionIdFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if _, err := api.revokeSession(ctx, username, sessionId); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	s := StandardResponse{
+		Status:  http.StatusOK,
+		Message: "signed out successfully",
+	}
+
+	writeJson(w, http.StatusOK, s)
+}
+
+// @Summary Get active sessions
+// @Description Responds with json
+// @Tags Auth
+// @Produce json
+// @Success 200 {array} database.Session
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/auth/sessions [get]
+func (api *ApiService) GetSessions(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	sessionId, _ := getSessionIdFromCtx(ctx)
+
+	sessions, err := api.database.GetActiveSessions(ctx, username)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == sessionId
+	}
+
+	writeJson(w, http.StatusOK, sessions)
+}
+
+// @Summary Revoke session
+// @Description Signs out one of the user's sessions
+// @Tags Auth
+// @Produce json
+// @Param id path string true "session id"
+// @Success 200 {object} StandardResponse
+// @Failure 404 {object} errorslope
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/auth/sessions/{id} [delete]
+func (api *ApiService) RevokeSession(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+
+	revoked, err := api.revokeSession(ctx, username, id)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if !revoked {
+		notFound(w, r, errors.New("no active session found with id: "+id))
+		return
+	}
+
+	s := StandardResponse{
+		Status:  http.StatusOK,
+		Message: "session revoked",
+	}
+
+	writeJson(w, http.StatusOK, s)
+}
+
+// @Summary Revoke all sessions
+// @Description Signs out every session of the user including the current one
+// @Tags Auth
+// @Produce json
+// @Success 200 {object} StandardResponse
+// @Failure 500 {object} errorslope
+// @Security ApiKeyAuth
+// @Router /v1/auth/sessions [delete]
+func (api *ApiService) RevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	username, err := getUsernameFromCtx(ctx)
+
+	if err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if err := api.database.RevokeAllSessions(ctx, username); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	if err := api.database.DeleteDeviceTokensByUsername(ctx, username); err != nil {
+		internalServer(w, r, err)
+		return
+	}
+
+	s := StandardResponse{
+		Status:  http.StatusOK,
+		Message: "all sessions revoked",
+	}
+
+	writeJson(w, http.StatusOK, s)
+}
@@ -2,15 +2,12 @@ package api
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"image"
 	"io"
 	"log"
 	"main/database"
-	"math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -25,6 +22,9 @@ import (
 	_ "image/png"
 )
 
+// profile pictures are stored here and served from /v1/media/profiles/{img_name}
+const profileStorageDir = "/home/ifeanyi/nkata_storage/profile_storage/"
+
 type UpdatePayload struct {
 	DisplayName string `json:"display_name"`
 	Bio         string `json:"bio"`
@@ -42,6 +42,18 @@ func getUsernameFromCtx(ctx context.Context) (string, error) {
 	return username, nil
 }
 
+// user ids stay inside the server, clients only ever see usernames
+func getUserIdFromCtx(ctx context.Context) (int64, error) {
+
+	userId, ok := ctx.Value("user_id").(int64)
+
+	if !ok {
+		return 0, errors.New("no user id found in token")
+	}
+
+	return userId, nil
+}
+
 func (api *ApiService) GetByID(w http.ResponseWriter, r *http.Request) {
 
 }
@@ -112,6 +124,10 @@ func (api *ApiService) GetByUsernameSearch(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	if api.hiddenBy(w, r, user.ID, username) {
+		return
+	}
+
 	writeJson(w, http.StatusOK, user)
 	setRedisUser(r.Context(), api.database, username, api.rClient)
 }
@@ -160,7 +176,7 @@ func (api *ApiService) UploadProfilPic(w http.ResponseWriter, r *http.Request) {
 
 	currentTimeString := strconv.Itoa(int(currentTime)) + filepath.Ext(fileHeader.Filename)
 
-	destinationFile, err := os.Create("/home/ifeanyi/nkata_storage/profile_storage/" + currentTimeString)
+	destinationFile, err := os.Create(profileStorageDir + currentTimeString)
 
 	if err != nil {
 		internalServer(w, r, err)
@@ -215,7 +231,7 @@ func (api *ApiService) LoadProfilPic(w http.ResponseWriter, r *http.Request) {
 
 	filename := chi.URLParam(r, "img_name")
 	// url := "C:\\Users\\5557\\Desktop\\nkata_uploads\\profile\\" + filename
-	url := "/home/ifeanyi/nkata_storage/profile_storage/"+filename
+	url := profileStorageDir + filename
 	file, err := os.Open(url)
 
 	if err != nil {
@@ -277,164 +293,33 @@ func (api *ApiService) Update(w http.ResponseWriter, r *http.Request) {
 
 }
 
-// AddEmdil
-// @Summary Add email to user. endpoint sends otp
-// @Description Responds with json
-// @Tags User
-// @Param payload body EmailPayload true "valid email"
-// @Produce json
-// @Accept json
-// @Success 200 {object} StandardResponse
-// @Failure 404 {object} errorslope
-// @Failure 400 {object} errorslope
-// @Failure 500 {object} errorslope
-// @Router /v1/user/add-email [post]
-func (api *ApiService) AddEmail(w http.ResponseWriter, r *http.Request) {
-
-	username, err := getUsernameFromCtx(r.Context())
-
-	if err != nil {
-		internalServer(w, r, err)
-		return
-	}
-
-	var emailp EmailPayload
-
-	if err := readJson(w, r, &emailp); err != nil {
-		badRequest(w, r, err)
-		return
-	}
-
-	ctx := r.Context()
-
-	//send email with your smtp provider
-
-	otpToken := rand.Intn(9000000) + 100000
-
-	err = api.database.InsertOtp(ctx, username, emailp.Email, otpPurposeAddEmail, int64(otpToken))
-
-	if err != nil {
-		internalServer(w, r, err)
-		return
-	}
-
-	s := StandardResponse{
-		Status:  http.StatusOK,
-		Message: "otp " + strconv.Itoa(otpToken) + " sent to " + emailp.Email,
-	}
-
-	writeJson(w, http.StatusOK, s)
-
-}
-
-// AddEmailVerify
-// @Summary Send otp sent to email
-// @Description Responds with json
-// @Tags User
-// @Param payload body OtpPayload true "valid otp"
-// @Produce json
-// @Accept json
-// @Success 200 {object} StandardResponse
-// @Failure 404 {object} errorslope
-// @Failure 400 {object} errorslope
-// @Failure 500 {object} errorslope
-// @Router /v1/user/add-email-verify [post]
-func (api *ApiService) AddEmailVerify(w http.ResponseWriter, r *http.Request) {
-
-	username, err := getUsernameFromCtx(r.Context())
-
-	if err != nil {
-		internalServer(w, r, err)
-		return
-	}
-
-	var otpP OtpPayload
-
-	if err := readJson(w, r, &otpP); err != nil {
-		badRequest(w, r, err)
-		return
-	}
-
-	ctx := r.Context()
-
-	otp, err := api.database.GetOtp(ctx, otpP.Otp)
-
-	if err != nil {
-
-		if err.Error() == sql.ErrNoRows.Error() {
-			unauthorized(w, r, errors.New("invalid otp"))
-			return
-		}
-
-		if err.Error() == "sql: Rows are closed" {
-			unauthorized(w, r, errors.New("invalid otp"))
-			return
-		}
-
-		internalServer(w, r, err)
-		return
-	}
-
-	if otp.Purpose != otpPurposeAddEmail {
-		unauthorized(w, r, errors.New("user does not have permission to perform this action"))
-		return
-	}
-
-	if otp.Username != username {
-		unauthorized(w, r, errors.New("user does not have permission to perform this action"))
-		return
-	}
-
-	now := time.Now()
-	exp := otp.Exp;
-	// exp, err := time.Parse(time.RFC1123Z, otp.Exp)
-
-	// if err != nil {
-	// 	internalServer(w, r, err)
-	// 	return
-	// }
-
-	if exp.Before(now) {
-		unauthorized(w, r, errors.New("otp expired"))
-		return
-	}
-
-	err = api.database.UpdateUserEmail(ctx, username, otp.Email)
-	if err != nil {
-		internalServer(w, r, err)
-		return
-	}
-
-	s := StandardResponse{
-		Status:  http.StatusOK,
-		Message: "Email updated succesfully",
-	}
-
-	writeJson(w, http.StatusOK, s)
-
+func redisUserKey(username string) string {
+	return "user:" + username
 }
 
 func setRedisUser(ctx context.Context, database *database.DataRepository, username string, redisClient *redis.Client) {
 	user, err := database.GetByUsername(ctx, username)
 
 	if err != nil {
-		log.Printf(err.Error())
+		log.Print(err)
+		return
 	}
 
 	userJson, err := json.Marshal(user)
 
 	if err != nil {
-		log.Printf(err.Error())
+		log.Print(err)
+		return
 	}
 
-	redisKey := fmt.Sprintf("user:%g", username)
+	redisKey := redisUserKey(username)
 
 	redisClient.SetEx(ctx, redisKey, userJson, time.Minute*4)
 }
 
 func getRedisUser(ctx context.Context, username string, redisClient *redis.Client) (*database.User, error) {
 
-	redisKey := fmt.Sprintf("user:%g", username)
+	redisKey := redisUserKey(username)
 
 	userData, err := redisClient.Get(ctx, redisKey).Result()
 
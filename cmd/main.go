@@ -1,11 +1,19 @@
 package main
 
 import (
+	"crypto/rand"
 	"log"
 
 	"main/cmd/api"
 	"main/database"
 	"main/internal/evn"
+	"main/internal/mailer"
+	"main/internal/oidc"
+	"main/internal/token"
+	"main/internal/webauthn"
+	"os"
+	"strings"
+	"time"
 )
 
 // @title Nkata API
@@ -25,17 +33,153 @@ func main() {
 			MaxOpenConn:  evn.GetInt(20, "MAX_DATABASE_OPEN_CONN"),
 			MaxIdealConn: evn.GetInt(20, "MAX_DATABASE_IDEAL_CONN"),
 			MaxIdealTime: "15m",
+
+			RequireMigrations: evn.GetString("false", "DATABASE_REQUIRE_MIGRATIONS") == "true",
 		},
 		RateLimitConfig: api.RateLimitConfig{
 			MaxRequestPerMin: int64(evn.GetInt(3000, "RateLimitMaxReq")),
+			TrustedProxies:   evn.GetList("TRUSTED_PROXIES"),
 		},
 		RedisConfig: api.RedisConfig{
 			Addre:    "localhost:6379",
 			Password: "",
 			Db:       0,
 		},
+		PushConfig: api.PushConfig{
+			FCMCredentialsFile: evn.GetString("", "FCM_CREDENTIALS_FILE"),
+			APNsKeyFile:        evn.GetString("", "APNS_KEY_FILE"),
+			APNsKeyID:          evn.GetString("", "APNS_KEY_ID"),
+			APNsTeamID:         evn.GetString("", "APNS_TEAM_ID"),
+			APNsTopic:          evn.GetString("", "APNS_TOPIC"),
+			APNsProduction:     evn.GetString("false", "APNS_PRODUCTION") == "true",
+		},
+		MailConfig: api.MailConfig{
+			Driver: evn.GetString("smtp", "MAIL_DRIVER"), // log has to be asked for, it writes codes and links to the logs
+			From:   evn.GetString("Nkata <no-reply@nkata.local>", "MAIL_FROM"),
+			SMTP: mailer.SMTPConfig{
+				Host:       evn.GetString("localhost", "SMTP_HOST"),
+				Port:       evn.GetInt(587, "SMTP_PORT"),
+				Username:   evn.GetString("", "SMTP_USERNAME"),
+				Password:   evn.GetString("", "SMTP_PASSWORD"),
+				RequireTLS: evn.GetString("true", "SMTP_REQUIRE_TLS") == "true",
+			},
+			LogDir:      evn.GetString("", "MAIL_LOG_DIR"),
+			Workers:     evn.GetInt(2, "MAIL_WORKERS"),
+			MaxAttempts: evn.GetInt(5, "MAIL_MAX_ATTEMPTS"),
+		},
+		OtpConfig: api.OtpConfig{
+			HashKey:         otpHashKey(),
+			Ttl:             time.Duration(evn.GetInt(20, "OTP_TTL_MINUTES")) * time.Minute,
+			MaxAttempts:     evn.GetInt(5, "OTP_MAX_ATTEMPTS"),
+			ResendCooldown:  time.Duration(evn.GetInt(60, "OTP_RESEND_COOLDOWN_SECONDS")) * time.Second,
+			CleanupInterval: 10 * time.Minute,
+		},
+		SessionConfig: api.SessionConfig{
+			AccessTokenTtl:  time.Duration(evn.GetInt(15, "ACCESS_TOKEN_TTL_MINUTES")) * time.Minute,
+			RefreshTokenTtl: time.Duration(evn.GetInt(30, "REFRESH_TOKEN_TTL_DAYS")) * 24 * time.Hour,
+		},
+		TokenConfig: token.Config{
+			SigningKeyFile:       evn.GetString("", "JWT_SIGNING_KEY_FILE"),
+			VerificationKeyFiles: evn.GetList("JWT_VERIFICATION_KEY_FILES"),
+			Issuer:               evn.GetString("nkata", "JWT_ISSUER"),
+			Audience:             evn.GetString("nkata-api", "JWT_AUDIENCE"),
+		},
+		MfaConfig: api.MfaConfig{
+			Issuer: evn.GetString("Nkata", "TOTP_ISSUER"),
+			Skew:   evn.GetInt(1, "TOTP_SKEW_STEPS"),
+		},
+		WebAuthnConfig: webauthn.Config{
+			RPID:    evn.GetString("localhost", "WEBAUTHN_RP_ID"),
+			RPName:  evn.GetString("Nkata", "WEBAUTHN_RP_NAME"),
+			Origins: evn.GetList("WEBAUTHN_ORIGINS"),
+		},
+		OidcProviders: oidcProviders(),
+		LockoutConfig: api.LockoutConfig{
+			MaxFailures:     evn.GetInt(10, "SIGNIN_MAX_FAILURES"),
+			MaxIpFailures:   evn.GetInt(100, "SIGNIN_MAX_IP_FAILURES"),
+			BaseDelay:       time.Second,
+			MaxDelay:        time.Duration(evn.GetInt(60, "SIGNIN_MAX_BACKOFF_SECONDS")) * time.Second,
+			LockoutDuration: time.Duration(evn.GetInt(15, "SIGNIN_LOCKOUT_MINUTES")) * time.Minute,
+			FailureWindow:   time.Hour,
+		},
+		AccountConfig: api.AccountConfig{
+			DeletionGracePeriod: time.Duration(evn.GetInt(14, "ACCOUNT_DELETION_GRACE_DAYS")) * 24 * time.Hour,
+			PurgeInterval:       time.Hour,
+
+			UsernameChangeInterval: time.Duration(evn.GetInt(30, "USERNAME_CHANGE_INTERVAL_DAYS")) * 24 * time.Hour,
+			UsernameReservation:    time.Duration(evn.GetInt(90, "USERNAME_RESERVATION_DAYS")) * 24 * time.Hour,
+			EmailRevertWindow:      time.Duration(evn.GetInt(7, "EMAIL_REVERT_DAYS")) * 24 * time.Hour,
+		},
+		ExportConfig: api.ExportConfig{
+			Dir:           evn.GetString("/home/ifeanyi/nkata_storage/exports", "EXPORT_DIR"),
+			LinkTtl:       time.Duration(evn.GetInt(48, "EXPORT_LINK_TTL_HOURS")) * time.Hour,
+			PublicBaseUrl: evn.GetString("http://localhost:5557", "PUBLIC_BASE_URL"),
+		},
+		GroupConfig: api.GroupConfig{
+			MaxMembers: evn.GetInt(1024, "GROUP_MAX_MEMBERS"),
+		},
+	}
+
+	if len(os.Args) > 1 {
+
+		switch os.Args[1] {
+		case "create-admin":
+			createAdmin(config.DatabaseConfig, os.Args[2:])
+		case "migrate":
+			runMigrations(config.DatabaseConfig, os.Args[2:])
+		default:
+			log.Fatal("unknown command " + os.Args[1] + ", available: create-admin, migrate")
+		}
+
+		return
 	}
 
 	api.IntiApi(&config)
 
 }
+
+// without OTP_HASH_KEY a random key is used, which invalidates outstanding otps on restart
+// and does not work with more than one server instance
+func otpHashKey() []byte {
+
+	key := evn.GetString("", "OTP_HASH_KEY")
+
+	if key != "" {
+		return []byte(key)
+	}
+
+	log.Print("OTP_HASH_KEY not set using a random key for this process")
+
+	random := make([]byte, 32)
+
+	if _, err := rand.Read(random); err != nil {
+		log.Fatal(err)
+	}
+
+	return random
+}
+
+// OIDC_PROVIDERS=google,github then OIDC_GOOGLE_ISSUER, OIDC_GOOGLE_CLIENT_ID, ... per provider
+func oidcProviders() []oidc.ProviderConfig {
+
+	var providers []oidc.ProviderConfig
+
+	redirectBase := evn.GetString("http://localhost:5557", "OIDC_REDIRECT_BASE_URL")
+
+	for _, name := range evn.GetList("OIDC_PROVIDERS") {
+
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+
+		providers = append(providers, oidc.ProviderConfig{
+			Name:         name,
+			Type:         evn.GetString(oidc.TypeOIDC, prefix+"TYPE"),
+			Issuer:       evn.GetString("", prefix+"ISSUER"),
+			ClientID:     evn.GetString("", prefix+"CLIENT_ID"),
+			ClientSecret: evn.GetString("", prefix+"CLIENT_SECRET"),
+			Scopes:       evn.GetList(prefix + "SCOPES"),
+			RedirectURL:  redirectBase + "/v1/auth/oidc/" + name + "/callback",
+		})
+	}
+
+	return providers
+}
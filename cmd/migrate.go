@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"main/database"
+	"main/internal/migrate"
+	"os"
+	"time"
+)
+
+const migrateUsage = `usage:
+  nkata migrate up                    apply every pending migration
+  nkata migrate down [-steps 1]       revert the newest applied migrations
+  nkata migrate status                list migrations and when they were applied
+  nkata migrate create [-dir dir] name  add empty up and down files for the next version`
+
+// runMigrations runs the schema migrations built into the binary, see database/migrations
+func runMigrations(databaseConfig database.DatabaseConfig, args []string) {
+
+	if len(args) == 0 {
+		log.Fatal(migrateUsage)
+	}
+
+	command, args := args[0], args[1:]
+
+	// create only touches files, it needs no database
+	if command == "create" {
+
+		flags := flag.NewFlagSet("migrate create", flag.ExitOnError)
+		dir := flags.String("dir", database.MigrationsDir, "directory holding the migration files")
+		flags.Parse(args)
+
+		if flags.NArg() != 1 {
+			log.Fatal(migrateUsage)
+		}
+
+		up, down, err := migrate.Create(*dir, flags.Arg(0))
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Print("created " + up + " and " + down)
+		return
+	}
+
+	db, err := database.ConnectDatabase(databaseConfig)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer db.Close()
+
+	migrator, err := database.NewMigrator(db)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	switch command {
+	case "up":
+
+		applied, err := migrator.Up(ctx)
+
+		for _, m := range applied {
+			log.Printf("applied %04d_%s", m.Version, m.Name)
+		}
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if len(applied) == 0 {
+			log.Print("no pending migrations")
+		}
+
+	case "down":
+
+		flags := flag.NewFlagSet("migrate down", flag.ExitOnError)
+		steps := flags.Int("steps", 1, "number of migrations to revert")
+		flags.Parse(args)
+
+		if *steps < 1 {
+			log.Fatal("migrate down: -steps must be at least 1")
+		}
+
+		reverted, err := migrator.Down(ctx, *steps)
+
+		for _, m := range reverted {
+			log.Printf("reverted %04d_%s", m.Version, m.Name)
+		}
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if len(reverted) == 0 {
+			log.Print("no applied migrations")
+		}
+
+	case "status":
+
+		status, err := migrator.Status(ctx)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, s := range status {
+
+			state := "pending"
+
+			if s.AppliedAt != nil {
+				state = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+
+			if s.Unknown {
+				state += " (not in this binary)"
+			}
+
+			fmt.Fprintf(os.Stdout, "%04d_%-40s %s\n", s.Version, s.Name, state)
+		}
+
+	default:
+		log.Fatal(migrateUsage)
+	}
+}
@@ -0,0 +1,397 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// DeletedUsername replaces the sender of messages and the friend on chats of purged accounts.
+// It is longer than the 10 characters sign-up allows so it never belongs to a real account.
+const DeletedUsername = "deleted user"
+
+func (d *DataRepository) ScheduleAccountDeletion(ctx context.Context, username string, deleteAfter time.Time) error {
+
+	query := `UPDATE users SET delete_after = $1, modified_at = NOW() WHERE username = $2`
+
+	_, err := d.db.ExecContext(ctx, query, deleteAfter, username)
+
+	return err
+}
+
+// CancelAccountDeletion reports whether a pending deletion was cancelled
+func (d *DataRepository) CancelAccountDeletion(ctx context.Context, username string) (bool, error) {
+
+	query := `UPDATE users SET delete_after = NULL, modified_at = NOW() WHERE username = $1 AND delete_after IS NOT NULL`
+
+	result, err := d.db.ExecContext(ctx, query, username)
+
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+
+	return affected > 0, err
+}
+
+func (d *DataRepository) GetAccountsDueForDeletion(ctx context.Context, limit int) ([]string, error) {
+
+	query := `SELECT username FROM users WHERE delete_after <= NOW() ORDER BY delete_after LIMIT $1`
+
+	rows, err := d.db.QueryContext(ctx, query, limit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var usernames []string
+
+	for rows.Next() {
+
+		var username string
+
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+
+		usernames = append(usernames, username)
+	}
+
+	return usernames, rows.Err()
+}
+
+// handOverGroups makes sure no group the user owns is left without an owner when they leave, and
+// returns the groups that were deleted because the user was their last member
+func handOverGroups(ctx context.Context, tx *sql.Tx, userId int64) ([]DeletedGroup, error) {
+
+	rows, err := tx.QueryContext(ctx, `SELECT group_id FROM group_member WHERE user_id = $1 AND role = 'owner'`, userId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var groupIds []int64
+
+	for rows.Next() {
+
+		var groupId int64
+
+		if err := rows.Scan(&groupId); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		groupIds = append(groupIds, groupId)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var deleted []DeletedGroup
+
+	for _, groupId := range groupIds {
+
+		group, err := handOverGroup(ctx, tx, groupId, userId)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if group != nil {
+			deleted = append(deleted, *group)
+		}
+	}
+
+	return deleted, nil
+}
+
+// PurgeUser removes the account and everything tied to it in one transaction and returns the
+// profile picture url and the groups that went with the user so the caller can remove the files.
+// Messages the user sent stay in their chats under DeletedUsername, the foreign keys on users.id
+// take care of chats, friend requests and group memberships. Returns sql.ErrNoRows when the
+// deletion is no longer due, for example because the user signed in again.
+func (d *DataRepository) PurgeUser(ctx context.Context, username string) (string, []DeletedGroup, error) {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	defer tx.Rollback()
+
+	var userId int64
+	var imageUrl sql.NullString
+
+	err = tx.QueryRowContext(ctx, `SELECT id,image_url FROM users WHERE username = $1 AND delete_after <= NOW() FOR UPDATE`, username).Scan(&userId, &imageUrl)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	groups, err := handOverGroups(ctx, tx, userId)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	communityGroups, err := handOverCommunities(ctx, tx, userId)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	groups = append(groups, communityGroups...)
+
+	if err := handOverChannels(ctx, tx, userId); err != nil {
+		return "", nil, err
+	}
+
+	// the counts of the groups and friends the user leaves behind, the rows go with the user
+	counts := []string{
+		`UPDATE groupu SET member_count = member_count - 1 WHERE id IN (SELECT group_id FROM group_member WHERE user_id = $1)`,
+		`UPDATE users SET friends_count = friends_count - 1 WHERE id IN (SELECT friend_user_id FROM friendship WHERE user_id = $1 AND friendship_type = 'one-on-one')`,
+	}
+
+	for _, statement := range counts {
+		if _, err := tx.ExecContext(ctx, statement, userId); err != nil {
+			return "", nil, err
+		}
+	}
+
+	statements := []string{
+		`DELETE FROM otp WHERE username = $1`,
+		`DELETE FROM device_token WHERE username = $1`,
+		`DELETE FROM session WHERE username = $1`,
+		`DELETE FROM recovery_code WHERE username = $1`,
+		`DELETE FROM webauthn_credential WHERE username = $1`,
+		`DELETE FROM user_identity WHERE username = $1`,
+		`DELETE FROM users WHERE username = $1`,
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement, username); err != nil {
+			return "", nil, err
+		}
+	}
+
+	// history is kept by user id, the reservations of old names go with it
+	for _, statement := range []string{`DELETE FROM username_history WHERE user_id = $1`, `DELETE FROM email_change WHERE user_id = $1`} {
+		if _, err := tx.ExecContext(ctx, statement, userId); err != nil {
+			return "", nil, err
+		}
+	}
+
+	return imageUrl.String, groups, tx.Commit()
+}
+
+var (
+	ErrUsernameTaken      = errors.New("username is taken")
+	ErrUsernameChangeSoon = errors.New("username was changed recently")
+	ErrEmailRevertInvalid = errors.New("revert link is invalid, expired or already used")
+)
+
+// every column that stores a username, updated together when a user renames. Tables that
+// reference users.id are not listed, they follow the rename on their own.
+var usernameColumns = []struct{ table, column string }{
+	{"users", "username"},
+	{"otp", "username"},
+	{"session", "username"},
+	{"device_token", "username"},
+	{"recovery_code", "username"},
+	{"webauthn_credential", "username"},
+	{"user_identity", "username"},
+	{"data_export", "username"},
+}
+
+// ChangeUsername renames the user everywhere in one transaction and reserves the old name until
+// reservedUntil. A user may take back their own reserved names. Returns ErrUsernameChangeSoon when
+// the previous change was after notBefore.
+func (d *DataRepository) ChangeUsername(ctx context.Context, oldUsername, newUsername string, notBefore, reservedUntil time.Time) error {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	var userId int64
+
+	if err := tx.QueryRowContext(ctx, `SELECT id FROM users WHERE username = $1 FOR UPDATE`, oldUsername).Scan(&userId); err != nil {
+		return err
+	}
+
+	var recent bool
+
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM username_history WHERE user_id = $1 AND changed_at > $2)`, userId, notBefore).Scan(&recent)
+
+	if err != nil {
+		return err
+	}
+
+	if recent {
+		return ErrUsernameChangeSoon
+	}
+
+	var taken bool
+
+	query := `SELECT EXISTS(SELECT 1 FROM users WHERE username = $1) OR EXISTS(SELECT 1 FROM username_history WHERE old_username = $1 AND reserved_until > NOW() AND user_id <> $2)`
+
+	if err := tx.QueryRowContext(ctx, query, newUsername, userId).Scan(&taken); err != nil {
+		return err
+	}
+
+	if taken {
+		return ErrUsernameTaken
+	}
+
+	for _, c := range usernameColumns {
+
+		statement := `UPDATE ` + c.table + ` SET ` + c.column + ` = $1 WHERE ` + c.column + ` = $2`
+
+		if _, err := tx.ExecContext(ctx, statement, newUsername, oldUsername); err != nil {
+			if strings.Contains(err.Error(), "users_username_key") {
+				return ErrUsernameTaken
+			}
+			return err
+		}
+	}
+
+	history := `INSERT INTO username_history(user_id,old_username,new_username,reserved_until) VALUES($1,$2,$3,$4)`
+
+	if _, err := tx.ExecContext(ctx, history, userId, oldUsername, newUsername, reservedUntil); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+type UsernameChange struct {
+	OldUsername string    `json:"old_username"`
+	NewUsername string    `json:"new_username"`
+	ChangedAt   time.Time `json:"changed_at"`
+}
+
+func (d *DataRepository) GetUsernameHistory(ctx context.Context, username string) ([]UsernameChange, error) {
+
+	query := `SELECT h.old_username,h.new_username,h.changed_at FROM username_history h JOIN users u ON u.id = h.user_id WHERE u.username = $1 ORDER BY h.changed_at DESC`
+
+	rows, err := d.db.QueryContext(ctx, query, username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	history := []UsernameChange{}
+
+	for rows.Next() {
+
+		var change UsernameChange
+
+		if err := rows.Scan(&change.OldUsername, &change.NewUsername, &change.ChangedAt); err != nil {
+			return nil, err
+		}
+
+		history = append(history, change)
+	}
+
+	return history, rows.Err()
+}
+
+// ChangeUserEmail sets the new address and records the change, with a revert token when there was
+// an old address to send it to. Returns the old address, empty when the user had none.
+func (d *DataRepository) ChangeUserEmail(ctx context.Context, username, newEmail, revertTokenHash string, revertExpiresAt time.Time) (string, error) {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer tx.Rollback()
+
+	var userId int64
+	var oldEmail sql.NullString
+
+	err = tx.QueryRowContext(ctx, `SELECT id,email FROM users WHERE username = $1 FOR UPDATE`, username).Scan(&userId, &oldEmail)
+
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET email = $1, modified_at = NOW() WHERE id = $2`, newEmail, userId); err != nil {
+		return "", err
+	}
+
+	var tokenHash sql.NullString
+	var expiresAt sql.NullTime
+
+	if oldEmail.String != "" {
+		tokenHash = sql.NullString{String: revertTokenHash, Valid: true}
+		expiresAt = sql.NullTime{Time: revertExpiresAt, Valid: true}
+	}
+
+	query := `INSERT INTO email_change(user_id,old_email,new_email,revert_token_hash,revert_expires_at) VALUES($1,$2,$3,$4,$5)`
+
+	if _, err := tx.ExecContext(ctx, query, userId, oldEmail, newEmail, tokenHash, expiresAt); err != nil {
+		return "", err
+	}
+
+	return oldEmail.String, tx.Commit()
+}
+
+// RevertEmailChange puts the old address back if the account still uses the address it was changed
+// to, and returns the username so the caller can sign the account out.
+func (d *DataRepository) RevertEmailChange(ctx context.Context, revertTokenHash string) (string, error) {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer tx.Rollback()
+
+	var id, userId int64
+	var oldEmail, newEmail string
+
+	query := `SELECT id,user_id,old_email,new_email FROM email_change WHERE revert_token_hash = $1 AND reverted_at IS NULL AND revert_expires_at > NOW() FOR UPDATE`
+
+	err = tx.QueryRowContext(ctx, query, revertTokenHash).Scan(&id, &userId, &oldEmail, &newEmail)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrEmailRevertInvalid
+		}
+		return "", err
+	}
+
+	var username string
+
+	err = tx.QueryRowContext(ctx, `UPDATE users SET email = $1, modified_at = NOW() WHERE id = $2 AND email = $3 RETURNING username`, oldEmail, userId, newEmail).Scan(&username)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrEmailRevertInvalid
+		}
+		return "", err
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE email_change SET reverted_at = NOW() WHERE id = $1`, id); err != nil {
+		return "", err
+	}
+
+	return username, tx.Commit()
+}
@@ -0,0 +1,166 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// AdminUser is the account view admins work with, it includes the fields User keeps out of json
+type AdminUser struct {
+	ID          int64  `json:"id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+	Email       string `json:"email"`
+	Role        string `json:"role"`
+	Enabled     bool   `json:"enabled"`
+	TotpEnabled bool   `json:"totp_enabled"`
+	CreatedAt   string `json:"created_at"`
+}
+
+const adminUserColumns = `id,username,COALESCE(display_name,''),COALESCE(email,''),role,enabled,totp_enabled,created_at`
+
+func (r *DataRepository) listAdminUsers(ctx context.Context, where string, args []any, page, limit int64) (*PaginatedResponse, error) {
+
+	var totalCount int
+
+	err := r.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users `+where, args...).Scan(&totalCount)
+
+	if err != nil {
+		return nil, err
+	}
+
+	offset := (page - 1) * limit
+
+	query := `SELECT ` + adminUserColumns + ` FROM users ` + where + ` ORDER BY id LIMIT $` + strconv.Itoa(len(args)+1) + ` OFFSET $` + strconv.Itoa(len(args)+2)
+
+	rows, err := r.db.QueryContext(ctx, query, append(args, limit, offset)...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	users := []AdminUser{}
+
+	for rows.Next() {
+
+		var user AdminUser
+
+		err := rows.Scan(&user.ID, &user.Username, &user.DisplayName, &user.Email, &user.Role, &user.Enabled, &user.TotpEnabled, &user.CreatedAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &PaginatedResponse{
+		Data:       users,
+		TotalCount: totalCount,
+		Page:       int(page),
+		Limit:      int(limit),
+	}, nil
+}
+
+func (r *DataRepository) ListUsers(ctx context.Context, page, limit int64) (*PaginatedResponse, error) {
+	return r.listAdminUsers(ctx, "", nil, page, limit)
+}
+
+// SearchUsers matches the term anywhere in the username, display name or email
+func (r *DataRepository) SearchUsers(ctx context.Context, term string, page, limit int64) (*PaginatedResponse, error) {
+
+	where := `WHERE username ILIKE $1 OR display_name ILIKE $1 OR email ILIKE $1`
+
+	return r.listAdminUsers(ctx, where, []any{"%" + term + "%"}, page, limit)
+}
+
+func (r *DataRepository) GetAdminUser(ctx context.Context, username string) (*AdminUser, error) {
+
+	query := `SELECT ` + adminUserColumns + ` FROM users WHERE username = $1`
+
+	var user AdminUser
+
+	err := r.db.QueryRowContext(ctx, query, username).Scan(&user.ID, &user.Username, &user.DisplayName, &user.Email, &user.Role, &user.Enabled, &user.TotpEnabled, &user.CreatedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+type UserAccess struct {
+	ID      int64
+	Role    Role
+	Enabled bool
+}
+
+// GetUserAccess is the per request lookup behind HandleJWTAuth
+func (r *DataRepository) GetUserAccess(ctx context.Context, username string) (*UserAccess, error) {
+
+	var access UserAccess
+	var role string
+
+	err := r.db.QueryRowContext(ctx, `SELECT id,role,enabled FROM users WHERE username = $1`, username).Scan(&access.ID, &role, &access.Enabled)
+
+	if err != nil {
+		return nil, err
+	}
+
+	access.Role, err = ParseRole(role)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &access, nil
+}
+
+func (r *DataRepository) SetUserEnabled(ctx context.Context, username string, enabled bool) (bool, error) {
+
+	result, err := r.db.ExecContext(ctx, `UPDATE users SET enabled = $1, modified_at = NOW() WHERE username = $2`, enabled, username)
+
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+
+	return affected > 0, err
+}
+
+func (r *DataRepository) SetUserRole(ctx context.Context, username string, role Role) (bool, error) {
+
+	result, err := r.db.ExecContext(ctx, `UPDATE users SET role = $1, modified_at = NOW() WHERE username = $2`, role.String(), username)
+
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+
+	return affected > 0, err
+}
+
+// SetUserPasswordByUsername is UpdateUserPassword for accounts that may have no email
+func (r *DataRepository) SetUserPasswordByUsername(ctx context.Context, username, password string) error {
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+
+	if err != nil {
+		return errors.New("error hashing user password")
+	}
+
+	_, err = r.db.ExecContext(ctx, `UPDATE users SET password = $1, modified_at = NOW() WHERE username = $2`, string(hashedPassword), username)
+
+	return err
+}
@@ -0,0 +1,181 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// every check for blocks goes through the helpers in this file, the rest of the code only asks
+// whether one user may reach another
+
+var (
+	ErrUserBlocked    = errors.New("this user is not available")
+	ErrAlreadyBlocked = errors.New("you already blocked this user")
+	ErrNotBlocked     = errors.New("you have not blocked this user")
+
+	ErrNotChatParticipant = errors.New("you are not part of this chat")
+)
+
+type BlockedUser struct {
+	Username    string    `json:"username"`
+	DisplayName string    `json:"display_name"`
+	ImageUrl    string    `json:"image_url"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// blocks reports whether blockerId blocked blockedId
+func blocks(ctx context.Context, db rowQueryer, blockerId, blockedId int64) (bool, error) {
+
+	query := `SELECT EXISTS (SELECT 1 FROM user_block WHERE blocker_id = $1 AND blocked_id = $2)`
+
+	var blocked bool
+
+	err := db.QueryRowContext(ctx, query, blockerId, blockedId).Scan(&blocked)
+
+	return blocked, err
+}
+
+// blockedBetween reports whether either user blocked the other
+func blockedBetween(ctx context.Context, db rowQueryer, userId, otherId int64) (bool, error) {
+
+	query := `SELECT EXISTS (SELECT 1 FROM user_block WHERE (blocker_id = $1 AND blocked_id = $2) OR (blocker_id = $2 AND blocked_id = $1))`
+
+	var blocked bool
+
+	err := db.QueryRowContext(ctx, query, userId, otherId).Scan(&blocked)
+
+	return blocked, err
+}
+
+func (d *DataRepository) HasBlocked(ctx context.Context, blockerId, blockedId int64) (bool, error) {
+	return blocks(ctx, d.db, blockerId, blockedId)
+}
+
+// CheckChatAccess is whether userId may send to the one-on-one chat friendshipId: it has to be one of
+// their chats, ErrNotChatParticipant otherwise, and neither of the two may have blocked the other,
+// ErrUserBlocked otherwise. Group chats are checked against the group instead.
+func (d *DataRepository) CheckChatAccess(ctx context.Context, userId int64, friendshipId string) error {
+
+	query := `SELECT friend_user_id FROM friendship WHERE friendship_id = $1 AND user_id = $2 AND friendship_type = 'one-on-one'`
+
+	var friendId sql.NullInt64
+
+	if err := d.db.QueryRowContext(ctx, query, friendshipId, userId).Scan(&friendId); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrNotChatParticipant
+		}
+		return err
+	}
+
+	// the other side deleted their account, there is nobody left to block
+	if !friendId.Valid {
+		return nil
+	}
+
+	blocked, err := blockedBetween(ctx, d.db, userId, friendId.Int64)
+
+	if err != nil {
+		return err
+	}
+
+	if blocked {
+		return ErrUserBlocked
+	}
+
+	return nil
+}
+
+// BlockUser blocks blockedId for blockerId and drops the pending friend requests between them. The
+// chat stays, no new messages go through it until the block is lifted.
+func (d *DataRepository) BlockUser(ctx context.Context, blockerId, blockedId int64) error {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := `INSERT INTO user_block(blocker_id,blocked_id) VALUES($1,$2) ON CONFLICT (blocker_id,blocked_id) DO NOTHING`
+
+	result, err := tx.ExecContext(ctx, query, blockerId, blockedId)
+
+	if err != nil {
+		return err
+	}
+
+	if inserted, _ := result.RowsAffected(); inserted == 0 {
+		return ErrAlreadyBlocked
+	}
+
+	query = `DELETE FROM friendRequest WHERE status = 'pending' AND ((sent_by_id = $1 AND sent_to_id = $2) OR (sent_by_id = $2 AND sent_to_id = $1))`
+
+	if _, err := tx.ExecContext(ctx, query, blockerId, blockedId); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (d *DataRepository) UnblockUser(ctx context.Context, blockerId, blockedId int64) error {
+
+	result, err := d.db.ExecContext(ctx, `DELETE FROM user_block WHERE blocker_id = $1 AND blocked_id = $2`, blockerId, blockedId)
+
+	if err != nil {
+		return err
+	}
+
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return ErrNotBlocked
+	}
+
+	return nil
+}
+
+// GetBlockedUsers lists who userId blocked, most recent first
+func (d *DataRepository) GetBlockedUsers(ctx context.Context, userId, limit, page int64) (*PaginatedResponse, error) {
+
+	offset := (page - 1) * limit
+
+	var totalCount int64
+
+	if err := d.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM user_block WHERE blocker_id = $1`, userId).Scan(&totalCount); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT u.username,COALESCE(u.display_name,''),COALESCE(u.image_url,''),b.created_at FROM user_block b
+JOIN users u ON u.id = b.blocked_id WHERE b.blocker_id = $1 ORDER BY b.created_at DESC, u.id LIMIT $2 OFFSET $3`
+
+	rows, err := d.db.QueryContext(ctx, query, userId, limit, offset)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	blocked := []BlockedUser{}
+
+	for rows.Next() {
+
+		var user BlockedUser
+
+		if err := rows.Scan(&user.Username, &user.DisplayName, &user.ImageUrl, &user.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		blocked = append(blocked, user)
+	}
+
+	p := PaginatedResponse{
+		Data:       blocked,
+		TotalCount: int(totalCount),
+		Page:       int(page),
+		Limit:      int(limit),
+	}
+
+	return &p, rows.Err()
+}
@@ -0,0 +1,475 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ChannelChatPrefix marks the chat id of a channel's posts in message, "channel:<id>"
+const ChannelChatPrefix = "channel:"
+
+func ChannelChatId(channelId int64) string {
+	return ChannelChatPrefix + strconv.FormatInt(channelId, 10)
+}
+
+type ChannelRole string
+
+const (
+	ChannelRoleSubscriber ChannelRole = "subscriber"
+	ChannelRoleAdmin      ChannelRole = "admin" // may post
+	ChannelRoleOwner      ChannelRole = "owner" // exactly one per channel
+)
+
+var (
+	ErrChannelHandleTaken = errors.New("channel handle is taken")
+	ErrAlreadySubscribed  = errors.New("already subscribed to this channel")
+	ErrNotSubscribed      = errors.New("not subscribed to this channel")
+	ErrChannelOwnerLeave  = errors.New("the owner cannot unsubscribe, delete the channel instead")
+)
+
+type Channel struct {
+	ID              int64       `json:"id"`
+	Handle          string      `json:"handle,omitempty"`
+	Name            string      `json:"name"`
+	Description     string      `json:"description"`
+	IsPublic        bool        `json:"is_public"`
+	SubscriberCount int64       `json:"subscriber_count"`
+	Role            ChannelRole `json:"role,omitempty"` // of the signed in user, empty when not subscribed
+	CreatedAt       string      `json:"created_at"`
+	ModifiedAt      string      `json:"modified_at"`
+}
+
+// Visible reports whether the user the channel was loaded for may see it. Private channels are
+// only there for their subscribers, ids are sequential and easy to guess.
+func (c *Channel) Visible() bool {
+	return c.IsPublic || c.Role != ""
+}
+
+type ChannelSubscriber struct {
+	UserID    int64       `json:"-"`
+	Username  string      `json:"username"`
+	Role      ChannelRole `json:"role"`
+	CreatedAt string      `json:"created_at"`
+}
+
+// $1 is the signed in user, their role comes back empty when they are not subscribed
+const selectChannel = `SELECT c.id,COALESCE(c.handle,''),c.name,c.description,c.is_public,c.subscriber_count,COALESCE(s.role,''),c.created_at,c.modified_at
+FROM channel c LEFT JOIN channel_subscriber s ON s.channel_id = c.id AND s.user_id = $1`
+
+func scanChannel(row rowScanner) (*Channel, error) {
+
+	var channel Channel
+
+	err := row.Scan(&channel.ID, &channel.Handle, &channel.Name, &channel.Description, &channel.IsPublic, &channel.SubscriberCount, &channel.Role, &channel.CreatedAt, &channel.ModifiedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &channel, nil
+}
+
+func channelHandleErr(err error) error {
+
+	if err != nil && strings.Contains(err.Error(), "channel_handle_key") {
+		return ErrChannelHandleTaken
+	}
+
+	return err
+}
+
+// InsertChannel creates the channel with ownerId as its owner and first subscriber, an empty handle
+// leaves the channel without one
+func (d *DataRepository) InsertChannel(ctx context.Context, ownerId int64, name, handle, description string, public bool) (int64, error) {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback()
+
+	query := `INSERT INTO channel(name,handle,description,is_public,subscriber_count) VALUES($1,NULLIF($2,''),$3,$4,1) RETURNING id`
+
+	var id int64
+
+	if err := tx.QueryRowContext(ctx, query, name, handle, description, public).Scan(&id); err != nil {
+		return 0, channelHandleErr(err)
+	}
+
+	query = `INSERT INTO channel_subscriber(channel_id,user_id,role) VALUES($1,$2,$3)`
+
+	if _, err := tx.ExecContext(ctx, query, id, ownerId, ChannelRoleOwner); err != nil {
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+// GetChannel returns the channel as seen by userId, whether they may see it is up to the caller, see
+// Channel.Visible
+func (d *DataRepository) GetChannel(ctx context.Context, userId, channelId int64) (*Channel, error) {
+	return scanChannel(d.db.QueryRowContext(ctx, selectChannel+` WHERE c.id = $2`, userId, channelId))
+}
+
+// GetPublicChannelByHandle is how channels are discovered, private channels are never found here
+func (d *DataRepository) GetPublicChannelByHandle(ctx context.Context, userId int64, handle string) (*Channel, error) {
+	return scanChannel(d.db.QueryRowContext(ctx, selectChannel+` WHERE c.handle = $2 AND c.is_public`, userId, strings.ToLower(handle)))
+}
+
+// UpdateChannel changes the fields that are not nil
+func (d *DataRepository) UpdateChannel(ctx context.Context, channelId int64, name, handle, description *string, public *bool) error {
+
+	query := `UPDATE channel SET name = COALESCE($1,name), handle = CASE WHEN $2::VARCHAR IS NULL THEN handle ELSE NULLIF($2,'') END,
+description = COALESCE($3,description), is_public = COALESCE($4,is_public), modified_at = NOW() WHERE id = $5`
+
+	_, err := d.db.ExecContext(ctx, query, name, handle, description, public, channelId)
+
+	return channelHandleErr(err)
+}
+
+// DeleteChannel removes the channel with its posts and subscriptions
+func (d *DataRepository) DeleteChannel(ctx context.Context, channelId int64) error {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := deleteChannel(ctx, tx, channelId); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func deleteChannel(ctx context.Context, tx *sql.Tx, channelId int64) error {
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM message WHERE friendship_id = $1`, ChannelChatId(channelId)); err != nil {
+		return err
+	}
+
+	_, err := tx.ExecContext(ctx, `DELETE FROM channel WHERE id = $1`, channelId)
+
+	return err
+}
+
+// Subscribe keeps subscriber_count in step with the subscriber rows
+func (d *DataRepository) Subscribe(ctx context.Context, userId, channelId int64) error {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := insertChannelSubscriber(ctx, tx, channelId, userId); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// AddChannelSubscriber is how people get into a private channel, an admin adds them. It refuses with
+// ErrUserBlocked when the user blocked the actor.
+func (d *DataRepository) AddChannelSubscriber(ctx context.Context, channelId, userId, actorId int64) error {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	blocked, err := blocks(ctx, tx, userId, actorId)
+
+	if err != nil {
+		return err
+	}
+
+	if blocked {
+		return ErrUserBlocked
+	}
+
+	if err := insertChannelSubscriber(ctx, tx, channelId, userId); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func insertChannelSubscriber(ctx context.Context, tx *sql.Tx, channelId, userId int64) error {
+
+	query := `INSERT INTO channel_subscriber(channel_id,user_id) VALUES($1,$2) ON CONFLICT (channel_id,user_id) DO NOTHING`
+
+	result, err := tx.ExecContext(ctx, query, channelId, userId)
+
+	if err != nil {
+		return err
+	}
+
+	if inserted, _ := result.RowsAffected(); inserted == 0 {
+		return ErrAlreadySubscribed
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE channel SET subscriber_count = subscriber_count + 1 WHERE id = $1`, channelId)
+
+	return err
+}
+
+func (d *DataRepository) Unsubscribe(ctx context.Context, userId, channelId int64) error {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := `DELETE FROM channel_subscriber WHERE channel_id = $1 AND user_id = $2 AND role <> 'owner'`
+
+	result, err := tx.ExecContext(ctx, query, channelId, userId)
+
+	if err != nil {
+		return err
+	}
+
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+
+		var isOwner bool
+
+		query = `SELECT EXISTS (SELECT 1 FROM channel_subscriber WHERE channel_id = $1 AND user_id = $2)`
+
+		if err := tx.QueryRowContext(ctx, query, channelId, userId).Scan(&isOwner); err != nil {
+			return err
+		}
+
+		if isOwner {
+			return ErrChannelOwnerLeave
+		}
+
+		return ErrNotSubscribed
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE channel SET subscriber_count = subscriber_count - 1 WHERE id = $1`, channelId); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetChannelAdmin makes a subscriber an admin or back, the owner is never changed here
+func (d *DataRepository) SetChannelAdmin(ctx context.Context, userId, channelId int64, admin bool) error {
+
+	role := ChannelRoleSubscriber
+
+	if admin {
+		role = ChannelRoleAdmin
+	}
+
+	query := `UPDATE channel_subscriber SET role = $1 WHERE channel_id = $2 AND user_id = $3 AND role <> 'owner'`
+
+	result, err := d.db.ExecContext(ctx, query, role, channelId, userId)
+
+	if err != nil {
+		return err
+	}
+
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return ErrNotSubscribed
+	}
+
+	return nil
+}
+
+// GetSubscribedChannels lists the channels userId follows, most recently subscribed first
+func (d *DataRepository) GetSubscribedChannels(ctx context.Context, userId, limit, page int64) (*PaginatedResponse, error) {
+
+	offset := (page - 1) * limit
+
+	var totalCount int64
+
+	if err := d.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM channel_subscriber WHERE user_id = $1`, userId).Scan(&totalCount); err != nil {
+		return nil, err
+	}
+
+	query := selectChannel + ` WHERE s.user_id IS NOT NULL ORDER BY s.created_at DESC, c.id LIMIT $2 OFFSET $3`
+
+	rows, err := d.db.QueryContext(ctx, query, userId, limit, offset)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	channels := []Channel{}
+
+	for rows.Next() {
+
+		channel, err := scanChannel(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		channels = append(channels, *channel)
+	}
+
+	p := PaginatedResponse{
+		Data:       channels,
+		TotalCount: int(totalCount),
+		Page:       int(page),
+		Limit:      int(limit),
+	}
+
+	return &p, rows.Err()
+}
+
+func (d *DataRepository) GetChannelSubscribers(ctx context.Context, channelId, limit, page int64) (*PaginatedResponse, error) {
+
+	offset := (page - 1) * limit
+
+	var totalCount int64
+
+	if err := d.db.QueryRowContext(ctx, `SELECT subscriber_count FROM channel WHERE id = $1`, channelId).Scan(&totalCount); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT s.user_id,u.username,s.role,s.created_at FROM channel_subscriber s JOIN users u ON u.id = s.user_id
+WHERE s.channel_id = $1 ORDER BY s.created_at, s.user_id LIMIT $2 OFFSET $3`
+
+	rows, err := d.db.QueryContext(ctx, query, channelId, limit, offset)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	subscribers := []ChannelSubscriber{}
+
+	for rows.Next() {
+
+		var subscriber ChannelSubscriber
+
+		if err := rows.Scan(&subscriber.UserID, &subscriber.Username, &subscriber.Role, &subscriber.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		subscribers = append(subscribers, subscriber)
+	}
+
+	p := PaginatedResponse{
+		Data:       subscribers,
+		TotalCount: int(totalCount),
+		Page:       int(page),
+		Limit:      int(limit),
+	}
+
+	return &p, rows.Err()
+}
+
+// GetChannelSubscriberBatch pages through the usernames of a channel by user id for fan-out,
+// pass the last id of the previous batch as afterId, 0 for the first. Keyset paging stays
+// cheap however far into a large channel it gets.
+func (d *DataRepository) GetChannelSubscriberBatch(ctx context.Context, channelId, afterId int64, size int) ([]ChannelSubscriber, error) {
+
+	query := `SELECT s.user_id,u.username FROM channel_subscriber s JOIN users u ON u.id = s.user_id
+WHERE s.channel_id = $1 AND s.user_id > $2 ORDER BY s.user_id LIMIT $3`
+
+	rows, err := d.db.QueryContext(ctx, query, channelId, afterId, size)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var batch []ChannelSubscriber
+
+	for rows.Next() {
+
+		var subscriber ChannelSubscriber
+
+		if err := rows.Scan(&subscriber.UserID, &subscriber.Username); err != nil {
+			return nil, err
+		}
+
+		batch = append(batch, subscriber)
+	}
+
+	return batch, rows.Err()
+}
+
+// handOverChannels runs when a user is deleted: their subscriptions stop counting and every channel
+// they own passes to its longest standing admin, then subscriber, or is deleted when nobody is left
+func handOverChannels(ctx context.Context, tx *sql.Tx, userId int64) error {
+
+	query := `UPDATE channel SET subscriber_count = subscriber_count - 1 WHERE id IN (SELECT channel_id FROM channel_subscriber WHERE user_id = $1)`
+
+	if _, err := tx.ExecContext(ctx, query, userId); err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT channel_id FROM channel_subscriber WHERE user_id = $1 AND role = 'owner'`, userId)
+
+	if err != nil {
+		return err
+	}
+
+	var channelIds []int64
+
+	for rows.Next() {
+
+		var channelId int64
+
+		if err := rows.Scan(&channelId); err != nil {
+			rows.Close()
+			return err
+		}
+
+		channelIds = append(channelIds, channelId)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, channelId := range channelIds {
+
+		if _, err := tx.ExecContext(ctx, `DELETE FROM channel_subscriber WHERE channel_id = $1 AND user_id = $2`, channelId, userId); err != nil {
+			return err
+		}
+
+		promote := `UPDATE channel_subscriber SET role = 'owner' WHERE channel_id = $1 AND user_id = (
+SELECT user_id FROM channel_subscriber WHERE channel_id = $1 ORDER BY CASE role WHEN 'admin' THEN 0 ELSE 1 END, created_at, user_id LIMIT 1)`
+
+		result, err := tx.ExecContext(ctx, promote, channelId)
+
+		if err != nil {
+			return err
+		}
+
+		if promoted, _ := result.RowsAffected(); promoted == 0 {
+			if err := deleteChannel(ctx, tx, channelId); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,30 @@
+package database
+
+import "testing"
+
+func TestChannelVisible(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		public  bool
+		role    ChannelRole
+		visible bool
+	}{
+		{name: "public to anyone", public: true, visible: true},
+		{name: "public to a subscriber", public: true, role: ChannelRoleSubscriber, visible: true},
+		{name: "private to anyone", public: false, visible: false},
+		{name: "private to a subscriber", public: false, role: ChannelRoleSubscriber, visible: true},
+		{name: "private to the owner", public: false, role: ChannelRoleOwner, visible: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			channel := Channel{IsPublic: tt.public, Role: tt.role}
+
+			if got := channel.Visible(); got != tt.visible {
+				t.Errorf("Visible() = %v, want %v", got, tt.visible)
+			}
+		})
+	}
+}
@@ -0,0 +1,711 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type CommunityRole string
+
+const (
+	CommunityRoleMember CommunityRole = "member"
+	CommunityRoleAdmin  CommunityRole = "admin" // manages members and groups
+	CommunityRoleOwner  CommunityRole = "owner" // exactly one per community
+)
+
+var communityRoleRank = map[CommunityRole]int{
+	CommunityRoleMember: 0,
+	CommunityRoleAdmin:  1,
+	CommunityRoleOwner:  2,
+}
+
+func (r CommunityRole) AtLeast(other CommunityRole) bool {
+	return communityRoleRank[r] >= communityRoleRank[other]
+}
+
+func (r CommunityRole) Outranks(other CommunityRole) bool {
+	return communityRoleRank[r] > communityRoleRank[other]
+}
+
+var (
+	ErrNotCommunityMember     = errors.New("only members of the community can join its groups")
+	ErrAlreadyCommunityMember = errors.New("already a member of this community")
+)
+
+type Community struct {
+	ID                  int64         `json:"id"`
+	Name                string        `json:"name"`
+	Description         string        `json:"description"`
+	AnnouncementGroupID int64         `json:"announcement_group_id,omitempty"` // 0 once that group was deleted
+	MemberCount         int64         `json:"member_count"`
+	Role                CommunityRole `json:"role,omitempty"` // of the signed in user, empty when not a member
+	CreatedAt           string        `json:"created_at"`
+	ModifiedAt          string        `json:"modified_at"`
+}
+
+type CommunityMember struct {
+	CommunityID int64         `json:"community_id"`
+	UserID      int64         `json:"-"`
+	Username    string        `json:"username"`
+	Role        CommunityRole `json:"role"`
+	CreatedAt   time.Time     `json:"created_at"`
+}
+
+// CommunityGroup is a group as listed to the members of its community
+type CommunityGroup struct {
+	ID             int64        `json:"id"`
+	Name           string       `json:"name"`
+	PicUrl         string       `json:"pic_url"`
+	Description    string       `json:"description"`
+	Privacy        GroupPrivacy `json:"privacy"`
+	MemberCount    int64        `json:"member_count"`
+	IsMember       bool         `json:"is_member"`
+	IsAnnouncement bool         `json:"is_announcement"`
+}
+
+// communityAdmits reports whether the user may enter the group: always for groups outside a
+// community, otherwise only when they are a member of its community
+func communityAdmits(ctx context.Context, db rowQueryer, userId, groupId int64) (bool, error) {
+
+	query := `SELECT NOT EXISTS (SELECT 1 FROM groupu g WHERE g.id = $1 AND g.community_id IS NOT NULL
+AND NOT EXISTS (SELECT 1 FROM community_member m WHERE m.community_id = g.community_id AND m.user_id = $2))`
+
+	var admitted bool
+
+	err := db.QueryRowContext(ctx, query, groupId, userId).Scan(&admitted)
+
+	return admitted, err
+}
+
+// CanSeeGroup reports whether the user may see the group. Groups outside a community are open to
+// everyone, a community group to its own members and, unless it is invite only, to the members of
+// its community, the same groups GetCommunityGroups lists.
+func (d *DataRepository) CanSeeGroup(ctx context.Context, userId, groupId int64) (bool, error) {
+
+	query := `SELECT NOT EXISTS (SELECT 1 FROM groupu g WHERE g.id = $1 AND g.community_id IS NOT NULL
+AND NOT EXISTS (SELECT 1 FROM group_member gm WHERE gm.group_id = g.id AND gm.user_id = $2)
+AND (g.privacy = 'invite_only' OR NOT EXISTS (SELECT 1 FROM community_member m WHERE m.community_id = g.community_id AND m.user_id = $2)))`
+
+	var visible bool
+
+	err := d.db.QueryRowContext(ctx, query, groupId, userId).Scan(&visible)
+
+	return visible, err
+}
+
+// insertCommunityGroup creates a group in the community with ownerId as its owner
+func (d *DataRepository) insertCommunityGroup(ctx context.Context, tx *sql.Tx, communityId, ownerId int64, name, description string, privacy GroupPrivacy, announcementOnly bool) (int64, error) {
+
+	query := `INSERT INTO groupu(name,pic_url,description,privacy,announcement_only,community_id) VALUES($1,'',$2,$3,$4,$5) RETURNING id`
+
+	var groupId int64
+
+	if err := tx.QueryRowContext(ctx, query, name, description, privacy, announcementOnly, communityId).Scan(&groupId); err != nil {
+		return 0, err
+	}
+
+	if err := d.insertGroupMembership(ctx, tx, ownerId, groupId, GroupRoleOwner); err != nil {
+		return 0, err
+	}
+
+	event := GroupAuditEvent{GroupID: groupId, ActorID: ownerId, Action: GroupEventCreated, After: name}
+
+	return groupId, insertGroupEvent(ctx, tx, event)
+}
+
+// InsertCommunity creates the community with ownerId as its owner and its announcement group, in
+// which only admins post and every member of the community is placed
+func (d *DataRepository) InsertCommunity(ctx context.Context, ownerId int64, name, description string) (int64, error) {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback()
+
+	var id int64
+
+	if err := tx.QueryRowContext(ctx, `INSERT INTO community(name,description) VALUES($1,$2) RETURNING id`, name, description).Scan(&id); err != nil {
+		return 0, err
+	}
+
+	query := `INSERT INTO community_member(community_id,user_id,role) VALUES($1,$2,$3)`
+
+	if _, err := tx.ExecContext(ctx, query, id, ownerId, CommunityRoleOwner); err != nil {
+		return 0, err
+	}
+
+	groupId, err := d.insertCommunityGroup(ctx, tx, id, ownerId, name+" announcements", "", GroupPrivacyInviteOnly, true)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE community SET announcement_group_id = $1 WHERE id = $2`, groupId, id); err != nil {
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+// InsertCommunityGroup adds a new group to the community, ownerId becomes its owner
+func (d *DataRepository) InsertCommunityGroup(ctx context.Context, communityId, ownerId int64, name, description string, privacy GroupPrivacy) (int64, error) {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback()
+
+	groupId, err := d.insertCommunityGroup(ctx, tx, communityId, ownerId, name, description, privacy, false)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return groupId, tx.Commit()
+}
+
+// $1 is the signed in user, their role comes back empty when they are not a member
+const selectCommunity = `SELECT c.id,c.name,c.description,COALESCE(c.announcement_group_id,0),
+(SELECT COUNT(*) FROM community_member a WHERE a.community_id = c.id),COALESCE(m.role,''),c.created_at,c.modified_at
+FROM community c LEFT JOIN community_member m ON m.community_id = c.id AND m.user_id = $1`
+
+func scanCommunity(row rowScanner) (*Community, error) {
+
+	var community Community
+
+	err := row.Scan(&community.ID, &community.Name, &community.Description, &community.AnnouncementGroupID,
+		&community.MemberCount, &community.Role, &community.CreatedAt, &community.ModifiedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &community, nil
+}
+
+// GetCommunity returns the community as seen by userId
+func (d *DataRepository) GetCommunity(ctx context.Context, userId, communityId int64) (*Community, error) {
+	return scanCommunity(d.db.QueryRowContext(ctx, selectCommunity+` WHERE c.id = $2`, userId, communityId))
+}
+
+// GetUserCommunities lists the communities userId is a member of, by name
+func (d *DataRepository) GetUserCommunities(ctx context.Context, userId int64) ([]Community, error) {
+
+	rows, err := d.db.QueryContext(ctx, selectCommunity+` WHERE m.user_id IS NOT NULL ORDER BY c.name, c.id`, userId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	communities := []Community{}
+
+	for rows.Next() {
+
+		community, err := scanCommunity(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		communities = append(communities, *community)
+	}
+
+	return communities, rows.Err()
+}
+
+// UpdateCommunity changes the fields that are not empty
+func (d *DataRepository) UpdateCommunity(ctx context.Context, communityId int64, name, description string) error {
+
+	query := `UPDATE community SET name = COALESCE(NULLIF($1,''),name), description = COALESCE(NULLIF($2,''),description), modified_at = NOW() WHERE id = $3`
+
+	_, err := d.db.ExecContext(ctx, query, name, description, communityId)
+
+	return err
+}
+
+func (d *DataRepository) GetCommunityMember(ctx context.Context, userId, communityId int64) (*CommunityMember, error) {
+
+	query := `SELECT m.community_id,m.user_id,u.username,m.role,m.created_at FROM community_member m JOIN users u ON u.id = m.user_id
+WHERE m.community_id = $1 AND m.user_id = $2`
+
+	var member CommunityMember
+
+	err := d.db.QueryRowContext(ctx, query, communityId, userId).Scan(&member.CommunityID, &member.UserID, &member.Username, &member.Role, &member.CreatedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &member, nil
+}
+
+// GetCommunityMembers is the member directory, owner and admins first. search matches the start of a
+// username and may be empty.
+func (d *DataRepository) GetCommunityMembers(ctx context.Context, communityId int64, search string, limit, page int64) (*PaginatedResponse, error) {
+
+	offset := (page - 1) * limit
+
+	from := ` FROM community_member m JOIN users u ON u.id = m.user_id WHERE m.community_id = $1 AND ($2 = '' OR u.username ILIKE $2 || '%')`
+
+	var totalCount int64
+
+	if err := d.db.QueryRowContext(ctx, `SELECT COUNT(*)`+from, communityId, search).Scan(&totalCount); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT m.community_id,m.user_id,u.username,m.role,m.created_at` + from +
+		` ORDER BY CASE m.role WHEN 'owner' THEN 0 WHEN 'admin' THEN 1 ELSE 2 END, u.username LIMIT $3 OFFSET $4`
+
+	rows, err := d.db.QueryContext(ctx, query, communityId, search, limit, offset)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	members := []CommunityMember{}
+
+	for rows.Next() {
+
+		var member CommunityMember
+
+		if err := rows.Scan(&member.CommunityID, &member.UserID, &member.Username, &member.Role, &member.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		members = append(members, member)
+	}
+
+	p := PaginatedResponse{
+		Data:       members,
+		TotalCount: int(totalCount),
+		Page:       int(page),
+		Limit:      int(limit),
+	}
+
+	return &p, rows.Err()
+}
+
+// GetCommunityGroups lists the groups of the community userId may see: the ones they are in and the
+// ones they can join or ask to join. Invite only groups stay hidden from everyone else.
+func (d *DataRepository) GetCommunityGroups(ctx context.Context, userId, communityId int64) ([]CommunityGroup, error) {
+
+	query := `SELECT g.id,COALESCE(g.name,''),COALESCE(g.pic_url,''),COALESCE(g.description,''),g.privacy,
+g.member_count,m.id IS NOT NULL,g.id = COALESCE(c.announcement_group_id,0)
+FROM groupu g JOIN community c ON c.id = g.community_id LEFT JOIN group_member m ON m.group_id = g.id AND m.user_id = $1
+WHERE g.community_id = $2 AND (m.id IS NOT NULL OR g.privacy <> 'invite_only')
+ORDER BY g.id = COALESCE(c.announcement_group_id,0) DESC, g.name, g.id`
+
+	rows, err := d.db.QueryContext(ctx, query, userId, communityId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	groups := []CommunityGroup{}
+
+	for rows.Next() {
+
+		var group CommunityGroup
+
+		err := rows.Scan(&group.ID, &group.Name, &group.PicUrl, &group.Description, &group.Privacy, &group.MemberCount, &group.IsMember, &group.IsAnnouncement)
+
+		if err != nil {
+			return nil, err
+		}
+
+		groups = append(groups, group)
+	}
+
+	return groups, rows.Err()
+}
+
+// AddCommunityMember lets the user into the community and its announcement group. It reports false
+// when they were not placed in that group, because it is gone, full or they are banned from it. It
+// refuses with ErrUserBlocked when the user blocked the actor. info is the message announcing them
+// there, see insertGroupJoin.
+func (d *DataRepository) AddCommunityMember(ctx context.Context, communityId, userId, actorId int64, info *Message) (bool, error) {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer tx.Rollback()
+
+	// joining the community puts them in its announcement group, someone they blocked cannot do that
+	if actorId != userId {
+
+		blocked, err := blocks(ctx, tx, userId, actorId)
+
+		if err != nil {
+			return false, err
+		}
+
+		if blocked {
+			return false, ErrUserBlocked
+		}
+	}
+
+	query := `INSERT INTO community_member(community_id,user_id) VALUES($1,$2) ON CONFLICT (community_id,user_id) DO NOTHING`
+
+	result, err := tx.ExecContext(ctx, query, communityId, userId)
+
+	if err != nil {
+		return false, err
+	}
+
+	if inserted, _ := result.RowsAffected(); inserted == 0 {
+		return false, ErrAlreadyCommunityMember
+	}
+
+	var announcementId sql.NullInt64
+
+	if err := tx.QueryRowContext(ctx, `SELECT announcement_group_id FROM community WHERE id = $1`, communityId).Scan(&announcementId); err != nil {
+		return false, err
+	}
+
+	joined := false
+
+	if announcementId.Valid {
+
+		// these are refused before anything is written, the rest of the join still goes through
+		err := d.insertGroupJoin(ctx, tx, actorId, userId, announcementId.Int64, "community", info)
+
+		switch err {
+		case nil:
+			joined = true
+		case ErrBannedFromGroup, ErrAlreadyGroupMember, ErrGroupFull:
+		default:
+			return false, err
+		}
+	}
+
+	return joined, tx.Commit()
+}
+
+// leaveCommunityGroups takes the user out of every group of the community, handing over the ones
+// they own. event is recorded in each group they leave, with GroupID and TargetID filled in here.
+func leaveCommunityGroups(ctx context.Context, tx *sql.Tx, communityId, userId int64, event GroupAuditEvent) ([]DeletedGroup, error) {
+
+	query := `SELECT m.group_id,m.role FROM group_member m JOIN groupu g ON g.id = m.group_id WHERE g.community_id = $1 AND m.user_id = $2`
+
+	rows, err := tx.QueryContext(ctx, query, communityId, userId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	type membership struct {
+		groupId int64
+		role    GroupRole
+	}
+
+	var memberships []membership
+
+	for rows.Next() {
+
+		var m membership
+
+		if err := rows.Scan(&m.groupId, &m.role); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		memberships = append(memberships, m)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var deleted []DeletedGroup
+
+	for _, m := range memberships {
+
+		if m.role == GroupRoleOwner {
+
+			group, err := handOverGroup(ctx, tx, m.groupId, userId)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if group != nil {
+				deleted = append(deleted, *group)
+				continue
+			}
+		}
+
+		if _, err := deleteGroupMembership(ctx, tx, userId, m.groupId); err != nil {
+			return nil, err
+		}
+
+		event.GroupID, event.TargetID = m.groupId, userId
+
+		if err := insertGroupEvent(ctx, tx, event); err != nil {
+			return nil, err
+		}
+	}
+
+	return deleted, nil
+}
+
+// RemoveCommunityMember takes the user out of the community and all of its groups, groups deleted
+// on the way because nobody else was left are returned
+func (d *DataRepository) RemoveCommunityMember(ctx context.Context, communityId, userId, actorId int64) ([]DeletedGroup, error) {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM community_member WHERE community_id = $1 AND user_id = $2 AND role <> 'owner'`, communityId, userId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if removed, _ := result.RowsAffected(); removed == 0 {
+		return nil, ErrNotCommunityMember
+	}
+
+	deleted, err := leaveCommunityGroups(ctx, tx, communityId, userId, GroupAuditEvent{ActorID: actorId, Action: GroupEventMemberKicked, After: "community"})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return deleted, tx.Commit()
+}
+
+// handOverCommunity passes the community to its longest standing admin, then member, and deletes it
+// when nobody else is in it. The leaving owner's own membership is removed by the caller.
+func handOverCommunity(ctx context.Context, tx *sql.Tx, communityId, ownerId int64) ([]DeletedGroup, error) {
+
+	if _, err := tx.ExecContext(ctx, `UPDATE community_member SET role = 'member' WHERE community_id = $1 AND user_id = $2`, communityId, ownerId); err != nil {
+		return nil, err
+	}
+
+	promote := `UPDATE community_member SET role = 'owner' WHERE community_id = $1 AND user_id = (
+SELECT user_id FROM community_member WHERE community_id = $1 AND user_id <> $2
+ORDER BY CASE role WHEN 'admin' THEN 0 ELSE 1 END, created_at, user_id LIMIT 1)`
+
+	result, err := tx.ExecContext(ctx, promote, communityId, ownerId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if promoted, _ := result.RowsAffected(); promoted > 0 {
+		return nil, nil
+	}
+
+	return deleteCommunity(ctx, tx, communityId)
+}
+
+// LeaveCommunity takes the user out of the community and its groups. An owner hands the community
+// over first, when they were the last member it is deleted with its groups. Deleted groups are returned.
+func (d *DataRepository) LeaveCommunity(ctx context.Context, communityId, userId int64) ([]DeletedGroup, error) {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	var role CommunityRole
+
+	err = tx.QueryRowContext(ctx, `SELECT role FROM community_member WHERE community_id = $1 AND user_id = $2 FOR UPDATE`, communityId, userId).Scan(&role)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotCommunityMember
+		}
+		return nil, err
+	}
+
+	if role == CommunityRoleOwner {
+
+		deleted, err := handOverCommunity(ctx, tx, communityId, userId)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if deleted != nil {
+			return deleted, tx.Commit()
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM community_member WHERE community_id = $1 AND user_id = $2`, communityId, userId); err != nil {
+		return nil, err
+	}
+
+	deleted, err := leaveCommunityGroups(ctx, tx, communityId, userId, GroupAuditEvent{ActorID: userId, Action: GroupEventMemberLeft})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return deleted, tx.Commit()
+}
+
+// SetCommunityAdmin makes a member an admin or back, the owner is never changed here
+func (d *DataRepository) SetCommunityAdmin(ctx context.Context, communityId, userId int64, admin bool) error {
+
+	role := CommunityRoleMember
+
+	if admin {
+		role = CommunityRoleAdmin
+	}
+
+	query := `UPDATE community_member SET role = $1 WHERE community_id = $2 AND user_id = $3 AND role <> 'owner'`
+
+	result, err := d.db.ExecContext(ctx, query, role, communityId, userId)
+
+	if err != nil {
+		return err
+	}
+
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return ErrNotCommunityMember
+	}
+
+	return nil
+}
+
+// deleteCommunity removes the community with every one of its groups
+func deleteCommunity(ctx context.Context, tx *sql.Tx, communityId int64) ([]DeletedGroup, error) {
+
+	rows, err := tx.QueryContext(ctx, `SELECT id FROM groupu WHERE community_id = $1`, communityId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var groupIds []int64
+
+	for rows.Next() {
+
+		var groupId int64
+
+		if err := rows.Scan(&groupId); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		groupIds = append(groupIds, groupId)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	deleted := []DeletedGroup{}
+
+	for _, groupId := range groupIds {
+
+		group, err := deleteGroup(ctx, tx, groupId)
+
+		if err != nil {
+			return nil, err
+		}
+
+		deleted = append(deleted, *group)
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM community WHERE id = $1`, communityId)
+
+	return deleted, err
+}
+
+// DeleteCommunity removes the community and its groups, the groups are returned so the caller can
+// remove their files
+func (d *DataRepository) DeleteCommunity(ctx context.Context, communityId int64) ([]DeletedGroup, error) {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	deleted, err := deleteCommunity(ctx, tx, communityId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return deleted, tx.Commit()
+}
+
+// handOverCommunities runs when a user is deleted, every community they own passes on or is deleted
+// with its groups when they were its last member
+func handOverCommunities(ctx context.Context, tx *sql.Tx, userId int64) ([]DeletedGroup, error) {
+
+	rows, err := tx.QueryContext(ctx, `SELECT community_id FROM community_member WHERE user_id = $1 AND role = 'owner'`, userId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var communityIds []int64
+
+	for rows.Next() {
+
+		var communityId int64
+
+		if err := rows.Scan(&communityId); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		communityIds = append(communityIds, communityId)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var deleted []DeletedGroup
+
+	for _, communityId := range communityIds {
+
+		groups, err := handOverCommunity(ctx, tx, communityId, userId)
+
+		if err != nil {
+			return nil, err
+		}
+
+		deleted = append(deleted, groups...)
+	}
+
+	return deleted, nil
+}
@@ -12,16 +12,26 @@ type DatabaseConfig struct {
 	MaxOpenConn  int
 	MaxIdealConn int
 	MaxIdealTime string
+
+	RequireMigrations bool // refuse to start the server while migrations are pending
 }
 
 type DataRepository struct {
 	db *sql.DB
+
+	maxGroupMembers int64 // 0 is no limit
 }
 
 func NewUserRepository(db *sql.DB) *DataRepository {
 	return &DataRepository{db: db}
 }
 
+// SetMaxGroupMembers caps how many members a group may have, 0 lifts the cap. Groups already over
+// it keep their members but take no new ones.
+func (d *DataRepository) SetMaxGroupMembers(max int) {
+	d.maxGroupMembers = int64(max)
+}
+
 type PaginatedResponse struct {
 	Data       any `json:"data"`
 	TotalCount int   `json:"total_count"`
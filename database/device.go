@@ -0,0 +1,101 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+type DeviceToken struct {
+	ID         int64  `json:"id"`
+	Username   string `json:"username"`
+	SessionID  string `json:"session_id"`
+	Token      string `json:"token"`
+	Platform   string `json:"platform"` // android or ios
+	CreatedAt  string `json:"created_at"`
+	ModifiedAt string `json:"modified_at"`
+}
+
+// a token belongs to one install, so registering it again (new login on the same phone) moves it to the new session
+func (d *DataRepository) InsertDeviceToken(ctx context.Context, username, sessionId, token, platform string) error {
+
+	query := `INSERT INTO device_token(username,session_id,token,platform,modified_at) VALUES($1,$2,$3,$4,$5)
+	ON CONFLICT (token) DO UPDATE SET username = EXCLUDED.username, session_id = EXCLUDED.session_id, platform = EXCLUDED.platform, modified_at = EXCLUDED.modified_at`
+
+	_, err := d.db.ExecContext(ctx, query, username, sessionId, token, platform, time.Now())
+
+	return err
+}
+
+// only devices whose session is still signed in
+func (d *DataRepository) GetDeviceTokensByUsername(ctx context.Context, username string) ([]DeviceToken, error) {
+
+	query := `SELECT dt.id,dt.username,dt.session_id,dt.token,dt.platform,dt.created_at,dt.modified_at FROM device_token dt
+	JOIN session s ON s.id = dt.session_id WHERE dt.username = $1 AND s.revoked_at IS NULL AND s.expires_at > $2`
+
+	row, err := d.db.QueryContext(ctx, query, username, time.Now())
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer row.Close()
+
+	var devices []DeviceToken
+
+	for row.Next() {
+
+		var device DeviceToken
+
+		err := row.Scan(&device.ID, &device.Username, &device.SessionID, &device.Token, &device.Platform, &device.CreatedAt, &device.ModifiedAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		devices = append(devices, device)
+	}
+
+	return devices, row.Err()
+}
+
+func (d *DataRepository) DeleteDeviceToken(ctx context.Context, token string) error {
+
+	query := `DELETE FROM device_token WHERE token = $1`
+
+	_, err := d.db.ExecContext(ctx, query, token)
+
+	return err
+}
+
+func (d *DataRepository) DeleteDeviceTokenForUser(ctx context.Context, username, token string) (bool, error) {
+
+	query := `DELETE FROM device_token WHERE username = $1 AND token = $2`
+
+	result, err := d.db.ExecContext(ctx, query, username, token)
+
+	if err != nil {
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+
+	return count > 0, err
+}
+
+func (d *DataRepository) DeleteDeviceTokensBySession(ctx context.Context, sessionId string) error {
+
+	query := `DELETE FROM device_token WHERE session_id = $1`
+
+	_, err := d.db.ExecContext(ctx, query, sessionId)
+
+	return err
+}
+
+func (d *DataRepository) DeleteDeviceTokensByUsername(ctx context.Context, username string) error {
+
+	query := `DELETE FROM device_token WHERE username = $1`
+
+	_, err := d.db.ExecContext(ctx, query, username)
+
+	return err
+}
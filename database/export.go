@@ -0,0 +1,247 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrExportRunning = errors.New("an export is already in progress")
+
+const (
+	ExportPending = "pending"
+	ExportRunning = "running"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+type DataExport struct {
+	ID                string     `json:"id"`
+	Username          string     `json:"-"`
+	Status            string     `json:"status"`
+	FilePath          string     `json:"-"`
+	DownloadTokenHash string     `json:"-"`
+	Error             string     `json:"error,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	CompletedAt       *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt         *time.Time `json:"expires_at,omitempty"`
+}
+
+const dataExportColumns = `id,username,status,COALESCE(file_path,''),COALESCE(download_token_hash,''),COALESCE(error,''),created_at,completed_at,expires_at`
+
+func scanDataExport(row interface{ Scan(...any) error }) (*DataExport, error) {
+
+	var export DataExport
+	var completedAt, expiresAt sql.NullTime
+
+	err := row.Scan(&export.ID, &export.Username, &export.Status, &export.FilePath, &export.DownloadTokenHash, &export.Error, &export.CreatedAt, &completedAt, &expiresAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if completedAt.Valid {
+		export.CompletedAt = &completedAt.Time
+	}
+
+	if expiresAt.Valid {
+		export.ExpiresAt = &expiresAt.Time
+	}
+
+	return &export, nil
+}
+
+// InsertDataExport returns ErrExportRunning when the user already has a pending or running export
+func (d *DataRepository) InsertDataExport(ctx context.Context, id, username string) error {
+
+	query := `INSERT INTO data_export(id,username,status) VALUES($1,$2,$3)`
+
+	_, err := d.db.ExecContext(ctx, query, id, username, ExportPending)
+
+	if err != nil && strings.Contains(err.Error(), "data_export_one_running_idx") {
+		return ErrExportRunning
+	}
+
+	return err
+}
+
+func (d *DataRepository) MarkDataExportRunning(ctx context.Context, id string) error {
+
+	_, err := d.db.ExecContext(ctx, `UPDATE data_export SET status = $1 WHERE id = $2`, ExportRunning, id)
+
+	return err
+}
+
+func (d *DataRepository) CompleteDataExport(ctx context.Context, id, filePath, downloadTokenHash string, expiresAt time.Time) error {
+
+	query := `UPDATE data_export SET status = $1, file_path = $2, download_token_hash = $3, completed_at = NOW(), expires_at = $4 WHERE id = $5`
+
+	_, err := d.db.ExecContext(ctx, query, ExportReady, filePath, downloadTokenHash, expiresAt, id)
+
+	return err
+}
+
+func (d *DataRepository) FailDataExport(ctx context.Context, id, reason string) error {
+
+	query := `UPDATE data_export SET status = $1, error = $2, completed_at = NOW() WHERE id = $3`
+
+	_, err := d.db.ExecContext(ctx, query, ExportFailed, reason, id)
+
+	return err
+}
+
+// FailInterruptedDataExports marks exports a previous process left unfinished, run at startup
+func (d *DataRepository) FailInterruptedDataExports(ctx context.Context) error {
+
+	query := `UPDATE data_export SET status = $1, error = 'interrupted by a server restart', completed_at = NOW() WHERE status IN ($2,$3)`
+
+	_, err := d.db.ExecContext(ctx, query, ExportFailed, ExportPending, ExportRunning)
+
+	return err
+}
+
+func (d *DataRepository) GetDataExportById(ctx context.Context, id string) (*DataExport, error) {
+
+	row := d.db.QueryRowContext(ctx, `SELECT `+dataExportColumns+` FROM data_export WHERE id = $1`, id)
+
+	return scanDataExport(row)
+}
+
+func (d *DataRepository) GetLatestDataExport(ctx context.Context, username string) (*DataExport, error) {
+
+	row := d.db.QueryRowContext(ctx, `SELECT `+dataExportColumns+` FROM data_export WHERE username = $1 ORDER BY created_at DESC LIMIT 1`, username)
+
+	return scanDataExport(row)
+}
+
+func (d *DataRepository) deleteDataExports(ctx context.Context, query string, args ...any) ([]string, error) {
+
+	rows, err := d.db.QueryContext(ctx, query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var files []string
+
+	for rows.Next() {
+
+		var file string
+
+		if err := rows.Scan(&file); err != nil {
+			return nil, err
+		}
+
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+
+	return files, rows.Err()
+}
+
+// DeleteExpiredDataExports removes finished exports past their link expiry and returns their files
+func (d *DataRepository) DeleteExpiredDataExports(ctx context.Context) ([]string, error) {
+	return d.deleteDataExports(ctx, `DELETE FROM data_export WHERE expires_at < NOW() OR (status = $1 AND completed_at < NOW() - INTERVAL '7 days') RETURNING COALESCE(file_path,'')`, ExportFailed)
+}
+
+func (d *DataRepository) DeleteDataExportsByUsername(ctx context.Context, username string) ([]string, error) {
+	return d.deleteDataExports(ctx, `DELETE FROM data_export WHERE username = $1 RETURNING COALESCE(file_path,'')`, username)
+}
+
+type UserDataSection struct {
+	Name        string
+	Description string
+	Rows        []map[string]any
+}
+
+// secrets such as password and token hashes are left out, everything else about the user is included
+var userDataQueries = []struct {
+	name        string
+	description string
+	query       string
+}{
+	{"profile", "your account", `SELECT id,username,display_name,email,image_url,bio,friends_count,groups_count,role,enabled,totp_enabled,delete_after,created_at,modified_at FROM users WHERE username = $1`},
+	{"friendships", "your chats and friends", `SELECT f.id,f.friendship_id,f.last_message,fu.username AS friend_username,f.friendship_type,f.group_id,f.created_at,f.modified_at FROM friendship f JOIN users u ON u.id = f.user_id LEFT JOIN users fu ON fu.id = f.friend_user_id WHERE u.username = $1 ORDER BY f.id`},
+	{"friend_requests_sent", "friend requests you sent", `SELECT f.id,t.username AS sent_to,f.status,f.created_at,f.modified_at FROM friendRequest f JOIN users s ON s.id = f.sent_by_id JOIN users t ON t.id = f.sent_to_id WHERE s.username = $1 ORDER BY f.id`},
+	{"friend_requests_received", "friend requests you received", `SELECT f.id,s.username AS sent_by,f.status,f.created_at,f.modified_at FROM friendRequest f JOIN users s ON s.id = f.sent_by_id JOIN users t ON t.id = f.sent_to_id WHERE t.username = $1 ORDER BY f.id`},
+	{"group_memberships", "groups you are a member of", `SELECT gm.group_id,g.name AS group_name,gm.role,gm.created_at AS joined_at FROM group_member gm JOIN users u ON u.id = gm.user_id LEFT JOIN groupu g ON g.id = gm.group_id WHERE u.username = $1 ORDER BY gm.id`},
+	{"messages", "messages you sent", `SELECT m.message_id,m.friendship_id,m.message_type,m.text_content,m.media_url,m.media_type,m.created_at,m.modified_at FROM message m JOIN users u ON u.id = m.sender_id WHERE u.username = $1 ORDER BY m.created_at`},
+	{"notification_devices", "devices registered for push notifications", `SELECT platform,session_id,created_at FROM device_token WHERE username = $1 ORDER BY id`},
+	{"sessions", "devices you signed in from", `SELECT id,device_name,ip,user_agent,created_at,last_used_at,expires_at,revoked_at FROM session WHERE username = $1 ORDER BY created_at`},
+	{"passkeys", "passkeys on your account", `SELECT name,created_at,last_used_at FROM webauthn_credential WHERE username = $1 ORDER BY id`},
+	{"username_history", "your previous usernames", `SELECT h.old_username,h.new_username,h.changed_at FROM username_history h JOIN users u ON u.id = h.user_id WHERE u.username = $1 ORDER BY h.changed_at`},
+	{"email_changes", "changes to your email address", `SELECT e.old_email,e.new_email,e.changed_at,e.reverted_at FROM email_change e JOIN users u ON u.id = e.user_id WHERE u.username = $1 ORDER BY e.changed_at`},
+	{"linked_accounts", "sign-in providers linked to your account", `SELECT provider,email,created_at FROM user_identity WHERE username = $1 ORDER BY id`},
+}
+
+// CollectUserData reads every table that holds data about the user, rows are keyed by column name
+func (d *DataRepository) CollectUserData(ctx context.Context, username string) ([]UserDataSection, error) {
+
+	var sections []UserDataSection
+
+	for _, q := range userDataQueries {
+
+		rows, err := d.queryMaps(ctx, q.query, username)
+
+		if err != nil {
+			return nil, errors.New("export " + q.name + ": " + err.Error())
+		}
+
+		sections = append(sections, UserDataSection{Name: q.name, Description: q.description, Rows: rows})
+	}
+
+	return sections, nil
+}
+
+func (d *DataRepository) queryMaps(ctx context.Context, query string, args ...any) ([]map[string]any, error) {
+
+	rows, err := d.db.QueryContext(ctx, query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := []map[string]any{}
+
+	for rows.Next() {
+
+		values := make([]any, len(columns))
+		pointers := make([]any, len(columns))
+
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+
+		row := make(map[string]any, len(columns))
+
+		for i, column := range columns {
+			// text columns come back as []byte, which json would base64
+			if b, ok := values[i].([]byte); ok {
+				row[column] = string(b)
+			} else {
+				row[column] = values[i]
+			}
+		}
+
+		result = append(result, row)
+	}
+
+	return result, rows.Err()
+}
@@ -2,151 +2,130 @@ package database
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"time"
 )
 
+var ErrFriendRequestAnswered = errors.New("this friend request was already answered")
+
 type Friendship struct {
 	ID             int64     `json:"id"`
 	FriendShipId   string    `json:"firendship_id"`
+	UserID         int64     `json:"-"`
 	Username       string    `json:"username"`
 	LastMessage    string    `json:"last_message"`
+	FriendUserID   int64     `json:"-"`
 	FirendUsername string    `json:"friend_username,omitempty"`
 	FriendshipType string    `json:"friendship_type"`    //one-on-one or group
 	GroupID        int64     `json:"group_id,omitempty"` //if group; remove id to remove member from group
 	CreatedAt      time.Time `json:"created_at"`
-	ModifiedAt time.Time `json:"modified_at"`
+	ModifiedAt     time.Time `json:"modified_at"`
 }
 
 type FriendRequest struct {
 	ID         int64     `json:"id"`
+	SentByID   int64     `json:"-"`
 	SentBy     string    `json:"sent_by"`
+	SentToID   int64     `json:"-"`
 	SentTo     string    `json:"sent_to"`
 	Status     string    `json:"status"` //accepted, pendding, rejected
 	CreatedAt  time.Time `json:"created_at"`
 	ModifiedAt time.Time `json:"modified_at"`
 }
 
-// ------------------------------ Friend Request ----------------------------------------------------------------------
-func (r *DataRepository) InsertFriendRequest(ctx context.Context, sentTo, sentBy string) error {
-
-	query := `INSERT INTO friendRequest(sent_by,sent_to,status,modified_at) VALUES($1,$2,$3,$4)`
-
-	_, err := r.db.ExecContext(ctx, query, sentBy, sentTo, "pending", time.Now())
-
-	return err
-}
-
-func (r *DataRepository) DeleteFriendRequest(ctx context.Context, id int64) error {
-
-	query := `DELETE FROM friendRequest WHERE id = $1`
-	_, err := r.db.ExecContext(ctx, query, id)
+// the tables only hold user ids, usernames are joined in for the api
+const selectFriendRequest = `SELECT f.id,f.sent_by_id,s.username,f.sent_to_id,t.username,f.status,f.created_at,f.modified_at FROM friendRequest f JOIN users s ON s.id = f.sent_by_id JOIN users t ON t.id = f.sent_to_id`
 
-	return err
+const selectFriendship = `SELECT f.id,f.friendship_id,f.user_id,u.username,COALESCE(f.last_message,''),COALESCE(f.friend_user_id,0),
+CASE WHEN f.friendship_type = 'one-on-one' THEN COALESCE(fu.username,'` + DeletedUsername + `') ELSE '' END,
+f.friendship_type,COALESCE(f.group_id,0),f.created_at,COALESCE(f.modified_at,f.created_at)
+FROM friendship f JOIN users u ON u.id = f.user_id LEFT JOIN users fu ON fu.id = f.friend_user_id`
 
+type rowScanner interface {
+	Scan(dest ...any) error
 }
 
-func (r *DataRepository) HasSentMeRequest(ctx context.Context, friendUsername, username string) bool {
+func scanFriendRequest(row rowScanner) (*FriendRequest, error) {
 
-	query := `SELECT * FROM friendRequest WHERE sent_by = $1 AND sent_to = $2`
+	var item FriendRequest
 
-	row, err := r.db.Query(query, friendUsername, username)
+	err := row.Scan(&item.ID, &item.SentByID, &item.SentBy, &item.SentToID, &item.SentTo, &item.Status, &item.CreatedAt, &item.ModifiedAt)
 
 	if err != nil {
-		return true
+		return nil, err
 	}
 
-	defer row.Close()
-
-	return row.Next()
+	return &item, nil
 }
 
-func (r *DataRepository) CheckDuplicateRequest(ctx context.Context, username, firendUsername string) bool {
+// ------------------------------ Friend Request ----------------------------------------------------------------------
 
-	query := `SELECT * FROM friendRequest WHERE sent_by = $1 AND sent_to = $2`
+// InsertFriendRequest refuses with ErrUserBlocked when either user blocked the other
+func (r *DataRepository) InsertFriendRequest(ctx context.Context, sentToId, sentById int64) error {
 
-	row, err := r.db.Query(query, username, firendUsername)
+	blocked, err := blockedBetween(ctx, r.db, sentById, sentToId)
 
 	if err != nil {
-		return true
+		return err
 	}
 
-	defer row.Close()
-
-	return row.Next()
-}
-
-// request i (client) sent out
-func (r *DataRepository) GetFriendRequestSentBy(ctx context.Context, sentByUsername string, page, limit int64) (*PaginatedResponse, error) {
-
-	var request []FriendRequest
-
-	query := `SELECT * FROM friendRequest WHERE sent_by = $1 AND status = $2 LIMIT $3 OFFSET $4`
-	queryCount := `SELECT COUNT(*) FROM friendRequest WHERE sent_by = $1 AND status = $2`
-
-	var totalCount int
+	if blocked {
+		return ErrUserBlocked
+	}
 
-	cRow := r.db.QueryRowContext(ctx, queryCount, sentByUsername, "pending")
+	query := `INSERT INTO friendRequest(sent_by_id,sent_to_id,status,modified_at) VALUES($1,$2,$3,$4)`
 
-	err := cRow.Scan(&totalCount)
-	if err != nil {
-		return nil, err
-	}
+	_, err = r.db.ExecContext(ctx, query, sentById, sentToId, "pending", time.Now())
 
-	offset := (page - 1) * limit
+	return err
+}
 
-	row, err := r.db.Query(query, sentByUsername, "pending", limit, offset)
+func (r *DataRepository) DeleteFriendRequest(ctx context.Context, id int64) error {
 
-	if err != nil {
-		return nil, err
-	}
+	query := `DELETE FROM friendRequest WHERE id = $1`
+	_, err := r.db.ExecContext(ctx, query, id)
 
-	defer row.Close()
+	return err
 
-	for row.Next() {
+}
 
-		item := FriendRequest{}
+func (r *DataRepository) HasSentMeRequest(ctx context.Context, friendId, userId int64) bool {
 
-		err := row.Scan(&item.ID, &item.SentBy, &item.SentTo, &item.Status, &item.CreatedAt,&item.ModifiedAt)
+	return r.CheckDuplicateRequest(ctx, friendId, userId)
+}
 
-		if err != nil {
-			return nil, err
-		}
+func (r *DataRepository) CheckDuplicateRequest(ctx context.Context, userId, friendId int64) bool {
 
-		request = append(request, item)
+	query := `SELECT EXISTS(SELECT 1 FROM friendRequest WHERE sent_by_id = $1 AND sent_to_id = $2)`
 
-	}
+	var exists bool
 
-	p := PaginatedResponse{
-		Data:       request,
-		TotalCount: totalCount,
-		Page:       int(page),
-		Limit:      int(limit),
+	if err := r.db.QueryRowContext(ctx, query, userId, friendId).Scan(&exists); err != nil {
+		return true
 	}
 
-	return &p, nil
+	return exists
 }
 
-// request i (client) was sent
-func (r *DataRepository) GetFriendRequestSentTo(ctx context.Context, sentToUsername string, page, limit int64) (*PaginatedResponse, error) {
+func (r *DataRepository) getFriendRequests(ctx context.Context, column string, userId, page, limit int64) (*PaginatedResponse, error) {
 
-	var request []FriendRequest
+	request := []FriendRequest{}
 
-	query := `SELECT * FROM friendRequest WHERE sent_to = $1 AND status = $2 LIMIT $3 OFFSET $4`
-	queryCount := `SELECT COUNT(*) FROM friendRequest WHERE sent_to = $1 AND status = $2`
+	query := selectFriendRequest + ` WHERE f.` + column + ` = $1 AND f.status = $2 ORDER BY f.created_at DESC LIMIT $3 OFFSET $4`
+	queryCount := `SELECT COUNT(*) FROM friendRequest WHERE ` + column + ` = $1 AND status = $2`
 
 	var totalCount int
 
-	cRow := r.db.QueryRowContext(ctx, queryCount, sentToUsername, "pending")
+	err := r.db.QueryRowContext(ctx, queryCount, userId, "pending").Scan(&totalCount)
 
-	err := cRow.Scan(&totalCount)
 	if err != nil {
 		return nil, err
 	}
 
 	offset := (page - 1) * limit
 
-	row, err := r.db.Query(query, sentToUsername, "pending", limit, offset)
+	row, err := r.db.QueryContext(ctx, query, userId, "pending", limit, offset)
 
 	if err != nil {
 		return nil, err
@@ -156,15 +135,13 @@ func (r *DataRepository) GetFriendRequestSentTo(ctx context.Context, sentToUsern
 
 	for row.Next() {
 
-		item := FriendRequest{}
-
-		err := row.Scan(&item.ID, &item.SentBy, &item.SentTo, &item.Status, &item.CreatedAt, &item.ModifiedAt)
+		item, err := scanFriendRequest(row)
 
 		if err != nil {
 			return nil, err
 		}
 
-		request = append(request, item)
+		request = append(request, *item)
 
 	}
 
@@ -175,133 +152,129 @@ func (r *DataRepository) GetFriendRequestSentTo(ctx context.Context, sentToUsern
 		Limit:      int(limit),
 	}
 
-	return &p, nil
+	return &p, row.Err()
 }
 
-func (r *DataRepository) GetFriendRequestById(ctx context.Context, id int64) (*FriendRequest, error) {
-
-	query := `SELECT * FROM friendRequest WHERE id = $1`
-
-	row, err := r.db.Query(query, id)
+// request i (client) sent out
+func (r *DataRepository) GetFriendRequestSentBy(ctx context.Context, sentById, page, limit int64) (*PaginatedResponse, error) {
 
-	if err != nil {
-		return nil, err
-	}
+	return r.getFriendRequests(ctx, "sent_by_id", sentById, page, limit)
+}
 
-	defer row.Close()
+// request i (client) was sent
+func (r *DataRepository) GetFriendRequestSentTo(ctx context.Context, sentToId, page, limit int64) (*PaginatedResponse, error) {
 
-	row.Next()
-	item := FriendRequest{}
+	return r.getFriendRequests(ctx, "sent_to_id", sentToId, page, limit)
+}
 
-	err = row.Scan(&item.ID, &item.SentBy, &item.SentTo, &item.Status, &item.CreatedAt, &item.ModifiedAt)
+func (r *DataRepository) GetFriendRequestById(ctx context.Context, id int64) (*FriendRequest, error) {
 
-	if err != nil {
-		return nil, err
-	}
+	query := selectFriendRequest + ` WHERE f.id = $1`
 
-	return &item, nil
+	return scanFriendRequest(r.db.QueryRowContext(ctx, query, id))
 }
 
+// UpdateFriendRequestStatus answers a pending request, ErrFriendRequestAnswered when it was answered before
 func (d *DataRepository) UpdateFriendRequestStatus(ctx context.Context, status string, request_id int64) error {
 
 	if status != "accepted" && status != "rejected" {
 		return errors.New("status can either be accepted or rejected only")
 	}
 
-	// f, err := d.GetFriendRequestById(ctx, request_id)
-
-	// if err != nil {
-	// 	return err
-	// }
+	return updateFriendRequestStatus(ctx, d.db, status, request_id)
+}
 
-	// if f.SentTo != sentToId {
-	// 	return errors.New("unauthorized: sentToId is not same")
-	// }
+func updateFriendRequestStatus(ctx context.Context, db execer, status string, request_id int64) error {
 
-	query := `UPDATE friendRequest SET status = $1,modified_at = $2 WHERE id = $3`
+	query := `UPDATE friendRequest SET status = $1,modified_at = $2 WHERE id = $3 AND status = 'pending'`
 
 	modifiedAt := time.Now()
 
-	_, err := d.db.ExecContext(ctx, query, status, modifiedAt, request_id)
+	result, err := db.ExecContext(ctx, query, status, modifiedAt, request_id)
 
-	return err
-}
-
-//------------------------------ Friendship ----------------------------------------------------------------------
-
-func (d *DataRepository) InsertFriendship(ctx context.Context, username, firendUsername, friendship_id string) error {
-
-	query := `INSERT INTO friendship(friendship_id,username,last_message,friend_username,friendship_type,group_id,modified_at) VALUES($1,$2,$3,$4,$5,$6,$7,$8)`
-
-	_, err := d.db.ExecContext(ctx, query, friendship_id, username,"New chat", firendUsername, "one-on-one", 0,time.Now())
+	if err != nil {
+		return err
+	}
 
-	return err
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return ErrFriendRequestAnswered
+	}
 
+	return nil
 }
 
-func (d *DataRepository) UpdateFriendshipGroupId(ctx context.Context, username string, group_id int64) error {
+//------------------------------ Friendship ----------------------------------------------------------------------
 
-	query := `UPDATE friendship SET group_id = $1 WHERE username = $2`
-	_, err := d.db.ExecContext(ctx, query, group_id, username)
+// AcceptFriendRequest answers the request and creates the friendship in one transaction, a request
+// accepted twice never makes a second chat or counts the two as friends twice
+func (d *DataRepository) AcceptFriendRequest(ctx context.Context, request_id, userId, friendUserId int64, friendship_id string) error {
 
-	return err
-}
+	tx, err := d.db.BeginTx(ctx, nil)
 
-func (d *DataRepository) InsertFriendshipGroup(ctx context.Context, username string, groupId int64) error {
+	if err != nil {
+		return err
+	}
 
-	query := `INSERT INTO friendship(username,group_id,modified_at) VALUES($1,$2,$3,$4)`
+	defer tx.Rollback()
 
-	_, err := d.db.ExecContext(ctx, query, username, groupId, "group", time.Now())
+	if err := updateFriendRequestStatus(ctx, tx, "accepted", request_id); err != nil {
+		return err
+	}
 
-	return err
+	if err := insertFriendship(ctx, tx, userId, friendUserId, friendship_id); err != nil {
+		return err
+	}
 
+	return tx.Commit()
 }
 
-func (d *DataRepository) RemoveGroupFromFriendship(ctx context.Context, id int64) error {
-	query := `UPDATE friendship SET friendship SET group_id = $1,modified_at = $2  WHERE id = $3`
+// insertFriendship gives both users the chat and counts them as friends of each other
+func insertFriendship(ctx context.Context, tx *sql.Tx, userId, friendUserId int64, friendship_id string) error {
 
-	_, err := d.db.ExecContext(ctx, query, 0, time.Now(), id)
+	query := `INSERT INTO friendship(friendship_id,user_id,last_message,friend_user_id,friendship_type,modified_at) VALUES($1,$2,$3,$4,$5,$6)`
 
-	return err
-}
+	now := time.Now()
 
-func (d *DataRepository) DeleteFriendship(ctx context.Context, id int64) error {
-	query := `DELETE FROM friendship WHERE id = $1`
+	for _, pair := range [][2]int64{{userId, friendUserId}, {friendUserId, userId}} {
+		if _, err := tx.ExecContext(ctx, query, friendship_id, pair[0], "New chat", pair[1], "one-on-one", now); err != nil {
+			return err
+		}
+	}
 
-	_, err := d.db.ExecContext(ctx, query, id)
+	_, err := tx.ExecContext(ctx, `UPDATE users SET friends_count = friends_count + 1 WHERE id IN ($1,$2)`, userId, friendUserId)
 
 	return err
 }
 
-func (d *DataRepository) GetFriendshipByUserID(ctx context.Context, username, page, limit int64) (*PaginatedResponse, error) {
+func (d *DataRepository) GetFriendshipByUserID(ctx context.Context, userId, page, limit int64) (*PaginatedResponse, error) {
 
 	offset := (page - 1) * limit
 	var totalCount int
 
-	query := "SELECT * FROM friendship WHERE username = $1 LIMIT = $2 OFFSET = $3"
-	queryCount := `SELECT COUNT(*) WHERE username`
+	query := selectFriendship + ` WHERE f.user_id = $1 ORDER BY f.modified_at DESC NULLS LAST LIMIT $2 OFFSET $3`
+	queryCount := `SELECT COUNT(*) FROM friendship WHERE user_id = $1`
 
-	counrRow := d.db.QueryRowContext(ctx, queryCount, username)
-
-	err := counrRow.Scan(&totalCount)
+	err := d.db.QueryRowContext(ctx, queryCount, userId).Scan(&totalCount)
 
 	if err != nil {
 		return nil, err
 	}
 
-	row, err := d.db.QueryContext(ctx, query, username, limit, offset)
+	row, err := d.db.QueryContext(ctx, query, userId, limit, offset)
 
 	if err != nil {
 		return nil, err
 	}
 
-	var friendship []Friendship
+	defer row.Close()
+
+	friendship := []Friendship{}
 
 	for row.Next() {
 
 		item := Friendship{}
 
-		err := row.Scan(&item.ID, &item.Username, &item.FirendUsername, &item.FriendshipType, &item.GroupID, &item.CreatedAt)
+		err := row.Scan(&item.ID, &item.FriendShipId, &item.UserID, &item.Username, &item.LastMessage, &item.FriendUserID, &item.FirendUsername, &item.FriendshipType, &item.GroupID, &item.CreatedAt, &item.ModifiedAt)
 
 		if err != nil {
 			return nil, err
@@ -317,6 +290,35 @@ func (d *DataRepository) GetFriendshipByUserID(ctx context.Context, username, pa
 		TotalCount: totalCount,
 	}
 
-	return &p, nil
+	return &p, row.Err()
+
+}
+
+// everyone on a chat shares the same friendship_id
+func (d *DataRepository) GetFriendshipParticipants(ctx context.Context, friendshipId string) ([]string, error) {
+
+	query := `SELECT u.username FROM friendship f JOIN users u ON u.id = f.user_id WHERE f.friendship_id = $1`
+
+	row, err := d.db.QueryContext(ctx, query, friendshipId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer row.Close()
+
+	var usernames []string
+
+	for row.Next() {
+
+		var username string
+
+		if err := row.Scan(&username); err != nil {
+			return nil, err
+		}
+
+		usernames = append(usernames, username)
+	}
 
+	return usernames, row.Err()
 }
@@ -2,24 +2,53 @@ package database
 
 import (
 	"context"
+	"database/sql"
 	"errors"
+	"strconv"
+	"time"
 )
 
 type Group struct {
-	ID          int64  `json:"id"`
-	Name        string `json:"name"`
-	PicUrl      string `json:"pic_url"`
-	Description string `json:"description"`
-	CreatedAt   string `json:"created_at"`
-	ModifiedAt  string `json:"modified_at"`
+	ID               int64        `json:"id"`
+	Name             string       `json:"name"`
+	PicUrl           string       `json:"pic_url"`
+	Description      string       `json:"description"`
+	Privacy          GroupPrivacy `json:"privacy"`
+	AnnouncementOnly bool         `json:"announcement_only"`      // only admins post, everyone else reads and reacts
+	CommunityID      int64        `json:"community_id,omitempty"` // 0 when the group is not part of a community
+	CreatedAt        string       `json:"created_at"`
+	ModifiedAt       string       `json:"modified_at"`
+}
+
+// GroupPrivacy decides how someone who is not a member gets in
+type GroupPrivacy string
+
+const (
+	GroupPrivacyOpen       GroupPrivacy = "open"            // anyone can join
+	GroupPrivacyRequest    GroupPrivacy = "request_to_join" // an admin approves each request
+	GroupPrivacyInviteOnly GroupPrivacy = "invite_only"     // added by an admin or with an invite link
+)
+
+var ErrUnknownGroupPrivacy = errors.New("group privacy can be open, request_to_join or invite_only")
+
+func ParseGroupPrivacy(privacy string) (GroupPrivacy, error) {
+
+	switch p := GroupPrivacy(privacy); p {
+	case GroupPrivacyOpen, GroupPrivacyRequest, GroupPrivacyInviteOnly:
+		return p, nil
+	}
+
+	return "", ErrUnknownGroupPrivacy
 }
 
 type GroupMember struct {
-	ID        int64  `json:"id"`
-	GroupID   int64  `json:"group_id"`
-	Username  int64  `json:"username"`
-	Role      string `json:"role"` // admin or member
-	CreatedAt string `json:"created_at"`
+	ID         int64      `json:"id"`
+	GroupID    int64      `json:"group_id"`
+	UserID     int64      `json:"-"`
+	Username   string     `json:"username"`
+	Role       GroupRole  `json:"role"`
+	MutedUntil *time.Time `json:"muted_until,omitempty"`
+	CreatedAt  string     `json:"created_at"`
 } // once u add a user to a group they get added here and in friendship
 
 // type GroupMemberRemoved struct {
@@ -29,144 +58,343 @@ type GroupMember struct {
 // 	CreatedAt string `json:"created_at"`
 // }
 
-func (d *DataRepository) InsertGroup(ctx context.Context, name string) (int64, error) {
+// InsertGroup creates the group with ownerId as its owner and records it in the audit log, all or
+// nothing so a group is never left without an owner
+func (d *DataRepository) InsertGroup(ctx context.Context, ownerId int64, name string) (int64, error) {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback()
 
 	query := `INSERT INTO groupu(name,pic_url,description) VALUES($1,$2,$3) RETURNING id `
 
 	var id int64
 
-	err := d.db.QueryRowContext(ctx, query, name, "", "").Scan(&id)
+	if err := tx.QueryRowContext(ctx, query, name, "", "").Scan(&id); err != nil {
+		return 0, err
+	}
+
+	if err := d.insertGroupMembership(ctx, tx, ownerId, id, GroupRoleOwner); err != nil {
+		return 0, err
+	}
+
+	event := GroupAuditEvent{GroupID: id, ActorID: ownerId, Action: GroupEventCreated, After: name}
+
+	if err := insertGroupEvent(ctx, tx, event); err != nil {
+		return 0, err
+	}
 
-	return id, err
+	return id, tx.Commit()
 }
 
 func (d *DataRepository) GetGroupById(cxt context.Context, id int64) (*Group, error) {
 
-	query := `SELECT * FROM groupu WHERE id = $1`
+	query := `SELECT id,COALESCE(name,''),COALESCE(pic_url,''),COALESCE(description,''),privacy,announcement_only,COALESCE(community_id,0),created_at,COALESCE(modified_at,created_at) FROM groupu WHERE id = $1`
+
+	var group Group
 
-	row, err := d.db.QueryContext(cxt, query, id)
+	err := d.db.QueryRowContext(cxt, query, id).Scan(&group.ID, &group.Name, &group.PicUrl, &group.Description, &group.Privacy, &group.AnnouncementOnly, &group.CommunityID, &group.CreatedAt, &group.ModifiedAt)
 
 	if err != nil {
 		return nil, err
 	}
 
-	row.Next()
+	return &group, nil
+}
+
+// UpdateGroup changes the fields that are not empty and leaves the rest as they are
+func (d *DataRepository) UpdateGroup(cxt context.Context, id int, name, description, picUrl string) error {
 
-	var group Group
+	if name == "" && description == "" && picUrl == "" {
+		return errors.New("name,description,picUrl cannot all be empty")
+	}
+
+	query := `UPDATE groupu SET name = COALESCE(NULLIF($1,''),name), description = COALESCE(NULLIF($2,''),description),
+pic_url = COALESCE(NULLIF($3,''),pic_url), modified_at = NOW() WHERE id = $4`
+
+	_, err := d.db.ExecContext(cxt, query, name, description, picUrl, id)
+
+	return err
+}
+
+func (d *DataRepository) SetGroupPrivacy(ctx context.Context, id int64, privacy GroupPrivacy) error {
+
+	query := `UPDATE groupu SET privacy = $1, modified_at = NOW() WHERE id = $2`
+
+	_, err := d.db.ExecContext(ctx, query, privacy, id)
+
+	return err
+}
+
+func (d *DataRepository) SetGroupAnnouncementOnly(ctx context.Context, id int64, announcementOnly bool) error {
+
+	query := `UPDATE groupu SET announcement_only = $1, modified_at = NOW() WHERE id = $2`
+
+	_, err := d.db.ExecContext(ctx, query, announcementOnly, id)
+
+	return err
+}
+
+//------------------------------ GroupMemeber ----------------------------------------------------------------------
+
+const selectGroupMember = `SELECT m.id,m.group_id,m.user_id,u.username,m.role,m.muted_until,m.created_at FROM group_member m JOIN users u ON u.id = m.user_id`
 
-	err = row.Scan(&group.ID, &group.Name, &group.PicUrl, &group.Description, &group.CreatedAt, &group.ModifiedAt)
+func scanGroupMember(row rowScanner) (*GroupMember, error) {
+
+	var member GroupMember
+
+	err := row.Scan(&member.ID, &member.GroupID, &member.UserID, &member.Username, &member.Role, &member.MutedUntil, &member.CreatedAt)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return &group, nil
+	return &member, nil
 }
 
-func (d *DataRepository) UpdateGroup(cxt context.Context, id int, name, description, picUrl string) error {
+// IsMuted reports whether the member may read but not post right now
+func (m *GroupMember) IsMuted() bool {
+	return m.MutedUntil != nil && m.MutedUntil.After(time.Now())
+}
 
-	queryAll := `UPDATE groupu SET name = $1, description = $2,pic_url = $3 WHERE id = $4?`
-	queryPicUrl := `UPDATE groupu SET pic_url = $1 WHERE id = $2`
-	queryName := `UPDATE groupu SET name = $1 WHERE id = $2`
-	queryDescription := `UPDATE groupu SET description = $1 WHERE id = $2`
+var (
+	ErrAlreadyGroupMember = errors.New("already a member of this group")
+	ErrGroupFull          = errors.New("this group has reached its member limit")
+)
 
-	if name != "" && description != "" && picUrl != "" {
-		_, err := d.db.ExecContext(cxt, queryAll, name, description, picUrl)
-		if err != nil {
-			return err
-		}
-		return nil
-	} else if name != "" {
-		_, err := d.db.ExecContext(cxt, queryName, name)
-		if err != nil {
-			return err
-		}
-		return nil
-	} else if description != "" {
-		_, err := d.db.ExecContext(cxt, queryDescription, description)
-		if err != nil {
+// insertGroupMembership adds the member and their group chat. Every way into a group goes through
+// it so the two rows and the member counts never get out of step, banned users stay out and the
+// member limit holds. Nothing is written when it refuses.
+func (d *DataRepository) insertGroupMembership(ctx context.Context, tx *sql.Tx, userId, groupId int64, role GroupRole) error {
+
+	banned, err := groupBanned(ctx, tx, userId, groupId)
+
+	if err != nil {
+		return err
+	}
+
+	if banned {
+		return ErrBannedFromGroup
+	}
+
+	admitted, err := communityAdmits(ctx, tx, userId, groupId)
+
+	if err != nil {
+		return err
+	}
+
+	if !admitted {
+		return ErrNotCommunityMember
+	}
+
+	var memberCount int64
+
+	// the row lock makes concurrent joins wait their turn so the limit cannot be overshot
+	if err := tx.QueryRowContext(ctx, `SELECT member_count FROM groupu WHERE id = $1 FOR UPDATE`, groupId).Scan(&memberCount); err != nil {
+		return err
+	}
+
+	if d.maxGroupMembers > 0 && memberCount >= d.maxGroupMembers {
+
+		var isMember bool
+
+		if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM group_member WHERE group_id = $1 AND user_id = $2)`, groupId, userId).Scan(&isMember); err != nil {
 			return err
 		}
-		return nil
-	} else if picUrl != "" {
-		_, err := d.db.ExecContext(cxt, queryPicUrl, picUrl)
-		if err != nil {
-			return err
+
+		if isMember {
+			return ErrAlreadyGroupMember
 		}
-		return nil
+
+		return ErrGroupFull
 	}
 
-	return errors.New("name,description,picUrl cannot all be empty")
+	query := `INSERT INTO group_member(user_id,group_id,role) VALUES($1,$2,$3) ON CONFLICT (group_id,user_id) DO NOTHING`
+
+	result, err := tx.ExecContext(ctx, query, userId, groupId, role)
+
+	if err != nil {
+		return err
+	}
+
+	if inserted, _ := result.RowsAffected(); inserted == 0 {
+		return ErrAlreadyGroupMember
+	}
+
+	// a group chat uses the group id as its friendship_id
+	query = `INSERT INTO friendship(friendship_id,user_id,last_message,friendship_type,group_id,modified_at) VALUES($1,$2,$3,$4,$5,$6)`
+
+	if _, err := tx.ExecContext(ctx, query, strconv.FormatInt(groupId, 10), userId, "New chat", "group", groupId, time.Now()); err != nil {
+		return err
+	}
+
+	return countGroupMembership(ctx, tx, userId, groupId, 1)
 }
 
-func (d *DataRepository) DeleteGroup(ctx context.Context, id int64) error {
-	query := `DELETE FROM groupu WHERE id = $1`
+// countGroupMembership moves the member count of the group and the group count of the user by delta
+func countGroupMembership(ctx context.Context, tx *sql.Tx, userId, groupId int64, delta int) error {
+
+	if _, err := tx.ExecContext(ctx, `UPDATE groupu SET member_count = member_count + $1 WHERE id = $2`, delta, groupId); err != nil {
+		return err
+	}
 
-	_, err := d.db.ExecContext(ctx, query, id)
+	_, err := tx.ExecContext(ctx, `UPDATE users SET groups_count = groups_count + $1 WHERE id = $2`, delta, userId)
 
 	return err
 }
 
-//------------------------------ GroupMemeber ----------------------------------------------------------------------
+// deleteGroupMembership is the way out of a group, it reports false when the user was not a member
+func deleteGroupMembership(ctx context.Context, tx *sql.Tx, userId, groupId int64) (bool, error) {
 
-func (d *DataRepository) InsertGroupMember(ctx context.Context, username string, groupId int64, role string) error {
+	result, err := tx.ExecContext(ctx, `DELETE FROM group_member WHERE user_id = $1 AND group_id = $2`, userId, groupId)
 
-	query := `INSERT INTO group_member(username,group_id,role) VALUES($1,$2,$3)`
+	if err != nil {
+		return false, err
+	}
 
-	_, err := d.db.ExecContext(ctx, query, username, groupId, role)
+	deleted, err := result.RowsAffected()
 
-	return err
+	if err != nil {
+		return false, err
+	}
+
+	if deleted == 0 {
+		return false, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM friendship WHERE user_id = $1 AND group_id = $2`, userId, groupId); err != nil {
+		return false, err
+	}
+
+	return true, countGroupMembership(ctx, tx, userId, groupId, -1)
 }
 
-func (d *DataRepository) GetGroupMemberByUsername(cxt context.Context, username string, id int) (*GroupMember, error) {
+// insertGroupJoin is a user joining on their own, through an invite, an approved request or an open
+// group, the group chat gets info so the others see who came in and the audit log records how. info
+// only needs MessageID and TextContent, the rest is filled in. actorId is whoever let them in.
+func (d *DataRepository) insertGroupJoin(ctx context.Context, tx *sql.Tx, actorId, userId, groupId int64, via string, info *Message) error {
 
-	query := `SELECT * FROM group_member WHERE group_id = $1 AND username = $2`
+	if err := d.insertGroupMembership(ctx, tx, userId, groupId, GroupRoleMember); err != nil {
+		return err
+	}
 
-	row, err := d.db.QueryContext(cxt, query, id, username)
+	event := GroupAuditEvent{
+		GroupID:  groupId,
+		ActorID:  actorId,
+		TargetID: userId,
+		Action:   GroupEventMemberJoined,
+		After:    via,
+	}
 
-	if err != nil {
-		return nil, err
+	if err := insertGroupEvent(ctx, tx, event); err != nil {
+		return err
 	}
 
-	var member GroupMember
+	info.FriendshipID = strconv.FormatInt(groupId, 10)
+	info.SenderID = userId
+	info.MessageType = "MessageInfo"
+
+	return insertMessage(ctx, tx, info, time.Now())
+}
 
-	err = row.Scan(&member.ID, &member.GroupID, &member.Username, &member.Role, &member.CreatedAt)
+// AddGroupMember is actorId putting userId in the group, refused with ErrUserBlocked when userId
+// blocked the actor. event is recorded with the membership.
+func (d *DataRepository) AddGroupMember(ctx context.Context, actorId, userId, groupId int64, role GroupRole, event GroupAuditEvent) error {
+
+	tx, err := d.db.BeginTx(ctx, nil)
 
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return &member,err
+	defer tx.Rollback()
+
+	if actorId != userId {
+
+		blocked, err := blocks(ctx, tx, userId, actorId)
+
+		if err != nil {
+			return err
+		}
+
+		if blocked {
+			return ErrUserBlocked
+		}
+	}
+
+	if err := d.insertGroupMembership(ctx, tx, userId, groupId, role); err != nil {
+		return err
+	}
+
+	if err := insertGroupEvent(ctx, tx, event); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (d *DataRepository) GetGroupMembersByGroupId(cxt context.Context, id, limit, page int64) (*PaginatedResponse, error) {
+func (d *DataRepository) GetGroupMember(cxt context.Context, userId, groupId int64) (*GroupMember, error) {
+
+	query := selectGroupMember + ` WHERE m.group_id = $1 AND m.user_id = $2`
+
+	return scanGroupMember(d.db.QueryRowContext(cxt, query, groupId, userId))
+}
+
+// GroupMemberProfile is a row of the member list, the membership together with what the others see
+// of the user
+type GroupMemberProfile struct {
+	Username    string     `json:"username"`
+	DisplayName string     `json:"display_name"`
+	ImageUrl    string     `json:"image_url"`
+	Role        GroupRole  `json:"role"`
+	IsOnline    bool       `json:"is_online"`
+	LastSeenAt  *time.Time `json:"last_seen_at,omitempty"`
+	MutedUntil  *time.Time `json:"muted_until,omitempty"`
+	JoinedAt    string     `json:"joined_at"`
+}
+
+// GetGroupMembersByGroupId lists the members owner first, then by role and in the order they joined.
+// search matches the start of a username or display name whatever the case and may be empty.
+func (d *DataRepository) GetGroupMembersByGroupId(cxt context.Context, id int64, search string, limit, page int64) (*PaginatedResponse, error) {
 
 	offset := (page - 1) * limit
 
 	var totalCount int64
 
-	query := `SELECT * FROM group_member WHERE group_id = $1 LIMIT $2 OFFSET $3`
-	queryCount := `SELECT COUNT(*) FROM group_member WHERE group_id = $1`
+	from := ` FROM group_member m JOIN users u ON u.id = m.user_id WHERE m.group_id = $1
+AND ($2 = '' OR lower(u.username) LIKE lower($2) || '%' OR lower(u.display_name) LIKE lower($2) || '%')`
 
-	if err := d.db.QueryRowContext(cxt, queryCount, id).Scan(&totalCount); err != nil {
+	if search == "" {
+		// the count kept on the group saves counting a large group on every page
+		if err := d.db.QueryRowContext(cxt, `SELECT member_count FROM groupu WHERE id = $1`, id).Scan(&totalCount); err != nil {
+			return nil, err
+		}
+	} else if err := d.db.QueryRowContext(cxt, `SELECT COUNT(*)`+from, id, search).Scan(&totalCount); err != nil {
 		return nil, err
 	}
 
-	row, err := d.db.QueryContext(cxt, query, id, limit, offset)
+	query := `SELECT u.username,COALESCE(u.display_name,''),COALESCE(u.image_url,''),m.role,u.is_online,u.last_seen_at,m.muted_until,m.created_at` + from +
+		` ORDER BY CASE m.role WHEN 'owner' THEN 0 WHEN 'admin' THEN 1 WHEN 'moderator' THEN 2 ELSE 3 END, m.created_at, m.id LIMIT $3 OFFSET $4`
+
+	row, err := d.db.QueryContext(cxt, query, id, search, limit, offset)
 
 	if err != nil {
 		return nil, err
 	}
 
-	var members []GroupMember
+	defer row.Close()
 
-	for row.Next() {
+	members := []GroupMemberProfile{}
 
-		var member GroupMember
+	for row.Next() {
 
-		err := row.Scan(&member.ID, &member.GroupID, &member.Username, &member.Role, &member.CreatedAt)
+		var member GroupMemberProfile
 
-		if err != nil {
+		if err := row.Scan(&member.Username, &member.DisplayName, &member.ImageUrl, &member.Role, &member.IsOnline, &member.LastSeenAt, &member.MutedUntil, &member.JoinedAt); err != nil {
 			return nil, err
 		}
 
@@ -180,22 +408,5 @@ func (d *DataRepository) GetGroupMembersByGroupId(cxt context.Context, id, limit
 		Limit:      int(limit),
 	}
 
-	return &p, nil
+	return &p, row.Err()
 }
-
-//remove from group
-func (d *DataRepository) DeleteGroupMember(ctx context.Context, username string,id int64) error {
-	query := `DELETE FROM group_member WHERE username = $1 AND group_id = $2`
-
-	_, err := d.db.ExecContext(ctx, query, username,id)
-
-	return err
-}
-
-func (d *DataRepository) DeleteAllGroupMembers(ctx context.Context,id int64) error{
-		query := `DELETE FROM group_member WHERE group_id = $1`
-
-	_, err := d.db.ExecContext(ctx, query,id)
-
-	return err
-}
\ No newline at end of file
@@ -0,0 +1,213 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// GroupEvent is what happened in a group, stored as the action of a GroupAuditEvent
+type GroupEvent string
+
+const (
+	GroupEventCreated              GroupEvent = "group_created"
+	GroupEventRenamed              GroupEvent = "group_renamed"
+	GroupEventDescriptionChanged   GroupEvent = "description_changed"
+	GroupEventPictureChanged       GroupEvent = "picture_changed"
+	GroupEventPrivacyChanged       GroupEvent = "privacy_changed"
+	GroupEventAnnouncementChanged  GroupEvent = "announcement_changed"
+	GroupEventPermissionChanged    GroupEvent = "permission_changed"
+	GroupEventMemberAdded          GroupEvent = "member_added"
+	GroupEventMemberJoined         GroupEvent = "member_joined" // after is how: invite, join_request, open_group or community
+	GroupEventMemberKicked         GroupEvent = "member_kicked" // after is community when they were removed from it
+	GroupEventMemberLeft           GroupEvent = "member_left"
+	GroupEventMemberPromoted       GroupEvent = "member_promoted"
+	GroupEventMemberDemoted        GroupEvent = "member_demoted"
+	GroupEventOwnershipOffered     GroupEvent = "ownership_offered"
+	GroupEventOwnershipTransferred GroupEvent = "ownership_transferred" // after is accepted or automatic
+	GroupEventMemberBanned         GroupEvent = "member_banned"
+	GroupEventMemberUnbanned       GroupEvent = "member_unbanned"
+	GroupEventMemberMuted          GroupEvent = "member_muted"
+	GroupEventMemberUnmuted        GroupEvent = "member_unmuted"
+	GroupEventJoinRequestRejected  GroupEvent = "join_request_rejected"
+	GroupEventInviteCreated        GroupEvent = "invite_created"
+	GroupEventInviteRevoked        GroupEvent = "invite_revoked"
+	GroupEventMessagePinned        GroupEvent = "message_pinned"
+	GroupEventMessageUnpinned      GroupEvent = "message_unpinned"
+	GroupEventMessageDeleted       GroupEvent = "message_deleted" // only when a moderator deletes someone else's
+)
+
+var groupEvents = map[GroupEvent]bool{
+	GroupEventCreated:              true,
+	GroupEventRenamed:              true,
+	GroupEventDescriptionChanged:   true,
+	GroupEventPictureChanged:       true,
+	GroupEventPrivacyChanged:       true,
+	GroupEventAnnouncementChanged:  true,
+	GroupEventPermissionChanged:    true,
+	GroupEventMemberAdded:          true,
+	GroupEventMemberJoined:         true,
+	GroupEventMemberKicked:         true,
+	GroupEventMemberLeft:           true,
+	GroupEventMemberPromoted:       true,
+	GroupEventMemberDemoted:        true,
+	GroupEventOwnershipOffered:     true,
+	GroupEventOwnershipTransferred: true,
+	GroupEventMemberBanned:         true,
+	GroupEventMemberUnbanned:       true,
+	GroupEventMemberMuted:          true,
+	GroupEventMemberUnmuted:        true,
+	GroupEventJoinRequestRejected:  true,
+	GroupEventInviteCreated:        true,
+	GroupEventInviteRevoked:        true,
+	GroupEventMessagePinned:        true,
+	GroupEventMessageUnpinned:      true,
+	GroupEventMessageDeleted:       true,
+}
+
+var ErrUnknownGroupEvent = errors.New("unknown group audit action")
+
+func ParseGroupEvent(action string) (GroupEvent, error) {
+
+	if !groupEvents[GroupEvent(action)] {
+		return "", ErrUnknownGroupEvent
+	}
+
+	return GroupEvent(action), nil
+}
+
+// GroupAuditFilter narrows the audit log, zero values match everything
+type GroupAuditFilter struct {
+	Action GroupEvent
+	Actor  string
+	Target string
+	From   *time.Time
+	To     *time.Time
+}
+
+type GroupAuditEvent struct {
+	ID       int64      `json:"id"`
+	GroupID  int64      `json:"group_id"`
+	ActorID  int64      `json:"-"` // 0 when the system acted
+	Actor    string     `json:"actor,omitempty"`
+	TargetID int64      `json:"-"` // 0 when the event is about the group itself
+	Target   string     `json:"target,omitempty"`
+	Action   GroupEvent `json:"action"`
+	Before   string     `json:"before,omitempty"` // "" when there was no value
+	After    string     `json:"after,omitempty"`
+	// set by the database
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// auditValue stores "" as NULL
+func auditValue(value string) *string {
+
+	if value == "" {
+		return nil
+	}
+
+	return &value
+}
+
+func nullableUserId(id int64) any {
+
+	if id == 0 {
+		return nil
+	}
+
+	return id
+}
+
+// insertGroupEvent writes event with the change it records, db is either the pool or a transaction
+func insertGroupEvent(ctx context.Context, db execer, event GroupAuditEvent) error {
+
+	query := `INSERT INTO group_audit_event(group_id,actor_id,target_id,action,before_value,after_value) VALUES($1,$2,$3,$4,$5,$6)`
+
+	_, err := db.ExecContext(ctx, query, event.GroupID, nullableUserId(event.ActorID), nullableUserId(event.TargetID), event.Action, auditValue(event.Before), auditValue(event.After))
+
+	return err
+}
+
+func (d *DataRepository) InsertGroupEvent(ctx context.Context, event GroupAuditEvent) error {
+	return insertGroupEvent(ctx, d.db, event)
+}
+
+// GetGroupAuditEvents pages through the audit log of a group, newest first
+func (d *DataRepository) GetGroupAuditEvents(ctx context.Context, groupId int64, filter GroupAuditFilter, limit, page int64) (*PaginatedResponse, error) {
+
+	offset := (page - 1) * limit
+
+	where := ` WHERE e.group_id = $1`
+	args := []any{groupId}
+
+	add := func(condition string, value any) {
+		args = append(args, value)
+		where += ` AND ` + condition + ` $` + strconv.Itoa(len(args))
+	}
+
+	if filter.Action != "" {
+		add(`e.action =`, filter.Action)
+	}
+
+	if filter.Actor != "" {
+		add(`a.username =`, filter.Actor)
+	}
+
+	if filter.Target != "" {
+		add(`t.username =`, filter.Target)
+	}
+
+	if filter.From != nil {
+		add(`e.created_at >=`, *filter.From)
+	}
+
+	if filter.To != nil {
+		add(`e.created_at <`, *filter.To)
+	}
+
+	from := ` FROM group_audit_event e LEFT JOIN users a ON a.id = e.actor_id LEFT JOIN users t ON t.id = e.target_id`
+
+	var totalCount int64
+
+	if err := d.db.QueryRowContext(ctx, `SELECT COUNT(*)`+from+where, args...).Scan(&totalCount); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT e.id,e.group_id,COALESCE(e.actor_id,0),COALESCE(a.username,''),COALESCE(e.target_id,0),COALESCE(t.username,''),
+e.action,COALESCE(e.before_value,''),COALESCE(e.after_value,''),e.created_at` + from + where +
+		` ORDER BY e.created_at DESC, e.id DESC LIMIT $` + strconv.Itoa(len(args)+1) + ` OFFSET $` + strconv.Itoa(len(args)+2)
+
+	rows, err := d.db.QueryContext(ctx, query, append(args, limit, offset)...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	events := []GroupAuditEvent{}
+
+	for rows.Next() {
+
+		var event GroupAuditEvent
+
+		err := rows.Scan(&event.ID, &event.GroupID, &event.ActorID, &event.Actor, &event.TargetID, &event.Target,
+			&event.Action, &event.Before, &event.After, &event.CreatedAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, event)
+	}
+
+	p := PaginatedResponse{
+		Data:       events,
+		TotalCount: int(totalCount),
+		Page:       int(page),
+		Limit:      int(limit),
+	}
+
+	return &p, rows.Err()
+}
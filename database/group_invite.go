@@ -0,0 +1,144 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrInviteInvalid = errors.New("invite link is invalid, expired or used up")
+
+type GroupInvite struct {
+	ID        int64      `json:"id"`
+	GroupID   int64      `json:"group_id"`
+	CreatedBy string     `json:"created_by"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	MaxUses   *int64     `json:"max_uses,omitempty"`
+	Uses      int64      `json:"uses"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// GroupInvitePreview is what anyone holding the link may see before joining
+type GroupInvitePreview struct {
+	GroupID     int64  `json:"group_id"`
+	Name        string `json:"name"`
+	PicUrl      string `json:"pic_url"`
+	Description string `json:"description"`
+	MemberCount int64  `json:"member_count"`
+}
+
+const inviteUsable = `revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW()) AND (max_uses IS NULL OR uses < max_uses)`
+
+func (d *DataRepository) InsertGroupInvite(ctx context.Context, groupId, createdById int64, tokenHash string, expiresAt *time.Time, maxUses *int64) (*GroupInvite, error) {
+
+	query := `INSERT INTO group_invite(group_id,token_hash,created_by_id,expires_at,max_uses) VALUES($1,$2,$3,$4,$5) RETURNING id,created_at`
+
+	invite := GroupInvite{GroupID: groupId, ExpiresAt: expiresAt, MaxUses: maxUses}
+
+	err := d.db.QueryRowContext(ctx, query, groupId, tokenHash, createdById, expiresAt, maxUses).Scan(&invite.ID, &invite.CreatedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &invite, nil
+}
+
+func (d *DataRepository) GetGroupInvites(ctx context.Context, groupId int64) ([]GroupInvite, error) {
+
+	query := `SELECT i.id,i.group_id,COALESCE(u.username,'` + DeletedUsername + `'),i.expires_at,i.max_uses,i.uses,i.revoked_at,i.created_at
+FROM group_invite i LEFT JOIN users u ON u.id = i.created_by_id WHERE i.group_id = $1 ORDER BY i.created_at DESC`
+
+	rows, err := d.db.QueryContext(ctx, query, groupId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	invites := []GroupInvite{}
+
+	for rows.Next() {
+
+		var invite GroupInvite
+
+		if err := rows.Scan(&invite.ID, &invite.GroupID, &invite.CreatedBy, &invite.ExpiresAt, &invite.MaxUses, &invite.Uses, &invite.RevokedAt, &invite.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		invites = append(invites, invite)
+	}
+
+	return invites, rows.Err()
+}
+
+// RevokeGroupInvite reports false when the group has no such invite or it was already revoked
+func (d *DataRepository) RevokeGroupInvite(ctx context.Context, groupId, inviteId int64) (bool, error) {
+
+	query := `UPDATE group_invite SET revoked_at = NOW() WHERE id = $1 AND group_id = $2 AND revoked_at IS NULL`
+
+	result, err := d.db.ExecContext(ctx, query, inviteId, groupId)
+
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+
+	return affected > 0, err
+}
+
+func (d *DataRepository) GetGroupInvitePreview(ctx context.Context, tokenHash string) (*GroupInvitePreview, error) {
+
+	query := `SELECT g.id,COALESCE(g.name,''),COALESCE(g.pic_url,''),COALESCE(g.description,''),g.member_count
+FROM group_invite i JOIN groupu g ON g.id = i.group_id WHERE i.token_hash = $1 AND ` + inviteUsable
+
+	var preview GroupInvitePreview
+
+	err := d.db.QueryRowContext(ctx, query, tokenHash).Scan(&preview.GroupID, &preview.Name, &preview.PicUrl, &preview.Description, &preview.MemberCount)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrInviteInvalid
+		}
+		return nil, err
+	}
+
+	return &preview, nil
+}
+
+// JoinGroupByInvite uses one slot of the invite and joins the user to the group in one transaction
+func (d *DataRepository) JoinGroupByInvite(ctx context.Context, tokenHash string, userId int64, info *Message) error {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	var inviteId, groupId int64
+
+	query := `SELECT id,group_id FROM group_invite WHERE token_hash = $1 AND ` + inviteUsable + ` FOR UPDATE`
+
+	if err := tx.QueryRowContext(ctx, query, tokenHash).Scan(&inviteId, &groupId); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrInviteInvalid
+		}
+		return err
+	}
+
+	if err := d.insertGroupJoin(ctx, tx, userId, userId, groupId, "invite", info); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE group_invite SET uses = uses + 1 WHERE id = $1`, inviteId); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
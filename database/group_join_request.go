@@ -0,0 +1,255 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrJoinRequestPending  = errors.New("you already asked to join this group")
+	ErrJoinRequestNotFound = errors.New("no pending join request found")
+)
+
+type GroupJoinRequest struct {
+	ID        int64     `json:"id"`
+	GroupID   int64     `json:"group_id"`
+	UserID    int64     `json:"-"`
+	Username  string    `json:"username"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (d *DataRepository) InsertGroupJoinRequest(ctx context.Context, userId, groupId int64, message string) (int64, error) {
+
+	banned, err := groupBanned(ctx, d.db, userId, groupId)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if banned {
+		return 0, ErrBannedFromGroup
+	}
+
+	admitted, err := communityAdmits(ctx, d.db, userId, groupId)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if !admitted {
+		return 0, ErrNotCommunityMember
+	}
+
+	query := `INSERT INTO group_join_request(group_id,user_id,message) VALUES($1,$2,$3) ON CONFLICT (group_id,user_id) WHERE status = 'pending' DO NOTHING RETURNING id`
+
+	var id int64
+
+	err = d.db.QueryRowContext(ctx, query, groupId, userId, message).Scan(&id)
+
+	if err == sql.ErrNoRows {
+		return 0, ErrJoinRequestPending
+	}
+
+	return id, err
+}
+
+func (d *DataRepository) GetGroupJoinRequests(ctx context.Context, groupId, limit, page int64) (*PaginatedResponse, error) {
+
+	offset := (page - 1) * limit
+
+	var totalCount int64
+
+	queryCount := `SELECT COUNT(*) FROM group_join_request WHERE group_id = $1 AND status = 'pending'`
+
+	if err := d.db.QueryRowContext(ctx, queryCount, groupId).Scan(&totalCount); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT r.id,r.group_id,r.user_id,u.username,r.message,r.created_at FROM group_join_request r JOIN users u ON u.id = r.user_id
+WHERE r.group_id = $1 AND r.status = 'pending' ORDER BY r.created_at, r.id LIMIT $2 OFFSET $3`
+
+	rows, err := d.db.QueryContext(ctx, query, groupId, limit, offset)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	requests := []GroupJoinRequest{}
+
+	for rows.Next() {
+
+		var request GroupJoinRequest
+
+		if err := rows.Scan(&request.ID, &request.GroupID, &request.UserID, &request.Username, &request.Message, &request.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		requests = append(requests, request)
+	}
+
+	p := PaginatedResponse{
+		Data:       requests,
+		TotalCount: int(totalCount),
+		Page:       int(page),
+		Limit:      int(limit),
+	}
+
+	return &p, rows.Err()
+}
+
+// decideJoinRequest closes a pending request and returns who sent it
+func decideJoinRequest(ctx context.Context, tx *sql.Tx, groupId, requestId, decidedById int64, status string) (int64, error) {
+
+	query := `UPDATE group_join_request SET status = $1, decided_by_id = $2, decided_at = NOW()
+WHERE id = $3 AND group_id = $4 AND status = 'pending' RETURNING user_id`
+
+	var userId int64
+
+	err := tx.QueryRowContext(ctx, query, status, decidedById, requestId, groupId).Scan(&userId)
+
+	if err == sql.ErrNoRows {
+		return 0, ErrJoinRequestNotFound
+	}
+
+	return userId, err
+}
+
+func (d *DataRepository) GetGroupJoinRequest(ctx context.Context, groupId, requestId int64) (*GroupJoinRequest, error) {
+
+	query := `SELECT r.id,r.group_id,r.user_id,u.username,r.message,r.created_at FROM group_join_request r JOIN users u ON u.id = r.user_id
+WHERE r.id = $1 AND r.group_id = $2 AND r.status = 'pending'`
+
+	var request GroupJoinRequest
+
+	err := d.db.QueryRowContext(ctx, query, requestId, groupId).Scan(&request.ID, &request.GroupID, &request.UserID, &request.Username, &request.Message, &request.CreatedAt)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrJoinRequestNotFound
+		}
+		return nil, err
+	}
+
+	return &request, nil
+}
+
+// ApproveGroupJoinRequest closes the request and joins its sender to the group in one transaction,
+// info is filled in as for insertGroupJoin
+func (d *DataRepository) ApproveGroupJoinRequest(ctx context.Context, groupId, requestId, approvedById int64, info *Message) error {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	userId, err := decideJoinRequest(ctx, tx, groupId, requestId, approvedById, "approved")
+
+	if err != nil {
+		return err
+	}
+
+	if err := d.insertGroupJoin(ctx, tx, approvedById, userId, groupId, "join_request", info); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (d *DataRepository) RejectGroupJoinRequest(ctx context.Context, groupId, requestId, rejectedById int64) error {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	userId, err := decideJoinRequest(ctx, tx, groupId, requestId, rejectedById, "rejected")
+
+	if err != nil {
+		return err
+	}
+
+	event := GroupAuditEvent{
+		GroupID:  groupId,
+		ActorID:  rejectedById,
+		TargetID: userId,
+		Action:   GroupEventJoinRequestRejected,
+	}
+
+	if err := insertGroupEvent(ctx, tx, event); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// JoinOpenGroup joins the user to an open group, closing any request they left while it was not
+func (d *DataRepository) JoinOpenGroup(ctx context.Context, userId, groupId int64, info *Message) error {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := d.insertGroupJoin(ctx, tx, userId, userId, groupId, "open_group", info); err != nil {
+		return err
+	}
+
+	query := `UPDATE group_join_request SET status = 'approved', decided_at = NOW() WHERE group_id = $1 AND user_id = $2 AND status = 'pending'`
+
+	if _, err := tx.ExecContext(ctx, query, groupId, userId); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetGroupUsernamesByRole lists the members of a group holding one of roles
+func (d *DataRepository) GetGroupUsernamesByRole(ctx context.Context, groupId int64, roles []GroupRole) ([]string, error) {
+
+	names := make([]string, len(roles))
+
+	for i, role := range roles {
+		names[i] = string(role)
+	}
+
+	query := `SELECT u.username FROM group_member m JOIN users u ON u.id = m.user_id WHERE m.group_id = $1 AND m.role = ANY($2)`
+
+	rows, err := d.db.QueryContext(ctx, query, groupId, pq.Array(names))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	usernames := []string{}
+
+	for rows.Next() {
+
+		var username string
+
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+
+		usernames = append(usernames, username)
+	}
+
+	return usernames, rows.Err()
+}
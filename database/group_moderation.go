@@ -0,0 +1,192 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrBannedFromGroup = errors.New("you are banned from this group")
+	ErrNotGroupMember  = errors.New("not a member of this group")
+)
+
+type GroupBan struct {
+	GroupID    int64      `json:"group_id"`
+	UserID     int64      `json:"-"`
+	Username   string     `json:"username"`
+	BannedByID int64      `json:"-"`
+	BannedBy   string     `json:"banned_by"`
+	Reason     string     `json:"reason"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"` // nil is permanent
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+const activeBan = `(expires_at IS NULL OR expires_at > NOW())`
+
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func groupBanned(ctx context.Context, db rowQueryer, userId, groupId int64) (bool, error) {
+
+	query := `SELECT EXISTS (SELECT 1 FROM group_ban WHERE group_id = $1 AND user_id = $2 AND ` + activeBan + `)`
+
+	var banned bool
+
+	err := db.QueryRowContext(ctx, query, groupId, userId).Scan(&banned)
+
+	return banned, err
+}
+
+// RemoveGroupMember kicks the member, they may join again. event is recorded with the removal.
+func (d *DataRepository) RemoveGroupMember(ctx context.Context, userId, groupId int64, event GroupAuditEvent) error {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	removed, err := deleteGroupMembership(ctx, tx, userId, groupId)
+
+	if err != nil {
+		return err
+	}
+
+	if !removed {
+		return ErrNotGroupMember
+	}
+
+	if err := insertGroupEvent(ctx, tx, event); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// BanGroupMember removes the user if they are a member, closes their pending join requests and
+// keeps them out until the ban expires. Banning again replaces the reason and expiry.
+func (d *DataRepository) BanGroupMember(ctx context.Context, ban GroupBan, event GroupAuditEvent) error {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := `INSERT INTO group_ban(group_id,user_id,banned_by_id,reason,expires_at) VALUES($1,$2,$3,$4,$5)
+ON CONFLICT (group_id,user_id) DO UPDATE SET banned_by_id = EXCLUDED.banned_by_id, reason = EXCLUDED.reason, expires_at = EXCLUDED.expires_at, created_at = NOW()`
+
+	if _, err := tx.ExecContext(ctx, query, ban.GroupID, ban.UserID, ban.BannedByID, ban.Reason, ban.ExpiresAt); err != nil {
+		return err
+	}
+
+	if _, err := deleteGroupMembership(ctx, tx, ban.UserID, ban.GroupID); err != nil {
+		return err
+	}
+
+	query = `UPDATE group_join_request SET status = 'rejected', decided_by_id = $1, decided_at = NOW() WHERE group_id = $2 AND user_id = $3 AND status = 'pending'`
+
+	if _, err := tx.ExecContext(ctx, query, ban.BannedByID, ban.GroupID, ban.UserID); err != nil {
+		return err
+	}
+
+	if err := insertGroupEvent(ctx, tx, event); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UnbanGroupMember reports false when the user had no active ban
+func (d *DataRepository) UnbanGroupMember(ctx context.Context, userId, groupId int64, event GroupAuditEvent) (bool, error) {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM group_ban WHERE group_id = $1 AND user_id = $2 AND `+activeBan, groupId, userId)
+
+	if err != nil {
+		return false, err
+	}
+
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return false, nil
+	}
+
+	if err := insertGroupEvent(ctx, tx, event); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// GetGroupBans lists the bans still in force, newest first
+func (d *DataRepository) GetGroupBans(ctx context.Context, groupId int64) ([]GroupBan, error) {
+
+	query := `SELECT b.group_id,b.user_id,u.username,COALESCE(b.banned_by_id,0),COALESCE(a.username,'` + DeletedUsername + `'),b.reason,b.expires_at,b.created_at
+FROM group_ban b JOIN users u ON u.id = b.user_id LEFT JOIN users a ON a.id = b.banned_by_id
+WHERE b.group_id = $1 AND (b.expires_at IS NULL OR b.expires_at > NOW()) ORDER BY b.created_at DESC`
+
+	rows, err := d.db.QueryContext(ctx, query, groupId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	bans := []GroupBan{}
+
+	for rows.Next() {
+
+		var ban GroupBan
+
+		if err := rows.Scan(&ban.GroupID, &ban.UserID, &ban.Username, &ban.BannedByID, &ban.BannedBy, &ban.Reason, &ban.ExpiresAt, &ban.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		bans = append(bans, ban)
+	}
+
+	return bans, rows.Err()
+}
+
+// SetGroupMemberMute mutes the member until until, nil unmutes them
+func (d *DataRepository) SetGroupMemberMute(ctx context.Context, userId, groupId int64, until *time.Time, event GroupAuditEvent) error {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `UPDATE group_member SET muted_until = $1 WHERE user_id = $2 AND group_id = $3`, until, userId, groupId)
+
+	if err != nil {
+		return err
+	}
+
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return ErrNotGroupMember
+	}
+
+	if err := insertGroupEvent(ctx, tx, event); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
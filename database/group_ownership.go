@@ -0,0 +1,304 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+)
+
+var ErrNoOwnershipTransfer = errors.New("no ownership transfer is waiting for you in this group")
+
+type GroupOwnershipTransfer struct {
+	GroupID   int64     `json:"group_id"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DeletedGroup lists the files a deleted group leaves behind, the caller removes them once the
+// transaction is committed
+type DeletedGroup struct {
+	ID        int64
+	PicUrl    string
+	MediaUrls []string
+}
+
+// deleteGroup removes the group with its chat messages, the group chats of every member and
+// everything else that references it
+func deleteGroup(ctx context.Context, tx *sql.Tx, groupId int64) (*DeletedGroup, error) {
+
+	deleted := DeletedGroup{ID: groupId}
+
+	err := tx.QueryRowContext(ctx, `SELECT COALESCE(pic_url,'') FROM groupu WHERE id = $1 FOR UPDATE`, groupId).Scan(&deleted.PicUrl)
+
+	if err != nil {
+		return nil, err
+	}
+
+	chatId := strconv.FormatInt(groupId, 10)
+
+	rows, err := tx.QueryContext(ctx, `SELECT media_url FROM message WHERE friendship_id = $1 AND media_url <> ''`, chatId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+
+		var mediaUrl string
+
+		if err := rows.Scan(&mediaUrl); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		deleted.MediaUrls = append(deleted.MediaUrls, mediaUrl)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	statements := []struct {
+		query string
+		arg   any
+	}{
+		{`DELETE FROM message WHERE friendship_id = $1`, chatId},
+		{`UPDATE users SET groups_count = groups_count - 1 WHERE id IN (SELECT user_id FROM group_member WHERE group_id = $1)`, groupId},
+		{`DELETE FROM friendship WHERE group_id = $1`, groupId},
+		// members, bans, invites, requests, permissions and the audit log go with it
+		{`DELETE FROM groupu WHERE id = $1`, groupId},
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement.query, statement.arg); err != nil {
+			return nil, err
+		}
+	}
+
+	return &deleted, nil
+}
+
+// DeleteGroup returns sql.ErrNoRows when there is no such group
+func (d *DataRepository) DeleteGroup(ctx context.Context, id int64) (*DeletedGroup, error) {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	deleted, err := deleteGroup(ctx, tx, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return deleted, tx.Commit()
+}
+
+// handOverGroup passes ownership of the group to the highest ranking, longest standing other member
+// and demotes the leaving owner. The group is deleted when nobody else is in it, it is then returned.
+func handOverGroup(ctx context.Context, tx *sql.Tx, groupId, ownerId int64) (*DeletedGroup, error) {
+
+	demote := `UPDATE group_member SET role = 'member' WHERE group_id = $1 AND user_id = $2`
+
+	if _, err := tx.ExecContext(ctx, demote, groupId, ownerId); err != nil {
+		return nil, err
+	}
+
+	promote := `UPDATE group_member SET role = 'owner' WHERE id = (
+SELECT id FROM group_member WHERE group_id = $1 AND user_id <> $2
+ORDER BY CASE role WHEN 'admin' THEN 0 WHEN 'moderator' THEN 1 ELSE 2 END, created_at, id LIMIT 1) RETURNING user_id`
+
+	var newOwnerId int64
+
+	err := tx.QueryRowContext(ctx, promote, groupId, ownerId).Scan(&newOwnerId)
+
+	if err == sql.ErrNoRows {
+		return deleteGroup(ctx, tx, groupId)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// an offer the leaving owner made is void now
+	if _, err := tx.ExecContext(ctx, `DELETE FROM group_ownership_transfer WHERE group_id = $1`, groupId); err != nil {
+		return nil, err
+	}
+
+	event := GroupAuditEvent{
+		GroupID:  groupId,
+		ActorID:  ownerId,
+		TargetID: newOwnerId,
+		Action:   GroupEventOwnershipTransferred,
+		After:    "automatic",
+	}
+
+	return nil, insertGroupEvent(ctx, tx, event)
+}
+
+// OfferGroupOwnership replaces any open offer in the group
+func (d *DataRepository) OfferGroupOwnership(ctx context.Context, groupId, fromId, toId int64, expiresAt time.Time) error {
+
+	query := `INSERT INTO group_ownership_transfer(group_id,from_user_id,to_user_id,expires_at) VALUES($1,$2,$3,$4)
+ON CONFLICT (group_id) DO UPDATE SET from_user_id = EXCLUDED.from_user_id, to_user_id = EXCLUDED.to_user_id, expires_at = EXCLUDED.expires_at, created_at = NOW()`
+
+	_, err := d.db.ExecContext(ctx, query, groupId, fromId, toId, expiresAt)
+
+	return err
+}
+
+// GetGroupOwnershipTransfer returns the open offer of the group, ErrNoOwnershipTransfer when there is none
+func (d *DataRepository) GetGroupOwnershipTransfer(ctx context.Context, groupId int64) (*GroupOwnershipTransfer, error) {
+
+	query := `SELECT t.group_id,f.username,o.username,t.expires_at,t.created_at FROM group_ownership_transfer t
+JOIN users f ON f.id = t.from_user_id JOIN users o ON o.id = t.to_user_id WHERE t.group_id = $1 AND t.expires_at > NOW()`
+
+	var transfer GroupOwnershipTransfer
+
+	err := d.db.QueryRowContext(ctx, query, groupId).Scan(&transfer.GroupID, &transfer.From, &transfer.To, &transfer.ExpiresAt, &transfer.CreatedAt)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNoOwnershipTransfer
+		}
+		return nil, err
+	}
+
+	return &transfer, nil
+}
+
+// AcceptGroupOwnership makes userId the owner if an offer to them is still open and whoever made it
+// still owns the group, the previous owner stays on as admin. Returns the previous owner's id.
+func (d *DataRepository) AcceptGroupOwnership(ctx context.Context, groupId, userId int64) (int64, error) {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback()
+
+	var fromId int64
+
+	query := `DELETE FROM group_ownership_transfer WHERE group_id = $1 AND to_user_id = $2 AND expires_at > NOW() RETURNING from_user_id`
+
+	if err := tx.QueryRowContext(ctx, query, groupId, userId).Scan(&fromId); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrNoOwnershipTransfer
+		}
+		return 0, err
+	}
+
+	// the old owner steps down first, a group never has two owners
+	result, err := tx.ExecContext(ctx, `UPDATE group_member SET role = 'admin' WHERE group_id = $1 AND user_id = $2 AND role = 'owner'`, groupId, fromId)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if demoted, _ := result.RowsAffected(); demoted == 0 {
+		return 0, ErrNoOwnershipTransfer
+	}
+
+	result, err = tx.ExecContext(ctx, `UPDATE group_member SET role = 'owner' WHERE group_id = $1 AND user_id = $2`, groupId, userId)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if promoted, _ := result.RowsAffected(); promoted == 0 {
+		return 0, ErrNotGroupMember
+	}
+
+	event := GroupAuditEvent{
+		GroupID:  groupId,
+		ActorID:  fromId,
+		TargetID: userId,
+		Action:   GroupEventOwnershipTransferred,
+		After:    "accepted",
+	}
+
+	if err := insertGroupEvent(ctx, tx, event); err != nil {
+		return 0, err
+	}
+
+	return fromId, tx.Commit()
+}
+
+// CancelGroupOwnershipTransfer drops the open offer when userId made it or received it
+func (d *DataRepository) CancelGroupOwnershipTransfer(ctx context.Context, groupId, userId int64) (bool, error) {
+
+	query := `DELETE FROM group_ownership_transfer WHERE group_id = $1 AND (from_user_id = $2 OR to_user_id = $2)`
+
+	result, err := d.db.ExecContext(ctx, query, groupId, userId)
+
+	if err != nil {
+		return false, err
+	}
+
+	cancelled, err := result.RowsAffected()
+
+	return cancelled > 0, err
+}
+
+// LeaveGroup removes the user from the group. An owner hands the group over first, when they were
+// the last member the group is deleted and returned.
+func (d *DataRepository) LeaveGroup(ctx context.Context, userId, groupId int64) (*DeletedGroup, error) {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	var role GroupRole
+
+	err = tx.QueryRowContext(ctx, `SELECT role FROM group_member WHERE group_id = $1 AND user_id = $2 FOR UPDATE`, groupId, userId).Scan(&role)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotGroupMember
+		}
+		return nil, err
+	}
+
+	if role == GroupRoleOwner {
+
+		deleted, err := handOverGroup(ctx, tx, groupId, userId)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if deleted != nil {
+			return deleted, tx.Commit()
+		}
+	}
+
+	if _, err := deleteGroupMembership(ctx, tx, userId, groupId); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM group_ownership_transfer WHERE group_id = $1 AND to_user_id = $2`, groupId, userId); err != nil {
+		return nil, err
+	}
+
+	if err := insertGroupEvent(ctx, tx, GroupAuditEvent{GroupID: groupId, ActorID: userId, Action: GroupEventMemberLeft}); err != nil {
+		return nil, err
+	}
+
+	return nil, tx.Commit()
+}
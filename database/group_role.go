@@ -0,0 +1,217 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+type GroupRole string
+
+const (
+	GroupRoleMember    GroupRole = "member"
+	GroupRoleModerator GroupRole = "moderator"
+	GroupRoleAdmin     GroupRole = "admin"
+	GroupRoleOwner     GroupRole = "owner" // exactly one per group
+)
+
+var groupRoleRank = map[GroupRole]int{
+	GroupRoleMember:    0,
+	GroupRoleModerator: 1,
+	GroupRoleAdmin:     2,
+	GroupRoleOwner:     3,
+}
+
+var ErrUnknownGroupRole = errors.New("group role can be owner, admin, moderator or member")
+
+func ParseGroupRole(role string) (GroupRole, error) {
+
+	if _, ok := groupRoleRank[GroupRole(role)]; !ok {
+		return "", ErrUnknownGroupRole
+	}
+
+	return GroupRole(role), nil
+}
+
+func (r GroupRole) AtLeast(other GroupRole) bool {
+	return groupRoleRank[r] >= groupRoleRank[other]
+}
+
+// Outranks is what acting on another member needs: admins manage moderators, not other admins
+func (r GroupRole) Outranks(other GroupRole) bool {
+	return groupRoleRank[r] > groupRoleRank[other]
+}
+
+type GroupAction string
+
+const (
+	GroupAddMember       GroupAction = "add_member"
+	GroupRemoveMember    GroupAction = "remove_member" // kick, the member may come back
+	GroupBanMember       GroupAction = "ban_member"
+	GroupMuteMember      GroupAction = "mute_member"
+	GroupEditInfo        GroupAction = "edit_info"
+	GroupChangePicture   GroupAction = "change_picture"
+	GroupPinMessage      GroupAction = "pin_message"
+	GroupPostMessage     GroupAction = "post_message"
+	GroupReact           GroupAction = "react"
+	GroupDeleteMessage   GroupAction = "delete_message" // messages sent by someone else
+	GroupManageRoles     GroupAction = "manage_roles"
+	GroupManageInvites   GroupAction = "manage_invites"
+	GroupManageRequests  GroupAction = "manage_join_requests"
+	GroupEditPrivacy     GroupAction = "edit_privacy"
+	GroupSetAnnouncement GroupAction = "set_announcement"
+	GroupViewAudit       GroupAction = "view_audit"
+	GroupEditPermissions GroupAction = "edit_permissions"
+	GroupTransferOwner   GroupAction = "transfer_ownership"
+	GroupDelete          GroupAction = "delete_group"
+)
+
+var ErrUnknownGroupAction = errors.New("unknown group action")
+
+// GroupPermissions is the lowest role allowed to perform each action in a group
+type GroupPermissions map[GroupAction]GroupRole
+
+// DefaultGroupPermissions applies to every action a group has not changed
+var DefaultGroupPermissions = GroupPermissions{
+	GroupAddMember:       GroupRoleAdmin,
+	GroupRemoveMember:    GroupRoleAdmin,
+	GroupBanMember:       GroupRoleAdmin,
+	GroupMuteMember:      GroupRoleModerator,
+	GroupEditInfo:        GroupRoleAdmin,
+	GroupChangePicture:   GroupRoleAdmin,
+	GroupPinMessage:      GroupRoleModerator,
+	GroupPostMessage:     GroupRoleMember,
+	GroupReact:           GroupRoleMember,
+	GroupDeleteMessage:   GroupRoleModerator,
+	GroupManageRoles:     GroupRoleAdmin,
+	GroupManageInvites:   GroupRoleAdmin,
+	GroupManageRequests:  GroupRoleAdmin,
+	GroupEditPrivacy:     GroupRoleAdmin,
+	GroupSetAnnouncement: GroupRoleAdmin,
+	GroupViewAudit:       GroupRoleAdmin,
+	GroupEditPermissions: GroupRoleOwner,
+	GroupTransferOwner:   GroupRoleOwner,
+	GroupDelete:          GroupRoleOwner,
+}
+
+// these stay with the owner whatever the group settings say
+var ownerOnlyActions = map[GroupAction]bool{
+	GroupEditPermissions: true,
+	GroupTransferOwner:   true,
+	GroupDelete:          true,
+}
+
+// ParseGroupAction accepts the actions a group owner may change the role for
+func ParseGroupAction(action string) (GroupAction, error) {
+
+	a := GroupAction(action)
+
+	if _, ok := DefaultGroupPermissions[a]; !ok || ownerOnlyActions[a] {
+		return "", ErrUnknownGroupAction
+	}
+
+	return a, nil
+}
+
+func (p GroupPermissions) Allows(role GroupRole, action GroupAction) bool {
+
+	if ownerOnlyActions[action] {
+		return role == GroupRoleOwner
+	}
+
+	min, ok := p[action]
+
+	if !ok {
+		return false
+	}
+
+	return role.AtLeast(min)
+}
+
+// RolesAllowed lists every role that may perform action
+func (p GroupPermissions) RolesAllowed(action GroupAction) []GroupRole {
+
+	var roles []GroupRole
+
+	for role := range groupRoleRank {
+		if p.Allows(role, action) {
+			roles = append(roles, role)
+		}
+	}
+
+	return roles
+}
+
+func (d *DataRepository) GetGroupPermissions(ctx context.Context, groupId int64) (GroupPermissions, error) {
+
+	permissions := GroupPermissions{}
+
+	for action, role := range DefaultGroupPermissions {
+		permissions[action] = role
+	}
+
+	rows, err := d.db.QueryContext(ctx, `SELECT action,min_role FROM group_permission WHERE group_id = $1`, groupId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var action string
+		var role GroupRole
+
+		if err := rows.Scan(&action, &role); err != nil {
+			return nil, err
+		}
+
+		// rows for actions that were removed since are ignored
+		if a, err := ParseGroupAction(action); err == nil {
+			permissions[a] = role
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var announcementOnly bool
+
+	if err := d.db.QueryRowContext(ctx, `SELECT announcement_only FROM groupu WHERE id = $1`, groupId).Scan(&announcementOnly); err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if announcementOnly {
+		permissions.restrictToAnnouncements()
+	}
+
+	return permissions, nil
+}
+
+// restrictToAnnouncements keeps posting to admins whatever post_message is set to
+func (p GroupPermissions) restrictToAnnouncements() {
+
+	if !p[GroupPostMessage].AtLeast(GroupRoleAdmin) {
+		p[GroupPostMessage] = GroupRoleAdmin
+	}
+}
+
+func (d *DataRepository) SetGroupPermission(ctx context.Context, groupId int64, action GroupAction, role GroupRole) error {
+
+	query := `INSERT INTO group_permission(group_id,action,min_role) VALUES($1,$2,$3) ON CONFLICT (group_id,action) DO UPDATE SET min_role = EXCLUDED.min_role`
+
+	_, err := d.db.ExecContext(ctx, query, groupId, action, role)
+
+	return err
+}
+
+func (d *DataRepository) SetGroupMemberRole(ctx context.Context, userId, groupId int64, role GroupRole) error {
+
+	query := `UPDATE group_member SET role = $1 WHERE user_id = $2 AND group_id = $3`
+
+	_, err := d.db.ExecContext(ctx, query, role, userId, groupId)
+
+	return err
+}
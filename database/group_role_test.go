@@ -0,0 +1,164 @@
+package database
+
+import "testing"
+
+var allGroupRoles = []GroupRole{GroupRoleMember, GroupRoleModerator, GroupRoleAdmin, GroupRoleOwner}
+
+func TestDefaultGroupPermissionsAllows(t *testing.T) {
+
+	// the lowest role expected for each action, spelled out rather than read from the defaults
+	tests := []struct {
+		action GroupAction
+		min    GroupRole
+	}{
+		{GroupAddMember, GroupRoleAdmin},
+		{GroupRemoveMember, GroupRoleAdmin},
+		{GroupBanMember, GroupRoleAdmin},
+		{GroupMuteMember, GroupRoleModerator},
+		{GroupEditInfo, GroupRoleAdmin},
+		{GroupChangePicture, GroupRoleAdmin},
+		{GroupPinMessage, GroupRoleModerator},
+		{GroupPostMessage, GroupRoleMember},
+		{GroupReact, GroupRoleMember},
+		{GroupDeleteMessage, GroupRoleModerator},
+		{GroupManageRoles, GroupRoleAdmin},
+		{GroupManageInvites, GroupRoleAdmin},
+		{GroupManageRequests, GroupRoleAdmin},
+		{GroupEditPrivacy, GroupRoleAdmin},
+		{GroupSetAnnouncement, GroupRoleAdmin},
+		{GroupViewAudit, GroupRoleAdmin},
+		{GroupEditPermissions, GroupRoleOwner},
+		{GroupTransferOwner, GroupRoleOwner},
+		{GroupDelete, GroupRoleOwner},
+	}
+
+	if len(tests) != len(DefaultGroupPermissions) {
+		t.Fatalf("table covers %d actions, DefaultGroupPermissions has %d", len(tests), len(DefaultGroupPermissions))
+	}
+
+	for _, tt := range tests {
+		for _, role := range allGroupRoles {
+
+			want := groupRoleRank[role] >= groupRoleRank[tt.min]
+
+			if got := DefaultGroupPermissions.Allows(role, tt.action); got != want {
+				t.Errorf("Allows(%s, %s) = %v, want %v", role, tt.action, got, want)
+			}
+		}
+	}
+}
+
+func TestGroupPermissionsUnknownAction(t *testing.T) {
+
+	for _, role := range allGroupRoles {
+		if DefaultGroupPermissions.Allows(role, GroupAction("no_such_action")) {
+			t.Errorf("Allows(%s, no_such_action) = true, want false", role)
+		}
+	}
+}
+
+func TestOwnerOnlyActions(t *testing.T) {
+
+	// a group that opened everything up to members still keeps these with the owner
+	permissions := GroupPermissions{}
+
+	for action := range DefaultGroupPermissions {
+		permissions[action] = GroupRoleMember
+	}
+
+	for action := range ownerOnlyActions {
+
+		if _, err := ParseGroupAction(string(action)); err != ErrUnknownGroupAction {
+			t.Errorf("ParseGroupAction(%s) error = %v, want %v", action, err, ErrUnknownGroupAction)
+		}
+
+		for _, role := range allGroupRoles {
+
+			want := role == GroupRoleOwner
+
+			if got := permissions.Allows(role, action); got != want {
+				t.Errorf("Allows(%s, %s) = %v, want %v", role, action, got, want)
+			}
+		}
+	}
+}
+
+func TestRestrictToAnnouncements(t *testing.T) {
+
+	tests := []struct {
+		name string
+		post GroupRole
+		want GroupRole
+	}{
+		{"members post", GroupRoleMember, GroupRoleAdmin},
+		{"moderators post", GroupRoleModerator, GroupRoleAdmin},
+		{"admins post", GroupRoleAdmin, GroupRoleAdmin},
+		{"owner posts", GroupRoleOwner, GroupRoleOwner},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			permissions := GroupPermissions{GroupPostMessage: tt.post, GroupReact: GroupRoleMember}
+
+			permissions.restrictToAnnouncements()
+
+			if got := permissions[GroupPostMessage]; got != tt.want {
+				t.Errorf("post_message = %s, want %s", got, tt.want)
+			}
+
+			// everyone else still reads and reacts
+			if !permissions.Allows(GroupRoleMember, GroupReact) {
+				t.Error("members can no longer react")
+			}
+
+			if permissions.Allows(GroupRoleMember, GroupPostMessage) {
+				t.Error("members can still post")
+			}
+		})
+	}
+}
+
+func TestGroupRoleOutranks(t *testing.T) {
+
+	// kick, ban, mute and role changes all need the actor to outrank the target, promote and demote
+	// also need the new role to sit above or below the current one
+	tests := []struct {
+		actor  GroupRole
+		target GroupRole
+		want   bool
+	}{
+		{GroupRoleOwner, GroupRoleAdmin, true},
+		{GroupRoleOwner, GroupRoleModerator, true},
+		{GroupRoleOwner, GroupRoleMember, true},
+		{GroupRoleOwner, GroupRoleOwner, false},
+		{GroupRoleAdmin, GroupRoleOwner, false},
+		{GroupRoleAdmin, GroupRoleAdmin, false},
+		{GroupRoleAdmin, GroupRoleModerator, true},
+		{GroupRoleAdmin, GroupRoleMember, true},
+		{GroupRoleModerator, GroupRoleAdmin, false},
+		{GroupRoleModerator, GroupRoleModerator, false},
+		{GroupRoleModerator, GroupRoleMember, true},
+		{GroupRoleMember, GroupRoleModerator, false},
+		{GroupRoleMember, GroupRoleMember, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.actor.Outranks(tt.target); got != tt.want {
+			t.Errorf("%s.Outranks(%s) = %v, want %v", tt.actor, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestParseGroupRole(t *testing.T) {
+
+	for _, role := range allGroupRoles {
+		if got, err := ParseGroupRole(string(role)); err != nil || got != role {
+			t.Errorf("ParseGroupRole(%s) = %s, %v", role, got, err)
+		}
+	}
+
+	if _, err := ParseGroupRole("superuser"); err != ErrUnknownGroupRole {
+		t.Errorf("ParseGroupRole(superuser) error = %v, want %v", err, ErrUnknownGroupRole)
+	}
+}
@@ -0,0 +1,130 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrIdentityExists means the provider account already belongs to a user, usually because another
+// first sign-in with it finished first
+var ErrIdentityExists = errors.New("provider account is already linked to a user")
+
+type UserIdentity struct {
+	ID        int64     `json:"id"`
+	Username  string    `json:"-"`
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (d *DataRepository) InsertUserIdentity(ctx context.Context, username, provider, subject, email string) error {
+
+	query := `INSERT INTO user_identity(username,provider,subject,email) VALUES($1,$2,$3,$4)`
+
+	_, err := d.db.ExecContext(ctx, query, username, provider, subject, email)
+
+	return err
+}
+
+// InsertOidcUser creates the user of a first social sign-in together with its identity, so a user is
+// never left without the identity that signs them in. A verified email is put on the account only
+// when no other account has it.
+func (d *DataRepository) InsertOidcUser(ctx context.Context, user *User, provider, subject, email string, emailVerified bool) error {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := insertUser(ctx, tx, user); err != nil {
+		return err
+	}
+
+	if email != "" && emailVerified {
+
+		query := `UPDATE users SET email = $1 WHERE username = $2 AND NOT EXISTS (SELECT 1 FROM users WHERE email = $1)`
+
+		if _, err := tx.ExecContext(ctx, query, email, user.Username); err != nil {
+			return err
+		}
+	}
+
+	query := `INSERT INTO user_identity(username,provider,subject,email) VALUES($1,$2,$3,$4)`
+
+	if _, err := tx.ExecContext(ctx, query, user.Username, provider, subject, email); err != nil {
+
+		if strings.Contains(err.Error(), "user_identity_provider_subject_key") {
+			return ErrIdentityExists
+		}
+
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (d *DataRepository) GetUserIdentity(ctx context.Context, provider, subject string) (*UserIdentity, error) {
+
+	query := `SELECT id,username,provider,subject,email,created_at FROM user_identity WHERE provider = $1 AND subject = $2`
+
+	var identity UserIdentity
+
+	err := d.db.QueryRowContext(ctx, query, provider, subject).Scan(&identity.ID, &identity.Username, &identity.Provider, &identity.Subject, &identity.Email, &identity.CreatedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &identity, nil
+}
+
+func (d *DataRepository) GetUserIdentities(ctx context.Context, username string) ([]UserIdentity, error) {
+
+	query := `SELECT id,username,provider,subject,email,created_at FROM user_identity WHERE username = $1 ORDER BY created_at`
+
+	row, err := d.db.QueryContext(ctx, query, username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer row.Close()
+
+	var identities []UserIdentity
+
+	for row.Next() {
+
+		var identity UserIdentity
+
+		err := row.Scan(&identity.ID, &identity.Username, &identity.Provider, &identity.Subject, &identity.Email, &identity.CreatedAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		identities = append(identities, identity)
+	}
+
+	return identities, row.Err()
+}
+
+func (d *DataRepository) DeleteUserIdentity(ctx context.Context, username, provider string) (bool, error) {
+
+	query := `DELETE FROM user_identity WHERE username = $1 AND provider = $2`
+
+	result, err := d.db.ExecContext(ctx, query, username, provider)
+
+	if err != nil {
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+
+	return count == 1, err
+}
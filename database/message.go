@@ -2,6 +2,7 @@ package database
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"time"
 )
@@ -35,33 +36,69 @@ const (
 )
 
 type Message struct {
-	ID             int64  `json:"id"`
-	MessageID      string `json:"message_id"`
-	FriendshipID   string `json:"friendship_id"` //put groupd id here if group
-	SenderUsername string `json:"sender_username"`
-	MessageType    string `json:"message_type"` //MessageChat,MessageRaction,MessageInfo
-	TextContent    string `json:"text_content"`
-	Media          Media  `json:"media"`
-	CreatedAt      string `json:"created_at"`
-	ModifiedAt     string `json:"modified_at"`
+	ID             int64      `json:"id"`
+	MessageID      string     `json:"message_id"`
+	FriendshipID   string     `json:"friendship_id"` //put groupd id here if group
+	SenderID       int64      `json:"-"`
+	SenderUsername string     `json:"sender_username"`
+	MessageType    string     `json:"message_type"` //MessageChat,MessageRaction,MessageInfo
+	TextContent    string     `json:"text_content"`
+	Media          Media      `json:"media"`
+	PinnedAt       *time.Time `json:"pinned_at,omitempty"`
+	CreatedAt      string     `json:"created_at"`
+	ModifiedAt     string     `json:"modified_at"`
 }
 
-func (d *DataRepository) InsertMessage(cxt context.Context, MessageID, FriendshipID, SenderUsername, MessageType, TextContent string, now time.Time) error {
+// sender_id is NULL once the sender deleted their account
+const selectMessage = `SELECT m.id,m.message_id,m.friendship_id,COALESCE(m.sender_id,0),COALESCE(u.username,'` + DeletedUsername + `'),m.message_type,
+COALESCE(m.text_content,''),COALESCE(m.media_url,''),COALESCE(m.media_type,''),m.pinned_at,m.created_at,COALESCE(m.modified_at,m.created_at)
+FROM message m LEFT JOIN users u ON u.id = m.sender_id`
 
-	query := `INSERT INTO message(message_id,friendship_id,sender_username,message_type,text_content,media_url,media_type,modified_at,created_at)`
+func scanMessage(row rowScanner) (*Message, error) {
 
-	if MessageType != "MessageChat" && MessageType != "MessageRaction" && MessageType != "MessageInfo" {
+	var message Message
+
+	err := row.Scan(&message.ID, &message.MessageID, &message.FriendshipID, &message.SenderID, &message.SenderUsername, &message.MessageType, &message.TextContent, &message.Media.MediaUrl, &message.Media.MediaType, &message.PinnedAt, &message.CreatedAt, &message.ModifiedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// insertMessage stores a text message, db is either the pool or a transaction
+func insertMessage(cxt context.Context, db execer, message *Message, now time.Time) error {
+
+	query := `INSERT INTO message(message_id,friendship_id,sender_id,message_type,text_content,media_url,media_type,modified_at,created_at) VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9)`
+
+	if message.MessageType != "MessageChat" && message.MessageType != "MessageRaction" && message.MessageType != "MessageInfo" {
 		return errors.New("MessageType is invalide")
 	}
 
-	_, err := d.db.ExecContext(cxt, query, FriendshipID, SenderUsername, MessageType, TextContent, "", "NoMedia", now)
+	message.Media = Media{MediaType: "NoMedia"}
+	message.CreatedAt = now.String()
+	message.ModifiedAt = now.String()
+
+	_, err := db.ExecContext(cxt, query, message.MessageID, message.FriendshipID, message.SenderID, message.MessageType, message.TextContent, "", "NoMedia", now, now)
 
 	return err
 }
 
-func (d *DataRepository) InsertMessageMedia(cxt context.Context, MessageID, FriendshipID, SenderUsername, MessageType, MediaUrl, MediaType string, now time.Time) error {
+func (d *DataRepository) InsertMessage(cxt context.Context, MessageID, FriendshipID string, SenderID int64, MessageType, TextContent string, now time.Time) error {
+
+	message := Message{MessageID: MessageID, FriendshipID: FriendshipID, SenderID: SenderID, MessageType: MessageType, TextContent: TextContent}
+
+	return insertMessage(cxt, d.db, &message, now)
+}
 
-	query := `INSERT INTO message(message_id,friendship_id,sender_username,message_type,text_content,media_url,media_type,modified_at,created_at)`
+func (d *DataRepository) InsertMessageMedia(cxt context.Context, MessageID, FriendshipID string, SenderID int64, MessageType, MediaUrl, MediaType string, now time.Time) error {
+
+	query := `INSERT INTO message(message_id,friendship_id,sender_id,message_type,text_content,media_url,media_type,modified_at,created_at) VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9)`
 
 	if MessageType != "MessageChat" && MessageType != "MessageRaction" && MessageType != "MessageInfo" {
 		return errors.New("MessageType is invalide")
@@ -71,7 +108,7 @@ func (d *DataRepository) InsertMessageMedia(cxt context.Context, MessageID, Frie
 	// 	return errors.New("MediaType is invalide")
 	// }
 
-	_, err := d.db.ExecContext(cxt, query, FriendshipID, SenderUsername, MessageType, "", MediaUrl, MediaType, now, now)
+	_, err := d.db.ExecContext(cxt, query, MessageID, FriendshipID, SenderID, MessageType, "", MediaUrl, MediaType, now, now)
 
 	return err
 }
@@ -86,28 +123,42 @@ func (d *DataRepository) DeleteMessageById(cxt context.Context, MessageID string
 
 func (d *DataRepository) GetMessageById(cxt context.Context, MessageID string) (*Message, error) {
 
-	query := `SELECT * FROM message WHERE message_id = $1`
+	query := selectMessage + ` WHERE m.message_id = $1`
+
+	return scanMessage(d.db.QueryRowContext(cxt, query, MessageID))
+}
+
+func (d *DataRepository) queryMessages(cxt context.Context, query string, args ...any) ([]Message, error) {
 
-	row, err := d.db.QueryContext(cxt, query, MessageID)
+	row, err := d.db.QueryContext(cxt, query, args...)
 
 	if err != nil {
 		return nil, err
 	}
 
-	row.Next()
+	defer row.Close()
 
-	var message Message
+	messages := []Message{}
 
-	row.Scan(&message.ID, &message.MessageID, &message.FriendshipID, &message.SenderUsername, &message.TextContent, &message.Media.MediaUrl, &message.Media.MediaType, &message.CreatedAt, &message.ModifiedAt)
+	for row.Next() {
 
-	return &message, nil
+		message, err := scanMessage(row)
+
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, *message)
+	}
+
+	return messages, row.Err()
 }
 
 func (d *DataRepository) GetMessages(cxt context.Context, FriendshipID string, page, limit int) (*PaginatedResponse, error) {
 
 	var totalCount int
 	offset := (page - 1) * limit
-	query := `SELECT * FROM message WHERE friendship_id = $1 LIMIT $2 OFFSET $3 ORDER BY created_at DESC`
+	query := selectMessage + ` WHERE m.friendship_id = $1 ORDER BY m.created_at DESC LIMIT $2 OFFSET $3`
 	queryCount := `SELECT COUNT(*) FROM message WHERE friendship_id = $1`
 
 	counrRow := d.db.QueryRowContext(cxt, queryCount, FriendshipID)
@@ -118,22 +169,12 @@ func (d *DataRepository) GetMessages(cxt context.Context, FriendshipID string, p
 		return nil, err
 	}
 
-	row, err := d.db.QueryContext(cxt, query, FriendshipID, limit, offset)
+	messages, err := d.queryMessages(cxt, query, FriendshipID, limit, offset)
 
 	if err != nil {
 		return nil, err
 	}
 
-	var messages []Message
-
-	for row.Next() {
-
-		var message Message
-
-		row.Scan(&message.ID, &message.MessageID, &message.FriendshipID, &message.SenderUsername, &message.TextContent, &message.Media.MediaUrl, &message.Media.MediaType, &message.CreatedAt, &message.ModifiedAt)
-		messages = append(messages, message)
-	}
-
 	s := PaginatedResponse{
 		Data:       messages,
 		TotalCount: totalCount,
@@ -146,8 +187,8 @@ func (d *DataRepository) GetMessages(cxt context.Context, FriendshipID string, p
 
 func (d *DataRepository) SearchMessages(cxt context.Context, FriendshipID, search, start_at, end_at string, page, limit int) (*PaginatedResponse, error) {
 
-	query := `SELECT * FROM message WHERE friendship_id = $1 AND text_content LIKE =$2 AND created_at BETWEEN =$3 AND =$4  LIMIT $5 OFFSET $6 ORDER BY created_at DESC`
-	queryCount := `SELECT COUNT(*) FROM message WHERE friendship_id = $1 AND text_content LIKE =$2 AND created_at BETWEEN =$3 AND =$4`
+	query := selectMessage + ` WHERE m.friendship_id = $1 AND m.text_content ILIKE '%' || $2 || '%' AND m.created_at BETWEEN $3 AND $4 ORDER BY m.created_at DESC LIMIT $5 OFFSET $6`
+	queryCount := `SELECT COUNT(*) FROM message WHERE friendship_id = $1 AND text_content ILIKE '%' || $2 || '%' AND created_at BETWEEN $3 AND $4`
 
 	var totalCount int
 	offset := (page - 1) * limit
@@ -160,22 +201,12 @@ func (d *DataRepository) SearchMessages(cxt context.Context, FriendshipID, searc
 		return nil, err
 	}
 
-	row, err := d.db.QueryContext(cxt, query, FriendshipID, search, start_at, end_at, limit, offset)
+	messages, err := d.queryMessages(cxt, query, FriendshipID, search, start_at, end_at, limit, offset)
 
 	if err != nil {
 		return nil, err
 	}
 
-	var messages []Message
-
-	for row.Next() {
-
-		var message Message
-
-		row.Scan(&message.ID, &message.MessageID, &message.FriendshipID, &message.SenderUsername, &message.TextContent, &message.Media.MediaUrl, &message.Media.MediaType, &message.CreatedAt, &message.ModifiedAt)
-		messages = append(messages, message)
-	}
-
 	s := PaginatedResponse{
 		Data:       messages,
 		TotalCount: totalCount,
@@ -194,3 +225,33 @@ func (d *DataRepository) UpdateMessage(cxt context.Context, MessageId string, up
 
 	return err
 }
+
+// SetMessagePinned pins or unpins a message of the chat, false when the chat has no such message
+func (d *DataRepository) SetMessagePinned(cxt context.Context, MessageID, FriendshipID string, pinnedById int64, pinned bool) (bool, error) {
+
+	query := `UPDATE message SET pinned_at = NOW(), pinned_by_id = $1 WHERE message_id = $2 AND friendship_id = $3`
+
+	args := []any{pinnedById, MessageID, FriendshipID}
+
+	if !pinned {
+		query = `UPDATE message SET pinned_at = NULL, pinned_by_id = NULL WHERE message_id = $1 AND friendship_id = $2`
+		args = args[1:]
+	}
+
+	result, err := d.db.ExecContext(cxt, query, args...)
+
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+
+	return affected > 0, err
+}
+
+func (d *DataRepository) GetPinnedMessages(cxt context.Context, FriendshipID string) ([]Message, error) {
+
+	query := selectMessage + ` WHERE m.friendship_id = $1 AND m.pinned_at IS NOT NULL ORDER BY m.pinned_at DESC`
+
+	return d.queryMessages(cxt, query, FriendshipID)
+}
@@ -0,0 +1,133 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type Totp struct {
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+func (r *DataRepository) GetTotp(ctx context.Context, username string) (*Totp, error) {
+
+	query := `SELECT totp_secret,totp_enabled,totp_last_step FROM users WHERE username = $1`
+
+	var secret sql.NullString
+	var totp Totp
+
+	err := r.db.QueryRowContext(ctx, query, username).Scan(&secret, &totp.Enabled, &totp.LastStep)
+
+	if err != nil {
+		return nil, err
+	}
+
+	totp.Secret = secret.String
+
+	return &totp, nil
+}
+
+// the secret stays pending (totp_enabled false) until a first code confirms the user scanned it
+func (r *DataRepository) SetPendingTotpSecret(ctx context.Context, username, secret string) error {
+
+	query := `UPDATE users SET totp_secret = $1, totp_enabled = FALSE, totp_last_step = 0, modified_at = $2 WHERE username = $3 AND totp_enabled = FALSE`
+
+	_, err := r.db.ExecContext(ctx, query, secret, time.Now(), username)
+
+	return err
+}
+
+func (r *DataRepository) EnableTotp(ctx context.Context, username string, step int64, recoveryCodeHashes []string) error {
+
+	tx, err := r.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := `UPDATE users SET totp_enabled = TRUE, totp_last_step = $1, modified_at = $2 WHERE username = $3`
+
+	if _, err := tx.ExecContext(ctx, query, step, time.Now(), username); err != nil {
+		return err
+	}
+
+	if err := replaceRecoveryCodes(ctx, tx, username, recoveryCodeHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *DataRepository) DisableTotp(ctx context.Context, username string) error {
+
+	tx, err := r.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := `UPDATE users SET totp_secret = NULL, totp_enabled = FALSE, totp_last_step = 0, modified_at = $1 WHERE username = $2`
+
+	if _, err := tx.ExecContext(ctx, query, time.Now(), username); err != nil {
+		return err
+	}
+
+	if err := replaceRecoveryCodes(ctx, tx, username, nil); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseTotpStep records step as used, it reports false when the step (or a later one) was already used
+func (r *DataRepository) UseTotpStep(ctx context.Context, username string, step int64) (bool, error) {
+
+	query := `UPDATE users SET totp_last_step = $1 WHERE username = $2 AND totp_last_step < $1`
+
+	result, err := r.db.ExecContext(ctx, query, step, username)
+
+	if err != nil {
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+
+	return count == 1, err
+}
+
+func (r *DataRepository) UseRecoveryCode(ctx context.Context, username, codeHash string) (bool, error) {
+
+	query := `UPDATE recovery_code SET used_at = $1 WHERE username = $2 AND code_hash = $3 AND used_at IS NULL`
+
+	result, err := r.db.ExecContext(ctx, query, time.Now(), username, codeHash)
+
+	if err != nil {
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+
+	return count == 1, err
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, username string, codeHashes []string) error {
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM recovery_code WHERE username = $1`, username); err != nil {
+		return err
+	}
+
+	for _, hash := range codeHashes {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO recovery_code(username,code_hash) VALUES($1,$2)`, username, hash); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
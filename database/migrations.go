@@ -0,0 +1,26 @@
+package database
+
+import (
+	"database/sql"
+	"embed"
+	"io/fs"
+	"main/internal/migrate"
+)
+
+// MigrationsDir is where `nkata migrate create` puts new files, relative to the repository root
+const MigrationsDir = "database/migrations"
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// NewMigrator returns a migrator for the schema migrations built into the binary
+func NewMigrator(db *sql.DB) (*migrate.Migrator, error) {
+
+	files, err := fs.Sub(migrationFiles, "migrations")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return migrate.New(db, files)
+}
@@ -0,0 +1,16 @@
+DROP TABLE IF EXISTS email_change;
+DROP TABLE IF EXISTS username_history;
+DROP TABLE IF EXISTS data_export;
+DROP TABLE IF EXISTS user_identity;
+DROP TABLE IF EXISTS webauthn_credential;
+DROP TABLE IF EXISTS recovery_code;
+DROP TABLE IF EXISTS device_token;
+DROP TABLE IF EXISTS refresh_token;
+DROP TABLE IF EXISTS session;
+DROP TABLE IF EXISTS otp;
+DROP TABLE IF EXISTS message;
+DROP TABLE IF EXISTS group_member;
+DROP TABLE IF EXISTS groupu;
+DROP TABLE IF EXISTS friendRequest;
+DROP TABLE IF EXISTS friendship;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,199 @@
+-- The schema as it stood in the loose database/sql files. IF NOT EXISTS lets databases that were
+-- set up by hand from those files adopt the migrations without being recreated.
+
+CREATE TABLE IF NOT EXISTS users (
+id SERIAL NOT NULL PRIMARY KEY,
+username VARCHAR(100) NOT NULL UNIQUE,
+display_name VARCHAR(255),
+email VARCHAR(255) UNIQUE,
+password VARCHAR(255) NOT NULL,
+image_url VARCHAR(255),
+bio VARCHAR(255),
+is_online BOOLEAN,
+friends_count INT,
+groups_count INT,
+role VARCHAR(255) NOT NULL,
+enabled BOOLEAN NOT NULL,
+totp_secret VARCHAR(64),
+totp_enabled BOOLEAN DEFAULT FALSE NOT NULL,
+totp_last_step BIGINT DEFAULT 0 NOT NULL,
+delete_after TIMESTAMP WITH TIME ZONE,
+created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL,
+modified_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS friendship (
+id SERIAL NOT NULL PRIMARY KEY,
+friendship_id VARCHAR(255),
+username VARCHAR(255),
+last_message VARCHAR(255),
+friend_username VARCHAR(255),
+friendship_type VARCHAR(255),
+group_id INT,
+created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL,
+modified_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS friendRequest (
+id SERIAL NOT NULL PRIMARY KEY,
+sent_by VARCHAR(255),
+sent_to VARCHAR(255),
+status VARCHAR(255),
+created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL,
+modified_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS groupu (
+id SERIAL NOT NULL PRIMARY KEY,
+name VARCHAR(255),
+pic_url VARCHAR(255),
+description VARCHAR(255),
+created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL,
+modified_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS group_member (
+id SERIAL NOT NULL PRIMARY KEY,
+group_id INT,
+username VARCHAR(255),
+role VARCHAR(50),
+created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS message (
+id SERIAL NOT NULL PRIMARY KEY,
+message_id VARCHAR(100),
+friendship_id VARCHAR(100),
+sender_username VARCHAR(100),
+message_type VARCHAR(100),
+text_content VARCHAR(255),
+media_url VARCHAR(200),
+media_type VARCHAR(100),
+created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL,
+modified_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS otp (
+id SERIAL NOT NULL PRIMARY KEY,
+username VARCHAR(255),
+token_hash VARCHAR(64) NOT NULL,
+email VARCHAR(255) NOT NULL,
+purpose VARCHAR(255) NOT NULL,
+attempts INT DEFAULT 0 NOT NULL,
+exp TIMESTAMP,
+created_at TIMESTAMP ,
+modified_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS otp_email_purpose_idx ON otp(email,purpose);
+
+CREATE TABLE IF NOT EXISTS session (
+id VARCHAR(36) NOT NULL PRIMARY KEY,
+username VARCHAR(255) NOT NULL,
+device_name VARCHAR(255),
+ip VARCHAR(100),
+user_agent VARCHAR(512),
+created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL,
+last_used_at TIMESTAMP WITH TIME ZONE,
+expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+revoked_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS session_username_idx ON session(username);
+
+-- every refresh token ever issued for a session, the session is the token family
+CREATE TABLE IF NOT EXISTS refresh_token (
+id SERIAL NOT NULL PRIMARY KEY,
+session_id VARCHAR(36) NOT NULL REFERENCES session(id) ON DELETE CASCADE,
+token_hash VARCHAR(64) NOT NULL UNIQUE,
+rotated_at TIMESTAMP WITH TIME ZONE,
+created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS device_token (
+id SERIAL NOT NULL PRIMARY KEY,
+username VARCHAR(255) NOT NULL,
+session_id VARCHAR(36) NOT NULL,
+token VARCHAR(512) NOT NULL UNIQUE,
+platform VARCHAR(20) NOT NULL,
+created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL,
+modified_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS device_token_username_idx ON device_token(username);
+
+CREATE TABLE IF NOT EXISTS recovery_code (
+id SERIAL NOT NULL PRIMARY KEY,
+username VARCHAR(255) NOT NULL,
+code_hash VARCHAR(64) NOT NULL,
+used_at TIMESTAMP WITH TIME ZONE,
+created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS recovery_code_username_idx ON recovery_code(username);
+
+CREATE TABLE IF NOT EXISTS webauthn_credential (
+id SERIAL NOT NULL PRIMARY KEY,
+username VARCHAR(255) NOT NULL,
+credential_id VARCHAR(1024) NOT NULL UNIQUE,
+public_key BYTEA NOT NULL,
+algorithm INT NOT NULL,
+sign_count BIGINT DEFAULT 0 NOT NULL,
+name VARCHAR(255),
+created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL,
+last_used_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS webauthn_credential_username_idx ON webauthn_credential(username);
+
+CREATE TABLE IF NOT EXISTS user_identity (
+id SERIAL NOT NULL PRIMARY KEY,
+username VARCHAR(255) NOT NULL,
+provider VARCHAR(100) NOT NULL,
+subject VARCHAR(255) NOT NULL,
+email VARCHAR(255),
+created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL,
+UNIQUE(provider,subject),
+UNIQUE(username,provider)
+);
+
+CREATE TABLE IF NOT EXISTS data_export (
+id VARCHAR(36) NOT NULL PRIMARY KEY,
+username VARCHAR(255) NOT NULL,
+status VARCHAR(20) NOT NULL,
+file_path VARCHAR(255),
+download_token_hash VARCHAR(64),
+error VARCHAR(255),
+created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL,
+completed_at TIMESTAMP WITH TIME ZONE,
+expires_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS data_export_username_idx ON data_export(username);
+CREATE UNIQUE INDEX IF NOT EXISTS data_export_one_running_idx ON data_export(username) WHERE status IN ('pending','running');
+
+CREATE TABLE IF NOT EXISTS username_history (
+id SERIAL NOT NULL PRIMARY KEY,
+user_id INT NOT NULL,
+old_username VARCHAR(100) NOT NULL,
+new_username VARCHAR(100) NOT NULL,
+changed_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL,
+-- nobody else can sign up with old_username until then
+reserved_until TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS username_history_user_id_idx ON username_history(user_id);
+CREATE INDEX IF NOT EXISTS username_history_old_username_idx ON username_history(old_username);
+
+CREATE TABLE IF NOT EXISTS email_change (
+id SERIAL NOT NULL PRIMARY KEY,
+user_id INT NOT NULL,
+old_email VARCHAR(255),
+new_email VARCHAR(255) NOT NULL,
+revert_token_hash VARCHAR(64) UNIQUE,
+revert_expires_at TIMESTAMP WITH TIME ZONE,
+reverted_at TIMESTAMP WITH TIME ZONE,
+changed_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS email_change_user_id_idx ON email_change(user_id);
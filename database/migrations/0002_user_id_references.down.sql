@@ -0,0 +1,32 @@
+-- Puts the username columns back. Rows of deleted accounts get the "deleted user" placeholder.
+
+ALTER TABLE friendship ADD COLUMN username VARCHAR(255), ADD COLUMN friend_username VARCHAR(255);
+ALTER TABLE friendRequest ADD COLUMN sent_by VARCHAR(255), ADD COLUMN sent_to VARCHAR(255);
+ALTER TABLE group_member ADD COLUMN username VARCHAR(255);
+ALTER TABLE message ADD COLUMN sender_username VARCHAR(100);
+
+UPDATE friendship f SET username = u.username FROM users u WHERE u.id = f.user_id;
+UPDATE friendship f SET friend_username = u.username FROM users u WHERE u.id = f.friend_user_id;
+UPDATE friendship SET friend_username = 'deleted user' WHERE friend_user_id IS NULL AND friendship_type = 'one-on-one';
+UPDATE friendRequest f SET sent_by = u.username FROM users u WHERE u.id = f.sent_by_id;
+UPDATE friendRequest f SET sent_to = u.username FROM users u WHERE u.id = f.sent_to_id;
+UPDATE group_member m SET username = u.username FROM users u WHERE u.id = m.user_id;
+UPDATE message m SET sender_username = u.username FROM users u WHERE u.id = m.sender_id;
+UPDATE message SET sender_username = 'deleted user' WHERE sender_id IS NULL;
+
+DROP INDEX IF EXISTS friendship_user_id_idx;
+DROP INDEX IF EXISTS friendship_friendship_id_idx;
+DROP INDEX IF EXISTS friendship_group_id_idx;
+DROP INDEX IF EXISTS friendrequest_sent_by_id_idx;
+DROP INDEX IF EXISTS friendrequest_sent_to_id_idx;
+DROP INDEX IF EXISTS group_member_user_id_idx;
+DROP INDEX IF EXISTS message_friendship_id_idx;
+DROP INDEX IF EXISTS message_sender_id_idx;
+
+-- dropping the columns drops their foreign keys and the unique constraint with them
+ALTER TABLE friendship DROP COLUMN user_id, DROP COLUMN friend_user_id;
+ALTER TABLE friendship DROP CONSTRAINT IF EXISTS friendship_group_id_fkey;
+ALTER TABLE friendRequest DROP COLUMN sent_by_id, DROP COLUMN sent_to_id;
+ALTER TABLE group_member DROP COLUMN user_id;
+ALTER TABLE group_member DROP CONSTRAINT IF EXISTS group_member_group_id_fkey, ALTER COLUMN group_id DROP NOT NULL;
+ALTER TABLE message DROP COLUMN sender_id;
@@ -0,0 +1,59 @@
+-- Moves friendship, friendRequest, group_member and message from usernames to users.id.
+
+ALTER TABLE friendship ADD COLUMN user_id INT, ADD COLUMN friend_user_id INT;
+ALTER TABLE friendRequest ADD COLUMN sent_by_id INT, ADD COLUMN sent_to_id INT;
+ALTER TABLE group_member ADD COLUMN user_id INT;
+ALTER TABLE message ADD COLUMN sender_id INT;
+
+UPDATE friendship f SET user_id = u.id FROM users u WHERE u.username = f.username;
+UPDATE friendship f SET friend_user_id = u.id FROM users u WHERE u.username = f.friend_username;
+UPDATE friendRequest f SET sent_by_id = u.id FROM users u WHERE u.username = f.sent_by;
+UPDATE friendRequest f SET sent_to_id = u.id FROM users u WHERE u.username = f.sent_to;
+UPDATE group_member m SET user_id = u.id FROM users u WHERE u.username = m.username;
+UPDATE message m SET sender_id = u.id FROM users u WHERE u.username = m.sender_username;
+
+-- rows whose user no longer exists could never be read again
+DELETE FROM friendship WHERE user_id IS NULL;
+DELETE FROM friendRequest WHERE sent_by_id IS NULL OR sent_to_id IS NULL;
+DELETE FROM group_member WHERE user_id IS NULL OR group_id IS NULL OR group_id NOT IN (SELECT id FROM groupu);
+DELETE FROM group_member a USING group_member b WHERE a.group_id = b.group_id AND a.user_id = b.user_id AND a.id > b.id;
+
+-- group_id 0 used to mean "not a group"
+UPDATE friendship SET group_id = NULL WHERE group_id = 0 OR group_id NOT IN (SELECT id FROM groupu);
+
+ALTER TABLE friendship
+    ALTER COLUMN user_id SET NOT NULL,
+    ADD FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    ADD FOREIGN KEY (friend_user_id) REFERENCES users(id) ON DELETE SET NULL,
+    ADD FOREIGN KEY (group_id) REFERENCES groupu(id) ON DELETE CASCADE,
+    DROP COLUMN username,
+    DROP COLUMN friend_username;
+
+ALTER TABLE friendRequest
+    ALTER COLUMN sent_by_id SET NOT NULL,
+    ALTER COLUMN sent_to_id SET NOT NULL,
+    ADD FOREIGN KEY (sent_by_id) REFERENCES users(id) ON DELETE CASCADE,
+    ADD FOREIGN KEY (sent_to_id) REFERENCES users(id) ON DELETE CASCADE,
+    DROP COLUMN sent_by,
+    DROP COLUMN sent_to;
+
+ALTER TABLE group_member
+    ALTER COLUMN user_id SET NOT NULL,
+    ALTER COLUMN group_id SET NOT NULL,
+    ADD FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    ADD FOREIGN KEY (group_id) REFERENCES groupu(id) ON DELETE CASCADE,
+    ADD UNIQUE (group_id, user_id),
+    DROP COLUMN username;
+
+ALTER TABLE message
+    ADD FOREIGN KEY (sender_id) REFERENCES users(id) ON DELETE SET NULL,
+    DROP COLUMN sender_username;
+
+CREATE INDEX friendship_user_id_idx ON friendship(user_id);
+CREATE INDEX friendship_friendship_id_idx ON friendship(friendship_id);
+CREATE INDEX friendship_group_id_idx ON friendship(group_id);
+CREATE INDEX friendrequest_sent_by_id_idx ON friendRequest(sent_by_id);
+CREATE INDEX friendrequest_sent_to_id_idx ON friendRequest(sent_to_id);
+CREATE INDEX group_member_user_id_idx ON group_member(user_id);
+CREATE INDEX message_friendship_id_idx ON message(friendship_id, created_at);
+CREATE INDEX message_sender_id_idx ON message(sender_id);
@@ -0,0 +1,14 @@
+DROP INDEX IF EXISTS message_pinned_idx;
+ALTER TABLE message DROP COLUMN pinned_at, DROP COLUMN pinned_by_id;
+
+DROP TABLE IF EXISTS group_permission;
+
+DROP INDEX IF EXISTS group_member_one_owner_idx;
+
+ALTER TABLE group_member
+    DROP CONSTRAINT IF EXISTS group_member_role_check,
+    ALTER COLUMN role DROP DEFAULT,
+    ALTER COLUMN role DROP NOT NULL;
+
+UPDATE group_member SET role = 'admin' WHERE role = 'owner';
+UPDATE group_member SET role = 'member' WHERE role = 'moderator';
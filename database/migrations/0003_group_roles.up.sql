@@ -0,0 +1,35 @@
+-- Group roles become owner, admin, moderator or member. The oldest admin of every group becomes its
+-- owner, groups without an admin get their oldest member.
+
+UPDATE group_member SET role = 'member' WHERE role IS NULL OR role NOT IN ('admin','member');
+
+UPDATE group_member SET role = 'owner' WHERE id IN (
+    SELECT DISTINCT ON (group_id) id FROM group_member WHERE role = 'admin' ORDER BY group_id, created_at, id
+);
+
+UPDATE group_member SET role = 'owner' WHERE id IN (
+    SELECT DISTINCT ON (group_id) id FROM group_member m
+    WHERE NOT EXISTS (SELECT 1 FROM group_member o WHERE o.group_id = m.group_id AND o.role = 'owner')
+    ORDER BY group_id, created_at, id
+);
+
+ALTER TABLE group_member
+    ALTER COLUMN role SET NOT NULL,
+    ALTER COLUMN role SET DEFAULT 'member',
+    ADD CONSTRAINT group_member_role_check CHECK (role IN ('owner','admin','moderator','member'));
+
+CREATE UNIQUE INDEX group_member_one_owner_idx ON group_member(group_id) WHERE role = 'owner';
+
+-- only actions a group changed are stored, the rest use the defaults in the code
+CREATE TABLE group_permission (
+group_id INT NOT NULL REFERENCES groupu(id) ON DELETE CASCADE,
+action VARCHAR(50) NOT NULL,
+min_role VARCHAR(50) NOT NULL CHECK (min_role IN ('owner','admin','moderator','member')),
+PRIMARY KEY (group_id, action)
+);
+
+ALTER TABLE message
+    ADD COLUMN pinned_at TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN pinned_by_id INT REFERENCES users(id) ON DELETE SET NULL;
+
+CREATE INDEX message_pinned_idx ON message(friendship_id, pinned_at) WHERE pinned_at IS NOT NULL;
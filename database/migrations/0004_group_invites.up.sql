@@ -0,0 +1,14 @@
+CREATE TABLE group_invite (
+id SERIAL NOT NULL PRIMARY KEY,
+group_id INT NOT NULL REFERENCES groupu(id) ON DELETE CASCADE,
+token_hash VARCHAR(64) NOT NULL UNIQUE,
+created_by_id INT REFERENCES users(id) ON DELETE SET NULL,
+-- NULL means the link never expires or has no usage cap
+expires_at TIMESTAMP WITH TIME ZONE,
+max_uses INT,
+uses INT DEFAULT 0 NOT NULL,
+revoked_at TIMESTAMP WITH TIME ZONE,
+created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL
+);
+
+CREATE INDEX group_invite_group_id_idx ON group_invite(group_id);
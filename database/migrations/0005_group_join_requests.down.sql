@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS group_join_request;
+
+ALTER TABLE groupu DROP COLUMN IF EXISTS privacy;
@@ -0,0 +1,18 @@
+-- existing groups keep working as before: members only come in when someone adds or invites them
+ALTER TABLE groupu
+    ADD COLUMN privacy VARCHAR(20) DEFAULT 'invite_only' NOT NULL
+    CHECK (privacy IN ('open','request_to_join','invite_only'));
+
+CREATE TABLE group_join_request (
+id SERIAL NOT NULL PRIMARY KEY,
+group_id INT NOT NULL REFERENCES groupu(id) ON DELETE CASCADE,
+user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+message VARCHAR(500) DEFAULT '' NOT NULL,
+status VARCHAR(20) DEFAULT 'pending' NOT NULL CHECK (status IN ('pending','approved','rejected')),
+decided_by_id INT REFERENCES users(id) ON DELETE SET NULL,
+decided_at TIMESTAMP WITH TIME ZONE,
+created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL
+);
+
+-- a user has at most one open request per group, decided ones are kept as history
+CREATE UNIQUE INDEX group_join_request_pending_idx ON group_join_request(group_id, user_id) WHERE status = 'pending';
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS group_audit_event;
+
+ALTER TABLE group_member DROP COLUMN IF EXISTS muted_until;
+
+DROP TABLE IF EXISTS group_ban;
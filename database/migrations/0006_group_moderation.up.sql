@@ -0,0 +1,26 @@
+-- a ban removes the member and keeps them out until it expires, NULL expires_at is permanent
+CREATE TABLE group_ban (
+group_id INT NOT NULL REFERENCES groupu(id) ON DELETE CASCADE,
+user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+banned_by_id INT REFERENCES users(id) ON DELETE SET NULL,
+reason VARCHAR(500) DEFAULT '' NOT NULL,
+expires_at TIMESTAMP WITH TIME ZONE,
+created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL,
+PRIMARY KEY (group_id, user_id)
+);
+
+-- muted members keep reading the group chat but cannot post until muted_until
+ALTER TABLE group_member ADD COLUMN muted_until TIMESTAMP WITH TIME ZONE;
+
+CREATE TABLE group_audit_event (
+id BIGSERIAL NOT NULL PRIMARY KEY,
+group_id INT NOT NULL REFERENCES groupu(id) ON DELETE CASCADE,
+actor_id INT REFERENCES users(id) ON DELETE SET NULL,
+target_id INT REFERENCES users(id) ON DELETE SET NULL,
+action VARCHAR(50) NOT NULL,
+before_value TEXT,
+after_value TEXT,
+created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL
+);
+
+CREATE INDEX group_audit_event_group_idx ON group_audit_event(group_id, created_at DESC, id DESC);
@@ -0,0 +1,11 @@
+-- an owner offers the group to a member, it changes hands once they accept. A group has at most one
+-- open offer, a new one replaces it.
+CREATE TABLE group_ownership_transfer (
+group_id INT NOT NULL PRIMARY KEY REFERENCES groupu(id) ON DELETE CASCADE,
+from_user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+to_user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL
+);
+
+CREATE INDEX group_ownership_transfer_to_user_idx ON group_ownership_transfer(to_user_id);
@@ -0,0 +1,7 @@
+DELETE FROM message WHERE friendship_id LIKE 'channel:%';
+
+DROP TABLE IF EXISTS channel_subscriber;
+
+DROP TABLE IF EXISTS channel;
+
+ALTER TABLE groupu DROP COLUMN IF EXISTS announcement_only;
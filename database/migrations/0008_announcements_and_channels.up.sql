@@ -0,0 +1,26 @@
+-- in announcement groups only admins post, everyone else reads and reacts
+ALTER TABLE groupu ADD COLUMN announcement_only BOOLEAN DEFAULT FALSE NOT NULL;
+
+-- channels broadcast to subscribers. Posts are stored once in message under the chat id
+-- "channel:<id>", there are no friendship rows per subscriber.
+CREATE TABLE channel (
+id SERIAL NOT NULL PRIMARY KEY,
+handle VARCHAR(32) UNIQUE, -- lowercase, NULL when the channel has none
+name VARCHAR(255) NOT NULL,
+description VARCHAR(500) DEFAULT '' NOT NULL,
+is_public BOOLEAN DEFAULT FALSE NOT NULL,
+subscriber_count INT DEFAULT 0 NOT NULL,
+created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL,
+modified_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL
+);
+
+CREATE TABLE channel_subscriber (
+channel_id INT NOT NULL REFERENCES channel(id) ON DELETE CASCADE,
+user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+role VARCHAR(20) DEFAULT 'subscriber' NOT NULL CHECK (role IN ('owner','admin','subscriber')),
+created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL,
+PRIMARY KEY (channel_id, user_id)
+);
+
+CREATE INDEX channel_subscriber_user_id_idx ON channel_subscriber(user_id);
+CREATE UNIQUE INDEX channel_subscriber_one_owner_idx ON channel_subscriber(channel_id) WHERE role = 'owner';
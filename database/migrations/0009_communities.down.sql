@@ -0,0 +1,5 @@
+ALTER TABLE groupu DROP COLUMN IF EXISTS community_id;
+
+DROP TABLE IF EXISTS community_member;
+
+DROP TABLE IF EXISTS community;
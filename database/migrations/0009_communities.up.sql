@@ -0,0 +1,26 @@
+-- a community gathers related groups. Only its members see and join those groups, and everyone who
+-- joins is put in its announcement group.
+CREATE TABLE community (
+id SERIAL NOT NULL PRIMARY KEY,
+name VARCHAR(255) NOT NULL,
+description VARCHAR(500) DEFAULT '' NOT NULL,
+announcement_group_id INT REFERENCES groupu(id) ON DELETE SET NULL,
+created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL,
+modified_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL
+);
+
+CREATE TABLE community_member (
+community_id INT NOT NULL REFERENCES community(id) ON DELETE CASCADE,
+user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+role VARCHAR(20) DEFAULT 'member' NOT NULL CHECK (role IN ('owner','admin','member')),
+created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL,
+PRIMARY KEY (community_id, user_id)
+);
+
+CREATE INDEX community_member_user_id_idx ON community_member(user_id);
+CREATE UNIQUE INDEX community_member_one_owner_idx ON community_member(community_id) WHERE role = 'owner';
+
+-- the groups of a community are deleted with it by the code, which also removes their files
+ALTER TABLE groupu ADD COLUMN community_id INT REFERENCES community(id) ON DELETE SET NULL;
+
+CREATE INDEX groupu_community_id_idx ON groupu(community_id) WHERE community_id IS NOT NULL;
@@ -0,0 +1,16 @@
+DROP INDEX IF EXISTS users_display_name_lower_idx;
+
+DROP INDEX IF EXISTS users_username_lower_idx;
+
+DROP INDEX IF EXISTS group_member_listing_idx;
+
+ALTER TABLE groupu DROP COLUMN IF EXISTS member_count;
+
+ALTER TABLE users
+    DROP COLUMN IF EXISTS last_seen_at,
+    ALTER COLUMN friends_count DROP NOT NULL,
+    ALTER COLUMN friends_count DROP DEFAULT,
+    ALTER COLUMN groups_count DROP NOT NULL,
+    ALTER COLUMN groups_count DROP DEFAULT,
+    ALTER COLUMN is_online DROP NOT NULL,
+    ALTER COLUMN is_online DROP DEFAULT;
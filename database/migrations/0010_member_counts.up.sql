@@ -0,0 +1,25 @@
+-- the counters on users were never kept up to date, they are rebuilt here and maintained by the
+-- code from now on together with the new member count of every group
+UPDATE users u SET
+    friends_count = (SELECT COUNT(*) FROM friendship f WHERE f.user_id = u.id AND f.friendship_type = 'one-on-one'),
+    groups_count = (SELECT COUNT(*) FROM group_member m WHERE m.user_id = u.id),
+    is_online = COALESCE(is_online, FALSE);
+
+ALTER TABLE users
+    ALTER COLUMN friends_count SET DEFAULT 0,
+    ALTER COLUMN friends_count SET NOT NULL,
+    ALTER COLUMN groups_count SET DEFAULT 0,
+    ALTER COLUMN groups_count SET NOT NULL,
+    ALTER COLUMN is_online SET DEFAULT FALSE,
+    ALTER COLUMN is_online SET NOT NULL,
+    ADD COLUMN last_seen_at TIMESTAMP WITH TIME ZONE;
+
+ALTER TABLE groupu ADD COLUMN member_count INT DEFAULT 0 NOT NULL;
+
+UPDATE groupu g SET member_count = (SELECT COUNT(*) FROM group_member m WHERE m.group_id = g.id);
+
+-- member listings page through a group in join order, searches match the start of a username or
+-- display name whatever the case
+CREATE INDEX group_member_listing_idx ON group_member(group_id, created_at, id);
+CREATE INDEX users_username_lower_idx ON users(lower(username) text_pattern_ops);
+CREATE INDEX users_display_name_lower_idx ON users(lower(display_name) text_pattern_ops);
@@ -0,0 +1,12 @@
+-- a block is one way, blocker_id no longer hears from blocked_id. Either direction is enough to stop
+-- friend requests and one-on-one messages between the two.
+CREATE TABLE user_block (
+blocker_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+blocked_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL,
+PRIMARY KEY (blocker_id, blocked_id),
+CHECK (blocker_id <> blocked_id)
+);
+
+-- the primary key answers who a user blocked, this answers who blocked them
+CREATE INDEX user_block_blocked_idx ON user_block(blocked_id, blocker_id);
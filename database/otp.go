@@ -2,52 +2,104 @@ package database
 
 import (
 	"context"
+	"database/sql"
 	"time"
 )
 
 type Otp struct {
 	ID         int64     `json:"id"`
 	Username   string    `json:"username"`
-	Token      int64     `json:"token"`
+	TokenHash  string    `json:"-"`
 	Email      string    `json:"email"`
 	Purpose    string    `json:"purpose"`
+	Attempts   int       `json:"attempts"`
 	Exp        time.Time `json:"exp"`
 	CreatedAt  string    `json:"created_at"`
 	ModifiedAt string    `json:"modified_at"`
 }
 
-func (r *DataRepository) InsertOtp(ctx context.Context, username, email, purpose string, token int64) error {
+func (r *DataRepository) InsertOtp(ctx context.Context, username, email, purpose, tokenHash string, exp time.Time) error {
 
-	query := `INSERT INTO otp (username,email,purpose,exp,token,created_at,modified_at) VALUES($1,$2,$3,$4,$5,$6,$7)`
-
-	exp := time.Now().Add(time.Minute * 20)
+	query := `INSERT INTO otp (username,email,purpose,exp,token_hash,attempts,created_at,modified_at) VALUES($1,$2,$3,$4,$5,$6,$7,$8)`
 
 	now := time.Now()
 
-	_, err := r.db.ExecContext(ctx, query, username, email, purpose, exp, token, now, now)
+	_, err := r.db.ExecContext(ctx, query, username, email, purpose, exp, tokenHash, 0, now, now)
 
 	return err
 }
 
-func (r *DataRepository) GetOtp(ctx context.Context, token int64) (*Otp, error) {
+// latest unexpired otp for the email and purpose, older ones are deleted whenever a new one is issued
+func (r *DataRepository) GetActiveOtp(ctx context.Context, email, purpose string) (*Otp, error) {
+
+	query := `SELECT id,username,token_hash,email,purpose,attempts,exp,created_at,modified_at FROM otp WHERE email = $1 AND purpose = $2 AND exp > $3 ORDER BY created_at DESC LIMIT 1`
 
-	query := `SELECT id,username,token,email,purpose,exp,created_at,modified_at FROM otp WHERE token = $1`
+	row := r.db.QueryRowContext(ctx, query, email, purpose, time.Now())
 
-	row, err := r.db.QueryContext(ctx, query, token)
+	var otp Otp
+
+	err := row.Scan(&otp.ID, &otp.Username, &otp.TokenHash, &otp.Email, &otp.Purpose, &otp.Attempts, &otp.Exp, &otp.CreatedAt, &otp.ModifiedAt)
 
 	if err != nil {
 		return nil, err
 	}
 
-	row.Next()
+	return &otp, nil
+}
 
-	var otp Otp
+// ClaimOtpAttempt counts a guess against the otp before the code is compared. It reports false
+// when the otp is gone or maxAttempts guesses were already claimed, so parallel guesses cannot
+// all read the same count and get past the limit.
+func (r *DataRepository) ClaimOtpAttempt(ctx context.Context, id int64, maxAttempts int) (bool, error) {
+
+	query := `UPDATE otp SET attempts = attempts + 1, modified_at = $1 WHERE id = $2 AND attempts < $3 RETURNING attempts`
+
+	var attempts int
 
-	err = row.Scan(&otp.ID, &otp.Username, &otp.Token, &otp.Email, &otp.Purpose, &otp.Exp, &otp.CreatedAt, &otp.ModifiedAt)
+	err := r.db.QueryRowContext(ctx, query, time.Now(), id, maxAttempts).Scan(&attempts)
+
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// ConsumeOtp deletes the otp and reports whether this call was the one that deleted it,
+// so two requests racing with the same code cannot both succeed
+func (r *DataRepository) ConsumeOtp(ctx context.Context, id int64) (bool, error) {
+
+	query := `DELETE FROM otp WHERE id = $1`
+
+	result, err := r.db.ExecContext(ctx, query, id)
 
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
-	return &otp, nil
+	count, err := result.RowsAffected()
+
+	return count == 1, err
+}
+
+func (r *DataRepository) DeleteOtps(ctx context.Context, email, purpose string) error {
+
+	query := `DELETE FROM otp WHERE email = $1 AND purpose = $2`
+
+	_, err := r.db.ExecContext(ctx, query, email, purpose)
+
+	return err
+}
+
+func (r *DataRepository) DeleteExpiredOtps(ctx context.Context) (int64, error) {
+
+	query := `DELETE FROM otp WHERE exp < $1`
+
+	result, err := r.db.ExecContext(ctx, query, time.Now())
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
 }
@@ -0,0 +1,118 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+type Passkey struct {
+	ID           int64      `json:"id"`
+	Username     string     `json:"-"`
+	CredentialID string     `json:"credential_id"`
+	PublicKey    []byte     `json:"-"`
+	Algorithm    int        `json:"algorithm"` // COSE alg, -7 ES256 or -257 RS256
+	SignCount    int64      `json:"-"`
+	Name         string     `json:"name"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   *time.Time `json:"last_used_at"`
+}
+
+func (d *DataRepository) InsertPasskey(ctx context.Context, passkey *Passkey) error {
+
+	query := `INSERT INTO webauthn_credential(username,credential_id,public_key,algorithm,sign_count,name) VALUES($1,$2,$3,$4,$5,$6)`
+
+	_, err := d.db.ExecContext(ctx, query, passkey.Username, passkey.CredentialID, passkey.PublicKey, passkey.Algorithm, passkey.SignCount, passkey.Name)
+
+	return err
+}
+
+func (d *DataRepository) GetPasskeyByCredentialId(ctx context.Context, credentialId string) (*Passkey, error) {
+
+	query := `SELECT id,username,credential_id,public_key,algorithm,sign_count,name,created_at,last_used_at FROM webauthn_credential WHERE credential_id = $1`
+
+	var p Passkey
+
+	err := d.db.QueryRowContext(ctx, query, credentialId).Scan(&p.ID, &p.Username, &p.CredentialID, &p.PublicKey, &p.Algorithm, &p.SignCount, &p.Name, &p.CreatedAt, &p.LastUsedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+func (d *DataRepository) GetPasskeysByUsername(ctx context.Context, username string) ([]Passkey, error) {
+
+	query := `SELECT id,username,credential_id,public_key,algorithm,sign_count,name,created_at,last_used_at FROM webauthn_credential WHERE username = $1 ORDER BY created_at`
+
+	row, err := d.db.QueryContext(ctx, query, username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer row.Close()
+
+	var passkeys []Passkey
+
+	for row.Next() {
+
+		var p Passkey
+
+		err := row.Scan(&p.ID, &p.Username, &p.CredentialID, &p.PublicKey, &p.Algorithm, &p.SignCount, &p.Name, &p.CreatedAt, &p.LastUsedAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		passkeys = append(passkeys, p)
+	}
+
+	return passkeys, row.Err()
+}
+
+// the sign count only moves forward, a concurrent assertion with the same count loses
+func (d *DataRepository) UpdatePasskeySignCount(ctx context.Context, id, oldCount, newCount int64) (bool, error) {
+
+	query := `UPDATE webauthn_credential SET sign_count = $1, last_used_at = $2 WHERE id = $3 AND sign_count = $4`
+
+	result, err := d.db.ExecContext(ctx, query, newCount, time.Now(), id, oldCount)
+
+	if err != nil {
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+
+	return count == 1, err
+}
+
+func (d *DataRepository) RenamePasskey(ctx context.Context, username string, id int64, name string) (bool, error) {
+
+	query := `UPDATE webauthn_credential SET name = $1 WHERE id = $2 AND username = $3`
+
+	result, err := d.db.ExecContext(ctx, query, name, id, username)
+
+	if err != nil {
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+
+	return count == 1, err
+}
+
+func (d *DataRepository) DeletePasskey(ctx context.Context, username string, id int64) (bool, error) {
+
+	query := `DELETE FROM webauthn_credential WHERE id = $1 AND username = $2`
+
+	result, err := d.db.ExecContext(ctx, query, id, username)
+
+	if err != nil {
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+
+	return count == 1, err
+}
@@ -0,0 +1,191 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+	ErrSessionInvalid     = errors.New("session expired or revoked")
+)
+
+type Session struct {
+	ID         string     `json:"id"`
+	Username   string     `json:"-"`
+	DeviceName string     `json:"device_name"`
+	Ip         string     `json:"ip"`
+	UserAgent  string     `json:"user_agent"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"-"`
+	Current    bool       `json:"current"`
+}
+
+func (s *Session) Active() bool {
+	return s.RevokedAt == nil && s.ExpiresAt.After(time.Now())
+}
+
+func (d *DataRepository) InsertSession(ctx context.Context, session *Session, refreshTokenHash string) error {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := `INSERT INTO session(id,username,device_name,ip,user_agent,last_used_at,expires_at) VALUES($1,$2,$3,$4,$5,$6,$7)`
+
+	_, err = tx.ExecContext(ctx, query, session.ID, session.Username, session.DeviceName, session.Ip, session.UserAgent, time.Now(), session.ExpiresAt)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO refresh_token(session_id,token_hash) VALUES($1,$2)`, session.ID, refreshTokenHash)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (d *DataRepository) GetSessionById(ctx context.Context, id string) (*Session, error) {
+
+	query := `SELECT id,username,device_name,ip,user_agent,created_at,last_used_at,expires_at,revoked_at FROM session WHERE id = $1`
+
+	var session Session
+
+	err := d.db.QueryRowContext(ctx, query, id).Scan(&session.ID, &session.Username, &session.DeviceName, &session.Ip, &session.UserAgent, &session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt, &session.RevokedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+func (d *DataRepository) GetActiveSessions(ctx context.Context, username string) ([]Session, error) {
+
+	query := `SELECT id,username,device_name,ip,user_agent,created_at,last_used_at,expires_at,revoked_at FROM session
+	WHERE username = $1 AND revoked_at IS NULL AND expires_at > $2 ORDER BY last_used_at DESC`
+
+	row, err := d.db.QueryContext(ctx, query, username, time.Now())
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer row.Close()
+
+	var sessions []Session
+
+	for row.Next() {
+
+		var session Session
+
+		err := row.Scan(&session.ID, &session.Username, &session.DeviceName, &session.Ip, &session.UserAgent, &session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt, &session.RevokedAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions, row.Err()
+}
+
+// RotateRefreshToken swaps a refresh token for a new one in the same family. Presenting a token
+// that was already rotated means it leaked, so the whole session is revoked and ErrRefreshTokenReused returned.
+func (d *DataRepository) RotateRefreshToken(ctx context.Context, oldHash, newHash string) (*Session, error) {
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	var tokenId int64
+	var rotatedAt *time.Time
+	var session Session
+
+	query := `SELECT rt.id,rt.rotated_at,s.id,s.username,s.expires_at,s.revoked_at FROM refresh_token rt
+	JOIN session s ON s.id = rt.session_id WHERE rt.token_hash = $1 FOR UPDATE`
+
+	err = tx.QueryRowContext(ctx, query, oldHash).Scan(&tokenId, &rotatedAt, &session.ID, &session.Username, &session.ExpiresAt, &session.RevokedAt)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrSessionInvalid
+		}
+		return nil, err
+	}
+
+	now := time.Now()
+
+	if rotatedAt != nil {
+
+		_, err := tx.ExecContext(ctx, `UPDATE session SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL`, now, session.ID)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+
+		return &session, ErrRefreshTokenReused
+	}
+
+	if !session.Active() {
+		return nil, ErrSessionInvalid
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE refresh_token SET rotated_at = $1 WHERE id = $2`, now, tokenId); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO refresh_token(session_id,token_hash) VALUES($1,$2)`, session.ID, newHash); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE session SET last_used_at = $1 WHERE id = $2`, now, session.ID); err != nil {
+		return nil, err
+	}
+
+	return &session, tx.Commit()
+}
+
+func (d *DataRepository) RevokeSession(ctx context.Context, username, id string) (bool, error) {
+
+	query := `UPDATE session SET revoked_at = $1 WHERE id = $2 AND username = $3 AND revoked_at IS NULL`
+
+	result, err := d.db.ExecContext(ctx, query, time.Now(), id, username)
+
+	if err != nil {
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+
+	return count > 0, err
+}
+
+func (d *DataRepository) RevokeAllSessions(ctx context.Context, username string) error {
+
+	query := `UPDATE session SET revoked_at = $1 WHERE username = $2 AND revoked_at IS NULL`
+
+	_, err := d.db.ExecContext(ctx, query, time.Now(), username)
+
+	return err
+}
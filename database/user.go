@@ -17,6 +17,32 @@ const (
 	Admin
 )
 
+var ErrUnknownRole = errors.New("unknown role")
+
+// roles are stored by name in users.role
+func (role Role) String() string {
+
+	switch role {
+	case Admin:
+		return "admin"
+	default:
+		return "user"
+	}
+}
+
+// ParseRole also accepts the numeric values older rows were written with
+func ParseRole(value string) (Role, error) {
+
+	switch value {
+	case "user", "0":
+		return NUser, nil
+	case "admin", "1":
+		return Admin, nil
+	}
+
+	return NUser, ErrUnknownRole
+}
+
 type User struct {
 	ID           int64  `json:"id"`
 	Username     string `json:"username"`
@@ -28,13 +54,18 @@ type User struct {
 	IsOnline     bool   `json:"is_online"`
 	FriendsCount int64  `json:"friends_count"`
 	GroupsCount  int16  `json:"groups_count"`
-	Role         string `json:"_"`
-	Enabled      bool   `json:"_"`
+	Role         string `json:"-"`
+	Enabled      bool   `json:"-"`
 	CreatedAt    string `json:"created_at"`
 	ModifiedAt   string `json:"modified_at"`
 }
 
 func (r *DataRepository) CreateUser(ctx context.Context, user *User) error {
+	return insertUser(ctx, r.db, user)
+}
+
+// insertUser hashes the password and stores the user, db is either the pool or a transaction
+func insertUser(ctx context.Context, db execer, user *User) error {
 
 	query := `INSERT INTO users (username,display_name,email,password,image_url,bio,is_online,friends_count,groups_count,role,enabled,modified_at) VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)`
 
@@ -44,7 +75,7 @@ func (r *DataRepository) CreateUser(ctx context.Context, user *User) error {
 		return errors.New("error hashing user password")
 	}
 
-	_, err = r.db.ExecContext(ctx, query, user.Username, user.DisplayName, "", string(hashedPassword), "", "", false, 0, 0, 0, true, time.Now())
+	_, err = db.ExecContext(ctx, query, user.Username, user.DisplayName, "", string(hashedPassword), "", "", false, 0, 0, NUser.String(), true, time.Now())
 
 	if err != nil {
 
@@ -56,13 +87,13 @@ func (r *DataRepository) CreateUser(ctx context.Context, user *User) error {
 
 func (r *DataRepository) GetUserByID(ctx context.Context, id int64) (*User, error) {
 
-	query := `SELECT id,username,display_name,email,password,image_url,bio,is_online,friends_count,groups_count,created_at,modified_at FROM users WHERE id = $1`
+	query := `SELECT id,username,display_name,email,password,image_url,bio,is_online,friends_count,groups_count,role,enabled,created_at,modified_at FROM users WHERE id = $1`
 
 	row := r.db.QueryRowContext(ctx, query, id)
 
 	var user User
 
-	err := row.Scan(&user.ID, &user.Username, &user.DisplayName, &user.Email, &user.Password, &user.ImageUrl, &user.Bio, &user.IsOnline, &user.FriendsCount, &user.GroupsCount, &user.CreatedAt, &user.ModifiedAt)
+	err := row.Scan(&user.ID, &user.Username, &user.DisplayName, &user.Email, &user.Password, &user.ImageUrl, &user.Bio, &user.IsOnline, &user.FriendsCount, &user.GroupsCount, &user.Role, &user.Enabled, &user.CreatedAt, &user.ModifiedAt)
 
 	if err != nil {
 		return nil, err
@@ -74,13 +105,13 @@ func (r *DataRepository) GetUserByID(ctx context.Context, id int64) (*User, erro
 
 func (r *DataRepository) GetUserByEmail(ctx context.Context, email string) (*User, error) {
 
-	query := `SELECT id,username,display_name,email,password,image_url,bio,is_online,friends_count,groups_count,created_at,modified_at FROM users WHERE email = $1`
+	query := `SELECT id,username,display_name,email,password,image_url,bio,is_online,friends_count,groups_count,role,enabled,created_at,modified_at FROM users WHERE email = $1`
 
 	row := r.db.QueryRowContext(ctx, query, email)
 
 	var user User
 
-	err := row.Scan(&user.ID, &user.Username, &user.DisplayName, &user.Email, &user.Password, &user.ImageUrl, &user.Bio, &user.IsOnline, &user.FriendsCount, &user.GroupsCount, &user.CreatedAt, &user.ModifiedAt)
+	err := row.Scan(&user.ID, &user.Username, &user.DisplayName, &user.Email, &user.Password, &user.ImageUrl, &user.Bio, &user.IsOnline, &user.FriendsCount, &user.GroupsCount, &user.Role, &user.Enabled, &user.CreatedAt, &user.ModifiedAt)
 
 	if err != nil {
 		return nil, err
@@ -92,13 +123,13 @@ func (r *DataRepository) GetUserByEmail(ctx context.Context, email string) (*Use
 
 func (r *DataRepository) GetByUsername(ctx context.Context, username string) (*User, error) {
 
-	query := `SELECT id,username,display_name,email,password,image_url,bio,is_online,friends_count,groups_count,created_at,modified_at FROM users WHERE username = $1`
+	query := `SELECT id,username,display_name,email,password,image_url,bio,is_online,friends_count,groups_count,role,enabled,created_at,modified_at FROM users WHERE username = $1`
 
 	row := r.db.QueryRowContext(ctx, query, username)
 
 	var user User
 
-	err := row.Scan(&user.ID, &user.Username, &user.DisplayName, &user.Email, &user.Password, &user.ImageUrl, &user.Bio, &user.IsOnline, &user.FriendsCount, &user.GroupsCount, &user.CreatedAt, &user.ModifiedAt)
+	err := row.Scan(&user.ID, &user.Username, &user.DisplayName, &user.Email, &user.Password, &user.ImageUrl, &user.Bio, &user.IsOnline, &user.FriendsCount, &user.GroupsCount, &user.Role, &user.Enabled, &user.CreatedAt, &user.ModifiedAt)
 
 	if err != nil {
 		return nil, err
@@ -175,13 +206,34 @@ func (r *DataRepository) UpdateUserPassword(ctx context.Context, password, email
 
 func (r *DataRepository) CheackUsernameAvailability(ctx context.Context, username string) bool {
 
-	query := `SELECT username FROM users WHERE username = $1`
+	// names given up in a username change stay taken while they are reserved
+	query := `SELECT EXISTS(SELECT 1 FROM users WHERE username = $1) OR EXISTS(SELECT 1 FROM username_history WHERE old_username = $1 AND reserved_until > NOW())`
 	row := r.db.QueryRowContext(ctx, query, username)
 
-	var dbUsername string
+	var exists bool
 
-	row.Scan(&dbUsername)
+	row.Scan(&exists)
 
-	return dbUsername != ""
+	return exists
 
 }
+
+// GetUserIdByUsername resolves a username from a request to the id the tables reference
+func (r *DataRepository) GetUserIdByUsername(ctx context.Context, username string) (int64, error) {
+
+	var id int64
+
+	err := r.db.QueryRowContext(ctx, `SELECT id FROM users WHERE username = $1`, username).Scan(&id)
+
+	return id, err
+}
+
+// SetUserOnline records presence, going offline also stamps when the user was last seen
+func (r *DataRepository) SetUserOnline(ctx context.Context, userId int64, online bool) error {
+
+	query := `UPDATE users SET is_online = $1, last_seen_at = CASE WHEN $1 THEN last_seen_at ELSE NOW() END WHERE id = $2`
+
+	_, err := r.db.ExecContext(ctx, query, online, userId)
+
+	return err
+}
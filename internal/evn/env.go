@@ -3,6 +3,7 @@ package evn
 import (
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/joho/godotenv"
 )
@@ -35,3 +36,20 @@ func GetInt(fallback int, key string) int {
 
 	return intVal
 }
+
+// comma separated values, empty entries dropped
+func GetList(key string) []string {
+
+	var list []string
+
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+
+		value = strings.TrimSpace(value)
+
+		if value != "" {
+			list = append(list, value)
+		}
+	}
+
+	return list
+}
@@ -0,0 +1,110 @@
+// Package export writes personal data archives: a zip of json files and media with a manifest.json
+// describing every entry so the archive can be read by other programs.
+package export
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+)
+
+const FormatVersion = 1
+
+type Entry struct {
+	Path        string `json:"path"`
+	Description string `json:"description"`
+	Kind        string `json:"kind"`              // json or media
+	Records     int    `json:"records,omitempty"` // rows in a json entry
+	Bytes       int64  `json:"bytes,omitempty"`   // size of a media entry
+}
+
+type Manifest struct {
+	FormatVersion int       `json:"format_version"`
+	Subject       string    `json:"subject"`
+	GeneratedAt   time.Time `json:"generated_at"`
+	Entries       []Entry   `json:"entries"`
+	Missing       []string  `json:"missing,omitempty"` // media referenced in the data that could not be read
+}
+
+type Writer struct {
+	zip      *zip.Writer
+	manifest Manifest
+}
+
+func NewWriter(w io.Writer, subject string) *Writer {
+	return &Writer{
+		zip:      zip.NewWriter(w),
+		manifest: Manifest{FormatVersion: FormatVersion, Subject: subject, GeneratedAt: time.Now().UTC()},
+	}
+}
+
+// AddJSON writes data as indented json, records is the number of rows it holds
+func (w *Writer) AddJSON(path, description string, data any, records int) error {
+
+	file, err := w.zip.Create(path)
+
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+
+	if err := encoder.Encode(data); err != nil {
+		return err
+	}
+
+	w.manifest.Entries = append(w.manifest.Entries, Entry{Path: path, Description: description, Kind: "json", Records: records})
+
+	return nil
+}
+
+// AddFile copies a file from disk, a file that cannot be opened is listed as missing rather than failing the archive
+func (w *Writer) AddFile(path, description, source string) error {
+
+	src, err := os.Open(source)
+
+	if err != nil {
+		w.manifest.Missing = append(w.manifest.Missing, path)
+		return nil
+	}
+
+	defer src.Close()
+
+	file, err := w.zip.Create(path)
+
+	if err != nil {
+		return err
+	}
+
+	size, err := io.Copy(file, src)
+
+	if err != nil {
+		return err
+	}
+
+	w.manifest.Entries = append(w.manifest.Entries, Entry{Path: path, Description: description, Kind: "media", Bytes: size})
+
+	return nil
+}
+
+// Close writes manifest.json and finishes the zip
+func (w *Writer) Close() error {
+
+	file, err := w.zip.Create("manifest.json")
+
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+
+	if err := encoder.Encode(w.manifest); err != nil {
+		return err
+	}
+
+	return w.zip.Close()
+}
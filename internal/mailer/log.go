@@ -0,0 +1,36 @@
+package mailer
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// LogMailer is the development mailer. With an empty Dir it prints the text
+// part to the log, otherwise every message is written to Dir as a .eml file
+// that can be opened in a mail client.
+type LogMailer struct {
+	From string
+	Dir  string
+}
+
+func (l *LogMailer) Send(ctx context.Context, message Message) error {
+
+	if l.Dir == "" {
+		log.Printf("mail to %s: %s\n%s", message.To, message.Subject, message.Text)
+		return nil
+	}
+
+	body, err := buildMIME(l.From, message)
+
+	if err != nil {
+		return err
+	}
+
+	name := strconv.Itoa(int(time.Now().UnixNano())) + ".eml"
+
+	return os.WriteFile(filepath.Join(l.Dir, name), body, 0o600)
+}
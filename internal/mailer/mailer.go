@@ -0,0 +1,107 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"errors"
+	htmltemplate "html/template"
+	texttemplate "text/template"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+type Mailer interface {
+	Send(ctx context.Context, message Message) error
+}
+
+//go:embed templates
+var templateFS embed.FS
+
+var (
+	htmlTemplates = htmltemplate.Must(htmltemplate.ParseFS(templateFS, "templates/*.html"))
+	textTemplates = texttemplate.Must(texttemplate.ParseFS(templateFS, "templates/*.txt"))
+)
+
+type template struct {
+	subject string
+	name    string // file name without extension, shared by the .html and .txt version
+}
+
+// one template per otp purpose, keyed by the purpose stored in the otp table
+var otpTemplates = map[string]template{
+	"Login":         {subject: "Your Nkata sign-in code", name: "otp_login"},
+	"Reset":         {subject: "Reset your Nkata password", name: "otp_reset"},
+	"ChangeEmail":   {subject: "Confirm your email for Nkata", name: "otp_change_email"},
+	"DeleteAccount": {subject: "Confirm deleting your Nkata account", name: "otp_delete_account"},
+}
+
+type OtpData struct {
+	Username      string
+	Code          string
+	ExpiresInMins int
+}
+
+func render(to, subject, name string, data any) (Message, error) {
+
+	var html, text bytes.Buffer
+
+	if err := htmlTemplates.ExecuteTemplate(&html, name+".html", data); err != nil {
+		return Message{}, err
+	}
+
+	if err := textTemplates.ExecuteTemplate(&text, name+".txt", data); err != nil {
+		return Message{}, err
+	}
+
+	return Message{To: to, Subject: subject, Text: text.String(), HTML: html.String()}, nil
+}
+
+func OtpMessage(purpose, to string, data OtpData) (Message, error) {
+
+	t, ok := otpTemplates[purpose]
+
+	if !ok {
+		return Message{}, errors.New("mailer: no template for otp purpose " + purpose)
+	}
+
+	return render(to, t.subject, t.name, data)
+}
+
+type LockoutData struct {
+	Username      string
+	Failures      int64
+	LockedForMins int
+	Ip            string
+}
+
+func LockoutMessage(to string, data LockoutData) (Message, error) {
+	return render(to, "Your Nkata account was locked", "account_locked", data)
+}
+
+type ExportData struct {
+	Username       string
+	Link           string
+	ExpiresInHours int
+}
+
+func ExportReadyMessage(to string, data ExportData) (Message, error) {
+	return render(to, "Your Nkata data export is ready", "export_ready", data)
+}
+
+type EmailChangedData struct {
+	Username         string
+	NewEmail         string
+	RevertLink       string
+	RevertWindowDays int
+}
+
+// EmailChangedMessage goes to the previous address so a hijacked change can be undone
+func EmailChangedMessage(to string, data EmailChangedData) (Message, error) {
+	return render(to, "The email on your Nkata account was changed", "email_changed", data)
+}
@@ -0,0 +1,85 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+var ErrQueueFull = errors.New("mailer: send queue is full")
+
+// Queue sends mail in the background through another Mailer, retrying a
+// failed message with exponential backoff. Send only enqueues, so request
+// handlers never wait on the mail server.
+type Queue struct {
+	mailer      Mailer
+	maxAttempts int
+	backoff     time.Duration
+	jobs        chan Message
+	wg          sync.WaitGroup
+}
+
+func NewQueue(mailer Mailer, workers, maxAttempts int, backoff time.Duration) *Queue {
+
+	q := &Queue{
+		mailer:      mailer,
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		jobs:        make(chan Message, 256),
+	}
+
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+
+	return q
+}
+
+func (q *Queue) Send(ctx context.Context, message Message) error {
+
+	select {
+	case q.jobs <- message:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Close stops accepting mail and waits for queued messages to finish
+func (q *Queue) Close() {
+	close(q.jobs)
+	q.wg.Wait()
+}
+
+func (q *Queue) work() {
+
+	defer q.wg.Done()
+
+	for message := range q.jobs {
+
+		wait := q.backoff
+
+		for attempt := 1; attempt <= q.maxAttempts; attempt++ {
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			err := q.mailer.Send(ctx, message)
+			cancel()
+
+			if err == nil {
+				break
+			}
+
+			if attempt == q.maxAttempts {
+				log.Printf("mailer: giving up on mail to %s after %d attempts: %v", message.To, attempt, err)
+				break
+			}
+
+			log.Printf("mailer: attempt %d to %s failed, retrying in %s: %v", attempt, message.To, wait, err)
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyMailer fails the first failures sends and records when every attempt was made
+type flakyMailer struct {
+	mutex    sync.Mutex
+	failures int
+	attempts []time.Time
+}
+
+func (f *flakyMailer) Send(ctx context.Context, message Message) error {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.attempts = append(f.attempts, time.Now())
+
+	if len(f.attempts) <= f.failures {
+		return errors.New("421 try again later")
+	}
+
+	return nil
+}
+
+func TestQueueRetriesWithBackoff(t *testing.T) {
+
+	const backoff = 20 * time.Millisecond
+
+	tests := []struct {
+		name        string
+		failures    int
+		maxAttempts int
+		attempts    int
+	}{
+		{name: "first attempt", failures: 0, maxAttempts: 4, attempts: 1},
+		{name: "succeeds on a retry", failures: 2, maxAttempts: 4, attempts: 3},
+		{name: "gives up", failures: 10, maxAttempts: 4, attempts: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			mailer := &flakyMailer{failures: tt.failures}
+
+			queue := NewQueue(mailer, 1, tt.maxAttempts, backoff)
+
+			if err := queue.Send(context.Background(), Message{To: "ada@example.com"}); err != nil {
+				t.Fatal(err)
+			}
+
+			// Close waits for the message to be delivered or given up on
+			queue.Close()
+
+			if len(mailer.attempts) != tt.attempts {
+				t.Fatalf("made %d attempts, want %d", len(mailer.attempts), tt.attempts)
+			}
+
+			// the wait doubles after every failure
+			wait := backoff
+
+			for i := 1; i < len(mailer.attempts); i++ {
+
+				if gap := mailer.attempts[i].Sub(mailer.attempts[i-1]); gap < wait {
+					t.Errorf("attempt %d came %s after the previous one, want at least %s", i+1, gap, wait)
+				}
+
+				wait *= 2
+			}
+		})
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+
+	// without workers nothing drains the queue
+	queue := NewQueue(&flakyMailer{}, 0, 1, time.Millisecond)
+
+	var err error
+
+	for i := 0; i <= cap(queue.jobs) && err == nil; i++ {
+		err = queue.Send(context.Background(), Message{To: "ada@example.com"})
+	}
+
+	if err != ErrQueueFull {
+		t.Errorf("Send error = %v, want %v", err, ErrQueueFull)
+	}
+
+	queue.Close()
+}
@@ -0,0 +1,180 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+type SMTPConfig struct {
+	Host       string
+	Port       int
+	Username   string // empty skips AUTH
+	Password   string
+	From       string
+	RequireTLS bool        // refuse to send when the server does not offer STARTTLS
+	TLSConfig  *tls.Config // nil checks the server against the system roots, override to trust a local server
+}
+
+// SMTPMailer delivers mail over a fresh SMTP connection per message,
+// upgrading with STARTTLS whenever the server offers it.
+type SMTPMailer struct {
+	config SMTPConfig
+}
+
+func NewSMTPMailer(config SMTPConfig) *SMTPMailer {
+	return &SMTPMailer{config: config}
+}
+
+func (s *SMTPMailer) Send(ctx context.Context, message Message) error {
+
+	addr := net.JoinHostPort(s.config.Host, fmt.Sprint(s.config.Port))
+
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+
+	if err != nil {
+		return err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, s.config.Host)
+
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	defer client.Close()
+
+	tlsConfig := &tls.Config{ServerName: s.config.Host}
+
+	if s.config.TLSConfig != nil {
+		tlsConfig = s.config.TLSConfig.Clone()
+		tlsConfig.ServerName = s.config.Host
+	}
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	} else if s.config.RequireTLS {
+		return errors.New("mailer: smtp server does not support STARTTLS")
+	}
+
+	if s.config.Username != "" {
+		// smtp.PlainAuth refuses to send credentials over an unencrypted connection unless the host is localhost
+		if err := client.Auth(smtp.PlainAuth("", s.config.Username, s.config.Password, s.config.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(addressOnly(s.config.From)); err != nil {
+		return err
+	}
+
+	if err := client.Rcpt(message.To); err != nil {
+		return err
+	}
+
+	writer, err := client.Data()
+
+	if err != nil {
+		return err
+	}
+
+	body, err := buildMIME(s.config.From, message)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := writer.Write(body); err != nil {
+		return err
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+func addressOnly(from string) string {
+
+	if start := strings.LastIndex(from, "<"); start != -1 {
+		return strings.TrimSuffix(from[start+1:], ">")
+	}
+
+	return from
+}
+
+// buildMIME writes a multipart/alternative message with the text part first so clients prefer the html part
+func buildMIME(from string, message Message) ([]byte, error) {
+
+	var buf bytes.Buffer
+
+	random := make([]byte, 12)
+
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+
+	boundary := "nkata-" + hex.EncodeToString(random)
+
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", message.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", message.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", boundary)
+
+	parts := []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain", message.Text},
+		{"text/html", message.HTML},
+	}
+
+	for _, part := range parts {
+
+		if part.content == "" {
+			continue
+		}
+
+		fmt.Fprintf(&buf, "--%s\r\n", boundary)
+		fmt.Fprintf(&buf, "Content-Type: %s; charset=utf-8\r\n", part.contentType)
+		fmt.Fprintf(&buf, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+		qp := quotedprintable.NewWriter(&buf)
+
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+
+		buf.WriteString("\r\n")
+	}
+
+	fmt.Fprintf(&buf, "--%s--\r\n", boundary)
+
+	return buf.Bytes(), nil
+}
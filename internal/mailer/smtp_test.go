@@ -0,0 +1,433 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	sinkUsername = "mailer"
+	sinkPassword = "s3cret"
+)
+
+// smtpSink is a local SMTP server that offers STARTTLS and, once the connection is encrypted, AUTH
+// PLAIN. It keeps every message it accepts.
+type smtpSink struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	starttls  bool
+
+	mutex    sync.Mutex
+	received []sinkMessage
+	tlsUsed  bool
+	authUsed bool
+}
+
+type sinkMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+func newSMTPSink(t *testing.T, starttls bool) (*smtpSink, *x509.CertPool) {
+
+	t.Helper()
+
+	cert, pool := selfSignedCert(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &smtpSink{
+		listener:  listener,
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		starttls:  starttls,
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go s.serve(conn)
+		}
+	}()
+
+	t.Cleanup(func() { listener.Close() })
+
+	return s, pool
+}
+
+func (s *smtpSink) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *smtpSink) messages() []sinkMessage {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]sinkMessage(nil), s.received...)
+}
+
+// used reports whether any connection upgraded with STARTTLS and whether any authenticated
+func (s *smtpSink) used() (bool, bool) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.tlsUsed, s.authUsed
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+
+	encrypted, authenticated := false, false
+
+	var current sinkMessage
+
+	reply("220 sink ESMTP ready")
+
+	for {
+		line, err := reader.ReadString('\n')
+
+		if err != nil {
+			return
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch verb {
+		case "EHLO", "HELO":
+			reply("250-sink greets you")
+			if s.starttls && !encrypted {
+				reply("250-STARTTLS")
+			}
+			if encrypted {
+				reply("250-AUTH PLAIN")
+			}
+			reply("250 8BITMIME")
+
+		case "STARTTLS":
+			reply("220 go ahead")
+
+			tlsConn := tls.Server(conn, s.tlsConfig)
+
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+
+			conn, reader, encrypted = tlsConn, bufio.NewReader(tlsConn), true
+
+			s.mutex.Lock()
+			s.tlsUsed = true
+			s.mutex.Unlock()
+
+		case "AUTH":
+			fields := strings.Fields(line)
+
+			if !encrypted || len(fields) != 3 || fields[1] != "PLAIN" {
+				reply("504 unsupported")
+				continue
+			}
+
+			credentials, err := base64.StdEncoding.DecodeString(fields[2])
+
+			if err != nil || string(credentials) != "\x00"+sinkUsername+"\x00"+sinkPassword {
+				reply("535 authentication failed")
+				continue
+			}
+
+			authenticated = true
+
+			s.mutex.Lock()
+			s.authUsed = true
+			s.mutex.Unlock()
+
+			reply("235 authenticated")
+
+		case "MAIL":
+			if s.starttls && !authenticated {
+				reply("530 authentication required")
+				continue
+			}
+			current = sinkMessage{from: envelopeAddress(strings.TrimPrefix(line, "MAIL FROM:"))}
+			reply("250 ok")
+
+		case "RCPT":
+			current.to = append(current.to, envelopeAddress(strings.TrimPrefix(line, "RCPT TO:")))
+			reply("250 ok")
+
+		case "DATA":
+			reply("354 end with .")
+
+			var data strings.Builder
+
+			for {
+				dataLine, err := reader.ReadString('\n')
+
+				if err != nil {
+					return
+				}
+
+				if dataLine == ".\r\n" {
+					break
+				}
+
+				data.WriteString(strings.TrimPrefix(dataLine, "."))
+			}
+
+			current.data = data.String()
+
+			s.mutex.Lock()
+			s.received = append(s.received, current)
+			s.mutex.Unlock()
+
+			reply("250 queued")
+
+		case "QUIT":
+			reply("221 bye")
+			return
+
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+// envelopeAddress drops the brackets and any parameters such as BODY=8BITMIME
+func envelopeAddress(arg string) string {
+	return strings.Trim(strings.Fields(arg)[0], "<>")
+}
+
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "smtp sink"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+func sinkMailer(sink *smtpSink, roots *x509.CertPool, password string, requireTLS bool) *SMTPMailer {
+
+	return NewSMTPMailer(SMTPConfig{
+		Host:       "127.0.0.1",
+		Port:       sink.port(),
+		Username:   sinkUsername,
+		Password:   password,
+		From:       "Nkata <no-reply@nkata.test>",
+		RequireTLS: requireTLS,
+		TLSConfig:  &tls.Config{RootCAs: roots},
+	})
+}
+
+func TestSMTPMailerSendsOverStartTLS(t *testing.T) {
+
+	sink, roots := newSMTPSink(t, true)
+
+	message, err := OtpMessage("Login", "ada@example.com", OtpData{Username: "ada", Code: "482913", ExpiresInMins: 20})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message.Subject = "Your Nkata sign-in code – ünïcode"
+
+	if err := sinkMailer(sink, roots, sinkPassword, true).Send(context.Background(), message); err != nil {
+		t.Fatal(err)
+	}
+
+	if tlsUsed, authUsed := sink.used(); !tlsUsed || !authUsed {
+		t.Fatalf("STARTTLS used %v, AUTH used %v, want both", tlsUsed, authUsed)
+	}
+
+	received := sink.messages()
+
+	if len(received) != 1 {
+		t.Fatalf("sink received %d messages, want 1", len(received))
+	}
+
+	if received[0].from != "no-reply@nkata.test" || len(received[0].to) != 1 || received[0].to[0] != "ada@example.com" {
+		t.Errorf("envelope from %q to %v", received[0].from, received[0].to)
+	}
+
+	parsed, err := mail.ReadMessage(strings.NewReader(received[0].data))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+
+	if err != nil || subject != message.Subject {
+		t.Errorf("subject = %q, %v, want %q", subject, err, message.Subject)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("content type = %q, %v", mediaType, err)
+	}
+
+	parts := multipart.NewReader(parsed.Body, params["boundary"])
+
+	// the text part comes first so clients that can show html prefer it
+	for _, want := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", message.Text},
+		{"text/html; charset=utf-8", message.HTML},
+	} {
+
+		part, err := parts.NextPart()
+
+		if err != nil {
+			t.Fatalf("reading %s part: %v", want.contentType, err)
+		}
+
+		if got := part.Header.Get("Content-Type"); got != want.contentType {
+			t.Errorf("part content type = %q, want %q", got, want.contentType)
+		}
+
+		// the reader undoes the quoted-printable encoding, line breaks go over the wire as CRLF
+		content, err := io.ReadAll(part)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.ReplaceAll(string(content), "\r\n", "\n") != want.content {
+			t.Errorf("%s part = %q, want %q", want.contentType, content, want.content)
+		}
+
+		if !strings.Contains(string(content), "482913") {
+			t.Errorf("%s part does not carry the code", want.contentType)
+		}
+	}
+
+	if _, err := parts.NextPart(); err != io.EOF {
+		t.Errorf("message has more than two parts: %v", err)
+	}
+}
+
+func TestSMTPMailerRejectedCredentials(t *testing.T) {
+
+	sink, roots := newSMTPSink(t, true)
+
+	err := sinkMailer(sink, roots, "wrong", true).Send(context.Background(), Message{To: "ada@example.com", Subject: "s", Text: "t"})
+
+	if err == nil || !strings.Contains(err.Error(), "535") {
+		t.Fatalf("Send error = %v, want the server's 535", err)
+	}
+
+	if len(sink.messages()) != 0 {
+		t.Error("message delivered without authenticating")
+	}
+}
+
+func TestSMTPMailerUntrustedCertificate(t *testing.T) {
+
+	sink, _ := newSMTPSink(t, true)
+
+	_, otherRoots := selfSignedCert(t)
+
+	err := sinkMailer(sink, otherRoots, sinkPassword, true).Send(context.Background(), Message{To: "ada@example.com", Subject: "s", Text: "t"})
+
+	if err == nil {
+		t.Fatal("Send trusted a certificate it was not given")
+	}
+
+	if _, authUsed := sink.used(); authUsed {
+		t.Error("credentials sent over a connection that failed verification")
+	}
+}
+
+func TestSMTPMailerRequireTLS(t *testing.T) {
+
+	sink, roots := newSMTPSink(t, false)
+
+	err := sinkMailer(sink, roots, sinkPassword, true).Send(context.Background(), Message{To: "ada@example.com", Subject: "s", Text: "t"})
+
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Fatalf("Send error = %v, want a refusal without STARTTLS", err)
+	}
+
+	if len(sink.messages()) != 0 {
+		t.Error("message delivered in the clear")
+	}
+}
+
+func TestBuildMIMESkipsEmptyParts(t *testing.T) {
+
+	body, err := buildMIME("no-reply@nkata.test", Message{To: "ada@example.com", Subject: "s", Text: "only text"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(body), "text/html") {
+		t.Error("empty html part was written")
+	}
+
+	if n := strings.Count(string(body), "Content-Transfer-Encoding: quoted-printable"); n != 1 {
+		t.Errorf("message has %d parts, want 1", n)
+	}
+}
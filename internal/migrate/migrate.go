@@ -0,0 +1,371 @@
+// Package migrate applies numbered SQL migrations to a postgres database. Migrations are pairs of
+// files named 0001_create_users.up.sql and 0001_create_users.down.sql, every migration runs in
+// its own transaction and applied versions are recorded in the schema_migrations table.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lockKey is the postgres advisory lock held while migrating, so two servers or a server and the
+// migrate command never apply the same migration twice, the value is "nkata" in ascii
+const lockKey int64 = 0x6e6b617461
+
+var fileName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+var ErrNoDown = errors.New("migration has no down file")
+
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+type Status struct {
+	Version   int64
+	Name      string
+	AppliedAt *time.Time // nil while pending
+	Unknown   bool       // applied but not shipped with this binary
+}
+
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// Load reads every migration in the root of fsys, sorted by version
+func Load(fsys fs.FS) ([]Migration, error) {
+
+	entries, err := fs.ReadDir(fsys, ".")
+
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*Migration{}
+
+	for _, entry := range entries {
+
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+
+		match := fileName.FindStringSubmatch(entry.Name())
+
+		if match == nil {
+			return nil, fmt.Errorf("migration %s: name must look like 0001_name.up.sql", entry.Name())
+		}
+
+		version, _ := strconv.ParseInt(match[1], 10, 64)
+
+		body, err := fs.ReadFile(fsys, entry.Name())
+
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+
+	for _, m := range byVersion {
+
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.Version, m.Name)
+		}
+
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+func New(db *sql.DB, fsys fs.FS) (*Migrator, error) {
+
+	migrations, err := Load(fsys)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// withLock runs fn on a single connection holding the advisory lock, after making sure the
+// schema_migrations table exists
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+
+	conn, err := m.db.Conn(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockKey); err != nil {
+		return err
+	}
+
+	// the lock belongs to the session, release it even when ctx is done
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, lockKey)
+
+	query := `CREATE TABLE IF NOT EXISTS schema_migrations(
+version BIGINT NOT NULL PRIMARY KEY,
+name VARCHAR(255) NOT NULL,
+applied_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL
+)`
+
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+func applied(ctx context.Context, conn *sql.Conn) (map[int64]Status, error) {
+
+	rows, err := conn.QueryContext(ctx, `SELECT version,name,applied_at FROM schema_migrations ORDER BY version`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	versions := map[int64]Status{}
+
+	for rows.Next() {
+
+		var s Status
+		var appliedAt time.Time
+
+		if err := rows.Scan(&s.Version, &s.Name, &appliedAt); err != nil {
+			return nil, err
+		}
+
+		s.AppliedAt = &appliedAt
+		versions[s.Version] = s
+	}
+
+	return versions, rows.Err()
+}
+
+func run(ctx context.Context, conn *sql.Conn, statements string, record string, args ...any) error {
+
+	tx, err := conn.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, statements); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Up applies every pending migration in version order and returns the ones it applied. It stops at
+// the first failure, the failed migration is rolled back and the ones before it stay applied.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+
+	var done []Migration
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+
+		versions, err := applied(ctx, conn)
+
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+
+			if _, ok := versions[migration.Version]; ok {
+				continue
+			}
+
+			record := `INSERT INTO schema_migrations(version,name) VALUES($1,$2)`
+
+			if err := run(ctx, conn, migration.Up, record, migration.Version, migration.Name); err != nil {
+				return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+
+			done = append(done, migration)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// Down reverts the last steps applied migrations, newest first, and returns the ones it reverted
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+
+	var done []Migration
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+
+		versions, err := applied(ctx, conn)
+
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+
+			migration := m.migrations[i]
+
+			if _, ok := versions[migration.Version]; !ok {
+				continue
+			}
+
+			if migration.Down == "" {
+				return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, ErrNoDown)
+			}
+
+			record := `DELETE FROM schema_migrations WHERE version = $1`
+
+			if err := run(ctx, conn, migration.Down, record, migration.Version); err != nil {
+				return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+
+			done = append(done, migration)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// Status lists every known migration and any applied version this binary does not ship
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+
+	var status []Status
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+
+		versions, err := applied(ctx, conn)
+
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+
+			s := Status{Version: migration.Version, Name: migration.Name}
+
+			if a, ok := versions[migration.Version]; ok {
+				s.AppliedAt = a.AppliedAt
+				delete(versions, migration.Version)
+			}
+
+			status = append(status, s)
+		}
+
+		for _, a := range versions {
+			a.Unknown = true
+			status = append(status, a)
+		}
+
+		sort.Slice(status, func(i, j int) bool { return status[i].Version < status[j].Version })
+
+		return nil
+	})
+
+	return status, err
+}
+
+// Pending returns the migrations that have not been applied yet
+func (m *Migrator) Pending(ctx context.Context) ([]Status, error) {
+
+	status, err := m.Status(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Status
+
+	for _, s := range status {
+		if s.AppliedAt == nil {
+			pending = append(pending, s)
+		}
+	}
+
+	return pending, nil
+}
+
+// Create writes empty up and down files for the next version into dir and returns their paths
+func Create(dir, name string) (string, string, error) {
+
+	name = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(name), " ", "_"))
+
+	if !regexp.MustCompile(`^[a-z0-9_]+$`).MatchString(name) {
+		return "", "", errors.New("migration name may only contain letters, digits and underscores")
+	}
+
+	migrations, err := Load(os.DirFS(dir))
+
+	if err != nil {
+		return "", "", err
+	}
+
+	var next int64 = 1
+
+	if len(migrations) > 0 {
+		next = migrations[len(migrations)-1].Version + 1
+	}
+
+	prefix := filepath.Join(dir, fmt.Sprintf("%04d_%s", next, name))
+	up, down := prefix+".up.sql", prefix+".down.sql"
+
+	if err := os.WriteFile(up, []byte("-- "+name+"\n"), 0o644); err != nil {
+		return "", "", err
+	}
+
+	if err := os.WriteFile(down, []byte("-- revert "+name+"\n"), 0o644); err != nil {
+		return "", "", err
+	}
+
+	return up, down, nil
+}
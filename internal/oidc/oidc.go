@@ -0,0 +1,219 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	gooidc "github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const (
+	TypeOIDC   = "oidc"
+	TypeGitHub = "github" // plain OAuth2, GitHub apps do not issue id tokens
+)
+
+type ProviderConfig struct {
+	Name         string // url segment, e.g. google
+	Type         string // oidc or github
+	Issuer       string // oidc issuer, or the github api base url
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	RedirectURL  string
+}
+
+// Identity is the external account a user signed in with
+type Identity struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+}
+
+type Provider struct {
+	config   ProviderConfig
+	oauth    oauth2.Config
+	verifier *gooidc.IDTokenVerifier
+	client   *http.Client
+}
+
+// NewProvider runs OIDC discovery against the issuer, so the issuer has to be reachable at startup
+func NewProvider(ctx context.Context, config ProviderConfig) (*Provider, error) {
+
+	p := &Provider{
+		config: config,
+		oauth: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.RedirectURL,
+			Scopes:       config.Scopes,
+		},
+		client: http.DefaultClient,
+	}
+
+	switch config.Type {
+	case TypeOIDC, "":
+
+		provider, err := gooidc.NewProvider(ctx, config.Issuer)
+
+		if err != nil {
+			return nil, fmt.Errorf("oidc: discovery for %s failed: %w", config.Name, err)
+		}
+
+		p.oauth.Endpoint = provider.Endpoint()
+		p.verifier = provider.Verifier(&gooidc.Config{ClientID: config.ClientID})
+
+		if len(p.oauth.Scopes) == 0 {
+			p.oauth.Scopes = []string{gooidc.ScopeOpenID, "email", "profile"}
+		}
+
+	case TypeGitHub:
+
+		p.oauth.Endpoint = oauth2.Endpoint{
+			AuthURL:  "https://github.com/login/oauth/authorize",
+			TokenURL: "https://github.com/login/oauth/access_token",
+		}
+
+		if p.config.Issuer == "" {
+			p.config.Issuer = "https://api.github.com"
+		}
+
+		if len(p.oauth.Scopes) == 0 {
+			p.oauth.Scopes = []string{"read:user", "user:email"}
+		}
+
+	default:
+		return nil, errors.New("oidc: unknown provider type " + config.Type)
+	}
+
+	return p, nil
+}
+
+func (p *Provider) Name() string {
+	return p.config.Name
+}
+
+// AuthCodeURL is where the user is sent to sign in, the PKCE challenge is derived from verifier
+func (p *Provider) AuthCodeURL(state, verifier, nonce string) string {
+
+	options := []oauth2.AuthCodeOption{oauth2.S256ChallengeOption(verifier)}
+
+	if p.verifier != nil {
+		options = append(options, gooidc.Nonce(nonce))
+	}
+
+	return p.oauth.AuthCodeURL(state, options...)
+}
+
+// Exchange redeems the authorization code and returns the verified identity
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*Identity, error) {
+
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, p.client)
+
+	token, err := p.oauth.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if p.verifier == nil {
+		return p.githubIdentity(ctx, token)
+	}
+
+	rawIdToken, ok := token.Extra("id_token").(string)
+
+	if !ok {
+		return nil, errors.New("oidc: token response has no id_token")
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIdToken)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if idToken.Nonce != nonce {
+		return nil, errors.New("oidc: nonce mismatch")
+	}
+
+	var claims struct {
+		Email             string `json:"email"`
+		EmailVerified     bool   `json:"email_verified"`
+		Name              string `json:"name"`
+		PreferredUsername string `json:"preferred_username"`
+	}
+
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		Subject:           idToken.Subject,
+		Email:             claims.Email,
+		EmailVerified:     claims.EmailVerified,
+		Name:              claims.Name,
+		PreferredUsername: claims.PreferredUsername,
+	}, nil
+}
+
+func (p *Provider) githubIdentity(ctx context.Context, token *oauth2.Token) (*Identity, error) {
+
+	client := p.oauth.Client(ctx, token)
+	base := strings.TrimRight(p.config.Issuer, "/")
+
+	var user struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+		Name  string `json:"name"`
+	}
+
+	if err := getJson(client, base+"/user", &user); err != nil {
+		return nil, err
+	}
+
+	identity := &Identity{
+		Subject:           fmt.Sprint(user.ID),
+		Name:              user.Name,
+		PreferredUsername: user.Login,
+	}
+
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+
+	if err := getJson(client, base+"/user/emails", &emails); err == nil {
+		for _, email := range emails {
+			if email.Primary {
+				identity.Email = email.Email
+				identity.EmailVerified = email.Verified
+			}
+		}
+	}
+
+	return identity, nil
+}
+
+func getJson(client *http.Client, url string, data any) error {
+
+	resp, err := client.Get(url)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: GET %s returned %d", url, resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(data)
+}
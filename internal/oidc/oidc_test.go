@@ -0,0 +1,160 @@
+package oidc
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+
+	"main/internal/oidc/oidctest"
+
+	"golang.org/x/oauth2"
+)
+
+const testRedirectURL = "https://nkata.test/v1/auth/oidc/mock/callback"
+
+var testAccount = oidctest.Account{
+	Subject:           "248289761001",
+	Email:             "ada@example.com",
+	EmailVerified:     true,
+	Name:              "Ada Lovelace",
+	PreferredUsername: "ada",
+}
+
+func newTestProvider(t *testing.T, issuer *oidctest.Issuer) *Provider {
+
+	t.Helper()
+
+	provider, err := NewProvider(context.Background(), ProviderConfig{
+		Name:         "mock",
+		Type:         TypeOIDC,
+		Issuer:       issuer.URL(),
+		ClientID:     issuer.ClientID,
+		ClientSecret: issuer.ClientSecret,
+		RedirectURL:  testRedirectURL,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return provider
+}
+
+func TestExchange(t *testing.T) {
+
+	issuer := oidctest.NewIssuer(t)
+	provider := newTestProvider(t, issuer)
+
+	verifier := oauth2.GenerateVerifier()
+
+	authURL := provider.AuthCodeURL("state-1", verifier, "nonce-1")
+
+	parsed, err := url.Parse(authURL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the verifier itself never goes to the browser, only its challenge
+	if query := parsed.Query(); query.Get("code_challenge") != oauth2.S256ChallengeFromVerifier(verifier) || query.Get("nonce") != "nonce-1" {
+		t.Errorf("authorization url %s is missing the challenge or nonce", authURL)
+	}
+
+	code, state := issuer.Authorize(t, authURL, testAccount)
+
+	if state != "state-1" {
+		t.Errorf("state = %q, want state-1", state)
+	}
+
+	identity, err := provider.Exchange(context.Background(), code, verifier, "nonce-1")
+
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+
+	want := Identity{
+		Subject:           testAccount.Subject,
+		Email:             testAccount.Email,
+		EmailVerified:     true,
+		Name:              testAccount.Name,
+		PreferredUsername: testAccount.PreferredUsername,
+	}
+
+	if *identity != want {
+		t.Errorf("identity = %+v, want %+v", *identity, want)
+	}
+}
+
+func TestExchangeRejected(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		exchange    func(t *testing.T, provider *Provider, code, verifier string) error
+		errContains string
+	}{
+		{
+			name: "nonce mismatch",
+			exchange: func(t *testing.T, provider *Provider, code, verifier string) error {
+				_, err := provider.Exchange(context.Background(), code, verifier, "nonce-of-another-sign-in")
+				return err
+			},
+			errContains: "nonce mismatch",
+		},
+		{
+			name: "wrong verifier",
+			exchange: func(t *testing.T, provider *Provider, code, verifier string) error {
+				_, err := provider.Exchange(context.Background(), code, oauth2.GenerateVerifier(), "nonce-1")
+				return err
+			},
+			errContains: "invalid_grant",
+		},
+		{
+			name: "code used twice",
+			exchange: func(t *testing.T, provider *Provider, code, verifier string) error {
+				if _, err := provider.Exchange(context.Background(), code, verifier, "nonce-1"); err != nil {
+					t.Fatalf("first exchange: %v", err)
+				}
+				_, err := provider.Exchange(context.Background(), code, verifier, "nonce-1")
+				return err
+			},
+			errContains: "invalid_grant",
+		},
+		{
+			name: "unknown code",
+			exchange: func(t *testing.T, provider *Provider, code, verifier string) error {
+				_, err := provider.Exchange(context.Background(), "made-up", verifier, "nonce-1")
+				return err
+			},
+			errContains: "invalid_grant",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			issuer := oidctest.NewIssuer(t)
+			provider := newTestProvider(t, issuer)
+
+			verifier := oauth2.GenerateVerifier()
+
+			code, _ := issuer.Authorize(t, provider.AuthCodeURL("state-1", verifier, "nonce-1"), testAccount)
+
+			if err := tt.exchange(t, provider, code, verifier); err == nil || !strings.Contains(err.Error(), tt.errContains) {
+				t.Fatalf("Exchange error = %v, want it to contain %q", err, tt.errContains)
+			}
+		})
+	}
+}
+
+func TestNewProviderRejectsIssuerMismatch(t *testing.T) {
+
+	issuer := oidctest.NewIssuer(t)
+
+	// discovery has to describe the issuer that was configured
+	_, err := NewProvider(context.Background(), ProviderConfig{Name: "mock", Issuer: issuer.URL() + "/", ClientID: issuer.ClientID})
+
+	if err == nil {
+		t.Fatal("NewProvider accepted discovery for another issuer")
+	}
+}
@@ -0,0 +1,239 @@
+// Package oidctest runs a local OpenID provider for tests. It serves discovery and the JWKS, hands
+// out codes for an authorization url the way the provider's login page would, and only redeems a
+// code for the PKCE verifier that matches its challenge.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const keyID = "oidctest-key"
+
+// Account is the provider side account the next sign-in is made with
+type Account struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+}
+
+type Issuer struct {
+	Server       *httptest.Server
+	ClientID     string
+	ClientSecret string
+
+	key *rsa.PrivateKey
+
+	mutex  sync.Mutex
+	grants map[string]grant
+}
+
+// grant is what the login page hands over to the token endpoint through the code
+type grant struct {
+	challenge   string
+	nonce       string
+	redirectURL string
+	account     Account
+}
+
+func NewIssuer(t *testing.T) *Issuer {
+
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := &Issuer{ClientID: "nkata", ClientSecret: "client-secret", key: key, grants: map[string]grant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", i.discovery)
+	mux.HandleFunc("GET /jwks", i.jwks)
+	mux.HandleFunc("POST /token", i.token)
+
+	i.Server = httptest.NewServer(mux)
+
+	t.Cleanup(i.Server.Close)
+
+	return i
+}
+
+func (i *Issuer) URL() string {
+	return i.Server.URL
+}
+
+// Authorize stands in for the browser visiting authURL and signing in as account, it returns the
+// code and state the provider would redirect back with
+func (i *Issuer) Authorize(t *testing.T, authURL string, account Account) (string, string) {
+
+	t.Helper()
+
+	parsed, err := url.Parse(authURL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := parsed.Query()
+
+	if !strings.HasPrefix(authURL, i.URL()+"/authorize?") {
+		t.Fatalf("authorization url %s is not on the issuer", authURL)
+	}
+
+	if query.Get("client_id") != i.ClientID || query.Get("response_type") != "code" {
+		t.Fatalf("authorization url has client_id %q and response_type %q", query.Get("client_id"), query.Get("response_type"))
+	}
+
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		t.Fatalf("authorization url has no S256 PKCE challenge: %s", authURL)
+	}
+
+	code := rand.Text()
+
+	i.mutex.Lock()
+	i.grants[code] = grant{
+		challenge:   query.Get("code_challenge"),
+		nonce:       query.Get("nonce"),
+		redirectURL: query.Get("redirect_uri"),
+		account:     account,
+	}
+	i.mutex.Unlock()
+
+	return code, query.Get("state")
+}
+
+func (i *Issuer) discovery(w http.ResponseWriter, r *http.Request) {
+
+	writeJson(w, http.StatusOK, map[string]any{
+		"issuer":                                i.URL(),
+		"authorization_endpoint":                i.URL() + "/authorize",
+		"token_endpoint":                        i.URL() + "/token",
+		"jwks_uri":                              i.URL() + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (i *Issuer) jwks(w http.ResponseWriter, r *http.Request) {
+
+	writeJson(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": keyID,
+			"n":   base64.RawURLEncoding.EncodeToString(i.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(i.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (i *Issuer) token(w http.ResponseWriter, r *http.Request) {
+
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request")
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+
+	if !ok {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	if clientID != i.ClientID || clientSecret != i.ClientSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, "unsupported_grant_type")
+		return
+	}
+
+	// a code is good for one exchange whatever the outcome
+	i.mutex.Lock()
+	grant, ok := i.grants[r.PostForm.Get("code")]
+	delete(i.grants, r.PostForm.Get("code"))
+	i.mutex.Unlock()
+
+	if !ok || r.PostForm.Get("redirect_uri") != grant.redirectURL {
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+
+	if base64.RawURLEncoding.EncodeToString(challenge[:]) != grant.challenge {
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	now := time.Now()
+
+	claims := jwt.MapClaims{
+		"iss":            i.URL(),
+		"aud":            i.ClientID,
+		"sub":            grant.account.Subject,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"email":          grant.account.Email,
+		"email_verified": grant.account.EmailVerified,
+		"name":           grant.account.Name,
+	}
+
+	if grant.nonce != "" {
+		claims["nonce"] = grant.nonce
+	}
+
+	if grant.account.PreferredUsername != "" {
+		claims["preferred_username"] = grant.account.PreferredUsername
+	}
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	idToken.Header["kid"] = keyID
+
+	signed, err := idToken.SignedString(i.key)
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, http.StatusOK, map[string]any{
+		"access_token": rand.Text(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     signed,
+	})
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	writeJson(w, http.StatusBadRequest, map[string]string{"error": code})
+}
+
+func writeJson(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
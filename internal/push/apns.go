@@ -0,0 +1,177 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	APNsProductionEndpoint  = "https://api.push.apple.com"
+	APNsDevelopmentEndpoint = "https://api.sandbox.push.apple.com"
+)
+
+// APNsProvider sends notifications with APNs token based auth. The provider
+// token is an ES256 JWT signed with the .p8 key; Apple rejects tokens older
+// than an hour and throttles refreshing more than every 20 minutes, so it
+// is reused for 40 minutes.
+type APNsProvider struct {
+	KeyID    string
+	TeamID   string
+	Topic    string // app bundle id
+	Endpoint string // APNs base url, override to point at a local stand-in
+	Client   *http.Client
+
+	signingKey any
+
+	mutex         sync.Mutex
+	providerToken string
+	issuedAt      time.Time
+}
+
+func NewAPNsProvider(keyFile, keyID, teamID, topic string, production bool) (*APNsProvider, error) {
+
+	data, err := os.ReadFile(keyFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := jwt.ParseECPrivateKeyFromPEM(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := APNsDevelopmentEndpoint
+
+	if production {
+		endpoint = APNsProductionEndpoint
+	}
+
+	return &APNsProvider{
+		KeyID:      keyID,
+		TeamID:     teamID,
+		Topic:      topic,
+		Endpoint:   endpoint,
+		Client:     &http.Client{Timeout: 10 * time.Second},
+		signingKey: key,
+	}, nil
+}
+
+type apnsPayload struct {
+	Aps struct {
+		Alert struct {
+			Title string `json:"title"`
+			Body  string `json:"body"`
+		} `json:"alert"`
+		Sound string `json:"sound"`
+	} `json:"aps"`
+	Data map[string]string `json:"data,omitempty"`
+}
+
+func (a *APNsProvider) Send(ctx context.Context, deviceToken string, notification Notification) error {
+
+	providerToken, err := a.getProviderToken()
+
+	if err != nil {
+		return err
+	}
+
+	var payload apnsPayload
+	payload.Aps.Alert.Title = notification.Title
+	payload.Aps.Alert.Body = notification.Body
+	payload.Aps.Sound = "default"
+	payload.Data = notification.Data
+
+	body, err := json.Marshal(payload)
+
+	if err != nil {
+		return err
+	}
+
+	sendUrl := strings.TrimRight(a.Endpoint, "/") + "/3/device/" + deviceToken
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sendUrl, bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("authorization", "bearer "+providerToken)
+	req.Header.Set("apns-topic", a.Topic)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.Client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	if resp.StatusCode == http.StatusGone {
+		return ErrInvalidToken
+	}
+
+	var aErr struct {
+		Reason string `json:"reason"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&aErr); err != nil {
+		return fmt.Errorf("apns: send failed with status %d, unreadable error body: %w", resp.StatusCode, err)
+	}
+
+	switch {
+	case aErr.Reason == "BadDeviceToken" || aErr.Reason == "Unregistered" || aErr.Reason == "DeviceTokenNotForTopic":
+		return ErrInvalidToken
+	case aErr.Reason == "ExpiredProviderToken":
+		a.mutex.Lock()
+		a.providerToken = ""
+		a.mutex.Unlock()
+	}
+
+	return fmt.Errorf("apns: send failed with status %d: %s", resp.StatusCode, aErr.Reason)
+}
+
+func (a *APNsProvider) getProviderToken() (string, error) {
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.providerToken != "" && time.Since(a.issuedAt) < 40*time.Minute {
+		return a.providerToken, nil
+	}
+
+	now := time.Now()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss": a.TeamID,
+		"iat": now.Unix(),
+	})
+	token.Header["kid"] = a.KeyID
+
+	signed, err := token.SignedString(a.signingKey)
+
+	if err != nil {
+		return "", err
+	}
+
+	a.providerToken = signed
+	a.issuedAt = now
+
+	return signed, nil
+}
@@ -0,0 +1,191 @@
+package push
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testKeyID  = "ABC123DEFG"
+	testTeamID = "TEAM123456"
+	testTopic  = "com.nkata.app"
+)
+
+// apnsStandIn answers like APNs: status decides the response for a device token, 200 when it has
+// no entry
+type apnsStandIn struct {
+	server *httptest.Server
+	key    *ecdsa.PrivateKey
+	sent   atomic.Int32
+	status map[string]apnsReply
+}
+
+type apnsReply struct {
+	code   int
+	reason string
+}
+
+func newAPNsStandIn(t *testing.T) *apnsStandIn {
+
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &apnsStandIn{key: key, status: map[string]apnsReply{}}
+
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		deviceToken, ok := strings.CutPrefix(r.URL.Path, "/3/device/")
+
+		if !ok || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Header.Get("apns-topic") != testTopic || r.Header.Get("apns-push-type") != "alert" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"reason": "BadTopic"})
+			return
+		}
+
+		providerToken, _ := strings.CutPrefix(r.Header.Get("authorization"), "bearer ")
+
+		token, err := jwt.Parse(providerToken, func(*jwt.Token) (any, error) {
+			return &key.PublicKey, nil
+		}, jwt.WithValidMethods([]string{"ES256"}), jwt.WithIssuer(testTeamID))
+
+		if err != nil || token.Header["kid"] != testKeyID {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"reason": "InvalidProviderToken"})
+			return
+		}
+
+		var payload apnsPayload
+
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Aps.Alert.Title == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"reason": "PayloadEmpty"})
+			return
+		}
+
+		if reply, ok := s.status[deviceToken]; ok {
+			w.WriteHeader(reply.code)
+			if reply.reason != "" {
+				json.NewEncoder(w).Encode(map[string]string{"reason": reply.reason})
+			}
+			return
+		}
+
+		s.sent.Add(1)
+	}))
+
+	t.Cleanup(s.server.Close)
+
+	return s
+}
+
+// provider loads the stand-in's key the way the server does, from a .p8 file
+func (s *apnsStandIn) provider(t *testing.T) *APNsProvider {
+
+	t.Helper()
+
+	keyFile := filepath.Join(t.TempDir(), "AuthKey.p8")
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: mustPKCS8(t, s.key)}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	provider, err := NewAPNsProvider(keyFile, testKeyID, testTeamID, testTopic, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider.Endpoint = s.server.URL
+
+	return provider
+}
+
+func TestAPNsSend(t *testing.T) {
+
+	standIn := newAPNsStandIn(t)
+
+	err := standIn.provider(t).Send(context.Background(), "device-1", Notification{Title: "New message", Body: "hello"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if standIn.sent.Load() != 1 {
+		t.Error("notification did not reach the stand-in")
+	}
+}
+
+func TestAPNsSendErrors(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		reply       apnsReply
+		invalid     bool
+		errContains string
+	}{
+		{name: "gone", reply: apnsReply{http.StatusGone, "Unregistered"}, invalid: true},
+		{name: "gone without a body", reply: apnsReply{code: http.StatusGone}, invalid: true},
+		{name: "bad device token", reply: apnsReply{http.StatusBadRequest, "BadDeviceToken"}, invalid: true},
+		{name: "token for another topic", reply: apnsReply{http.StatusBadRequest, "DeviceTokenNotForTopic"}, invalid: true},
+		{name: "too many requests", reply: apnsReply{http.StatusTooManyRequests, "TooManyRequests"}, errContains: "status 429: TooManyRequests"},
+		{name: "unreadable body", reply: apnsReply{code: http.StatusInternalServerError}, errContains: "status 500, unreadable error body"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			standIn := newAPNsStandIn(t)
+			standIn.status["device-1"] = tt.reply
+
+			err := standIn.provider(t).Send(context.Background(), "device-1", Notification{Title: "t", Body: "b"})
+
+			if got := errors.Is(err, ErrInvalidToken); got != tt.invalid {
+				t.Fatalf("Send error = %v, invalid token %v, want %v", err, got, tt.invalid)
+			}
+
+			if tt.errContains != "" && (err == nil || !strings.Contains(err.Error(), tt.errContains)) {
+				t.Errorf("Send error = %v, want it to contain %q", err, tt.errContains)
+			}
+		})
+	}
+}
+
+func TestAPNsExpiredProviderTokenIsDropped(t *testing.T) {
+
+	standIn := newAPNsStandIn(t)
+	standIn.status["device-1"] = apnsReply{http.StatusForbidden, "ExpiredProviderToken"}
+
+	provider := standIn.provider(t)
+
+	if err := provider.Send(context.Background(), "device-1", Notification{Title: "t", Body: "b"}); err == nil || errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("Send error = %v, want a plain failure", err)
+	}
+
+	if provider.providerToken != "" {
+		t.Error("expired provider token is still cached")
+	}
+}
@@ -0,0 +1,74 @@
+package push
+
+import (
+	"context"
+	"errors"
+	"log"
+)
+
+type Device struct {
+	Token    string
+	Platform Platform
+}
+
+// TokenStore is the device token registry the dispatcher reads from and
+// prunes rejected tokens out of.
+type TokenStore interface {
+	GetDevices(ctx context.Context, username string) ([]Device, error)
+	DeleteDevice(ctx context.Context, token string) error
+}
+
+type Dispatcher struct {
+	store     TokenStore
+	providers map[Platform]PushProvider
+}
+
+func NewDispatcher(store TokenStore) *Dispatcher {
+	return &Dispatcher{store: store, providers: make(map[Platform]PushProvider)}
+}
+
+func (d *Dispatcher) Register(platform Platform, provider PushProvider) {
+	d.providers[platform] = provider
+}
+
+// Dispatch sends the notification to every device registered by username.
+// Devices on a platform with no configured provider are skipped. Tokens the
+// provider rejects are removed from the registry; other failures are
+// returned joined together once every device has been tried.
+func (d *Dispatcher) Dispatch(ctx context.Context, username string, notification Notification) error {
+
+	devices, err := d.store.GetDevices(ctx, username)
+
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+
+	for _, device := range devices {
+
+		provider, ok := d.providers[device.Platform]
+
+		if !ok {
+			continue
+		}
+
+		err := provider.Send(ctx, device.Token, notification)
+
+		if errors.Is(err, ErrInvalidToken) {
+
+			log.Printf("push: pruning rejected %s device token for %s", device.Platform, username)
+
+			if err := d.store.DeleteDevice(ctx, device.Token); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
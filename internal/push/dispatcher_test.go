@@ -0,0 +1,104 @@
+package push
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+)
+
+type memoryTokenStore struct {
+	mutex   sync.Mutex
+	devices map[string][]Device
+	deleted []string
+}
+
+func (m *memoryTokenStore) GetDevices(ctx context.Context, username string) ([]Device, error) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return slices.Clone(m.devices[username]), nil
+}
+
+func (m *memoryTokenStore) DeleteDevice(ctx context.Context, token string) error {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.deleted = append(m.deleted, token)
+
+	for username, devices := range m.devices {
+		m.devices[username] = slices.DeleteFunc(devices, func(d Device) bool { return d.Token == token })
+	}
+
+	return nil
+}
+
+func TestDispatcherPrunesRejectedTokens(t *testing.T) {
+
+	fcm := newFCMStandIn(t)
+	fcm.reject = func(w http.ResponseWriter, deviceToken string) bool {
+		if deviceToken == "android-uninstalled" {
+			return fcmReject(http.StatusNotFound, "UNREGISTERED", "Requested entity was not found.")(w, deviceToken)
+		}
+		if deviceToken == "android-quota" {
+			return fcmReject(http.StatusTooManyRequests, "QUOTA_EXCEEDED", "quota exceeded")(w, deviceToken)
+		}
+		if deviceToken == "android-misrouted" {
+			// what a wrong project id looks like, nothing about the token
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":404,"message":"Requested entity was not found.","status":"NOT_FOUND"}}`))
+			return true
+		}
+		return false
+	}
+
+	apns := newAPNsStandIn(t)
+	apns.status["ios-gone"] = apnsReply{http.StatusGone, "Unregistered"}
+	apns.status["ios-bad"] = apnsReply{http.StatusBadRequest, "BadDeviceToken"}
+
+	store := &memoryTokenStore{devices: map[string][]Device{
+		"ada": {
+			{Token: "android-live", Platform: Android},
+			{Token: "android-uninstalled", Platform: Android},
+			{Token: "android-quota", Platform: Android},
+			{Token: "android-misrouted", Platform: Android},
+			{Token: "ios-live", Platform: IOS},
+			{Token: "ios-gone", Platform: IOS},
+			{Token: "ios-bad", Platform: IOS},
+			{Token: "web-1", Platform: Platform("web")}, // no provider, skipped
+		},
+	}}
+
+	dispatcher := NewDispatcher(store)
+	dispatcher.Register(Android, fcm.provider(t))
+	dispatcher.Register(IOS, apns.provider(t))
+
+	err := dispatcher.Dispatch(context.Background(), "ada", Notification{Title: "New message", Body: "hello"})
+
+	// a failure that says nothing about the token is reported and the token kept
+	if err == nil {
+		t.Error("Dispatch returned no error for the quota and not found failures")
+	}
+
+	slices.Sort(store.deleted)
+
+	if want := []string{"android-uninstalled", "ios-bad", "ios-gone"}; !slices.Equal(store.deleted, want) {
+		t.Errorf("pruned %v, want %v", store.deleted, want)
+	}
+
+	if fcm.sent.Load() != 1 || apns.sent.Load() != 1 {
+		t.Errorf("delivered %d android and %d ios notifications, want 1 each", fcm.sent.Load(), apns.sent.Load())
+	}
+
+	// the next notification only goes to the devices that are left
+	if err := dispatcher.Dispatch(context.Background(), "ada", Notification{Title: "t", Body: "b"}); err == nil {
+		t.Error("quota failure was not reported again")
+	}
+
+	if len(store.deleted) != 3 {
+		t.Errorf("pruned %v on the second dispatch, want nothing new", store.deleted)
+	}
+}
@@ -0,0 +1,253 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	fcmDefaultEndpoint = "https://fcm.googleapis.com"
+	fcmScope           = "https://www.googleapis.com/auth/firebase.messaging"
+)
+
+type fcmServiceAccount struct {
+	ProjectID   string `json:"project_id"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// FCMProvider sends notifications through the FCM HTTP v1 API. It signs
+// a service account assertion, exchanges it for an OAuth access token and
+// caches that token until shortly before it expires.
+type FCMProvider struct {
+	ProjectID string
+	Endpoint  string // FCM base url, override to point at a local stand-in
+	TokenURI  string // OAuth token url, override to point at a local stand-in
+	Client    *http.Client
+
+	clientEmail string
+	signingKey  any
+
+	mutex       sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+func NewFCMProvider(credentialsFile string) (*FCMProvider, error) {
+
+	data, err := os.ReadFile(credentialsFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var account fcmServiceAccount
+
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, err
+	}
+
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(account.PrivateKey))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &FCMProvider{
+		ProjectID:   account.ProjectID,
+		Endpoint:    fcmDefaultEndpoint,
+		TokenURI:    account.TokenURI,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		clientEmail: account.ClientEmail,
+		signingKey:  key,
+	}, nil
+}
+
+type fcmMessage struct {
+	Message struct {
+		Token        string            `json:"token"`
+		Notification Notification      `json:"notification"`
+		Data         map[string]string `json:"data,omitempty"`
+	} `json:"message"`
+}
+
+type fcmError struct {
+	Error struct {
+		Code    int              `json:"code"`
+		Status  string           `json:"status"`
+		Message string           `json:"message"`
+		Details []fcmErrorDetail `json:"details"`
+	} `json:"error"`
+}
+
+// fcmErrorDetail is either an FcmError carrying errorCode or a BadRequest listing the fields at fault
+type fcmErrorDetail struct {
+	Type            string `json:"@type"`
+	ErrorCode       string `json:"errorCode,omitempty"`
+	FieldViolations []struct {
+		Field       string `json:"field"`
+		Description string `json:"description"`
+	} `json:"fieldViolations,omitempty"`
+}
+
+// invalidToken is true only when FCM says the token itself is at fault. The status alone says
+// nothing, a wrong project id or endpoint answers 404 for every token.
+func (e *fcmError) invalidToken() bool {
+
+	invalidArgument, tokenField := false, false
+
+	for _, detail := range e.Error.Details {
+
+		switch detail.ErrorCode {
+		case "UNREGISTERED":
+			return true
+		case "INVALID_ARGUMENT":
+			invalidArgument = true
+		}
+
+		for _, violation := range detail.FieldViolations {
+			if violation.Field == "message.token" {
+				tokenField = true
+			}
+		}
+	}
+
+	return invalidArgument && tokenField
+}
+
+func (f *FCMProvider) Send(ctx context.Context, deviceToken string, notification Notification) error {
+
+	accessToken, err := f.getAccessToken(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	var payload fcmMessage
+	payload.Message.Token = deviceToken
+	payload.Message.Notification = Notification{Title: notification.Title, Body: notification.Body}
+	payload.Message.Data = notification.Data
+
+	body, err := json.Marshal(payload)
+
+	if err != nil {
+		return err
+	}
+
+	sendUrl := strings.TrimRight(f.Endpoint, "/") + "/v1/projects/" + f.ProjectID + "/messages:send"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sendUrl, bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := f.Client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var fErr fcmError
+
+	if err := json.NewDecoder(resp.Body).Decode(&fErr); err != nil {
+		return fmt.Errorf("fcm: send failed with status %d, unreadable error body: %w", resp.StatusCode, err)
+	}
+
+	if fErr.invalidToken() {
+		return ErrInvalidToken
+	}
+
+	return fmt.Errorf("fcm: send failed with status %d: %s", resp.StatusCode, fErr.Error.Message)
+}
+
+func (f *FCMProvider) getAccessToken(ctx context.Context) (string, error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.accessToken != "" && time.Now().Before(f.expiresAt.Add(-time.Minute)) {
+		return f.accessToken, nil
+	}
+
+	now := time.Now()
+
+	claims := jwt.MapClaims{
+		"iss":   f.clientEmail,
+		"scope": fcmScope,
+		"aud":   f.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+
+	assertion, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(f.signingKey)
+
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", assertion)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.TokenURI, strings.NewReader(form.Encode()))
+
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := f.Client.Do(req)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("fcm: token exchange failed with status %d: %s", resp.StatusCode, body)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+
+	if token.AccessToken == "" {
+		return "", errors.New("fcm: token exchange returned no access token")
+	}
+
+	f.accessToken = token.AccessToken
+	f.expiresAt = now.Add(time.Duration(token.ExpiresIn) * time.Second)
+
+	return f.accessToken, nil
+}
@@ -0,0 +1,305 @@
+package push
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// fcmStandIn is a local OAuth token endpoint and FCM send endpoint. reject decides the response
+// for a device token, nil means it is accepted.
+type fcmStandIn struct {
+	server         *httptest.Server
+	key            *rsa.PrivateKey
+	tokenExchanges atomic.Int32
+	sent           atomic.Int32
+	reject         func(w http.ResponseWriter, deviceToken string) bool
+}
+
+const (
+	testProjectID   = "nkata-test"
+	testClientEmail = "push@nkata-test.iam.gserviceaccount.com"
+	testAccessToken = "access-token-1"
+)
+
+func newFCMStandIn(t *testing.T) *fcmStandIn {
+
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fcmStandIn{key: key}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+
+		s.tokenExchanges.Add(1)
+
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if r.PostForm.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			http.Error(w, "unexpected grant_type", http.StatusBadRequest)
+			return
+		}
+
+		claims := jwt.MapClaims{}
+
+		_, err := jwt.ParseWithClaims(r.PostForm.Get("assertion"), claims, func(*jwt.Token) (any, error) {
+			return &key.PublicKey, nil
+		}, jwt.WithValidMethods([]string{"RS256"}), jwt.WithAudience(s.server.URL+"/token"), jwt.WithIssuer(testClientEmail))
+
+		if err != nil || claims["scope"] != fcmScope {
+			http.Error(w, "bad assertion", http.StatusUnauthorized)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{"access_token": testAccessToken, "expires_in": 3600})
+	})
+
+	mux.HandleFunc("/v1/projects/"+testProjectID+"/messages:send", func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Header.Get("Authorization") != "Bearer "+testAccessToken {
+			http.Error(w, "bad access token", http.StatusUnauthorized)
+			return
+		}
+
+		var message fcmMessage
+
+		if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if s.reject != nil && s.reject(w, message.Message.Token) {
+			return
+		}
+
+		s.sent.Add(1)
+
+		json.NewEncoder(w).Encode(map[string]string{"name": "projects/" + testProjectID + "/messages/1"})
+	})
+
+	s.server = httptest.NewServer(mux)
+	t.Cleanup(s.server.Close)
+
+	return s
+}
+
+// provider loads the stand-in's service account the way the server does, from a credentials file
+func (s *fcmStandIn) provider(t *testing.T) *FCMProvider {
+
+	t.Helper()
+
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: mustPKCS8(t, s.key)})
+
+	account, err := json.Marshal(fcmServiceAccount{
+		ProjectID:   testProjectID,
+		ClientEmail: testClientEmail,
+		PrivateKey:  string(keyPem),
+		TokenURI:    s.server.URL + "/token",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentialsFile := filepath.Join(t.TempDir(), "service-account.json")
+
+	if err := os.WriteFile(credentialsFile, account, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	provider, err := NewFCMProvider(credentialsFile)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider.Endpoint = s.server.URL
+
+	return provider
+}
+
+func mustPKCS8(t *testing.T, key any) []byte {
+
+	t.Helper()
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return der
+}
+
+func fcmReject(status int, errorCode, message string) func(w http.ResponseWriter, deviceToken string) bool {
+
+	return func(w http.ResponseWriter, deviceToken string) bool {
+
+		var body fcmError
+		body.Error.Code = status
+		body.Error.Message = message
+		body.Error.Details = append(body.Error.Details, fcmErrorDetail{Type: "type.googleapis.com/google.firebase.fcm.v1.FcmError", ErrorCode: errorCode})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+
+		return true
+	}
+}
+
+func TestFCMSendExchangesTokenOnce(t *testing.T) {
+
+	standIn := newFCMStandIn(t)
+	provider := standIn.provider(t)
+
+	notification := Notification{Title: "New message", Body: "hello", Data: map[string]string{"type": "message"}}
+
+	for i := 0; i < 3; i++ {
+		if err := provider.Send(context.Background(), "device-1", notification); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+
+	if got := standIn.sent.Load(); got != 3 {
+		t.Errorf("sent %d notifications, want 3", got)
+	}
+
+	// the access token is cached until shortly before it expires
+	if got := standIn.tokenExchanges.Load(); got != 1 {
+		t.Errorf("exchanged the assertion %d times, want 1", got)
+	}
+}
+
+func TestFCMTokenExchangeFailure(t *testing.T) {
+
+	standIn := newFCMStandIn(t)
+	provider := standIn.provider(t)
+
+	// an assertion signed with another key is refused by the token endpoint
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider.signingKey = otherKey
+
+	err = provider.Send(context.Background(), "device-1", Notification{Title: "t", Body: "b"})
+
+	if err == nil || !strings.Contains(err.Error(), "token exchange failed with status 401") {
+		t.Fatalf("Send error = %v, want a failed token exchange", err)
+	}
+
+	if standIn.sent.Load() != 0 {
+		t.Error("notification sent without an access token")
+	}
+}
+
+func TestFCMSendErrors(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		reject      func(w http.ResponseWriter, deviceToken string) bool
+		invalid     bool
+		errContains string
+	}{
+		{
+			name:    "unregistered",
+			reject:  fcmReject(http.StatusNotFound, "UNREGISTERED", "Requested entity was not found."),
+			invalid: true,
+		},
+		{
+			name:    "unregistered as bad request",
+			reject:  fcmReject(http.StatusBadRequest, "UNREGISTERED", "token is not registered"),
+			invalid: true,
+		},
+		{
+			name:        "invalid argument",
+			reject:      fcmReject(http.StatusBadRequest, "INVALID_ARGUMENT", "message is too big"),
+			errContains: "status 400: message is too big",
+		},
+		{
+			name: "invalid argument on the token",
+			reject: func(w http.ResponseWriter, deviceToken string) bool {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":{"code":400,"message":"The registration token is not a valid FCM registration token","status":"INVALID_ARGUMENT","details":[
+					{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"INVALID_ARGUMENT"},
+					{"@type":"type.googleapis.com/google.rpc.BadRequest","fieldViolations":[{"field":"message.token","description":"Invalid registration token"}]}]}}`))
+				return true
+			},
+			invalid: true,
+		},
+		{
+			// a wrong project id answers like this for every token, none of them may be pruned
+			name: "not found without details",
+			reject: func(w http.ResponseWriter, deviceToken string) bool {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error":{"code":404,"message":"Requested entity was not found.","status":"NOT_FOUND"}}`))
+				return true
+			},
+			errContains: "status 404: Requested entity was not found.",
+		},
+		{
+			name: "not found from something that is not fcm",
+			reject: func(w http.ResponseWriter, deviceToken string) bool {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte("404 page not found"))
+				return true
+			},
+			errContains: "status 404, unreadable error body",
+		},
+		{
+			name: "unreadable body",
+			reject: func(w http.ResponseWriter, deviceToken string) bool {
+				w.WriteHeader(http.StatusBadGateway)
+				w.Write([]byte("<html>bad gateway</html>"))
+				return true
+			},
+			errContains: "status 502, unreadable error body",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			standIn := newFCMStandIn(t)
+			standIn.reject = tt.reject
+
+			err := standIn.provider(t).Send(context.Background(), "device-1", Notification{Title: "t", Body: "b"})
+
+			if got := errors.Is(err, ErrInvalidToken); got != tt.invalid {
+				t.Fatalf("Send error = %v, invalid token %v, want %v", err, got, tt.invalid)
+			}
+
+			if tt.errContains != "" && (err == nil || !strings.Contains(err.Error(), tt.errContains)) {
+				t.Errorf("Send error = %v, want it to contain %q", err, tt.errContains)
+			}
+		})
+	}
+}
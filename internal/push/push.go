@@ -0,0 +1,38 @@
+package push
+
+import (
+	"context"
+	"errors"
+)
+
+type Platform string
+
+const (
+	Android Platform = "android" // delivered through FCM
+	IOS     Platform = "ios"     // delivered through APNs
+)
+
+// ErrInvalidToken is returned by a provider when it rejects a device token
+// for good (app uninstalled, token expired, wrong environment). The
+// dispatcher prunes tokens that fail with this error.
+var ErrInvalidToken = errors.New("push: device token rejected by provider")
+
+type Notification struct {
+	Title string            `json:"title"`
+	Body  string            `json:"body"`
+	Data  map[string]string `json:"data,omitempty"`
+}
+
+type PushProvider interface {
+	Send(ctx context.Context, deviceToken string, notification Notification) error
+}
+
+func ParsePlatform(value string) (Platform, error) {
+
+	switch Platform(value) {
+	case Android, IOS:
+		return Platform(value), nil
+	}
+
+	return "", errors.New("platform can either be android or ios")
+}
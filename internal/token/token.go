@@ -0,0 +1,306 @@
+package token
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+type Config struct {
+	SigningKeyFile       string   // PEM RSA or Ed25519 private key, empty generates a throwaway key
+	VerificationKeyFiles []string // PEM public (or private) keys still accepted after a rotation
+	Issuer               string
+	Audience             string
+}
+
+type Claims struct {
+	Username  string `json:"username"`
+	SessionID string `json:"sid,omitempty"`
+	Type      string `json:"typ"` // access, or the purpose of a short lived token
+	jwt.RegisteredClaims
+}
+
+type verificationKey struct {
+	method jwt.SigningMethod
+	key    crypto.PublicKey
+}
+
+// Manager issues and verifies every token Nkata hands out. Tokens are signed
+// with one key and carry its kid; any configured verification key is
+// accepted so tokens signed before a rotation stay valid until they expire.
+type Manager struct {
+	issuer   string
+	audience string
+
+	signingKey    crypto.Signer
+	signingMethod jwt.SigningMethod
+	signingKid    string
+
+	keys    map[string]verificationKey
+	methods []string
+}
+
+func NewManager(config Config) (*Manager, error) {
+
+	var signer crypto.Signer
+	var err error
+
+	if config.SigningKeyFile == "" {
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	} else {
+		signer, err = loadPrivateKey(config.SigningKeyFile)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manager{
+		issuer:     config.Issuer,
+		audience:   config.Audience,
+		signingKey: signer,
+		keys:       make(map[string]verificationKey),
+	}
+
+	m.signingKid, m.signingMethod, err = m.addKey(signer.Public())
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range config.VerificationKeyFiles {
+
+		key, err := loadPublicKey(file)
+
+		if err != nil {
+			return nil, fmt.Errorf("token: verification key %s: %w", file, err)
+		}
+
+		if _, _, err := m.addKey(key); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+func (m *Manager) addKey(key crypto.PublicKey) (string, jwt.SigningMethod, error) {
+
+	var method jwt.SigningMethod
+
+	switch key.(type) {
+	case *rsa.PublicKey:
+		method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		method = jwt.SigningMethodEdDSA
+	default:
+		return "", nil, errors.New("token: only RSA and Ed25519 keys are supported")
+	}
+
+	kid := thumbprint(key)
+
+	if _, ok := m.keys[kid]; !ok {
+		m.keys[kid] = verificationKey{method: method, key: key}
+		m.addMethod(method.Alg())
+	}
+
+	return kid, method, nil
+}
+
+func (m *Manager) addMethod(alg string) {
+
+	for _, existing := range m.methods {
+		if existing == alg {
+			return
+		}
+	}
+
+	m.methods = append(m.methods, alg)
+}
+
+// Sign fills in the registered claims and signs with the current key
+func (m *Manager) Sign(claims Claims, ttl time.Duration) (string, error) {
+
+	now := time.Now()
+
+	claims.Issuer = m.issuer
+	claims.Audience = jwt.ClaimStrings{m.audience}
+	claims.Subject = claims.Username
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(ttl))
+	claims.ID = uuid.New().String()
+
+	token := jwt.NewWithClaims(m.signingMethod, claims)
+	token.Header["kid"] = m.signingKid
+
+	return token.SignedString(m.signingKey)
+}
+
+// Parse verifies the signature, algorithm, issuer, audience, expiry and token type
+func (m *Manager) Parse(tokenString, tokenType string) (*Claims, error) {
+
+	var claims Claims
+
+	_, err := jwt.ParseWithClaims(tokenString, &claims, func(t *jwt.Token) (any, error) {
+
+		kid, _ := t.Header["kid"].(string)
+
+		key, ok := m.keys[kid]
+
+		if !ok {
+			return nil, errors.New("token: unknown kid")
+		}
+
+		// stops a token signed for one key type being checked against another
+		if t.Method.Alg() != key.method.Alg() {
+			return nil, errors.New("token: algorithm does not match key")
+		}
+
+		return key.key, nil
+	},
+		jwt.WithValidMethods(m.methods),
+		jwt.WithIssuer(m.issuer),
+		jwt.WithAudience(m.audience),
+		jwt.WithExpirationRequired(),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Type != tokenType {
+		return nil, errors.New("token: wrong token type")
+	}
+
+	return &claims, nil
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+func (m *Manager) JWKS() JWKSet {
+
+	set := JWKSet{Keys: []JWK{}}
+
+	for kid, key := range m.keys {
+		jwk := toJWK(key.key)
+		jwk.Kid = kid
+		jwk.Use = "sig"
+		jwk.Alg = key.method.Alg()
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	return set
+}
+
+func (m *Manager) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+
+	json.NewEncoder(w).Encode(m.JWKS())
+}
+
+func toJWK(key crypto.PublicKey) JWK {
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+		}
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(k)}
+	}
+
+	return JWK{}
+}
+
+// thumbprint is the RFC 7638 JWK thumbprint, so a key's kid never has to be configured
+func thumbprint(key crypto.PublicKey) string {
+
+	jwk := toJWK(key)
+
+	var canonical string
+
+	switch jwk.Kty {
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, jwk.E, jwk.N)
+	case "OKP":
+		canonical = fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":"%s"}`, jwk.X)
+	}
+
+	sum := sha256.Sum256([]byte(canonical))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func loadPrivateKey(file string) (crypto.Signer, error) {
+
+	data, err := os.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if key, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+
+	key, err := jwt.ParseEdPrivateKeyFromPEM(data)
+
+	if err != nil {
+		return nil, errors.New("token: signing key must be a PEM RSA or Ed25519 private key")
+	}
+
+	return key.(crypto.Signer), nil
+}
+
+func loadPublicKey(file string) (crypto.PublicKey, error) {
+
+	data, err := os.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+
+	if key, err := jwt.ParseEdPublicKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+
+	if key, err := loadPrivateKey(file); err == nil {
+		return key.Public(), nil
+	}
+
+	return nil, errors.New("token: not a PEM RSA or Ed25519 key")
+}
@@ -0,0 +1,114 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RFC 6238 defaults, the only parameters authenticator apps reliably support
+const (
+	Digits = 6
+	Period = 30
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a 160 bit secret in the base32 form authenticator apps expect
+func GenerateSecret() (string, error) {
+
+	secret := make([]byte, 20)
+
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return encoding.EncodeToString(secret), nil
+}
+
+func URI(issuer, account, secret string) string {
+
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", issuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprint(Digits))
+	values.Set("period", fmt.Sprint(Period))
+
+	label := url.PathEscape(issuer + ":" + account)
+
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+// Code is the HOTP value (RFC 4226) for the given time step
+func Code(secret string, step int64) (string, error) {
+
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+
+	if err != nil {
+		return "", err
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", Digits, value%1_000_000), nil
+}
+
+func Step(t time.Time) int64 {
+	return t.Unix() / Period
+}
+
+// Validate checks code against the steps within skew of t and returns the
+// matching step, so callers can refuse a step that was already used
+func Validate(secret, code string, t time.Time, skew int) (int64, bool) {
+
+	current := Step(t)
+
+	return validate(secret, code, current-int64(skew), current+int64(skew))
+}
+
+// ValidateAfter is Validate that only tries the steps after lastStep, the last
+// step a code was accepted for, so a code cannot be used twice
+func ValidateAfter(secret, code string, t time.Time, skew int, lastStep int64) (int64, bool) {
+
+	current := Step(t)
+
+	return validate(secret, code, max(current-int64(skew), lastStep+1), current+int64(skew))
+}
+
+func validate(secret, code string, first, last int64) (int64, bool) {
+
+	if len(code) != Digits {
+		return 0, false
+	}
+
+	for step := first; step <= last; step++ {
+
+		expected, err := Code(secret, step)
+
+		if err != nil {
+			return 0, false
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
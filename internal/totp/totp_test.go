@@ -0,0 +1,120 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// the SHA-1 seed from RFC 6238 appendix B
+var rfcSecret = encoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCodeRfc6238Vectors(t *testing.T) {
+
+	// the RFC lists 8 digit codes, a 6 digit code is their last six digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "94287082"},
+		{unix: 1111111109, want: "07081804"},
+		{unix: 1111111111, want: "14050471"},
+		{unix: 1234567890, want: "89005924"},
+		{unix: 2000000000, want: "69279037"},
+		{unix: 20000000000, want: "65353130"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+
+			code, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want := tt.want[len(tt.want)-Digits:]; code != want {
+				t.Errorf("Code at %d = %s, want %s", tt.unix, code, want)
+			}
+		})
+	}
+}
+
+func TestValidateWindow(t *testing.T) {
+
+	now := time.Unix(1234567890, 0)
+	current := Step(now)
+
+	tests := []struct {
+		name   string
+		offset int64
+		ok     bool
+	}{
+		{name: "two steps behind", offset: -2, ok: false},
+		{name: "one step behind", offset: -1, ok: true},
+		{name: "current step", offset: 0, ok: true},
+		{name: "one step ahead", offset: 1, ok: true},
+		{name: "two steps ahead", offset: 2, ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			code, err := Code(rfcSecret, current+tt.offset)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			step, ok := Validate(rfcSecret, code, now, 1)
+
+			if ok != tt.ok {
+				t.Fatalf("Validate ok = %v, want %v", ok, tt.ok)
+			}
+
+			if ok && step != current+tt.offset {
+				t.Errorf("Validate step = %d, want %d", step, current+tt.offset)
+			}
+		})
+	}
+}
+
+func TestValidateAfterRejectsUsedSteps(t *testing.T) {
+
+	now := time.Unix(1234567890, 0)
+	current := Step(now)
+
+	tests := []struct {
+		name     string
+		offset   int64
+		lastStep int64
+		ok       bool
+	}{
+		{name: "nothing used yet", offset: 0, lastStep: 0, ok: true},
+		{name: "step after the last one", offset: 0, lastStep: current - 1, ok: true},
+		{name: "step is the last one", offset: 0, lastStep: current, ok: false},
+		{name: "step before the last one", offset: -1, lastStep: current, ok: false},
+		{name: "previous step already used", offset: -1, lastStep: current - 1, ok: false},
+		{name: "next step after the current one was used", offset: 1, lastStep: current, ok: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			code, err := Code(rfcSecret, current+tt.offset)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			step, ok := ValidateAfter(rfcSecret, code, now, 1, tt.lastStep)
+
+			if ok != tt.ok {
+				t.Fatalf("ValidateAfter ok = %v, want %v", ok, tt.ok)
+			}
+
+			if ok && step <= tt.lastStep {
+				t.Errorf("ValidateAfter accepted step %d, last step was %d", step, tt.lastStep)
+			}
+		})
+	}
+}
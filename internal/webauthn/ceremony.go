@@ -0,0 +1,230 @@
+package webauthn
+
+import (
+	"crypto/sha256"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type CredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type RelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type User struct {
+	ID          string `json:"id"` // opaque user handle, base64url
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// CreationOptions is PublicKeyCredentialCreationOptions with binary fields base64url encoded
+type CreationOptions struct {
+	Challenge              string                 `json:"challenge"`
+	RP                     RelyingParty           `json:"rp"`
+	User                   User                   `json:"user"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int                    `json:"timeout"`
+	Attestation            string                 `json:"attestation"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+}
+
+// RequestOptions is PublicKeyCredentialRequestOptions, allowCredentials is left
+// empty so the authenticator offers its discoverable credentials for the site
+type RequestOptions struct {
+	Challenge        string `json:"challenge"`
+	RPID             string `json:"rpId"`
+	Timeout          int    `json:"timeout"`
+	UserVerification string `json:"userVerification"`
+}
+
+type AttestationResponse struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject"`
+}
+
+// RegistrationCredential is the PublicKeyCredential returned by navigator.credentials.create
+type RegistrationCredential struct {
+	ID       string              `json:"id"`
+	Type     string              `json:"type"`
+	Response AttestationResponse `json:"response"`
+}
+
+type AssertionResponse struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+	UserHandle        string `json:"userHandle"`
+}
+
+// AssertionCredential is the PublicKeyCredential returned by navigator.credentials.get
+type AssertionCredential struct {
+	ID       string            `json:"id"`
+	Type     string            `json:"type"`
+	Response AssertionResponse `json:"response"`
+}
+
+// Credential is what has to be stored to verify later assertions
+type Credential struct {
+	ID        string // base64url credential id
+	PublicKey []byte // COSE_Key
+	Algorithm int
+	SignCount uint32
+}
+
+func (c Config) CreationOptions(challenge string, user User, exclude []string) CreationOptions {
+
+	excludeCredentials := make([]CredentialDescriptor, 0, len(exclude))
+
+	for _, id := range exclude {
+		excludeCredentials = append(excludeCredentials, CredentialDescriptor{Type: "public-key", ID: id})
+	}
+
+	return CreationOptions{
+		Challenge: challenge,
+		RP:        RelyingParty{ID: c.RPID, Name: c.RPName},
+		User:      user,
+		PubKeyCredParams: []CredentialParameter{
+			{Type: "public-key", Alg: AlgES256},
+			{Type: "public-key", Alg: AlgRS256},
+		},
+		Timeout:            300000,
+		Attestation:        "none",
+		ExcludeCredentials: excludeCredentials,
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      "required",
+			UserVerification: "preferred",
+		},
+	}
+}
+
+func (c Config) RequestOptions(challenge string) RequestOptions {
+	return RequestOptions{
+		Challenge:        challenge,
+		RPID:             c.RPID,
+		Timeout:          300000,
+		UserVerification: "preferred",
+	}
+}
+
+type attestationObject struct {
+	Fmt      string          `cbor:"fmt"`
+	AttStmt  cbor.RawMessage `cbor:"attStmt"`
+	AuthData []byte          `cbor:"authData"`
+}
+
+// VerifyRegistration checks a navigator.credentials.create response against
+// the challenge issued for it and returns the credential to store. The
+// attestation statement is not verified, matching attestation "none".
+func (c Config) VerifyRegistration(challenge string, credential RegistrationCredential) (*Credential, error) {
+
+	clientDataJSON, err := b64.DecodeString(credential.Response.ClientDataJSON)
+
+	if err != nil {
+		return nil, ErrInvalidClientData
+	}
+
+	if err := c.verifyClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	rawAttestation, err := b64.DecodeString(credential.Response.AttestationObject)
+
+	if err != nil {
+		return nil, ErrInvalidAuthData
+	}
+
+	var attestation attestationObject
+
+	if err := cbor.Unmarshal(rawAttestation, &attestation); err != nil {
+		return nil, ErrInvalidAuthData
+	}
+
+	authData, err := c.parseAuthData(attestation.AuthData, true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := parsePublicKey(authData.publicKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Credential{
+		ID:        b64.EncodeToString(authData.credentialID),
+		PublicKey: authData.publicKey,
+		Algorithm: key.alg,
+		SignCount: authData.signCount,
+	}, nil
+}
+
+// VerifyAssertion checks a navigator.credentials.get response signed by the
+// stored credential. It returns the new sign count and whether the user was
+// verified (biometric or PIN) rather than only present.
+func (c Config) VerifyAssertion(challenge string, stored Credential, assertion AssertionCredential) (uint32, bool, error) {
+
+	clientDataJSON, err := b64.DecodeString(assertion.Response.ClientDataJSON)
+
+	if err != nil {
+		return 0, false, ErrInvalidClientData
+	}
+
+	if err := c.verifyClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, false, err
+	}
+
+	rawAuthData, err := b64.DecodeString(assertion.Response.AuthenticatorData)
+
+	if err != nil {
+		return 0, false, ErrInvalidAuthData
+	}
+
+	authData, err := c.parseAuthData(rawAuthData, false)
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	signature, err := b64.DecodeString(assertion.Response.Signature)
+
+	if err != nil {
+		return 0, false, ErrInvalidSignature
+	}
+
+	key, err := parsePublicKey(stored.PublicKey)
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+
+	if err := key.verify(signed, signature); err != nil {
+		return 0, false, err
+	}
+
+	// authenticators without a counter always report 0, otherwise it must move forward
+	if (authData.signCount != 0 || stored.SignCount != 0) && authData.signCount <= stored.SignCount {
+		return 0, false, ErrSignCount
+	}
+
+	return authData.signCount, authData.flags&flagUserVerified != 0, nil
+}
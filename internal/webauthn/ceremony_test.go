@@ -0,0 +1,409 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+var testConfig = Config{RPID: "nkata.test", RPName: "Nkata", Origins: []string{"https://nkata.test"}}
+
+// softAuthenticator plays the part of a platform authenticator, it creates a credential and signs
+// assertions the way a browser would hand them to the server
+type softAuthenticator struct {
+	t         *testing.T
+	rpID      string
+	origin    string
+	alg       int
+	credID    []byte
+	ecKey     *ecdsa.PrivateKey
+	rsaKey    *rsa.PrivateKey
+	signCount uint32
+	verified  bool // biometric or PIN, not only presence
+}
+
+func newSoftAuthenticator(t *testing.T, alg int) *softAuthenticator {
+
+	t.Helper()
+
+	a := &softAuthenticator{t: t, rpID: testConfig.RPID, origin: testConfig.Origins[0], alg: alg, verified: true}
+
+	a.credID = make([]byte, 16)
+
+	if _, err := rand.Read(a.credID); err != nil {
+		t.Fatal(err)
+	}
+
+	var err error
+
+	switch alg {
+	case AlgES256:
+		a.ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgRS256:
+		a.rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+
+	key := coseKey{Alg: a.alg}
+
+	switch a.alg {
+	case AlgES256:
+		key.Kty, key.Crv = 2, 1
+		key.X = a.ecKey.X.FillBytes(make([]byte, 32))
+		key.Y = a.ecKey.Y.FillBytes(make([]byte, 32))
+	case AlgRS256:
+		key.Kty = 3
+		key.X = a.rsaKey.N.Bytes()
+		key.Y = big.NewInt(int64(a.rsaKey.E)).Bytes()
+	}
+
+	raw, err := cbor.Marshal(key)
+
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return raw
+}
+
+func (a *softAuthenticator) authData(attested bool) []byte {
+
+	rpIdHash := sha256.Sum256([]byte(a.rpID))
+
+	flags := byte(flagUserPresent)
+
+	if a.verified {
+		flags |= flagUserVerified
+	}
+
+	if attested {
+		flags |= flagAttestedData
+	}
+
+	data := append([]byte{}, rpIdHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+
+	if attested {
+		data = append(data, make([]byte, 16)...) // aaguid
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.credID)))
+		data = append(data, a.credID...)
+		data = append(data, a.coseKey()...)
+	}
+
+	return data
+}
+
+func (a *softAuthenticator) clientData(ceremony, challenge string) []byte {
+
+	raw, err := json.Marshal(clientData{Type: ceremony, Challenge: challenge, Origin: a.origin})
+
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return raw
+}
+
+func (a *softAuthenticator) register(challenge string) RegistrationCredential {
+
+	attestation, err := cbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authData(true),
+	})
+
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return RegistrationCredential{
+		ID:   b64.EncodeToString(a.credID),
+		Type: "public-key",
+		Response: AttestationResponse{
+			ClientDataJSON:    b64.EncodeToString(a.clientData("webauthn.create", challenge)),
+			AttestationObject: b64.EncodeToString(attestation),
+		},
+	}
+}
+
+// assert signs in, moving the counter forward the way a real authenticator does
+func (a *softAuthenticator) assert(challenge string) AssertionCredential {
+
+	a.signCount++
+
+	authData := a.authData(false)
+	clientDataJSON := a.clientData("webauthn.get", challenge)
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	var signature []byte
+	var err error
+
+	switch a.alg {
+	case AlgES256:
+		signature, err = ecdsa.SignASN1(rand.Reader, a.ecKey, digest[:])
+	case AlgRS256:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, a.rsaKey, crypto.SHA256, digest[:])
+	}
+
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return AssertionCredential{
+		ID:   b64.EncodeToString(a.credID),
+		Type: "public-key",
+		Response: AssertionResponse{
+			ClientDataJSON:    b64.EncodeToString(clientDataJSON),
+			AuthenticatorData: b64.EncodeToString(authData),
+			Signature:         b64.EncodeToString(signature),
+		},
+	}
+}
+
+func mustChallenge(t *testing.T) string {
+
+	t.Helper()
+
+	challenge, err := NewChallenge()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return challenge
+}
+
+func TestRegistrationAndAssertion(t *testing.T) {
+
+	for _, alg := range []int{AlgES256, AlgRS256} {
+		t.Run(map[int]string{AlgES256: "ES256", AlgRS256: "RS256"}[alg], func(t *testing.T) {
+
+			authenticator := newSoftAuthenticator(t, alg)
+
+			challenge := mustChallenge(t)
+
+			credential, err := testConfig.VerifyRegistration(challenge, authenticator.register(challenge))
+
+			if err != nil {
+				t.Fatalf("VerifyRegistration: %v", err)
+			}
+
+			if credential.ID != b64.EncodeToString(authenticator.credID) || credential.Algorithm != alg || credential.SignCount != 0 {
+				t.Fatalf("stored credential = %+v", credential)
+			}
+
+			for i := uint32(1); i <= 2; i++ {
+
+				challenge := mustChallenge(t)
+
+				signCount, verified, err := testConfig.VerifyAssertion(challenge, *credential, authenticator.assert(challenge))
+
+				if err != nil {
+					t.Fatalf("VerifyAssertion %d: %v", i, err)
+				}
+
+				if signCount != i || !verified {
+					t.Fatalf("VerifyAssertion %d = count %d, verified %v", i, signCount, verified)
+				}
+
+				credential.SignCount = signCount
+			}
+		})
+	}
+}
+
+func TestRegistrationRejected(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		tamper func(a *softAuthenticator, challenge *string)
+	}{
+		{"wrong origin", func(a *softAuthenticator, challenge *string) { a.origin = "https://evil.test" }},
+		{"wrong challenge", func(a *softAuthenticator, challenge *string) { *challenge = "another-challenge" }},
+		{"wrong relying party", func(a *softAuthenticator, challenge *string) { a.rpID = "evil.test" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			authenticator := newSoftAuthenticator(t, AlgES256)
+
+			issued := mustChallenge(t)
+			answered := issued
+
+			tt.tamper(authenticator, &answered)
+
+			if _, err := testConfig.VerifyRegistration(issued, authenticator.register(answered)); err == nil {
+				t.Fatal("VerifyRegistration accepted the credential")
+			}
+		})
+	}
+}
+
+func TestAssertionRejected(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		alg     int
+		prepare func(t *testing.T, a *softAuthenticator, stored *Credential, challenge *string)
+		tamper  func(t *testing.T, assertion *AssertionCredential)
+		wantErr error
+	}{
+		{
+			name: "wrong origin",
+			alg:  AlgES256,
+			prepare: func(t *testing.T, a *softAuthenticator, stored *Credential, challenge *string) {
+				a.origin = "https://evil.test"
+			},
+			wantErr: ErrInvalidClientData,
+		},
+		{
+			name: "wrong challenge",
+			alg:  AlgRS256,
+			prepare: func(t *testing.T, a *softAuthenticator, stored *Credential, challenge *string) {
+				*challenge = mustChallenge(t)
+			},
+			wantErr: ErrInvalidClientData,
+		},
+		{
+			name: "sign count went back",
+			alg:  AlgES256,
+			prepare: func(t *testing.T, a *softAuthenticator, stored *Credential, challenge *string) {
+				stored.SignCount = 10
+				a.signCount = 4
+			},
+			wantErr: ErrSignCount,
+		},
+		{
+			name: "sign count repeated",
+			alg:  AlgRS256,
+			prepare: func(t *testing.T, a *softAuthenticator, stored *Credential, challenge *string) {
+				stored.SignCount = 5
+				a.signCount = 4 // assert moves it to 5
+			},
+			wantErr: ErrSignCount,
+		},
+		{
+			name: "signed by another key",
+			alg:  AlgES256,
+			prepare: func(t *testing.T, a *softAuthenticator, stored *Credential, challenge *string) {
+				other := newSoftAuthenticator(t, AlgES256)
+				a.ecKey = other.ecKey
+			},
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name: "authenticator data changed after signing",
+			alg:  AlgRS256,
+			tamper: func(t *testing.T, assertion *AssertionCredential) {
+				raw, _ := b64.DecodeString(assertion.Response.AuthenticatorData)
+				raw[32] ^= flagUserVerified
+				assertion.Response.AuthenticatorData = b64.EncodeToString(raw)
+			},
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name: "registration response replayed as an assertion",
+			alg:  AlgES256,
+			tamper: func(t *testing.T, assertion *AssertionCredential) {
+				raw, _ := b64.DecodeString(assertion.Response.ClientDataJSON)
+				var data clientData
+				json.Unmarshal(raw, &data)
+				data.Type = "webauthn.create"
+				raw, _ = json.Marshal(data)
+				assertion.Response.ClientDataJSON = b64.EncodeToString(raw)
+			},
+			wantErr: ErrInvalidClientData,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			authenticator := newSoftAuthenticator(t, tt.alg)
+
+			registration := mustChallenge(t)
+
+			stored, err := testConfig.VerifyRegistration(registration, authenticator.register(registration))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			issued := mustChallenge(t)
+			answered := issued
+
+			if tt.prepare != nil {
+				tt.prepare(t, authenticator, stored, &answered)
+			}
+
+			assertion := authenticator.assert(answered)
+
+			if tt.tamper != nil {
+				tt.tamper(t, &assertion)
+			}
+
+			if _, _, err := testConfig.VerifyAssertion(issued, *stored, assertion); err != tt.wantErr {
+				t.Fatalf("VerifyAssertion error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAssertionWithoutCounter(t *testing.T) {
+
+	// some authenticators never count, they report 0 every time and that is accepted
+	authenticator := newSoftAuthenticator(t, AlgES256)
+
+	registration := mustChallenge(t)
+
+	stored, err := testConfig.VerifyRegistration(registration, authenticator.register(registration))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+
+		authenticator.signCount = ^uint32(0) // assert wraps it back to 0
+
+		challenge := mustChallenge(t)
+
+		if _, _, err := testConfig.VerifyAssertion(challenge, *stored, authenticator.assert(challenge)); err != nil {
+			t.Fatalf("VerifyAssertion %d: %v", i, err)
+		}
+	}
+}
+
+func TestParsePublicKeyRejectsOtherAlgorithms(t *testing.T) {
+
+	raw, err := cbor.Marshal(coseKey{Kty: 1, Alg: -8, Crv: 6, X: make([]byte, 32)}) // Ed25519
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := parsePublicKey(raw); err != ErrUnsupportedKey {
+		t.Errorf("parsePublicKey error = %v, want %v", err, ErrUnsupportedKey)
+	}
+}
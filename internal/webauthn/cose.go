@@ -0,0 +1,93 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// COSE algorithm identifiers accepted for passkeys
+const (
+	AlgES256 = -7
+	AlgRS256 = -257
+)
+
+var ErrUnsupportedKey = errors.New("webauthn: only ES256 and RS256 credentials are supported")
+
+// coseKey covers the EC2 and RSA members of a COSE_Key map
+type coseKey struct {
+	Kty int    `cbor:"1,keyasint"`
+	Alg int    `cbor:"3,keyasint"`
+	Crv int    `cbor:"-1,keyasint,omitempty"`
+	X   []byte `cbor:"-2,keyasint,omitempty"` // EC2 x, or RSA modulus n
+	Y   []byte `cbor:"-3,keyasint,omitempty"` // EC2 y, or RSA exponent e
+}
+
+type publicKey struct {
+	alg    int
+	ecdsa  *ecdsa.PublicKey
+	rsaKey *rsa.PublicKey
+}
+
+func parsePublicKey(raw []byte) (*publicKey, error) {
+
+	var key coseKey
+
+	if err := cbor.Unmarshal(raw, &key); err != nil {
+		return nil, ErrUnsupportedKey
+	}
+
+	switch {
+	case key.Kty == 2 && key.Alg == AlgES256 && key.Crv == 1:
+
+		if len(key.X) != 32 || len(key.Y) != 32 {
+			return nil, ErrUnsupportedKey
+		}
+
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(key.X), Y: new(big.Int).SetBytes(key.Y)}
+
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, ErrUnsupportedKey
+		}
+
+		return &publicKey{alg: AlgES256, ecdsa: pub}, nil
+
+	case key.Kty == 3 && key.Alg == AlgRS256:
+
+		exponent := new(big.Int).SetBytes(key.Y)
+
+		if len(key.X) < 256 || !exponent.IsInt64() {
+			return nil, ErrUnsupportedKey
+		}
+
+		return &publicKey{alg: AlgRS256, rsaKey: &rsa.PublicKey{N: new(big.Int).SetBytes(key.X), E: int(exponent.Int64())}}, nil
+	}
+
+	return nil, ErrUnsupportedKey
+}
+
+func (k *publicKey) verify(signed, signature []byte) error {
+
+	digest := sha256.Sum256(signed)
+
+	switch k.alg {
+	case AlgES256:
+		if !ecdsa.VerifyASN1(k.ecdsa, digest[:], signature) {
+			return ErrInvalidSignature
+		}
+		return nil
+	case AlgRS256:
+		if rsa.VerifyPKCS1v15(k.rsaKey, crypto.SHA256, digest[:], signature) != nil {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+
+	return ErrUnsupportedKey
+}
@@ -0,0 +1,153 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Relying party settings. Attestation is always "none": we do not check
+// which authenticator model created a credential, only that it holds the key.
+type Config struct {
+	RPID    string   // registrable domain, e.g. nkata.app
+	RPName  string   // shown by the browser during the ceremony
+	Origins []string // allowed client origins, e.g. https://nkata.app
+}
+
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+)
+
+var (
+	ErrInvalidClientData = errors.New("webauthn: client data does not match the ceremony")
+	ErrInvalidAuthData   = errors.New("webauthn: authenticator data is invalid")
+	ErrInvalidSignature  = errors.New("webauthn: signature verification failed")
+	ErrSignCount         = errors.New("webauthn: sign count did not increase, credential may be cloned")
+)
+
+var b64 = base64.RawURLEncoding
+
+func NewChallenge() (string, error) {
+
+	challenge := make([]byte, 32)
+
+	if _, err := rand.Read(challenge); err != nil {
+		return "", err
+	}
+
+	return b64.EncodeToString(challenge), nil
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// ClientDataChallenge reads the challenge out of clientDataJSON so the caller
+// can look up the ceremony it belongs to before verifying anything else
+func ClientDataChallenge(clientDataJSON string) (string, error) {
+
+	raw, err := b64.DecodeString(clientDataJSON)
+
+	if err != nil {
+		return "", err
+	}
+
+	var data clientData
+
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return "", err
+	}
+
+	return data.Challenge, nil
+}
+
+func (c Config) verifyClientData(raw []byte, ceremony, challenge string) error {
+
+	var data clientData
+
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return ErrInvalidClientData
+	}
+
+	if data.Type != ceremony || subtle.ConstantTimeCompare([]byte(data.Challenge), []byte(challenge)) != 1 {
+		return ErrInvalidClientData
+	}
+
+	for _, origin := range c.Origins {
+		if data.Origin == origin {
+			return nil
+		}
+	}
+
+	return ErrInvalidClientData
+}
+
+type authenticatorData struct {
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte // COSE_Key, only present during registration
+}
+
+func (c Config) parseAuthData(raw []byte, attested bool) (*authenticatorData, error) {
+
+	if len(raw) < 37 {
+		return nil, ErrInvalidAuthData
+	}
+
+	rpIdHash := sha256.Sum256([]byte(c.RPID))
+
+	if !bytes.Equal(raw[:32], rpIdHash[:]) {
+		return nil, ErrInvalidAuthData
+	}
+
+	data := &authenticatorData{
+		flags:     raw[32],
+		signCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+
+	if data.flags&flagUserPresent == 0 {
+		return nil, ErrInvalidAuthData
+	}
+
+	if !attested {
+		return data, nil
+	}
+
+	if data.flags&flagAttestedData == 0 || len(raw) < 55 {
+		return nil, ErrInvalidAuthData
+	}
+
+	// aaguid (16 bytes) is skipped, with attestation none it is usually zeroed anyway
+	idLength := int(binary.BigEndian.Uint16(raw[53:55]))
+
+	if len(raw) < 55+idLength {
+		return nil, ErrInvalidAuthData
+	}
+
+	data.credentialID = raw[55 : 55+idLength]
+
+	// the COSE key is the first CBOR item after the id, extensions may follow it
+	var key cbor.RawMessage
+
+	_, err := cbor.UnmarshalFirst(raw[55+idLength:], &key)
+
+	if err != nil {
+		return nil, ErrInvalidAuthData
+	}
+
+	data.publicKey = key
+
+	return data, nil
+}